@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	tests := []struct {
+		name, level, format string
+		wantErr             bool
+	}{
+		{"text", "info", "text", false},
+		{"json", "debug", "json", false},
+		{"upper case level", "WARN", "json", false},
+		{"level with offset", "info+2", "text", false},
+		{"invalid level", "verbose", "text", true},
+		{"invalid format", "info", "logfmt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := setupLogging(tt.level, tt.format); (err != nil) != tt.wantErr {
+				t.Errorf("setupLogging(%q, %q) = %v, want an error: %v", tt.level, tt.format, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetupLoggingJSON(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	stderr := os.Stderr
+	defer func() { os.Stderr = stderr }()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	if err := setupLogging("info", "json"); err != nil {
+		t.Fatal(err)
+	}
+	slog.Debug("below the level")
+	slog.Warn("upstream request failed", "endpoint", "10.0.0.1:2379")
+	// the standard library log package logs at info level.
+	log.Print("http: proxy error")
+	w.Close()
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line %q isn't json: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %v", len(lines), lines)
+	}
+	if lines[0]["level"] != "WARN" || lines[0]["msg"] != "upstream request failed" || lines[0]["endpoint"] != "10.0.0.1:2379" {
+		t.Errorf("got %v, want the warning", lines[0])
+	}
+	if msg, _ := lines[1]["msg"].(string); !strings.Contains(msg, "http: proxy error") {
+		t.Errorf("got %v, want the standard library log line", lines[1])
+	}
+}
@@ -1,114 +1,141 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"flag"
 	"fmt"
-	"log"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/openinsight-proj/etcd-metrics-proxy/pkg/proxy"
+	"github.com/openinsight-proj/etcd-metrics-proxy/pkg/version"
 )
 
-type config struct {
-	port               int
-	upstreamHost       string
-	upstreamPort       int
-	upstreamServerName string
-	etcdCA             string
-	etcdCert           string
-	etcdKey            string
+const usage = "Usage: etcd-metrics-proxy [serve | check-config | healthcheck | version] [flags]"
+
+func main() {
+	cmd, args := "serve", os.Args[1:]
+	// without a command the flags are those of serve, as before subcommands
+	// existed.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		serve(args)
+	case "check-config":
+		checkConfig(args)
+	case "healthcheck":
+		healthcheck(args)
+	case "version":
+		printVersion()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s\n", cmd, usage)
+		os.Exit(2)
+	}
 }
 
-func initFlags(c *config) {
-	flag.IntVar(&c.port, "port", 2381, "Port to bind to.")
-	flag.StringVar(&c.upstreamHost, "upstream-host", "localhost", "The upstream etcd host.")
-	flag.IntVar(&c.upstreamPort, "upstream-port", 2379, "The upstream etcd port.")
-	flag.StringVar(&c.upstreamServerName, "upstream-server-name", "localhost", "The upstream tls server name.")
-	flag.StringVar(&c.etcdCA, "etcd-ca", "", "The CA file for etcd tls.")
-	flag.StringVar(&c.etcdCert, "etcd-cert", "", "The cert file for etcd tls.")
-	flag.StringVar(&c.etcdKey, "etcd-key", "", "The key file for etcd tls.")
+func newFlagSet(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	return fs
 }
 
-func validateFlags(c *config) {
-	if len(c.etcdCA) == 0 {
-		log.Fatal("--etcd-ca=<ca-file> is required")
+// parseFlags adds the proxy and logging flags to fs, parses args and sets up
+// logging.
+func parseFlags(fs *flag.FlagSet, args []string) proxy.Config {
+	var c proxy.Config
+	proxy.RegisterFlags(fs, &c)
+	logLevel := fs.String("log-level", "info", "Log level: debug, info, warn or error.")
+	logFormat := fs.String("log-format", "text", "Log format: text or json.")
+	showVersion := fs.Bool("version", false, "Print the build version and exit.")
+	fs.Parse(args)
+	if *showVersion {
+		printVersion()
+		os.Exit(0)
 	}
-	if len(c.etcdCert) == 0 {
-		log.Fatal("--etcd-cert=<cert-file> is required")
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %q\n%s\n", fs.Args(), usage)
+		os.Exit(2)
 	}
-	if len(c.etcdKey) == 0 {
-		log.Fatal("--etcd-key=<key-file> is required")
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fatal(err.Error())
 	}
+	return c
 }
 
-func main() {
-	c := config{}
-	initFlags(&c)
-	flag.Parse()
-	validateFlags(&c)
+// serve runs the proxy until SIGINT or SIGTERM. With --check it instead
+// performs a single scrape of every upstream, prints diagnostics and exits.
+func serve(args []string) {
+	fs := newFlagSet("serve")
+	check := fs.Bool("check", false, "Load the tls material, request /metrics from every upstream once, print diagnostics and exit non-zero on failure instead of serving.")
+	c := parseFlags(fs, args)
 
-	var tryHttp bool
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// a second signal during shutdown kills the process.
+		<-ctx.Done()
+		stop()
+	}()
 
-	pool := x509.NewCertPool()
-	capem, err := os.ReadFile(c.etcdCA)
+	p, err := proxy.NewProxy(c)
 	if err != nil {
-		log.Println(err)
-		tryHttp = true
+		fatal(err.Error())
 	}
-
-	var scheme string
-	var host string
-	if tryHttp {
-		scheme = "http"
-		host = fmt.Sprintf("%s:%d", c.upstreamHost, c.port)
-	} else {
-		scheme = "https"
-		host = fmt.Sprintf("%s:%d", c.upstreamHost, c.upstreamPort)
+	if *check {
+		if err := p.Preflight(ctx, os.Stdout); err != nil {
+			fatal("preflight check failed", "err", err)
+		}
+		fmt.Println("preflight check ok")
+		return
+	}
+	if err := p.Run(ctx); err != nil {
+		fatal(err.Error())
 	}
+}
 
-	log.Printf("will proxy: %s://%s", scheme, host)
-	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
-		Scheme: scheme,
-		Host:   host,
-	})
+// checkConfig validates the flags and config file and exits non-zero if
+// they are invalid, e.g. from an init container.
+func checkConfig(args []string) {
+	c := parseFlags(newFlagSet("check-config"), args)
+	if err := proxy.CheckConfig(c); err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	fmt.Println("configuration ok")
+}
 
-	if !tryHttp {
-		if !pool.AppendCertsFromPEM(capem) {
-			log.Fatal("error: failed to add ca to cert pool")
-		}
+// healthcheck exits 0 if the proxy serving with the same flags is ready and
+// 1 otherwise, for Docker HEALTHCHECK and exec probes. With --upstream it
+// checks the upstream itself instead of asking the running proxy.
+func healthcheck(args []string) {
+	fs := newFlagSet("healthcheck")
+	upstream := fs.Bool("upstream", false, "Check the upstream etcd directly, like /readyz does, instead of requesting /readyz from the running proxy.")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for the check.")
+	c := parseFlags(fs, args)
 
-		cert, err := tls.LoadX509KeyPair(c.etcdCert, c.etcdKey)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if *upstream {
+		p, err := proxy.NewProxy(c)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err.Error())
 		}
-
-		proxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:      pool,
-				Certificates: []tls.Certificate{cert},
-				ServerName:   c.upstreamServerName,
-			},
+		if err := p.CheckUpstream(ctx); err != nil {
+			fatal("upstream not ready", "err", err)
 		}
+	} else if err := proxy.Healthcheck(ctx, c); err != nil {
+		fatal("proxy not ready", "err", err)
 	}
+	fmt.Println("ok")
+}
 
-	director := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		log.Printf("server: proxy metrics request to etcd")
-		director(req)
-	}
-
-	server := http.NewServeMux()
-	server.Handle("/metrics", proxy)
-	server.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprint(w, "ok")
-	})
-
-	addr := fmt.Sprintf(":%d", c.port)
-	log.Printf("server: listening on %s\n", addr)
-	if err := http.ListenAndServe(addr, server); err != nil {
-		log.Fatal(err)
-	}
+func printVersion() {
+	fmt.Println(version.Get())
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runMain runs main with args in a child process of the test binary,
+// returning its exit code and output.
+func runMain(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestMainProcess$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "ETCD_METRICS_PROXY_MAIN=1")
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), out.String()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, out.String()
+}
+
+// TestMainProcess is main in the child processes of runMain.
+func TestMainProcess(t *testing.T) {
+	if os.Getenv("ETCD_METRICS_PROXY_MAIN") != "1" {
+		t.Skip("only run by runMain")
+	}
+	// the arguments after -- of the test binary.
+	os.Args = append([]string{"etcd-metrics-proxy"}, flag.Args()...)
+	main()
+	os.Exit(0)
+}
+
+func TestSubcommands(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("metric_deny: ['(']\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+	}{
+		{"version", []string{"version"}, 0, "etcd-metrics-proxy "},
+		{"version flag", []string{"--version"}, 0, "etcd-metrics-proxy "},
+		{"version flag of a command", []string{"check-config", "--version"}, 0, "etcd-metrics-proxy "},
+		{"check-config", []string{"check-config", "--upstream-scheme=http"}, 0, "configuration ok"},
+		{"check-config of invalid flags", []string{"check-config", "--upstream-scheme=ftp"}, 1, "invalid configuration"},
+		{"check-config of an invalid config file", []string{"check-config", "--upstream-scheme=http", "--config=" + config}, 1, "invalid metric filter"},
+		{"unknown command", []string{"start"}, 2, `unknown command "start"`},
+		{"unknown flag", []string{"serve", "--no-such-flag"}, 2, "flag provided but not defined: -no-such-flag"},
+		{"unexpected arguments", []string{"check-config", "--upstream-scheme=http", "extra"}, 2, `unexpected arguments ["extra"]`},
+		{"serve --check of an unreachable upstream", []string{"serve", "--check", "--upstream-url=http://127.0.0.1:1/metrics"}, 1, "preflight check failed"},
+		{"healthcheck of a proxy not running", []string{"healthcheck", "--upstream-scheme=http", "--listen-address=127.0.0.1:1"}, 1, "proxy not ready"},
+		{"healthcheck --upstream of an unreachable upstream", []string{"healthcheck", "--upstream", "--upstream-url=http://127.0.0.1:1/metrics"}, 1, "upstream not ready"},
+		{"serve is the default", []string{"--upstream-scheme=ftp"}, 1, "--upstream-scheme must be http or https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, out := runMain(t, tt.args...)
+			if code != tt.wantCode || !strings.Contains(out, tt.wantOut) {
+				t.Errorf("got exit code %d with\n%s\nwant %d with %q", code, out, tt.wantCode, tt.wantOut)
+			}
+		})
+	}
+}
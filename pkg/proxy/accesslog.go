@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogFields are the fields --access-log-fields may select.
+var accessLogFields = []string{"method", "path", "remote", "status", "bytes", "duration", "upstream", "upstream_duration", "user_agent", "request_id"}
+
+const defaultAccessLogFields = "method,path,remote,status,bytes,duration,upstream_duration,request_id"
+
+// parseAccessLogFields validates a comma separated --access-log-fields value.
+func parseAccessLogFields(s string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		known := false
+		for _, k := range accessLogFields {
+			known = known || f == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown access log field %q, must be one of %s", f, strings.Join(accessLogFields, ", "))
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// upstreamTiming is filled in by the failover transport so the access log
+// can report which endpoint served a request and how long it took.
+type upstreamTiming struct {
+	mu       sync.Mutex
+	addr     string
+	duration time.Duration
+}
+
+type upstreamTimingKey struct{}
+
+func withUpstreamTiming(ctx context.Context) (context.Context, *upstreamTiming) {
+	t := &upstreamTiming{}
+	return context.WithValue(ctx, upstreamTimingKey{}, t), t
+}
+
+// recordUpstream notes a served upstream request on the timing in ctx, if
+// any.
+func recordUpstream(ctx context.Context, addr string, d time.Duration) {
+	t, ok := ctx.Value(upstreamTimingKey{}).(*upstreamTiming)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	t.addr, t.duration = addr, d
+	t.mu.Unlock()
+}
+
+// requestSampler decides which requests the access log records, with
+// --request-log-mode: all of them, a share of rate picked at random, or
+// none. Failed requests are always logged.
+type requestSampler struct {
+	mode string
+	rate float64
+}
+
+func (s requestSampler) keep(status int) bool {
+	if s.mode == "all" || status >= http.StatusBadRequest {
+		return true
+	}
+	return s.mode == "sampled" && rand.Float64() < s.rate
+}
+
+// accessLogged logs the requests handled by next that sampler keeps. format
+// is "default" for a structured line through the configured logger or
+// "common" for the Common Log Format on w.
+func accessLogged(next http.Handler, format string, fields []string, sampler requestSampler, w io.Writer) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, timing := withUpstreamTiming(r.Context())
+		cw := &countingResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(cw, r.WithContext(ctx))
+		duration := time.Since(start)
+		if !sampler.keep(cw.status) {
+			return
+		}
+
+		timing.mu.Lock()
+		upstream, upstreamDuration := timing.addr, timing.duration
+		timing.mu.Unlock()
+
+		if format == "common" {
+			fmt.Fprintf(w, "%s - - [%s] %q %d %d\n", remoteHost(r), start.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method+" "+r.URL.RequestURI()+" "+r.Proto, cw.status, cw.bytes)
+			return
+		}
+		attrs := make([]slog.Attr, 0, len(fields))
+		for _, f := range fields {
+			switch f {
+			case "method":
+				attrs = append(attrs, slog.String(f, r.Method))
+			case "path":
+				attrs = append(attrs, slog.String(f, r.URL.Path))
+			case "remote":
+				attrs = append(attrs, slog.String(f, r.RemoteAddr))
+			case "status":
+				attrs = append(attrs, slog.Int(f, cw.status))
+			case "bytes":
+				attrs = append(attrs, slog.Int64(f, cw.bytes))
+			case "duration":
+				attrs = append(attrs, slog.Duration(f, duration))
+			case "upstream":
+				if upstream != "" {
+					attrs = append(attrs, slog.String(f, upstream))
+				}
+			case "upstream_duration":
+				if upstream != "" {
+					attrs = append(attrs, slog.Duration(f, upstreamDuration))
+				}
+			case "user_agent":
+				attrs = append(attrs, slog.String(f, r.UserAgent()))
+			case "request_id":
+				if id := requestID(r.Context()); id != "" {
+					attrs = append(attrs, slog.String(f, id))
+				}
+			}
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+	})
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || host == "" {
+		return "-"
+	}
+	return host
+}
+
+// countingResponseWriter records the status and body size of a response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
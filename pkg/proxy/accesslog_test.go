@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAccessLogFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "default", in: defaultAccessLogFields, want: []string{"method", "path", "remote", "status", "bytes", "duration", "upstream_duration", "request_id"}},
+		{name: "spaces and empty fields", in: " status, ,upstream ", want: []string{"status", "upstream"}},
+		{name: "empty", in: ""},
+		{name: "unknown field", in: "method,latency", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAccessLogFields(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAccessLogFields(%q) = %v, want an error: %v", tt.in, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordUpstream(r.Context(), "etcd-0:2379", 5*time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	})
+	tests := []struct {
+		name   string
+		format string
+		fields []string
+		// want are the fields of a default line, or a regexp of a common
+		// one.
+		want       map[string]any
+		wantCommon string
+	}{
+		{
+			name:   "default",
+			format: "default",
+			fields: []string{"method", "path", "remote", "status", "bytes", "upstream", "user_agent"},
+			want: map[string]any{
+				"msg": "access", "method": "GET", "path": "/metrics", "remote": "192.0.2.1:1234",
+				"status": float64(418), "bytes": float64(25), "upstream": "etcd-0:2379", "user_agent": "prometheus/3.0",
+			},
+		},
+		{
+			name:   "selected fields",
+			format: "default",
+			fields: []string{"status", "upstream_duration"},
+			want:   map[string]any{"msg": "access", "status": float64(418), "upstream_duration": float64(5 * time.Millisecond)},
+		},
+		{
+			name:       "common",
+			format:     "common",
+			wantCommon: `^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /metrics\?debug=1 HTTP/1\.1" 418 25\n$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs, out bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+			h := accessLogged(next, tt.format, tt.fields, requestSampler{mode: "all"}, &out)
+			req := httptest.NewRequest(http.MethodGet, "/metrics?debug=1", nil)
+			req.Header.Set("User-Agent", "prometheus/3.0")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if tt.format == "common" {
+				if logs.Len() != 0 {
+					t.Errorf("common log format logged %q through the logger", logs.String())
+				}
+				if !regexp.MustCompile(tt.wantCommon).MatchString(out.String()) {
+					t.Errorf("got %q, want it to match %s", out.String(), tt.wantCommon)
+				}
+				return
+			}
+			var got map[string]any
+			if err := json.Unmarshal(logs.Bytes(), &got); err != nil {
+				t.Fatalf("log %q: %v", logs.String(), err)
+			}
+			delete(got, "time")
+			delete(got, "level")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogFormatFlag(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantLog bool
+	}{
+		{"default", true},
+		{"none", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("etcd_server_has_leader 1\n"))
+			}), func(c *Config) { c.AccessLogFormat = tt.format })
+			getPath(p.Handler(), "/metrics")
+			if got := strings.Contains(logs.String(), "msg=access"); got != tt.wantLog {
+				t.Errorf("got logs %q, want an access log: %v", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestRequestLogMode(t *testing.T) {
+	const requests = 1000
+	tests := []struct {
+		name             string
+		sampler          requestSampler
+		status           int
+		wantMin, wantMax int
+	}{
+		{name: "all", sampler: requestSampler{mode: "all"}, status: http.StatusOK, wantMin: requests, wantMax: requests},
+		{name: "off", sampler: requestSampler{mode: "off"}, status: http.StatusOK},
+		{name: "off logs failures", sampler: requestSampler{mode: "off"}, status: http.StatusBadGateway, wantMin: requests, wantMax: requests},
+		{name: "sampled", sampler: requestSampler{mode: "sampled", rate: 0.1}, status: http.StatusOK, wantMin: 50, wantMax: 150},
+		{name: "sampled logs failures", sampler: requestSampler{mode: "sampled", rate: 0.1}, status: http.StatusNotFound, wantMin: requests, wantMax: requests},
+		{name: "sampled at 0", sampler: requestSampler{mode: "sampled"}, status: http.StatusOK},
+		{name: "sampled at 1", sampler: requestSampler{mode: "sampled", rate: 1}, status: http.StatusOK, wantMin: requests, wantMax: requests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			h := accessLogged(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}), "common", nil, tt.sampler, &out)
+			for range requests {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			}
+			if n := strings.Count(out.String(), "\n"); n < tt.wantMin || n > tt.wantMax {
+				t.Errorf("logged %d of %d requests, want %d to %d", n, requests, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestRequestLogModeFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		rate    float64
+		wantErr string
+	}{
+		{name: "all", mode: "all", rate: 0.01},
+		{name: "sampled", mode: "sampled", rate: 0.5},
+		{name: "off", mode: "off", rate: 0.01},
+		{name: "invalid mode", mode: "some", rate: 0.01, wantErr: `invalid --request-log-mode "some", must be all, sampled or off`},
+		{name: "negative rate", mode: "sampled", rate: -0.1, wantErr: "--request-log-sample-rate must be between 0 and 1, got -0.1"},
+		{name: "rate above 1", mode: "sampled", rate: 2, wantErr: "--request-log-sample-rate must be between 0 and 1, got 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			c.RequestLogMode, c.RequestLogRate = tt.mode, tt.rate
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses a list of CIDRs, each entry possibly comma separated.
+// Plain addresses are accepted as single host prefixes.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if !strings.Contains(s, "/") {
+				addr, err := netip.ParseAddr(s)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cidr %q: %w", s, err)
+				}
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", s, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowlist only passes requests whose client address is in allowed.
+// X-Forwarded-For is only consulted when the connecting peer is one of the
+// trusted proxies; it is then walked from the right, skipping further
+// trusted proxies, to find the client.
+type ipAllowlist struct {
+	next    http.Handler
+	allowed []netip.Prefix
+	trusted []netip.Prefix
+}
+
+// clientAddr returns the address of the client of r, read from
+// X-Forwarded-For when the peer is one of the trusted proxies. It fails for
+// requests without an ip, e.g. over a unix socket.
+func clientAddr(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	if !containsAddr(trusted, peer) {
+		return peer, true
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !containsAddr(trusted, hop) {
+			return hop, true
+		}
+	}
+	return peer, true
+}
+
+func (a *ipAllowlist) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr, ok := clientAddr(r, a.trusted)
+	// requests over a unix socket have no ip; access to them is governed
+	// by the socket's file mode.
+	if ok && !containsAddr(a.allowed, addr) {
+		slog.Debug("request from address not in --allowed-cidrs", "client", addr.String(), "remote", r.RemoteAddr)
+		noteRejection(r.Context(), "client address not in --allowed-cidrs")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	a.next.ServeHTTP(w, r)
+}
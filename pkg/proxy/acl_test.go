@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []string
+		want    []string
+		wantErr bool
+	}{
+		{"cidrs", []string{"10.244.0.0/16", "2001:db8::/32"}, []string{"10.244.0.0/16", "2001:db8::/32"}, false},
+		{"comma separated", []string{"10.244.0.0/16, 192.168.1.10,,"}, []string{"10.244.0.0/16", "192.168.1.10/32"}, false},
+		{"plain ipv6 address", []string{"2001:db8::1"}, []string{"2001:db8::1/128"}, false},
+		{"host bits are masked", []string{"10.244.1.7/16"}, []string{"10.244.0.0/16"}, false},
+		{"invalid address", []string{"10.244.0"}, nil, true},
+		{"invalid prefix", []string{"10.244.0.0/33"}, nil, true},
+		{"hostname", []string{"prometheus"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePrefixes(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePrefixes(%q) = %v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parsePrefixes(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+			for i := range got {
+				if got[i].String() != tt.want[i] {
+					t.Errorf("parsePrefixes(%q)[%d] = %v, want %v", tt.in, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"192.168.0.0/24", "fd00::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"untrusted peer", "203.0.113.5:41234", nil, "203.0.113.5"},
+		{"spoofed header from an untrusted peer", "203.0.113.5:41234", []string{"10.244.1.7"}, "203.0.113.5"},
+		{"trusted proxy", "192.168.0.1:41234", []string{"10.244.1.7"}, "10.244.1.7"},
+		{"chain of trusted proxies", "192.168.0.1:41234", []string{"10.244.1.7, 192.168.0.2, 192.168.0.3"}, "10.244.1.7"},
+		{"client prepends a spoofed address", "192.168.0.1:41234", []string{"10.244.1.7, 203.0.113.5"}, "203.0.113.5"},
+		{"several headers", "192.168.0.1:41234", []string{"10.244.1.7", "203.0.113.5, 192.168.0.2"}, "203.0.113.5"},
+		{"only trusted proxies", "192.168.0.1:41234", []string{"192.168.0.2"}, "192.168.0.1"},
+		{"no header from a trusted proxy", "192.168.0.1:41234", nil, "192.168.0.1"},
+		{"ipv6 peer", "[2001:db8::1]:41234", []string{"10.244.1.7"}, "2001:db8::1"},
+		{"ipv6 trusted proxy", "[fd00::1]:41234", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"ipv6 client behind ipv4 proxies", "192.168.0.1:41234", []string{"2001:db8::7 , 192.168.0.2"}, "2001:db8::7"},
+		{"ipv4-mapped peer", "[::ffff:192.168.0.1]:41234", []string{"10.244.1.7"}, "10.244.1.7"},
+		{"peer without port", "203.0.113.5", nil, "203.0.113.5"},
+		{"malformed header", "192.168.0.1:41234", []string{"not an address"}, "192.168.0.1"},
+		{"address with port", "192.168.0.1:41234", []string{"10.244.1.7:5555"}, "192.168.0.1"},
+		{"malformed hop stops the walk", "192.168.0.1:41234", []string{"10.244.1.7, garbage, 192.168.0.2"}, "192.168.0.1"},
+		{"empty header", "192.168.0.1:41234", []string{""}, "192.168.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			got, ok := clientAddr(r, trusted)
+			if !ok {
+				t.Fatalf("clientAddr() found no address")
+			}
+			if want := netip.MustParseAddr(tt.want); got.Unmap() != want {
+				t.Errorf("clientAddr() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestIPAllowlist(t *testing.T) {
+	allowed, err := parsePrefixes([]string{"10.244.0.0/16", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := parsePrefixes([]string{"192.168.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &ipAllowlist{next: okHandler, allowed: allowed, trusted: trusted}
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		want   int
+	}{
+		{"allowed", "10.244.1.7:41234", "", http.StatusOK},
+		{"denied", "203.0.113.5:41234", "", http.StatusForbidden},
+		{"spoofed header from an untrusted peer", "203.0.113.5:41234", "10.244.1.7", http.StatusForbidden},
+		{"allowed behind a trusted proxy", "192.168.0.1:41234", "10.244.1.7", http.StatusOK},
+		{"denied behind a trusted proxy", "192.168.0.1:41234", "203.0.113.5", http.StatusForbidden},
+		{"spoofed hop behind a trusted proxy", "192.168.0.1:41234", "10.244.1.7, 203.0.113.5", http.StatusForbidden},
+		{"trusted proxy itself isn't allowed", "192.168.0.1:41234", "", http.StatusForbidden},
+		{"malformed header", "192.168.0.1:41234", "10.244.1.7:5555", http.StatusForbidden},
+		{"ipv6 allowed", "[2001:db8:1::7]:41234", "", http.StatusOK},
+		{"ipv6 denied", "[2001:db8:2::7]:41234", "", http.StatusForbidden},
+		{"ipv4-mapped allowed", "[::ffff:10.244.1.7]:41234", "", http.StatusOK},
+		{"unix socket", "@", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			rec := httptest.NewRecorder()
+			a.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
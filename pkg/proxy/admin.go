@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// newAdminMux returns the handler for the admin listener: runtime profiling,
+// expvar and the proxy's own metrics. It is served separately from the
+// scrape listener so it can be kept private.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", selfMetricsHandler())
+	return mux
+}
+
+// readOnly rejects requests other than GET and HEAD with 405.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// registerLifecycle adds the /-/reload, /-/config and /-/quit endpoints to
+// mux. quit starts a graceful shutdown.
+func registerLifecycle(mux *http.ServeMux, r *reloader, quit func()) {
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		slog.Info("reload requested", "remote", req.RemoteAddr)
+		if err := r.reloadAll(); err != nil {
+			slog.Error("reload failed, keeping the current configuration", "err", err)
+			http.Error(w, fmt.Sprintf("reload failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	mux.Handle("/-/config", readOnly(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeRunningConfig(w, r.c.flags, r.fileConfig())
+	})))
+	mux.HandleFunc("/-/quit", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		slog.Info("shutdown requested", "remote", req.RemoteAddr)
+		fmt.Fprint(w, "shutting down")
+		quit()
+	})
+}
+
+// secretFlag reports whether the value of the named flag must not be shown.
+// Flags naming a file holding a secret are fine to show.
+func secretFlag(name string) bool {
+	if strings.HasSuffix(name, "-file") {
+		return false
+	}
+	for _, s := range []string{"password", "token", "secret"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRunningConfig writes the effective flag values, with secrets
+// redacted, followed by the config file contents in use. The flags are
+// omitted when the config wasn't built from a flag set.
+func writeRunningConfig(w http.ResponseWriter, flags *flag.FlagSet, fc *fileConfig) {
+	if flags != nil {
+		fmt.Fprintln(w, "# flags")
+		flags.VisitAll(func(f *flag.Flag) {
+			v := f.Value.String()
+			if secretFlag(f.Name) && v != "" {
+				v = "<redacted>"
+			}
+			fmt.Fprintf(w, "--%s=%s\n", f.Name, v)
+		})
+	}
+	if fc == nil {
+		return
+	}
+	fmt.Fprintln(w, "\n# config file")
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	enc.Encode(fc)
+	enc.Close()
+}
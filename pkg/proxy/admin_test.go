@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminListener(t *testing.T) {
+	dir := t.TempDir()
+	socket, adminSocket := filepath.Join(dir, "proxy.sock"), filepath.Join(dir, "admin.sock")
+	p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}), func(c *Config) {
+		c.ListenAddresses = []string{"unix://" + socket}
+		c.AdminListenAddress = "unix://" + adminSocket
+	})
+	stop, errc := startRun(t, p, socket)
+	defer func() {
+		stop()
+		if err := <-errc; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	}()
+	// the admin listener is opened after the scrape listeners.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("unix", adminSocket); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the admin listener didn't start")
+		}
+	}
+
+	tests := []struct {
+		name       string
+		socket     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"pprof index", adminSocket, "/debug/pprof/", http.StatusOK, "goroutine"},
+		{"pprof profile", adminSocket, "/debug/pprof/goroutine?debug=1", http.StatusOK, "goroutine profile"},
+		{"expvar", adminSocket, "/debug/vars", http.StatusOK, `"memstats"`},
+		{"self metrics", adminSocket, "/metrics", http.StatusOK, "etcd_metrics_proxy_build_info"},
+		{"etcd metrics on the scrape listener", socket, "/metrics", http.StatusOK, "etcd_server_has_leader 1"},
+		{"no pprof on the scrape listener", socket, "/debug/pprof/", http.StatusNotFound, ""},
+		{"no expvar on the scrape listener", socket, "/debug/vars", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := unixClient(tt.socket).Get("http://proxy" + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus || !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("got %d %.200q, want %d with %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestLifecycleEndpoints(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("metric_prefix: before_\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}), func(c *Config) {
+		c.ConfigFile = config
+		c.EnableLifecycle = true
+		c.AdminPort = 9091
+	})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	tests := []struct {
+		name       string
+		config     string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantAllow  string
+	}{
+		{name: "config", method: http.MethodGet, path: "/-/config", wantStatus: http.StatusOK, wantBody: "metric_prefix: before_\n"},
+		{name: "config only reads", method: http.MethodPost, path: "/-/config", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "reload only posts", method: http.MethodGet, path: "/-/reload", wantStatus: http.StatusMethodNotAllowed, wantAllow: http.MethodPost},
+		{name: "failed reload", config: "metric_prefix: [\n", method: http.MethodPost, path: "/-/reload", wantStatus: http.StatusInternalServerError, wantBody: "reload failed"},
+		{name: "config kept after a failed reload", method: http.MethodGet, path: "/-/config", wantStatus: http.StatusOK, wantBody: "metric_prefix: before_"},
+		{name: "reload", config: "metric_prefix: after_\n", method: http.MethodPost, path: "/-/reload", wantStatus: http.StatusOK, wantBody: "ok"},
+		{name: "reloaded config", method: http.MethodGet, path: "/-/config", wantStatus: http.StatusOK, wantBody: "metric_prefix: after_"},
+		{name: "quit only posts", method: http.MethodGet, path: "/-/quit", wantStatus: http.StatusMethodNotAllowed, wantAllow: http.MethodPost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config != "" {
+				if err := os.WriteFile(config, []byte(tt.config), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rec := serve(tt.method, tt.path)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d with %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("got Allow %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+	if rec := getPath(p.MetricsHandler(), "/metrics"); !strings.Contains(rec.Body.String(), "after_etcd_server_has_leader 1") {
+		t.Errorf("got %q, want the metrics renamed by the reloaded config", rec.Body.String())
+	}
+
+	select {
+	case <-p.quit:
+		t.Fatal("the proxy quit before /-/quit was posted")
+	default:
+	}
+	if rec := serve(http.MethodPost, "/-/quit"); rec.Code != http.StatusOK {
+		t.Errorf("got %d, want 200", rec.Code)
+	}
+	select {
+	case <-p.quit:
+	default:
+		t.Error("posting /-/quit didn't start a shutdown")
+	}
+}
+
+func TestWriteRunningConfig(t *testing.T) {
+	var c Config
+	set := flag.NewFlagSet("", flag.ContinueOnError)
+	RegisterFlags(set, &c)
+	if err := set.Parse([]string{
+		"--upstream-url=https://etcd-0:2379/metrics",
+		"--upstream-password-file=/etc/etcd-metrics-proxy/password",
+		"--etcd-tls-secret=kube-system/etcd-client",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	writeRunningConfig(rec, set, &fileConfig{MetricPrefix: "etcd_"})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"flag", "--upstream-url=https://etcd-0:2379/metrics\n"},
+		{"default", "--port=2381\n"},
+		{"file holding a secret", "--upstream-password-file=/etc/etcd-metrics-proxy/password\n"},
+		{"secret", "--etcd-tls-secret=<redacted>\n"},
+		{"config file", "\n# config file\n"},
+		{"config file contents", "metric_prefix: etcd_\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got\n%s\nwant it to contain %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
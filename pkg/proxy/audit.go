@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+)
+
+// auditLogger writes a JSON line per request on the scrape listener with
+// the identity of the scraper, for a record of who pulled the metrics.
+type auditLogger struct {
+	logger  *slog.Logger
+	trusted []netip.Prefix
+}
+
+// openAuditLog opens the --audit-log file for appending, or stdout for "-".
+func openAuditLog(path string, trusted []netip.Prefix) (*auditLogger, error) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		// every entry has the same level.
+		if a.Key == slog.LevelKey && len(groups) == 0 {
+			return slog.Attr{}
+		}
+		return a
+	}})
+	return &auditLogger{logger: slog.New(h), trusted: trusted}, nil
+}
+
+// auditRecord collects what the authentication steps of a request found.
+type auditRecord struct {
+	mu       sync.Mutex
+	auth     string
+	identity string
+	issuer   string
+	reason   string
+}
+
+type auditRecordKey struct{}
+
+// noteIdentity records on the audit record in ctx, if any, that the
+// scraper authenticated as identity with method, e.g. "jwt".
+func noteIdentity(ctx context.Context, method, identity, issuer string) {
+	if rec, ok := ctx.Value(auditRecordKey{}).(*auditRecord); ok {
+		rec.mu.Lock()
+		rec.auth, rec.identity, rec.issuer = method, identity, issuer
+		rec.mu.Unlock()
+	}
+}
+
+// noteRejection records why the request was rejected on the audit record
+// in ctx, if any.
+func noteRejection(ctx context.Context, reason string) {
+	if rec, ok := ctx.Value(auditRecordKey{}).(*auditRecord); ok {
+		rec.mu.Lock()
+		rec.reason = reason
+		rec.mu.Unlock()
+	}
+}
+
+// certIdentity names the client certificate: its SPIFFE ID or other URI
+// SAN if it has one, else its subject.
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.String()
+}
+
+func (a *auditLogger) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &auditRecord{auth: "none"}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			rec.auth, rec.identity = "tls", certIdentity(r.TLS.PeerCertificates[0])
+		}
+		cw := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, rec)))
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		result := "allowed"
+		switch {
+		case cw.status == http.StatusUnauthorized || cw.status == http.StatusForbidden:
+			result = "denied"
+		case cw.status >= http.StatusBadRequest:
+			result = "failed"
+		}
+		attrs := []slog.Attr{
+			slog.String("auth", rec.auth),
+			slog.String("identity", rec.identity),
+		}
+		if rec.issuer != "" {
+			attrs = append(attrs, slog.String("issuer", rec.issuer))
+		}
+		attrs = append(attrs, slog.String("remote", r.RemoteAddr))
+		if client, ok := clientAddr(r, a.trusted); ok {
+			attrs = append(attrs, slog.String("client", client.String()))
+		}
+		attrs = append(attrs,
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", cw.status),
+			slog.String("result", result),
+		)
+		if rec.reason != "" {
+			attrs = append(attrs, slog.String("reason", rec.reason))
+		}
+		if id := requestID(r.Context()); id != "" {
+			attrs = append(attrs, slog.String("request_id", id))
+		}
+		a.logger.LogAttrs(context.Background(), slog.LevelInfo, "audit", attrs...)
+	})
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertIdentity(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/monitoring/sa/prometheus")
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"subject", &x509.Certificate{Subject: pkix.Name{CommonName: "prometheus", Organization: []string{"monitoring"}}}, "CN=prometheus,O=monitoring"},
+		{"uri san", &x509.Certificate{Subject: pkix.Name{CommonName: "prometheus"}, URIs: []*url.URL{spiffeID}}, spiffeID.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := certIdentity(tt.cert); got != tt.want {
+				t.Errorf("certIdentity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	iss := newTestIssuer(t, "a")
+	withJWT := func(c *Config) {
+		c.JWTJWKSURL = iss.server.URL
+		c.JWTIssuer = "https://issuer.example.com"
+		c.JWTAudience = "etcd-metrics-proxy"
+	}
+	tests := []struct {
+		name       string
+		configure  func(*Config)
+		path       string
+		cert       *x509.Certificate
+		token      string
+		want       map[string]any
+		wantAbsent []string
+	}{
+		{
+			name: "anonymous",
+			path: "/metrics",
+			want: map[string]any{
+				"msg": "audit", "auth": "none", "identity": "", "remote": "192.0.2.1:41234", "client": "192.0.2.1",
+				"method": "GET", "path": "/metrics", "status": 200.0, "result": "allowed",
+			},
+			wantAbsent: []string{"level", "issuer", "reason"},
+		},
+		{
+			name: "client certificate",
+			path: "/metrics",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "prometheus"}},
+			want: map[string]any{"auth": "tls", "identity": "CN=prometheus", "result": "allowed"},
+		},
+		{
+			name:      "jwt",
+			configure: withJWT,
+			path:      "/metrics",
+			token:     iss.token("a", validClaims()),
+			want: map[string]any{
+				"auth": "jwt", "identity": "system:serviceaccount:monitoring:prometheus",
+				"issuer": "https://issuer.example.com", "status": 200.0, "result": "allowed",
+			},
+		},
+		{
+			name:      "without a jwt",
+			configure: withJWT,
+			path:      "/metrics",
+			want:      map[string]any{"auth": "none", "status": 401.0, "result": "denied", "reason": "no bearer token"},
+		},
+		{
+			name:      "outside the allowed cidrs",
+			configure: func(c *Config) { c.AllowedCIDRs = []string{"10.0.0.0/8"} },
+			path:      "/metrics",
+			want:      map[string]any{"status": 403.0, "result": "denied", "reason": "client address not in --allowed-cidrs"},
+		},
+		{
+			name: "unknown path",
+			path: "/not-metrics",
+			want: map[string]any{"path": "/not-metrics", "status": 404.0, "result": "failed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			p, _ := newTestProxy(t, okHandler, func(c *Config) {
+				c.AuditLog = path
+				if tt.configure != nil {
+					tt.configure(c)
+				}
+			})
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.RemoteAddr = "192.0.2.1:41234"
+			if tt.cert != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.cert}}
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			p.Handler().ServeHTTP(httptest.NewRecorder(), r)
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entry map[string]any
+			if err := json.Unmarshal(b, &entry); err != nil {
+				t.Fatalf("audit log %q isn't a json line: %v", b, err)
+			}
+			for k, v := range tt.want {
+				if entry[k] != v {
+					t.Errorf("got %s %v, want %v in %s", k, entry[k], v, b)
+				}
+			}
+			for _, k := range tt.wantAbsent {
+				if _, ok := entry[k]; ok {
+					t.Errorf("got %s in %s", k, b)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// httpAuth adds bearer or basic auth to outgoing requests, re-reading the
+// secret files on every request so rotated credentials are picked up.
+type httpAuth struct {
+	username        string
+	passwordFile    string
+	bearerTokenFile string
+}
+
+func (a *httpAuth) authorize(req *http.Request) error {
+	switch {
+	case a == nil:
+	case a.bearerTokenFile != "":
+		token, err := os.ReadFile(a.bearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	case a.username != "":
+		var password string
+		if a.passwordFile != "" {
+			b, err := os.ReadFile(a.passwordFile)
+			if err != nil {
+				return err
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		req.SetBasicAuth(a.username, password)
+	}
+	return nil
+}
+
+// newUpstreamAuth returns the auth for requests to etcd, or nil if none is
+// configured.
+func newUpstreamAuth(c *Config) *httpAuth {
+	if c.UpstreamBearerTokenFile == "" && c.UpstreamUsername == "" {
+		return nil
+	}
+	return &httpAuth{
+		username:        c.UpstreamUsername,
+		passwordFile:    c.UpstreamPasswordFile,
+		bearerTokenFile: c.UpstreamBearerTokenFile,
+	}
+}
+
+// authTransport authorizes every request before handing it to next.
+type authTransport struct {
+	auth *httpAuth
+	next http.RoundTripper
+}
+
+// withAuth returns next, authorizing its requests with a if set.
+func withAuth(next http.RoundTripper, a *httpAuth) http.RoundTripper {
+	if a == nil {
+		return next
+	}
+	return &authTransport{auth: a, next: next}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given.
+	req = req.Clone(req.Context())
+	if err := t.auth.authorize(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
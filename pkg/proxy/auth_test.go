@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPAuthorize(t *testing.T) {
+	dir := t.TempDir()
+	token, password := filepath.Join(dir, "token"), filepath.Join(dir, "password")
+	writeFile(t, token, "s3cr3t\n")
+	writeFile(t, password, " hunter2\n")
+	tests := []struct {
+		name    string
+		auth    *httpAuth
+		want    string
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "bearer token", auth: &httpAuth{bearerTokenFile: token}, want: "Bearer s3cr3t"},
+		// base64 of "etcd:hunter2".
+		{name: "basic", auth: &httpAuth{username: "etcd", passwordFile: password}, want: "Basic ZXRjZDpodW50ZXIy"},
+		// base64 of "etcd:".
+		{name: "basic without a password", auth: &httpAuth{username: "etcd"}, want: "Basic ZXRjZDo="},
+		{name: "missing token file", auth: &httpAuth{bearerTokenFile: filepath.Join(dir, "missing")}, wantErr: "no such file"},
+		{name: "missing password file", auth: &httpAuth{username: "etcd", passwordFile: filepath.Join(dir, "missing")}, wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			err := tt.auth.authorize(req)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("authorize() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("authorize() = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("got Authorization %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamAuth(t *testing.T) {
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token")
+	writeFile(t, token, "first")
+	var got []string
+	p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}), func(c *Config) { c.UpstreamBearerTokenFile = token })
+
+	getPath(p.MetricsHandler(), "/metrics")
+	// a rotated token is used for the next request.
+	writeFile(t, token, "second")
+	getPath(p.MetricsHandler(), "/metrics")
+	if len(got) != 2 || got[0] != "Bearer first" || got[1] != "Bearer second" {
+		t.Errorf("got Authorization %q, want the token of the file at the time of each request", got)
+	}
+
+	// a missing token fails the scrape rather than scraping without it.
+	if err := os.Remove(token); err != nil {
+		t.Fatal(err)
+	}
+	if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != http.StatusBadGateway || len(got) != 2 {
+		t.Errorf("got %d after %d upstream requests, want %d after 2", rec.Code, len(got), http.StatusBadGateway)
+	}
+}
+
+func TestUpstreamAuthFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "bearer token", configure: func(c *Config) { c.UpstreamBearerTokenFile = "token" }},
+		{name: "basic", configure: func(c *Config) { c.UpstreamUsername, c.UpstreamPasswordFile = "etcd", "password" }},
+		{
+			name:      "bearer token and basic",
+			configure: func(c *Config) { c.UpstreamBearerTokenFile, c.UpstreamUsername = "token", "etcd" },
+			wantErr:   "--upstream-bearer-token-file and --upstream-username are mutually exclusive",
+		},
+		{
+			name:      "password without a username",
+			configure: func(c *Config) { c.UpstreamPasswordFile = "password" },
+			wantErr:   "--upstream-password-file requires --upstream-username",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			tt.configure(&c)
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
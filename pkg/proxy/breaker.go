@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen fails requests while the circuit breaker of every upstream
+// target is open.
+var errCircuitOpen = errors.New("circuit breaker open for every upstream endpoint")
+
+type breakerState int
+
+// The states are exported as the value of the circuit breaker state metric.
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+type endpointBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// circuitBreaker stops sending requests to an upstream endpoint after
+// failures consecutive failures, for cooldown. The first request after the
+// cooldown probes the endpoint: success closes the circuit again, failure
+// reopens it. Other requests skip the endpoint while the probe is in
+// flight.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointBreaker
+}
+
+func newCircuitBreaker(c *Config) *circuitBreaker {
+	if c.CircuitBreakerFailures <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		failures:  c.CircuitBreakerFailures,
+		cooldown:  c.CircuitBreakerCooldown,
+		endpoints: map[string]*endpointBreaker{},
+	}
+}
+
+// available reports whether addr would currently be allowed a request.
+func (b *circuitBreaker) available(addr string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.endpoints[addr]
+	return e == nil || e.state == breakerClosed || (e.state == breakerOpen && time.Since(e.openedAt) >= b.cooldown)
+}
+
+// allow reports whether a request may be sent to addr now, moving an open
+// circuit whose cooldown has passed to half-open.
+func (b *circuitBreaker) allow(addr string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.endpoints[addr]
+	if e == nil {
+		return true
+	}
+	switch e.state {
+	case breakerOpen:
+		if time.Since(e.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(addr, e, breakerHalfOpen)
+		slog.Info("circuit breaker half-open, probing upstream endpoint", "endpoint", addr)
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record updates the circuit of addr with the outcome of a request.
+func (b *circuitBreaker) record(addr string, ok bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.endpoints[addr]
+	if e == nil {
+		e = &endpointBreaker{}
+		b.endpoints[addr] = e
+	}
+	if ok {
+		if e.state != breakerClosed {
+			slog.Info("circuit breaker closed", "endpoint", addr)
+		}
+		e.failures = 0
+		b.setState(addr, e, breakerClosed)
+		return
+	}
+	e.failures++
+	if e.state == breakerHalfOpen || (e.state == breakerClosed && e.failures >= b.failures) {
+		slog.Warn("circuit breaker opened, failing fast", "endpoint", addr, "failures", e.failures, "cooldown", b.cooldown)
+		e.openedAt = time.Now()
+		b.setState(addr, e, breakerOpen)
+	}
+}
+
+// abort ends a probe of addr that had no outcome, e.g. because the scrape
+// was cancelled, so the next request probes again.
+func (b *circuitBreaker) abort(addr string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e := b.endpoints[addr]; e != nil && e.state == breakerHalfOpen {
+		e.openedAt = time.Now().Add(-b.cooldown)
+		b.setState(addr, e, breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(addr string, e *endpointBreaker, state breakerState) {
+	e.state = state
+	circuitBreakerState.WithLabelValues(addr).Set(float64(state))
+}
+
+// forget drops the circuits of addrs, which are no longer upstream targets,
+// so that an address coming back starts with a closed circuit.
+func (b *circuitBreaker) forget(addrs []string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, addr := range addrs {
+		delete(b.endpoints, addr)
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// caFiles expands the --etcd-ca paths into the files they name. A directory
+// contributes each file in it holding a PEM certificate, in name order;
+// hidden entries such as the ..data symlink of kubernetes secret volumes and
+// other files, such as a key next to the CA, are skipped.
+func caFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		n := len(files)
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			f := filepath.Join(p, e.Name())
+			// entries of secret volumes are symlinks, so stat the target.
+			if info, err := os.Stat(f); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			data, err := os.ReadFile(f)
+			if err != nil || !bytes.Contains(data, []byte("-----BEGIN CERTIFICATE-----")) {
+				continue
+			}
+			files = append(files, f)
+		}
+		if len(files) == n {
+			return nil, fmt.Errorf("%s: no ca files found", p)
+		}
+	}
+	return files, nil
+}
+
+// loadCAPool reads every CA file into a single root pool, seeded from the
+// system pool when system is set.
+func loadCAPool(paths []string, system bool) (*x509.CertPool, error) {
+	files, err := caFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if system {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("failed to load system cert pool: %w", err)
+		}
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("failed to add ca %s to cert pool", f)
+		}
+	}
+	return pool, nil
+}
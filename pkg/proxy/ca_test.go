@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readTestCertificate parses the certificate written by writeTestCertificate.
+func readTestCertificate(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCAFiles(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "bundle")
+	for _, d := range []string{bundle, filepath.Join(bundle, "sub"), filepath.Join(dir, "empty")} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// old.crt and new.crt, with the key of new.crt next to them.
+	writeTestCertificate(t, filepath.Join(bundle, "old.crt"), filepath.Join(dir, "old.key"), "old")
+	writeTestCertificate(t, filepath.Join(bundle, "new.crt"), filepath.Join(bundle, "new.key"), "new")
+	writeTestCertificate(t, filepath.Join(bundle, ".hidden.crt"), filepath.Join(dir, "hidden.key"), "hidden")
+	writeTestCertificate(t, filepath.Join(bundle, "sub", "nested.crt"), filepath.Join(dir, "nested.key"), "nested")
+	if err := os.Symlink(filepath.Join(bundle, "old.crt"), filepath.Join(bundle, "linked.crt")); err != nil {
+		t.Fatal(err)
+	}
+	single := filepath.Join(dir, "ca.crt")
+	writeTestCertificate(t, single, filepath.Join(dir, "ca.key"), "ca")
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    []string
+		wantErr string
+	}{
+		{name: "file", paths: []string{single}, want: []string{single}},
+		{
+			name:  "directory",
+			paths: []string{bundle},
+			want:  []string{filepath.Join(bundle, "linked.crt"), filepath.Join(bundle, "new.crt"), filepath.Join(bundle, "old.crt")},
+		},
+		{
+			name:  "repeated",
+			paths: []string{single, filepath.Join(bundle, "new.crt")},
+			want:  []string{single, filepath.Join(bundle, "new.crt")},
+		},
+		{name: "directory without certificates", paths: []string{filepath.Join(dir, "empty")}, wantErr: "no ca files found"},
+		{name: "missing", paths: []string{filepath.Join(dir, "missing.crt")}, wantErr: "no such file or directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := caFiles(tt.paths)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("caFiles() = %v, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCAPool(t *testing.T) {
+	dir := t.TempDir()
+	oldCA, newCA := filepath.Join(dir, "old.crt"), filepath.Join(dir, "new.crt")
+	writeTestCertificate(t, oldCA, filepath.Join(dir, "old.key"), "old")
+	writeTestCertificate(t, newCA, filepath.Join(dir, "new.key"), "new")
+	other := filepath.Join(t.TempDir(), "other.crt")
+	writeTestCertificate(t, other, filepath.Join(t.TempDir(), "other.key"), "other")
+	invalid := filepath.Join(t.TempDir(), "invalid.crt")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		paths       []string
+		wantTrusted []string
+		wantErr     string
+	}{
+		{name: "old and new roots in separate files", paths: []string{oldCA, newCA}, wantTrusted: []string{oldCA, newCA}},
+		{name: "roots in a directory", paths: []string{dir}, wantTrusted: []string{oldCA, newCA}},
+		{name: "only the given roots", paths: []string{oldCA}, wantTrusted: []string{oldCA}},
+		{name: "invalid file", paths: []string{oldCA, invalid}, wantErr: "failed to add ca " + invalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := loadCAPool(tt.paths, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadCAPool() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []string{oldCA, newCA, other} {
+				_, err := readTestCertificate(t, f).Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+				want := false
+				for _, w := range tt.wantTrusted {
+					want = want || w == f
+				}
+				if got := err == nil; got != want {
+					t.Errorf("%s trusted: %v, want %v (%v)", filepath.Base(f), got, want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHashTLSFilesCoversCADirectory(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(t.TempDir(), "client.crt"), filepath.Join(t.TempDir(), "client.key")
+	writeTestCertificate(t, cert, key, "client")
+	writeTestCertificate(t, filepath.Join(dir, "old.crt"), filepath.Join(t.TempDir(), "old.key"), "old")
+	r := &reloader{c: &Config{EtcdCA: []string{dir}, EtcdCert: cert, EtcdKey: key}}
+	before, err := r.hashTLSFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new root of a rotation is added next to the old one.
+	writeTestCertificate(t, filepath.Join(dir, "new.crt"), filepath.Join(t.TempDir(), "new.key"), "new")
+	after, err := r.hashTLSFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Error("adding a ca file to the directory didn't change the hash of the tls files")
+	}
+}
+
+func TestLoadCAPoolWithSystemCA(t *testing.T) {
+	dir := t.TempDir()
+	system, explicit := filepath.Join(dir, "system.crt"), filepath.Join(dir, "explicit.crt")
+	writeTestCertificate(t, system, filepath.Join(dir, "system.key"), "system")
+	writeTestCertificate(t, explicit, filepath.Join(dir, "explicit.key"), "explicit")
+	// the system pool is read from these on linux, once per process.
+	t.Setenv("SSL_CERT_FILE", system)
+	t.Setenv("SSL_CERT_DIR", t.TempDir())
+
+	tests := []struct {
+		name        string
+		paths       []string
+		wantTrusted []string
+	}{
+		{name: "system pool", wantTrusted: []string{system}},
+		{name: "explicit ca merged on top", paths: []string{explicit}, wantTrusted: []string{system, explicit}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := loadCAPool(tt.paths, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range tt.wantTrusted {
+				if _, err := readTestCertificate(t, f).Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+					t.Errorf("%s isn't trusted: %v", filepath.Base(f), err)
+				}
+			}
+		})
+	}
+	// the explicit ca isn't added to the system pool itself.
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTestCertificate(t, explicit).Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err == nil {
+		t.Error("the explicit ca was added to the system pool")
+	}
+}
+
+func TestUseSystemCAFlag(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, cert, key, "client")
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "satisfies the ca requirement", configure: func(c *Config) { c.EtcdCert, c.EtcdKey = cert, key }},
+		{name: "with --etcd-ca", configure: func(c *Config) { c.EtcdCA, c.EtcdCert, c.EtcdKey = []string{cert}, cert, key }},
+		{
+			name:      "with plain http",
+			configure: func(c *Config) { c.UpstreamScheme = "http" },
+			wantErr:   "the etcd tls flags can't be used with --upstream-scheme=http",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UseSystemCA = true
+			c.AccessLogFormat = "none"
+			tt.configure(&c)
+			_, err := NewProxy(c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewProxy() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedResponse is a fully buffered response produced by a handler.
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// responseRecorder captures the response written by a handler.
+type responseRecorder struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+func recordResponse(h http.Handler, req *http.Request) *recordedResponse {
+	rec := &responseRecorder{header: http.Header{}}
+	h.ServeHTTP(rec, req)
+	rec.WriteHeader(http.StatusOK)
+	return &recordedResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()}
+}
+
+func (rr *recordedResponse) writeTo(w http.ResponseWriter) {
+	// the response is shared by every request it is served to, which may
+	// add to the values of their own headers.
+	for k, v := range rr.header {
+		w.Header()[k] = slices.Clone(v)
+	}
+	w.WriteHeader(rr.status)
+	w.Write(rr.body)
+}
+
+type cacheEntry struct {
+	resp    *recordedResponse
+	fetched time.Time
+	// etag is a hash of the cached body and modified the time it last
+	// changed, for conditional requests. Both are unset for responses that
+	// aren't cached.
+	etag     string
+	modified time.Time
+}
+
+// responseCache serves successful upstream responses for the ttl it
+// returns, so that scrapes arriving close together result in a single
+// upstream request. A ttl of 0 passes every request through.
+type responseCache struct {
+	next http.Handler
+	ttl  func() time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// fetching holds a channel per key being fetched, closed once the fetch
+	// is done, so that concurrent misses for a key wait for the first one
+	// instead of all going to etcd, without waiting on misses for other
+	// members or encodings.
+	fetching map[string]chan struct{}
+}
+
+func newResponseCache(next http.Handler, ttl func() time.Duration) *responseCache {
+	return &responseCache{next: next, ttl: ttl, entries: map[string]cacheEntry{}, fetching: map[string]chan struct{}{}}
+}
+
+// cacheKey separates responses that can differ by the member they were
+// pinned to and content negotiation.
+func cacheKey(r *http.Request) string {
+	return pinnedMember(r.Context()) + "\x00" + r.Header.Get("Accept") + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+// lookup returns the fresh entry for key. c.mu is held.
+func (c *responseCache) lookup(key string) (cacheEntry, bool) {
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.fetched) >= c.ttl() {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+// store caches resp and returns its entry. An unchanged body keeps the
+// modification time of the previous entry.
+func (c *responseCache) store(key string, resp *recordedResponse) cacheEntry {
+	now := time.Now()
+	e := cacheEntry{resp: resp, fetched: now, etag: bodyETag(resp.body), modified: now}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.entries[key]; ok && prev.etag == e.etag {
+		e.modified = prev.modified
+	}
+	for k, old := range c.entries {
+		if now.Sub(old.fetched) >= c.ttl() {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+	return e
+}
+
+// bodyETag is the entity tag of a response with body.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func (c *responseCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || c.ttl() <= 0 {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	key := cacheKey(r)
+	for {
+		c.mu.Lock()
+		e, ok := c.lookup(key)
+		if ok {
+			c.mu.Unlock()
+			e.serve(w, r)
+			return
+		}
+		done, fetching := c.fetching[key]
+		if !fetching {
+			c.fetching[key] = make(chan struct{})
+		}
+		c.mu.Unlock()
+		if !fetching {
+			break
+		}
+		// a failed fetch isn't cached, so the next waiter fetches again.
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	e := c.fetch(key, r)
+	e.serve(w, r)
+}
+
+// fetch requests key from the upstream, caching a successful response, and
+// wakes the requests waiting for it.
+func (c *responseCache) fetch(key string, r *http.Request) cacheEntry {
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		close(c.fetching[key])
+		delete(c.fetching, key)
+	}()
+	resp := recordResponse(c.next, r)
+	if resp.status == http.StatusOK && r.Method == http.MethodGet {
+		return c.store(key, resp)
+	}
+	return cacheEntry{resp: resp, fetched: time.Now()}
+}
+
+func (e cacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.fetched).Seconds())))
+	if e.etag != "" {
+		w.Header().Set("ETag", e.etag)
+		w.Header().Set("Last-Modified", e.modified.UTC().Format(http.TimeFormat))
+		if notModified(r, e.etag, e.modified) {
+			if vary := e.resp.header.Get("Vary"); vary != "" {
+				w.Header().Set("Vary", vary)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	e.resp.writeTo(w)
+}
+
+// notModified evaluates the If-None-Match or, in its absence, the
+// If-Modified-Since header of r against a cached response.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheCoalescesMisses(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	})
+	c := newResponseCache(next, func() time.Duration { return time.Minute })
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if rec.Code != http.StatusOK || rec.Body.String() != "etcd_server_has_leader 1\n" {
+				t.Errorf("got %d %q", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+}
+
+func TestResponseCacheKeysFetchIndependently(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pinnedMember(r.Context()) == "slow" {
+			<-stuck
+		}
+		w.Write([]byte(pinnedMember(r.Context())))
+	})
+	c := newResponseCache(next, func() time.Duration { return time.Minute })
+
+	slow := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	go c.ServeHTTP(httptest.NewRecorder(), slow.WithContext(context.WithValue(slow.Context(), pinnedMemberKey{}, "slow")))
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), pinnedMemberKey{}, "fast")))
+		if rec.Body.String() != "fast" {
+			t.Errorf("got %q, want fast", rec.Body.String())
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a miss for one member waited for the fetch of another")
+	}
+}
+
+func TestResponseCacheRetriesFailedFetch(t *testing.T) {
+	var fetches atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	c := newResponseCache(next, func() time.Duration { return time.Minute })
+	for _, want := range []int{http.StatusBadGateway, http.StatusOK, http.StatusOK} {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != want {
+			t.Errorf("got %d, want %d", rec.Code, want)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("%d upstream fetches, want 2", n)
+	}
+}
+
+func TestRecordedResponseWriteToCopiesHeaders(t *testing.T) {
+	resp := &recordedResponse{status: http.StatusOK, header: http.Header{"Vary": make([]string, 1, 4)}}
+	resp.header["Vary"][0] = "Accept"
+	a, b := httptest.NewRecorder(), httptest.NewRecorder()
+	resp.writeTo(a)
+	resp.writeTo(b)
+	a.Header().Add("Vary", "Accept-Encoding")
+	b.Header().Add("Vary", "Authorization")
+	if got := a.Header()["Vary"]; len(got) != 2 || got[1] != "Accept-Encoding" {
+		t.Errorf("first response Vary %q", got)
+	}
+	if got := resp.header["Vary"]; len(got) != 1 {
+		t.Errorf("recorded Vary changed to %q", got)
+	}
+}
+
+func TestResponseCacheConditionalRequests(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept")
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	})
+	c := newResponseCache(next, func() time.Duration { return time.Minute })
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	etag, modified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("got ETag %q, Last-Modified %q", etag, modified)
+	}
+	lastModified, err := http.ParseTime(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"unconditional", nil, http.StatusOK},
+		{"matching etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"weak matching etag in a list", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"any etag", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other etag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": modified}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": lastModified.Add(-time.Second).Format(http.TimeFormat)}, http.StatusOK},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		// If-None-Match takes precedence over If-Modified-Since.
+		{"other etag not modified since", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": modified}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			c.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Header().Get("ETag") != etag || rec.Header().Get("Vary") != "Accept" {
+				t.Errorf("got ETag %q, Vary %q", rec.Header().Get("ETag"), rec.Header().Get("Vary"))
+			}
+			if tt.want == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("304 with body %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestResponseCacheStoreKeepsModificationTime(t *testing.T) {
+	c := newResponseCache(http.NotFoundHandler(), func() time.Duration { return time.Minute })
+	first := c.store("k", &recordedResponse{status: http.StatusOK, body: []byte("a")})
+	time.Sleep(10 * time.Millisecond)
+	same := c.store("k", &recordedResponse{status: http.StatusOK, body: []byte("a")})
+	if same.etag != first.etag || !same.modified.Equal(first.modified) || !same.fetched.After(first.fetched) {
+		t.Errorf("unchanged body: got %s %v, want %s %v", same.etag, same.modified, first.etag, first.modified)
+	}
+	changed := c.store("k", &recordedResponse{status: http.StatusOK, body: []byte("b")})
+	if changed.etag == first.etag || !changed.modified.After(first.modified) {
+		t.Errorf("changed body: got %s %v, want a new etag and modification time", changed.etag, changed.modified)
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+)
+
+// clusterConfig configures an additional upstream etcd cluster, served
+// under /clusters/<name>/. Unset fields inherit the flags.
+type clusterConfig struct {
+	Name                string   `yaml:"name"`
+	UpstreamHost        string   `yaml:"upstream_host,omitempty"`
+	UpstreamPort        int      `yaml:"upstream_port,omitempty"`
+	UpstreamEndpoints   []string `yaml:"upstream_endpoints,omitempty"`
+	UpstreamScheme      string   `yaml:"upstream_scheme,omitempty"`
+	UpstreamServerName  string   `yaml:"upstream_server_name,omitempty"`
+	EtcdCA              []string `yaml:"etcd_ca,omitempty"`
+	EtcdCert            string   `yaml:"etcd_cert,omitempty"`
+	EtcdKey             string   `yaml:"etcd_key,omitempty"`
+	EtcdKeyPasswordFile string   `yaml:"etcd_key_password_file,omitempty"`
+	EtcdPKCS12          string   `yaml:"etcd_pkcs12,omitempty"`
+}
+
+var clusterNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func (cc *clusterConfig) validate() error {
+	if !clusterNameRE.MatchString(cc.Name) {
+		return fmt.Errorf("invalid cluster name %q", cc.Name)
+	}
+	for _, ep := range cc.UpstreamEndpoints {
+		if _, _, err := net.SplitHostPort(ep); err != nil {
+			return fmt.Errorf("invalid upstream endpoint %q: %w", ep, err)
+		}
+	}
+	return nil
+}
+
+func validateClusters(clusters []clusterConfig) error {
+	seen := map[string]bool{}
+	for i := range clusters {
+		cc := &clusters[i]
+		if err := cc.validate(); err != nil {
+			return fmt.Errorf("cluster %d: %w", i, err)
+		}
+		if seen[cc.Name] {
+			return fmt.Errorf("cluster %d: duplicate name %q", i, cc.Name)
+		}
+		seen[cc.Name] = true
+	}
+	return nil
+}
+
+// labelRewrite sets the label name to value on every sample, for
+// --cluster-label.
+func labelRewrite(name, value string) rewriteFunc {
+	return func(l *line) bool {
+		if l.kind == lineSample {
+			l.labels = setLabel(l.labels, name, value)
+		}
+		return true
+	}
+}
+
+// clusterConfig derives the Config of a cluster from the flags. Only the
+// upstream and its tls material differ; the cluster is served by the parent
+// proxy, so it gets no listeners or push exporters of its own.
+func (c Config) clusterConfig(cc clusterConfig) (Config, error) {
+	c.cluster = cc.Name
+	c.ListenAddresses = nil
+	c.AdminPort = 0
+	c.AdminListenAddress = ""
+	c.EnableLifecycle = false
+	c.AccessLogFormat = "none"
+	// requests to the clusters are audited by the parent.
+	c.AuditLog = ""
+	c.RemoteWriteURL = ""
+	c.OTLPMetricsEndpoint = ""
+	// discovery is configured for the default cluster only.
+	c.KubeDiscovery = false
+	c.UpstreamSRV = ""
+	c.DNSRefreshInterval = 0
+	c.UpstreamURL = ""
+	c.upstreamSocket = ""
+	c.upstreamPath = ""
+	c.revocation = nil
+
+	if cc.UpstreamHost != "" {
+		c.UpstreamHost = cc.UpstreamHost
+	}
+	if cc.UpstreamPort != 0 {
+		c.UpstreamPort = cc.UpstreamPort
+	}
+	c.UpstreamEndpoints = cc.UpstreamEndpoints
+	if cc.UpstreamScheme != "" {
+		c.UpstreamScheme = cc.UpstreamScheme
+	}
+	if cc.UpstreamServerName != "" {
+		c.UpstreamServerName = cc.UpstreamServerName
+	}
+	if len(cc.EtcdCA) > 0 || cc.EtcdCert != "" || cc.EtcdKey != "" || cc.EtcdPKCS12 != "" {
+		c.EtcdCA, c.EtcdCert, c.EtcdKey = cc.EtcdCA, cc.EtcdCert, cc.EtcdKey
+		c.EtcdKeyPasswordFile, c.EtcdPKCS12 = cc.EtcdKeyPasswordFile, cc.EtcdPKCS12
+		c.SPIFFESocket, c.SPIFFEServerID = "", ""
+		c.VaultAddr, c.EtcdTLSSecret = "", ""
+	}
+	if c.UpstreamScheme == "http" {
+		c.EtcdCA, c.EtcdCert, c.EtcdKey = nil, "", ""
+		c.UseSystemCA, c.InsecureSkipVerify = false, false
+		c.EtcdCRL, c.EtcdOCSP = "", false
+		c.EtcdKeyPasswordFile, c.EtcdPKCS12 = "", ""
+		c.SPIFFESocket, c.SPIFFEServerID = "", ""
+		c.VaultAddr, c.EtcdTLSSecret = "", ""
+	}
+	if err := c.validate(); err != nil {
+		return Config{}, fmt.Errorf("cluster %q: %w", cc.Name, err)
+	}
+	return c, nil
+}
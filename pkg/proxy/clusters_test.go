@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateClusters(t *testing.T) {
+	tests := []struct {
+		name     string
+		clusters []clusterConfig
+		wantErr  string
+	}{
+		{name: "none"},
+		{name: "clusters", clusters: []clusterConfig{{Name: "events"}, {Name: "calico.v3", UpstreamEndpoints: []string{"10.0.0.1:2379"}}}},
+		{name: "invalid name", clusters: []clusterConfig{{Name: "events/1"}}, wantErr: `cluster 0: invalid cluster name "events/1"`},
+		{name: "empty name", clusters: []clusterConfig{{}}, wantErr: `cluster 0: invalid cluster name ""`},
+		{name: "duplicate name", clusters: []clusterConfig{{Name: "events"}, {Name: "events"}}, wantErr: `cluster 1: duplicate name "events"`},
+		{name: "invalid endpoint", clusters: []clusterConfig{{Name: "events", UpstreamEndpoints: []string{"10.0.0.1"}}}, wantErr: `cluster 0: invalid upstream endpoint "10.0.0.1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateClusters(tt.clusters)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateClusters() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateClusters() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	// each upstream answers with its name.
+	upstream := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "etcd_server_has_leader{upstream=%q} 1\n", name)
+		}))
+		t.Cleanup(srv.Close)
+		t.Cleanup(func() { forgetEndpoints([]string{srv.Listener.Addr().String()}) })
+		return srv
+	}
+	events, calico := upstream("events"), upstream("calico")
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(eventsAddr, calicoAddr string) {
+		t.Helper()
+		data := fmt.Sprintf(`clusters:
+  - name: events
+    upstream_scheme: http
+    upstream_endpoints: [%s]
+  - name: calico
+    upstream_scheme: http
+    upstream_endpoints: [%s]
+`, eventsAddr, calicoAddr)
+		if err := os.WriteFile(config, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventsAddr, calicoAddr := events.Listener.Addr().String(), calico.Listener.Addr().String()
+	writeConfig(eventsAddr, calicoAddr)
+	p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`etcd_server_has_leader{upstream="main"} 1` + "\n"))
+	}), func(c *Config) { c.ConfigFile = config })
+
+	type route struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}
+	check := func(routes []route) {
+		t.Helper()
+		for _, tt := range routes {
+			rec := getPath(p.Handler(), tt.path)
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("%s got %d %q, want %d with %q", tt.path, rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		}
+	}
+	check([]route{
+		{"/metrics", http.StatusOK, `upstream="main"`},
+		{"/clusters/events/metrics", http.StatusOK, `upstream="events"`},
+		{"/clusters/calico/metrics", http.StatusOK, `upstream="calico"`},
+		{"/clusters/calico/healthz", http.StatusOK, "ok"},
+		{"/clusters/cilium/metrics", http.StatusNotFound, ""},
+	})
+
+	// every cluster reloads its own endpoints from the config file.
+	writeConfig(calicoAddr, eventsAddr)
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check([]route{
+		{"/metrics", http.StatusOK, `upstream="main"`},
+		{"/clusters/events/metrics", http.StatusOK, `upstream="calico"`},
+		{"/clusters/calico/metrics", http.StatusOK, `upstream="events"`},
+	})
+}
+
+func TestClusterLabel(t *testing.T) {
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	defer events.Close()
+	defer forgetEndpoints([]string{events.Listener.Addr().String()})
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf("clusters:\n  - name: events\n    upstream_scheme: http\n    upstream_endpoints: [%s]\n", events.Listener.Addr())
+	if err := os.WriteFile(config, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		path      string
+		want      string
+	}{
+		{name: "no label", path: "/metrics", want: `etcd_server_has_leader{member="etcd-0"} 1`},
+		{
+			name:      "default cluster",
+			configure: func(c *Config) { c.ClusterLabel = "cluster" },
+			path:      "/metrics",
+			want:      `etcd_server_has_leader{member="etcd-0",cluster="default"} 1`,
+		},
+		{
+			name:      "named default cluster",
+			configure: func(c *Config) { c.ClusterLabel, c.ClusterName = "etcd_cluster", "kube" },
+			path:      "/metrics",
+			want:      `etcd_server_has_leader{member="etcd-0",etcd_cluster="kube"} 1`,
+		},
+		{
+			name:      "cluster from the config file",
+			configure: func(c *Config) { c.ClusterLabel = "cluster" },
+			path:      "/clusters/events/metrics",
+			want:      `etcd_server_has_leader{cluster="events"} 1`,
+		},
+		{
+			name:      "replaces the label of the upstream",
+			configure: func(c *Config) { c.ClusterLabel = "member" },
+			path:      "/metrics",
+			want:      `etcd_server_has_leader{member="default"} 1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`etcd_server_has_leader{member="etcd-0"} 1` + "\n"))
+			}), func(c *Config) {
+				c.ConfigFile = config
+				if tt.configure != nil {
+					tt.configure(c)
+				}
+			})
+			if rec := getPath(p.Handler(), tt.path); rec.Code != http.StatusOK || rec.Body.String() != tt.want+"\n" {
+				t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterLabelFlags(t *testing.T) {
+	tests := []struct {
+		name               string
+		label, clusterName string
+		wantErr            string
+	}{
+		{name: "none", clusterName: "default"},
+		{name: "label", label: "cluster", clusterName: "default"},
+		{name: "invalid label", label: "etcd-cluster", clusterName: "default", wantErr: `invalid --cluster-label "etcd-cluster"`},
+		{name: "without a name", label: "cluster", wantErr: "--cluster-label requires --cluster-name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			c.ClusterLabel, c.ClusterName = tt.label, tt.clusterName
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
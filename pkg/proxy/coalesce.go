@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// coalescingHandler shares a single upstream fetch between concurrent
+// identical requests, so scrapes from several Prometheus replicas arriving
+// at the same instant hit etcd once. The response is written to every
+// waiting request as it arrives rather than buffered, so requests can only
+// join a fetch until its response starts.
+type coalescingHandler struct {
+	next http.Handler
+
+	mu      sync.Mutex
+	flights map[string]*sharedFetch
+}
+
+// sharedFetch is an upstream fetch whose response is broadcast to the
+// requests waiting for it. It outlives the request that started it while
+// others wait for it, and is cancelled once every waiting request has gone
+// away.
+type sharedFetch struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	// waiters is guarded by the handler's mu.
+	waiters int
+
+	mu      sync.Mutex
+	header  http.Header
+	started bool
+	writers []http.ResponseWriter
+}
+
+func (h *coalescingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	key := cacheKey(r)
+	h.mu.Lock()
+	f := h.flights[key]
+	if f == nil {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		f = &sharedFetch{done: make(chan struct{}), cancel: cancel, header: http.Header{}}
+		if h.flights == nil {
+			h.flights = map[string]*sharedFetch{}
+		}
+		h.flights[key] = f
+		go h.fetch(key, f, r.WithContext(ctx))
+	}
+	f.waiters++
+	f.mu.Lock()
+	f.writers = append(f.writers, w)
+	f.mu.Unlock()
+	h.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		// once removed, the fetch no longer writes to w.
+		f.drop(w)
+		h.mu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			// later requests start a fetch of their own.
+			h.forget(key, f)
+			f.cancel()
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *coalescingHandler) fetch(key string, f *sharedFetch, r *http.Request) {
+	defer f.cancel()
+	defer close(f.done)
+	bw := &broadcastWriter{h: h, key: key, f: f}
+	h.next.ServeHTTP(bw, r)
+	bw.WriteHeader(http.StatusOK)
+}
+
+// forget removes f from the flights joined by new requests. h.mu is held.
+func (h *coalescingHandler) forget(key string, f *sharedFetch) {
+	if h.flights[key] == f {
+		delete(h.flights, key)
+	}
+}
+
+// drop stops writing the response to w.
+func (f *sharedFetch) drop(w http.ResponseWriter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writers = slices.DeleteFunc(f.writers, func(other http.ResponseWriter) bool { return other == w })
+}
+
+// broadcastWriter writes the response of a shared fetch to each of its
+// waiting requests, so the upstream is read at the pace of the slowest one.
+type broadcastWriter struct {
+	h   *coalescingHandler
+	key string
+	f   *sharedFetch
+}
+
+func (b *broadcastWriter) Header() http.Header {
+	return b.f.header
+}
+
+func (b *broadcastWriter) WriteHeader(status int) {
+	b.f.mu.Lock()
+	started := b.f.started
+	b.f.mu.Unlock()
+	if started {
+		return
+	}
+	// the requests that joined so far are the ones the response is
+	// written to.
+	b.h.mu.Lock()
+	b.h.forget(b.key, b.f)
+	b.h.mu.Unlock()
+
+	b.f.mu.Lock()
+	defer b.f.mu.Unlock()
+	b.f.started = true
+	for _, w := range b.f.writers {
+		for k, v := range b.f.header {
+			w.Header()[k] = slices.Clone(v)
+		}
+		w.WriteHeader(status)
+	}
+}
+
+func (b *broadcastWriter) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	b.f.mu.Lock()
+	defer b.f.mu.Unlock()
+	// a request whose connection failed is served no further; it goes
+	// away with its context.
+	b.f.writers = slices.DeleteFunc(b.f.writers, func(w http.ResponseWriter) bool {
+		_, err := w.Write(p)
+		return err != nil
+	})
+	return len(p), nil
+}
+
+func (b *broadcastWriter) Flush() {
+	b.f.mu.Lock()
+	defer b.f.mu.Unlock()
+	for _, w := range b.f.writers {
+		http.NewResponseController(w).Flush()
+	}
+}
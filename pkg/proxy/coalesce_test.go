@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescingHandlerSharesFetch(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Header().Set("Content-Type", textContentType)
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	})
+	h := &coalescingHandler{next: next}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if rec.Code != http.StatusOK || rec.Body.String() != "etcd_server_has_leader 1\n" || rec.Header().Get("Content-Type") != textContentType {
+				t.Errorf("got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+}
+
+func TestCoalescingHandlerStartedResponse(t *testing.T) {
+	var fetches atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			w.Write([]byte("etcd_server_has_leader 1\n"))
+			close(started)
+			<-release
+		}
+		w.Write([]byte("etcd_server_is_leader 1\n"))
+	})
+	h := &coalescingHandler{next: next}
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+	<-started
+	// the response of the first fetch has started, so this one can't join it.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Body.String() != "etcd_server_is_leader 1\n" {
+		t.Errorf("got %q, want the response of a fetch of its own", rec.Body.String())
+	}
+	close(release)
+	<-done
+	if first.Body.String() != "etcd_server_has_leader 1\netcd_server_is_leader 1\n" {
+		t.Errorf("got %q for the first request", first.Body.String())
+	}
+}
+
+func TestCoalescingHandlerCancelledWaiter(t *testing.T) {
+	release := make(chan struct{})
+	var cancelled atomic.Bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			w.Write([]byte("etcd_server_has_leader 1\n"))
+		case <-r.Context().Done():
+			cancelled.Store(true)
+		}
+	})
+	h := &coalescingHandler{next: next}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+	}()
+	done := make(chan struct{})
+	stay := httptest.NewRecorder()
+	go func() {
+		defer close(done)
+		h.ServeHTTP(stay, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-gone
+	close(release)
+	<-done
+	if cancelled.Load() || stay.Body.String() != "etcd_server_has_leader 1\n" {
+		t.Errorf("the fetch was cancelled with one of its waiters, got %q", stay.Body.String())
+	}
+}
+
+// pacedRecorder is a ResponseWriter reporting how many bytes it was written.
+type pacedRecorder struct {
+	*httptest.ResponseRecorder
+	written chan int
+	n       int
+}
+
+func (r *pacedRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseRecorder.Write(p)
+	r.n += n
+	r.written <- r.n
+	return n, err
+}
+
+func TestMetricsAreStreamedByDefault(t *testing.T) {
+	const chunks, chunkSize = 256, 64 << 10
+	chunk := strings.Repeat("etcd_debugging_mvcc_keys_total "+strings.Repeat("1", 32)+"\n", chunkSize/64)
+	received := make(chan int, 1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", textContentType)
+		for i := range chunks {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			// the next chunk is only sent once the scraper got this one,
+			// which never happens if the proxy buffers the response.
+			for n := 0; n < (i+1)*len(chunk); {
+				select {
+				case n = <-received:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+	}))
+	defer upstream.Close()
+	defer forgetEndpoints([]string{upstream.Listener.Addr().String()})
+
+	c := DefaultConfig()
+	c.UpstreamURL = upstream.URL + "/metrics"
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &pacedRecorder{ResponseRecorder: httptest.NewRecorder(), written: received}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+	if ctx.Err() != nil {
+		t.Fatal("the exposition wasn't streamed to the scraper")
+	}
+	if rec.Code != http.StatusOK || rec.Body.Len() != chunks*len(chunk) || !bytes.HasPrefix(rec.Body.Bytes(), []byte(chunk)) {
+		t.Errorf("got %d with %d bytes, want 200 with %d", rec.Code, rec.Body.Len(), chunks*len(chunk))
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import "testing"
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=1.0", true},
+		{"identity", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.001", true},
+		{"*", true},
+		{"*;q=0", false},
+		{"*;q=0.5, gzip;q=0", false},
+		{"gzip;q=0, *;q=0.5", false},
+		{"*;q=0, gzip", true},
+		{"gzip, *;q=0", true},
+		{"br, *;q=0.1", true},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
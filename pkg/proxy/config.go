@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig holds the structured settings read from the --config file.
+type fileConfig struct {
+	Relabel    []relabelRule   `yaml:"relabel"`
+	Histograms []histogramRule `yaml:"histograms,omitempty"`
+	DropLabels []labelDropRule `yaml:"drop_labels,omitempty"`
+	Rename     []renameRule    `yaml:"rename,omitempty"`
+	// MetricPrefix is prepended to every metric name, after renaming.
+	MetricPrefix string          `yaml:"metric_prefix,omitempty"`
+	Clusters     []clusterConfig `yaml:"clusters,omitempty"`
+
+	// The settings below override the flags of the same name when set, and
+	// like the rules above take effect when the file is reloaded.
+	MetricAllow       []string       `yaml:"metric_allow,omitempty"`
+	MetricDeny        []string       `yaml:"metric_deny,omitempty"`
+	CacheTTL          *time.Duration `yaml:"cache_ttl,omitempty"`
+	UpstreamTimeout   *time.Duration `yaml:"upstream_timeout,omitempty"`
+	UpstreamEndpoints []string       `yaml:"upstream_endpoints,omitempty"`
+}
+
+func loadFileConfig(path string) (*fileConfig, error) {
+	fc := &fileConfig{}
+	if path == "" {
+		return fc, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(fc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range fc.Relabel {
+		if err := fc.Relabel[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: relabel rule %d: %w", path, i, err)
+		}
+	}
+	for i := range fc.Histograms {
+		if err := fc.Histograms[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: histogram rule %d: %w", path, i, err)
+		}
+	}
+	for i := range fc.DropLabels {
+		if err := fc.DropLabels[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: drop_labels rule %d: %w", path, i, err)
+		}
+	}
+	for i := range fc.Rename {
+		if err := fc.Rename[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: rename rule %d: %w", path, i, err)
+		}
+	}
+	if fc.MetricPrefix != "" && !metricNameRE.MatchString(fc.MetricPrefix) {
+		return nil, fmt.Errorf("%s: invalid metric_prefix %q", path, fc.MetricPrefix)
+	}
+	if fc.CacheTTL != nil && *fc.CacheTTL < 0 {
+		return nil, fmt.Errorf("%s: cache_ttl must not be negative", path)
+	}
+	if fc.UpstreamTimeout != nil && *fc.UpstreamTimeout < 0 {
+		return nil, fmt.Errorf("%s: upstream_timeout must not be negative", path)
+	}
+	for _, ep := range fc.UpstreamEndpoints {
+		if _, _, err := net.SplitHostPort(ep); err != nil {
+			return nil, fmt.Errorf("%s: invalid upstream endpoint %q: %w", path, ep, err)
+		}
+	}
+	if err := validateClusters(fc.Clusters); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fc, nil
+}
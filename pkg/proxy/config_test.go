@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadFileConfigSettings(t *testing.T) {
+	duration := func(d time.Duration) *time.Duration { return &d }
+	tests := []struct {
+		name    string
+		file    string
+		want    fileConfig
+		wantErr string
+	}{
+		{
+			name: "settings",
+			file: `metric_allow: ["etcd_.*"]
+metric_deny: ["etcd_debugging_.*"]
+cache_ttl: 15s
+upstream_timeout: 5s
+upstream_endpoints: ["10.0.0.1:2379", "10.0.0.2:2379"]
+`,
+			want: fileConfig{
+				MetricAllow:       []string{"etcd_.*"},
+				MetricDeny:        []string{"etcd_debugging_.*"},
+				CacheTTL:          duration(15 * time.Second),
+				UpstreamTimeout:   duration(5 * time.Second),
+				UpstreamEndpoints: []string{"10.0.0.1:2379", "10.0.0.2:2379"},
+			},
+		},
+		{name: "zero cache ttl", file: "cache_ttl: 0s\n", want: fileConfig{CacheTTL: duration(0)}},
+		{name: "none", file: "metric_prefix: etcd_\n", want: fileConfig{MetricPrefix: "etcd_"}},
+		{name: "negative cache ttl", file: "cache_ttl: -1s\n", wantErr: "cache_ttl must not be negative"},
+		{name: "negative upstream timeout", file: "upstream_timeout: -1s\n", wantErr: "upstream_timeout must not be negative"},
+		{name: "invalid endpoint", file: "upstream_endpoints: [10.0.0.1]\n", wantErr: `invalid upstream endpoint "10.0.0.1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			writeFile(t, path, tt.file)
+			fc, err := loadFileConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadFileConfig() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*fc, tt.want) {
+				t.Errorf("got %+v, want %+v", *fc, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfigSettings(t *testing.T) {
+	// each upstream counts its requests and answers with its name.
+	upstream := func(name string, requests *atomic.Int32) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			fmt.Fprintf(w, "etcd_server_has_leader{upstream=%q} 1\netcd_debugging_mvcc_keys_total 3\n", name)
+		}))
+		t.Cleanup(srv.Close)
+		t.Cleanup(func() { forgetEndpoints([]string{srv.Listener.Addr().String()}) })
+		return srv.Listener.Addr().String()
+	}
+	var flagRequests, fileRequests atomic.Int32
+	flagAddr, fileAddr := upstream("flag", &flagRequests), upstream("file", &fileRequests)
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, config, "{}\n")
+
+	c := DefaultConfig()
+	c.UpstreamScheme, c.UpstreamEndpoints = "http", []string{flagAddr}
+	c.UpstreamTimeout = 10 * time.Second
+	c.ConfigFile = config
+	c.AccessLogFormat = "none"
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const flagBody = "etcd_server_has_leader{upstream=\"flag\"} 1\netcd_debugging_mvcc_keys_total 3\n"
+	scrape := func(want string) {
+		t.Helper()
+		if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), want)
+		}
+	}
+	scrape(flagBody)
+
+	writeFile(t, config, fmt.Sprintf(`metric_deny: ["etcd_debugging_.*"]
+cache_ttl: 1h
+upstream_timeout: 2s
+upstream_endpoints: [%s]
+`, fileAddr))
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	scrape("etcd_server_has_leader{upstream=\"file\"} 1\n")
+	scrape("etcd_server_has_leader{upstream=\"file\"} 1\n")
+	if n := fileRequests.Load(); n != 1 {
+		t.Errorf("%d upstream requests, want the second scrape served by the cache", n)
+	}
+	if got := p.reload.settings.timeout(); got != 2*time.Second {
+		t.Errorf("got an upstream timeout of %v, want the one of the config file", got)
+	}
+
+	// an invalid file keeps the current settings.
+	writeFile(t, config, "cache_ttl: -1s\n")
+	if err := p.Reload(); err == nil {
+		t.Error("Reload() of an invalid config file succeeded")
+	}
+	if got := p.reload.settings.ttl(); got != time.Hour {
+		t.Errorf("got a cache ttl of %v, want the previous one kept", got)
+	}
+
+	// without the settings in the file, the flags apply again.
+	writeFile(t, config, "{}\n")
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	scrape(flagBody)
+	scrape(flagBody)
+	if n := flagRequests.Load(); n != 3 {
+		t.Errorf("%d upstream requests, want every scrape to fetch without the cache", n)
+	}
+	if got := p.reload.settings.timeout(); got != 10*time.Second {
+		t.Errorf("got an upstream timeout of %v, want the flag's", got)
+	}
+}
+
+func TestFileEndpointsWithDiscovery(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, config, "upstream_endpoints: [10.0.0.1:2379]\n")
+	c := DefaultConfig()
+	c.UpstreamURL = "unix:///run/etcd.sock"
+	c.ConfigFile = config
+	want := "upstream_endpoints of the config file can't be used with discovery"
+	if _, err := NewProxy(c); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("NewProxy() = %v, want an error containing %q", err, want)
+	}
+}
+
+func TestWatchAndReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yaml")
+	writeFile(t, config, "cache_ttl: 1s\n")
+	p, _ := newTestProxy(t, okHandler, func(c *Config) { c.ConfigFile = config })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.reload.watchAndReloadConfig(ctx)
+	// gives the watcher time to arm.
+	time.Sleep(100 * time.Millisecond)
+
+	// the file is replaced rather than written in place, like editors do.
+	writeFile(t, filepath.Join(dir, "new.yaml"), "cache_ttl: 1m\n")
+	if err := os.Rename(filepath.Join(dir, "new.yaml"), config); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.reload.settings.ttl() != time.Minute {
+		if time.Now().After(deadline) {
+			t.Fatalf("got a cache ttl of %v, want the changed file reloaded", p.reload.settings.ttl())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// trackedConn is an upstream connection counted in the open connection
+// gauge until it is closed and, while no request uses it, in the idle one.
+// A new connection is idle until a request gets it: the transport may hand
+// it to another request than the one it was dialed for, or pool it.
+type trackedConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	idle   bool
+	closed bool
+}
+
+func trackConn(conn net.Conn) *trackedConn {
+	upstreamConnsOpen.Inc()
+	upstreamConnsIdle.Inc()
+	return &trackedConn{Conn: conn, idle: true}
+}
+
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		upstreamConnsOpen.Dec()
+		if c.idle {
+			c.idle = false
+			upstreamConnsIdle.Dec()
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) setIdle(idle bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.idle == idle {
+		return
+	}
+	c.idle = idle
+	if idle {
+		upstreamConnsIdle.Inc()
+	} else {
+		upstreamConnsIdle.Dec()
+	}
+}
+
+// trackedConnOf returns the trackedConn under conn, which the transport
+// may have wrapped in a tls connection.
+func trackedConnOf(conn net.Conn) *trackedConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *trackedConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// withConnTracking traces req to tell when its connection is taken from and
+// returned to the idle pool, and to observe the tls handshake of a
+// connection dialed for it.
+func withConnTracking(req *http.Request) *http.Request {
+	var conn *trackedConn
+	var handshakeStart time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			handshakeStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			result := "full"
+			switch {
+			case err != nil:
+				result = "failed"
+			case state.DidResume:
+				result = "resumed"
+			}
+			tlsHandshakes.WithLabelValues(result).Inc()
+			if err == nil {
+				tlsHandshakeDuration.WithLabelValues(result).Observe(time.Since(handshakeStart).Seconds())
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn = trackedConnOf(info.Conn); conn != nil {
+				conn.setIdle(false)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && conn != nil {
+				conn.setIdle(true)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
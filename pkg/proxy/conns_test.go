@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTrackedConn(t *testing.T) {
+	open, idle := testutil.ToFloat64(upstreamConnsOpen), testutil.ToFloat64(upstreamConnsIdle)
+	check := func(step string, wantOpen, wantIdle float64) {
+		t.Helper()
+		if got := testutil.ToFloat64(upstreamConnsOpen) - open; got != wantOpen {
+			t.Errorf("%s: got %v open connections, want %v", step, got, wantOpen)
+		}
+		if got := testutil.ToFloat64(upstreamConnsIdle) - idle; got != wantIdle {
+			t.Errorf("%s: got %v idle connections, want %v", step, got, wantIdle)
+		}
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := trackConn(client)
+	check("dialed", 1, 1)
+	conn.setIdle(false)
+	conn.setIdle(false)
+	check("in use", 1, 0)
+	conn.setIdle(true)
+	check("back in the pool", 1, 1)
+	conn.Close()
+	conn.Close()
+	check("closed", 0, 0)
+	conn.setIdle(false)
+	conn.setIdle(true)
+	check("used after close", 0, 0)
+}
+
+func TestTrackedConnOf(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := trackConn(client)
+	defer conn.Close()
+	tests := []struct {
+		name string
+		conn net.Conn
+		want *trackedConn
+	}{
+		{"tracked", conn, conn},
+		{"tls", tls.Client(conn, &tls.Config{}), conn},
+		{"untracked", client, nil},
+		{"nil", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trackedConnOf(tt.conn); got != tt.want {
+				t.Errorf("trackedConnOf() = %p, want %p", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnTracking(t *testing.T) {
+	tests := []struct {
+		name              string
+		tls               bool
+		disableKeepAlives bool
+		wantIdle          bool
+	}{
+		{name: "http", wantIdle: true},
+		{name: "https", tls: true, wantIdle: true},
+		{name: "without keepalives", disableKeepAlives: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conn atomic.Pointer[trackedConn]
+			var inUse atomic.Bool
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if c := conn.Load(); c != nil {
+					c.mu.Lock()
+					inUse.Store(!c.idle)
+					c.mu.Unlock()
+				}
+				w.Write([]byte("etcd_server_has_leader 1\n"))
+			})
+			srv := httptest.NewUnstartedServer(h)
+			if tt.tls {
+				srv.StartTLS()
+			} else {
+				srv.Start()
+			}
+			defer srv.Close()
+
+			cfg := DefaultConfig()
+			cfg.DisableKeepAlives = tt.disableKeepAlives
+			tr := buildHTTPTransport(&cfg)
+			if tt.tls {
+				tr.TLSClientConfig = &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs, ServerName: "example.com"}
+			}
+			defer tr.CloseIdleConnections()
+			s := newTransportSwitcher(tr)
+
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { conn.Store(trackedConnOf(info.Conn)) }}
+			req := httptest.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+			req.RequestURI = ""
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+			resp, err := s.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			c := conn.Load()
+			if c == nil {
+				t.Fatal("the connection isn't tracked")
+			}
+			if !inUse.Load() {
+				t.Error("the connection was idle while serving the request")
+			}
+			// the transport returns the connection to the pool, or closes
+			// it, once it has read the response.
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				c.mu.Lock()
+				idle, closed := c.idle, c.closed
+				c.mu.Unlock()
+				if idle == tt.wantIdle && closed != tt.wantIdle {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("got idle %v, closed %v after the request, want idle %v", idle, closed, tt.wantIdle)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestConnPoolFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "limits", configure: func(c *Config) { c.MaxIdleConnsPerHost, c.MaxConnsPerHost = 10, 20 }},
+		{
+			name:      "negative idle connections",
+			configure: func(c *Config) { c.MaxIdleConnsPerHost = -1 },
+			wantErr:   "--max-idle-conns-per-host and --max-conns-per-host must not be negative",
+		},
+		{
+			name:      "negative connections",
+			configure: func(c *Config) { c.MaxConnsPerHost = -1 },
+			wantErr:   "--max-idle-conns-per-host and --max-conns-per-host must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			tt.configure(&c)
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSResumption(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	tests := []struct {
+		name        string
+		disable     bool
+		untrusted   bool
+		wantFull    float64
+		wantResumed float64
+		wantFailed  float64
+	}{
+		{name: "resumed", wantFull: 1, wantResumed: 2},
+		{name: "disabled", disable: true, wantFull: 3},
+		{name: "untrusted server", untrusted: true, wantFailed: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			// every request dials, so every one makes a handshake.
+			cfg.DisableKeepAlives = true
+			cfg.DisableTLSResumption = tt.disable
+			tlsConfig := &tls.Config{RootCAs: roots, ServerName: "example.com"}
+			if tt.untrusted {
+				tlsConfig.RootCAs = nil
+			}
+			tr := buildHTTPSTransport(&cfg, tlsConfig)
+			defer tr.CloseIdleConnections()
+			s := newTransportSwitcher(tr)
+
+			full, resumed, failed := testutil.ToFloat64(tlsHandshakes.WithLabelValues("full")), testutil.ToFloat64(tlsHandshakes.WithLabelValues("resumed")), testutil.ToFloat64(tlsHandshakes.WithLabelValues("failed"))
+			for range 3 {
+				req := httptest.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+				req.RequestURI = ""
+				resp, err := s.RoundTrip(req)
+				if err != nil {
+					if !tt.untrusted {
+						t.Fatal(err)
+					}
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if got := testutil.ToFloat64(tlsHandshakes.WithLabelValues("full")) - full; got != tt.wantFull {
+				t.Errorf("got %v full handshakes, want %v", got, tt.wantFull)
+			}
+			if got := testutil.ToFloat64(tlsHandshakes.WithLabelValues("resumed")) - resumed; got != tt.wantResumed {
+				t.Errorf("got %v resumed handshakes, want %v", got, tt.wantResumed)
+			}
+			if got := testutil.ToFloat64(tlsHandshakes.WithLabelValues("failed")) - failed; got != tt.wantFailed {
+				t.Errorf("got %v failed handshakes, want %v", got, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestTLSSessionCacheFlag(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "default"},
+		{name: "disabled", configure: func(c *Config) { c.DisableTLSResumption = true }},
+		{
+			name:      "zero",
+			configure: func(c *Config) { c.TLSSessionCacheSize = 0 },
+			wantErr:   "--tls-session-cache-size must be positive, use --disable-tls-resumption to turn resumption off",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			if tt.configure != nil {
+				tt.configure(&c)
+			}
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
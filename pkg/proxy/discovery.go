@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// upstreamTargets is the set of upstream etcd addresses (host:port) the
+// proxy may send requests to. It is updated at runtime by discovery.
+type upstreamTargets struct {
+	mu    sync.RWMutex
+	addrs []string
+	// onChange, if set, is called after the addresses changed.
+	onChange func()
+	// onRemove, if set, is called with the addresses that are no longer
+	// targets, to forget the state kept for them.
+	onRemove func(removed []string)
+}
+
+func newUpstreamTargets(addrs ...string) *upstreamTargets {
+	return &upstreamTargets{addrs: addrs}
+}
+
+// current returns the address requests should be sent to, or "" if none is
+// known.
+func (t *upstreamTargets) current() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.addrs) == 0 {
+		return ""
+	}
+	return t.addrs[0]
+}
+
+func (t *upstreamTargets) all() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Clone(t.addrs)
+}
+
+// set replaces the targets and reports whether they changed.
+func (t *upstreamTargets) set(addrs []string) bool {
+	t.mu.Lock()
+	if slices.Equal(t.addrs, addrs) {
+		t.mu.Unlock()
+		return false
+	}
+	removed := slices.DeleteFunc(slices.Clone(t.addrs), func(addr string) bool { return slices.Contains(addrs, addr) })
+	t.addrs = addrs
+	t.mu.Unlock()
+	forgetEndpoints(removed)
+	if t.onRemove != nil && len(removed) > 0 {
+		t.onRemove(removed)
+	}
+	if t.onChange != nil {
+		t.onChange()
+	}
+	return true
+}
+
+// forgetEndpoints deletes the series of upstream addresses that are no
+// longer targets, so members that went away don't linger in the metrics.
+func forgetEndpoints(addrs []string) {
+	for _, addr := range addrs {
+		upstreamDuration.DeleteLabelValues(addr)
+		upstreamFailures.DeletePartialMatch(prometheus.Labels{"endpoint": addr})
+		circuitBreakerState.DeleteLabelValues(addr)
+	}
+}
+
+// metricsPath is the path of the upstream metrics, from --upstream-url.
+func (c *Config) metricsPath() string {
+	if c.upstreamPath != "" {
+		return c.upstreamPath
+	}
+	return "/metrics"
+}
+
+// discovers reports whether the upstream members are discovered, or all
+// reached through a unix socket, rather than listed.
+func (c *Config) discovers() bool {
+	if c.KubeDiscovery || c.upstreamSocket != "" {
+		return true
+	}
+	return len(c.UpstreamEndpoints) == 0 && (c.UpstreamSRV != "" || c.DNSRefreshInterval > 0)
+}
+
+// kubeDiscovery follows the etcd members in Kubernetes, either through the
+// EndpointSlices of a service or the pods matching a label selector.
+type kubeDiscovery struct {
+	client    *kubeClient
+	namespace string
+	service   string
+	selector  string
+	// portName, if set, names the EndpointSlice port requests are sent to
+	// instead of port.
+	portName string
+	port     int
+	interval time.Duration
+	targets  *upstreamTargets
+}
+
+type endpointSliceList struct {
+	Items []struct {
+		Ports     []endpointSlicePort `json:"ports"`
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+type endpointSlicePort struct {
+	Name string `json:"name"`
+	Port *int   `json:"port"`
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			DeletionTimestamp *string `json:"deletionTimestamp"`
+		} `json:"metadata"`
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// discover returns the sorted addresses of the ready etcd members.
+func (d *kubeDiscovery) discover(ctx context.Context) ([]string, error) {
+	var addrs []string
+	if d.service != "" {
+		var list endpointSliceList
+		q := url.Values{"labelSelector": {"kubernetes.io/service-name=" + d.service}}
+		if err := d.client.get(ctx, "/apis/discovery.k8s.io/v1/namespaces/"+d.namespace+"/endpointslices", q, &list); err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			port := d.port
+			if d.portName != "" {
+				i := slices.IndexFunc(item.Ports, func(p endpointSlicePort) bool {
+					return p.Name == d.portName && p.Port != nil
+				})
+				if i < 0 {
+					continue
+				}
+				port = *item.Ports[i].Port
+			}
+			for _, ep := range item.Endpoints {
+				if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+					continue
+				}
+				for _, ip := range ep.Addresses {
+					addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(port)))
+				}
+			}
+		}
+	} else {
+		var list podList
+		q := url.Values{"labelSelector": {d.selector}}
+		if err := d.client.get(ctx, "/api/v1/namespaces/"+d.namespace+"/pods", q, &list); err != nil {
+			return nil, err
+		}
+		for _, pod := range list.Items {
+			if pod.Metadata.DeletionTimestamp != nil || pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+				continue
+			}
+			for _, cond := range pod.Status.Conditions {
+				if cond.Type == "Ready" && cond.Status == "True" {
+					addrs = append(addrs, net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(d.port)))
+				}
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if d.portName != "" {
+			return nil, fmt.Errorf("no ready etcd members found on a port named %q", d.portName)
+		}
+		return nil, errors.New("no ready etcd members found")
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs), nil
+}
+
+func (d *kubeDiscovery) refresh(ctx context.Context) error {
+	addrs, err := d.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if d.targets.set(addrs) {
+		slog.Info("discovered etcd members", "targets", addrs)
+	}
+	return nil
+}
+
+// startKubeDiscovery populates targets from the Kubernetes API and keeps them
+// updated in the background until ctx is done.
+func startKubeDiscovery(ctx context.Context, c *Config, targets *upstreamTargets) error {
+	client, err := newInClusterKubeClient()
+	if err != nil {
+		return fmt.Errorf("failed to set up kubernetes discovery: %w", err)
+	}
+	ns := c.KubeNamespace
+	if ns == "" {
+		if ns, err = inClusterNamespace(); err != nil {
+			return fmt.Errorf("failed to determine kubernetes namespace, set --kube-namespace: %w", err)
+		}
+	}
+	d := &kubeDiscovery{
+		client:    client,
+		namespace: ns,
+		service:   c.KubeService,
+		selector:  c.KubeSelector,
+		portName:  c.KubePortName,
+		port:      c.UpstreamPort,
+		interval:  c.KubeRefreshInterval,
+		targets:   targets,
+	}
+	if err := d.refresh(ctx); err != nil {
+		slog.Warn("kubernetes discovery failed", "err", err)
+	}
+	go d.run(ctx)
+	return nil
+}
+
+// run refreshes the targets every interval until ctx is done. The targets
+// are left untouched when discovery fails, so a flaky api server doesn't
+// take the proxy down.
+func (d *kubeDiscovery) run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.refresh(ctx); err != nil {
+				slog.Warn("kubernetes discovery failed", "err", err)
+			}
+		}
+	}
+}
+
+// dnsDiscovery resolves the upstream members from DNS, either from a SRV
+// record or the addresses of a host name.
+type dnsDiscovery struct {
+	resolver *net.Resolver
+	srv      string
+	host     string
+	port     int
+	interval time.Duration
+	targets  *upstreamTargets
+}
+
+// startDNSDiscovery resolves targets once and, if an interval is configured,
+// keeps re-resolving them in the background until ctx is done.
+func startDNSDiscovery(ctx context.Context, c *Config, targets *upstreamTargets) {
+	d := &dnsDiscovery{
+		resolver: net.DefaultResolver,
+		srv:      c.UpstreamSRV,
+		host:     c.UpstreamHost,
+		port:     c.UpstreamPort,
+		interval: c.DNSRefreshInterval,
+		targets:  targets,
+	}
+	if err := d.refresh(ctx); err != nil {
+		slog.Warn("dns discovery failed", "err", err)
+	}
+	if d.interval > 0 {
+		go d.run(ctx)
+	}
+}
+
+// discover returns the sorted addresses from DNS.
+func (d *dnsDiscovery) discover(ctx context.Context) ([]string, error) {
+	var addrs []string
+	if d.srv != "" {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.srv)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+	} else {
+		ips, err := d.resolver.LookupHost(ctx, d.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(d.port)))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no upstream addresses resolved")
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs), nil
+}
+
+func (d *dnsDiscovery) refresh(ctx context.Context) error {
+	addrs, err := d.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if d.targets.set(addrs) {
+		slog.Info("resolved etcd members", "targets", addrs)
+	}
+	return nil
+}
+
+// run re-resolves the targets every interval until ctx is done, keeping the
+// previous addresses when resolution fails.
+func (d *dnsDiscovery) run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.refresh(ctx); err != nil {
+				slog.Warn("dns discovery failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestUpstreamTargetsForgetRemovedEndpoints(t *testing.T) {
+	targets := newUpstreamTargets("10.0.0.1:2379", "10.0.0.2:2379")
+	breaker := &circuitBreaker{failures: 1, cooldown: time.Minute, endpoints: map[string]*endpointBreaker{}}
+	for _, addr := range targets.all() {
+		recordUpstreamResult(addr, time.Millisecond, nil, errors.New("connection refused"))
+		breaker.record(addr, false)
+	}
+	defer forgetEndpoints(targets.all())
+
+	if !targets.set([]string{"10.0.0.2:2379", "10.0.0.3:2379"}) {
+		t.Fatal("set reported no change")
+	}
+	if n := testutil.CollectAndCount(upstreamDuration); n != 1 {
+		t.Errorf("%d upstream duration series, want 1", n)
+	}
+	if n := testutil.CollectAndCount(upstreamFailures); n != 1 {
+		t.Errorf("%d upstream failure series, want 1", n)
+	}
+	if n := testutil.CollectAndCount(circuitBreakerState); n != 1 {
+		t.Errorf("%d circuit breaker series, want 1", n)
+	}
+	if got := testutil.ToFloat64(upstreamFailures.WithLabelValues("10.0.0.2:2379", "other")); got != 1 {
+		t.Errorf("failures of the remaining endpoint = %v, want 1", got)
+	}
+}
+
+func TestUpstreamTargetsChurnForgetsEndpointState(t *testing.T) {
+	targets := newUpstreamTargets()
+	breaker := &circuitBreaker{failures: 1, cooldown: time.Minute, endpoints: map[string]*endpointBreaker{}}
+	merger := &metricsListenerMerger{
+		port:      2381,
+		probe:     &schemeProber{schemes: map[string]*probedScheme{}},
+		discovery: &metricsListenerDiscovery{found: map[string]discoveredListener{}},
+	}
+	targets.onRemove = func(removed []string) {
+		breaker.forget(removed)
+		merger.forget(removed)
+	}
+	defer func() { forgetEndpoints(targets.all()) }()
+
+	for i := range 100 {
+		addrs := []string{fmt.Sprintf("10.0.%d.1:2379", i), fmt.Sprintf("10.0.%d.2:2379", i)}
+		targets.set(addrs)
+		for _, addr := range addrs {
+			breaker.record(addr, false)
+			merger.probe.schemes[merger.listenerAddr(addr)] = &probedScheme{scheme: "https"}
+			merger.discovery.found[addr] = discoveredListener{url: "https://" + merger.listenerAddr(addr) + "/metrics"}
+		}
+	}
+	if n := len(breaker.endpoints); n != 2 {
+		t.Errorf("%d circuit breakers after churning the targets, want 2", n)
+	}
+	if n := len(merger.probe.schemes); n != 2 {
+		t.Errorf("%d probed schemes after churning the targets, want 2", n)
+	}
+	if n := len(merger.discovery.found); n != 2 {
+		t.Errorf("%d discovered listeners after churning the targets, want 2", n)
+	}
+
+	// an address that comes back starts with a closed circuit.
+	breaker.record("10.0.99.1:2379", false)
+	targets.set([]string{"10.0.0.1:2379"})
+	targets.set([]string{"10.0.99.1:2379"})
+	if !breaker.allow("10.0.99.1:2379") {
+		t.Error("a returning address inherited its open circuit")
+	}
+}
+
+// testEndpointSlices are EndpointSlices of an etcd service, with the client
+// port on different numbers, under another name and without a number.
+const testEndpointSlices = `{"items":[
+	{"ports":[{"name":"peer","port":2380},{"name":"client","port":12379}],"endpoints":[
+		{"addresses":["10.244.1.7"],"conditions":{"ready":true}},
+		{"addresses":["10.244.2.7"],"conditions":{"ready":false}},
+		{"addresses":["10.244.3.7"],"conditions":{}}]},
+	{"ports":[{"name":"client","port":22379}],"endpoints":[
+		{"addresses":["10.244.4.7"],"conditions":{"ready":true}}]},
+	{"ports":[{"name":"etcd-client","port":2379}],"endpoints":[
+		{"addresses":["10.244.5.7"],"conditions":{"ready":true}}]},
+	{"ports":[{"name":"client"}],"endpoints":[
+		{"addresses":["10.244.6.7"],"conditions":{"ready":true}}]}]}`
+
+func TestKubeDiscoveryEndpointSlices(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("service-account-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/etcd/endpointslices" ||
+			r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=etcd-client" ||
+			r.Header.Get("Authorization") != "Bearer service-account-token" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(testEndpointSlices))
+	}))
+	defer api.Close()
+
+	tests := []struct {
+		name     string
+		portName string
+		want     []string
+		wantErr  string
+	}{
+		{
+			name: "upstream port",
+			want: []string{"10.244.1.7:2379", "10.244.3.7:2379", "10.244.4.7:2379", "10.244.5.7:2379", "10.244.6.7:2379"},
+		},
+		{
+			name:     "port by name",
+			portName: "client",
+			want:     []string{"10.244.1.7:12379", "10.244.3.7:12379", "10.244.4.7:22379"},
+		},
+		{
+			name:     "other port name",
+			portName: "etcd-client",
+			want:     []string{"10.244.5.7:2379"},
+		},
+		{
+			name:     "unknown port name",
+			portName: "metrics",
+			wantErr:  `no ready etcd members found on a port named "metrics"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &kubeDiscovery{
+				client:    &kubeClient{baseURL: api.URL, client: api.Client(), tokenFile: token},
+				namespace: "etcd",
+				service:   "etcd-client",
+				portName:  tt.portName,
+				port:      2379,
+			}
+			got, err := d.discover(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("discover() = %v, %v, want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("discover() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeDNS is a dns server answering A and SRV queries from its records;
+// other names don't exist.
+type fakeDNS struct {
+	mu  sync.Mutex
+	a   map[string][]string
+	srv map[string][]net.SRV
+}
+
+// resolver returns a resolver sending every query to the server.
+func (d *fakeDNS) resolver(t *testing.T) *net.Resolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp, err := d.answer(buf[:n]); err == nil {
+				pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "udp", pc.LocalAddr().String())
+	}}
+}
+
+func (d *fakeDNS) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	_, hasA := d.a[name]
+	_, hasSRV := d.srv[name]
+	rcode := dnsmessage.RCodeSuccess
+	if !hasA && !hasSRV {
+		rcode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: rcode})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		for _, ip := range d.a[name] {
+			b.AResource(rh, dnsmessage.AResource{A: [4]byte(net.ParseIP(ip).To4())})
+		}
+	case dnsmessage.TypeSRV:
+		for _, r := range d.srv[name] {
+			b.SRVResource(rh, dnsmessage.SRVResource{
+				Target: dnsmessage.MustNewName(r.Target),
+				Port:   r.Port,
+				Weight: r.Weight,
+			})
+		}
+	}
+	return b.Finish()
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	dns := &fakeDNS{
+		a: map[string][]string{"etcd.example.test": {"10.0.0.2", "10.0.0.1", "10.0.0.2"}},
+		srv: map[string][]net.SRV{"_etcd-client-ssl._tcp.example.test": {
+			{Target: "etcd-1.example.test.", Port: 2379},
+			{Target: "etcd-0.example.test.", Port: 2379},
+			{Target: "etcd-2.example.test.", Port: 12379},
+		}},
+	}
+	resolver := dns.resolver(t)
+	tests := []struct {
+		name    string
+		srv     string
+		host    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "srv",
+			srv:  "_etcd-client-ssl._tcp.example.test",
+			want: []string{"etcd-0.example.test:2379", "etcd-1.example.test:2379", "etcd-2.example.test:12379"},
+		},
+		{
+			name: "host",
+			host: "etcd.example.test",
+			want: []string{"10.0.0.1:2379", "10.0.0.2:2379"},
+		},
+		{name: "unknown srv", srv: "_etcd-client._tcp.example.test", wantErr: true},
+		{name: "unknown host", host: "etcd-3.example.test", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dnsDiscovery{resolver: resolver, srv: tt.srv, host: tt.host, port: 2379}
+			got, err := d.discover(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("discover() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("discover() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSDiscoveryReresolves(t *testing.T) {
+	dns := &fakeDNS{a: map[string][]string{"etcd.example.test": {"10.0.0.1"}}}
+	targets := newUpstreamTargets()
+	var changes atomic.Int32
+	targets.onChange = func() { changes.Add(1) }
+	d := &dnsDiscovery{resolver: dns.resolver(t), host: "etcd.example.test", port: 2379, interval: 10 * time.Millisecond, targets: targets}
+	defer func() { forgetEndpoints(targets.all()) }()
+	if err := d.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.run(ctx)
+
+	waitForTargets := func(want ...string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); strings.Join(targets.all(), " ") != strings.Join(want, " "); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("targets %v, want %v", targets.all(), want)
+			}
+		}
+	}
+	waitForTargets("10.0.0.1:2379")
+
+	// the pods of the headless service were rescheduled.
+	dns.mu.Lock()
+	dns.a["etcd.example.test"] = []string{"10.0.1.1", "10.0.1.2"}
+	dns.mu.Unlock()
+	waitForTargets("10.0.1.1:2379", "10.0.1.2:2379")
+	// idle connections are closed on every change.
+	if n := changes.Load(); n != 2 {
+		t.Errorf("%d target changes, want 2", n)
+	}
+
+	// a failed resolution keeps the previous addresses.
+	dns.mu.Lock()
+	delete(dns.a, "etcd.example.test")
+	dns.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	waitForTargets("10.0.1.1:2379", "10.0.1.2:2379")
+}
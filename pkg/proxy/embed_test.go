@@ -0,0 +1,84 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openinsight-proj/etcd-metrics-proxy/pkg/proxy"
+)
+
+// TestEmbedding uses the proxy only through its exported api, the way an
+// operator embedding it would.
+func TestEmbedding(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	defer upstream.Close()
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+
+	cfg := proxy.DefaultConfig()
+	cfg.UpstreamURL = upstream.URL + "/metrics"
+	cfg.ListenAddresses = []string{"unix://" + socket}
+	cfg.AccessLogFormat = "none"
+	p, err := proxy.NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the handlers can be mounted on the embedder's own server.
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		want    int
+	}{
+		{"metrics handler", p.MetricsHandler(), "/metrics", http.StatusOK},
+		{"handler", p.Handler(), "/metrics", http.StatusOK},
+		{"handler health", p.Handler(), "/healthz", http.StatusOK},
+		{"admin handler", p.AdminHandler(), "/debug/vars", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	// or the proxy serves its own listeners until the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- p.Run(ctx) }()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://proxy/metrics"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "etcd_server_has_leader 1\n" {
+		t.Errorf("got %q, want the upstream metrics", body)
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("Run() = %v", err)
+	}
+}
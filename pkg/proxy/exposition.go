@@ -0,0 +1,379 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+type lineKind int
+
+const (
+	lineBlank lineKind = iota
+	lineComment
+	lineHelp
+	lineType
+	lineUnit
+	lineSample
+	// lineEOF is the OpenMetrics "# EOF" terminator.
+	lineEOF
+)
+
+// label is a single name/value pair of a sample.
+type label struct {
+	name  string
+	value string
+}
+
+// line is a single parsed line of the prometheus text or OpenMetrics
+// exposition format.
+type line struct {
+	kind lineKind
+	// name is the metric name for samples and the family name for HELP and
+	// TYPE lines.
+	name string
+	// family is the metric family the line belongs to.
+	family string
+	labels []label
+	// rest holds everything after the name (and labels): the value,
+	// optional timestamp and exemplar for samples, the docstring, type or
+	// unit for HELP/TYPE/UNIT.
+	rest string
+	raw  string
+	// merge marks a sample to be merged with the other samples of its
+	// family that have the same name and labels.
+	merge bool
+}
+
+var errInvalidLine = errors.New("invalid exposition line")
+
+// familySuffixes are the sample name suffixes that still belong to the
+// family declared by the preceding HELP/TYPE lines.
+var familySuffixes = []string{"_bucket", "_sum", "_count", "_total", "_created", "_info", "_gsum", "_gcount"}
+
+// familyOf returns the family name of a sample given the most recently
+// declared family.
+func familyOf(name, current string) string {
+	if current == "" {
+		return name
+	}
+	if name == current {
+		return current
+	}
+	if strings.HasPrefix(name, current) {
+		for _, s := range familySuffixes {
+			if name == current+s {
+				return current
+			}
+		}
+	}
+	return name
+}
+
+func parseLine(s string) (line, error) {
+	l := line{raw: s}
+	if strings.TrimSpace(s) == "" {
+		l.kind = lineBlank
+		return l, nil
+	}
+	if s[0] == '#' {
+		l.kind = lineComment
+		if s == "# EOF" {
+			l.kind = lineEOF
+			return l, nil
+		}
+		fields := strings.SplitN(strings.TrimLeft(s[1:], " \t"), " ", 3)
+		if len(fields) < 2 {
+			return l, nil
+		}
+		switch fields[0] {
+		case "HELP":
+			l.kind = lineHelp
+		case "TYPE":
+			l.kind = lineType
+		case "UNIT":
+			l.kind = lineUnit
+		default:
+			return l, nil
+		}
+		l.name = fields[1]
+		l.family = fields[1]
+		if len(fields) == 3 {
+			l.rest = fields[2]
+		}
+		return l, nil
+	}
+
+	l.kind = lineSample
+	i := strings.IndexAny(s, "{ \t")
+	if i <= 0 {
+		return l, errInvalidLine
+	}
+	l.name = s[:i]
+	s = s[i:]
+	if s[0] == '{' {
+		labels, n, err := parseLabels(s)
+		if err != nil {
+			return l, err
+		}
+		l.labels = labels
+		s = s[n:]
+	}
+	l.rest = s
+	return l, nil
+}
+
+// parseLabels parses a brace enclosed label set at the start of s and returns
+// the labels along with the number of bytes consumed.
+func parseLabels(s string) ([]label, int, error) {
+	labels := make([]label, 0, strings.Count(s, `="`))
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, errInvalidLine
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+		eq := strings.IndexByte(s[i:], '=')
+		if eq <= 0 {
+			return nil, 0, errInvalidLine
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+		if i >= len(s) || s[i] != '"' {
+			return nil, 0, errInvalidLine
+		}
+		i++
+		// values without escapes share the memory of s.
+		start, escaped := i, false
+		for {
+			if i >= len(s) {
+				return nil, 0, errInvalidLine
+			}
+			if s[i] == '"' {
+				break
+			}
+			if s[i] == '\\' && i+1 < len(s) {
+				escaped = true
+				i++
+			}
+			i++
+		}
+		value := s[start:i]
+		i++
+		if escaped {
+			value = unescapeLabelValue(value)
+		}
+		labels = append(labels, label{name: name, value: value})
+	}
+}
+
+func unescapeLabelValue(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// lineWriter is implemented by both strings.Builder and bufio.Writer.
+type lineWriter interface {
+	io.Writer
+	io.StringWriter
+	io.ByteWriter
+}
+
+// String renders the line back into the text exposition format.
+func (l *line) String() string {
+	var b strings.Builder
+	l.writeTo(&b)
+	s := b.String()
+	return s[:len(s)-1]
+}
+
+// metaPrefixes start the HELP, TYPE and UNIT lines.
+var metaPrefixes = map[lineKind]string{
+	lineHelp: "# HELP ",
+	lineType: "# TYPE ",
+	lineUnit: "# UNIT ",
+}
+
+// writeTo writes the line, followed by a newline, to w without building it
+// as a string first.
+func (l *line) writeTo(w lineWriter) error {
+	switch l.kind {
+	case lineHelp, lineType, lineUnit:
+		w.WriteString(metaPrefixes[l.kind])
+		w.WriteString(l.name)
+		w.WriteByte(' ')
+		w.WriteString(l.rest)
+	case lineSample:
+		w.WriteString(l.name)
+		if len(l.labels) > 0 {
+			w.WriteByte('{')
+			for i, lb := range l.labels {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				w.WriteString(lb.name)
+				w.WriteString(`="`)
+				labelValueEscaper.WriteString(w, lb.value)
+				w.WriteByte('"')
+			}
+			w.WriteByte('}')
+		}
+		w.WriteString(l.rest)
+	default:
+		w.WriteString(l.raw)
+	}
+	return w.WriteByte('\n')
+}
+
+// rewriteFunc inspects or modifies a parsed line. Returning false drops it.
+type rewriteFunc func(l *line) bool
+
+// rewriteExposition reads the text or OpenMetrics exposition format from r,
+// applies fn to every line and writes the surviving lines to w. Lines that
+// cannot be parsed are passed through unchanged.
+func rewriteExposition(r io.Reader, w io.Writer, fn rewriteFunc) error {
+	br := getReader(r)
+	defer putReader(br)
+	bw := getWriter(w)
+	defer putWriter(bw)
+	var current string
+	var merger sampleMerger
+	// l is reused for every line, rather than escaping to fn anew.
+	var l line
+	for {
+		s, readErr := br.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if s == "" && readErr == io.EOF {
+			break
+		}
+		s = strings.TrimRight(s, "\n")
+
+		var err error
+		l, err = parseLine(s)
+		switch {
+		case err != nil:
+			bw.WriteString(s)
+			if err := bw.WriteByte('\n'); err != nil {
+				return err
+			}
+		default:
+			switch l.kind {
+			case lineHelp, lineType, lineUnit:
+				current = l.name
+			case lineSample:
+				l.family = familyOf(l.name, current)
+			}
+			if !fn(&l) {
+				break
+			}
+			if merger.pending() && (l.kind != lineSample || l.family != merger.family) {
+				if err := merger.flush(bw); err != nil {
+					return err
+				}
+			}
+			if l.kind == lineSample && l.merge && merger.add(l) {
+				break
+			}
+			if err := l.writeTo(bw); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if err := merger.flush(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// streamExposition rewrites the exposition read from r into w with fn,
+// followed by the lines of tail, keeping an OpenMetrics terminator last.
+func streamExposition(w io.Writer, r io.Reader, tail []byte, fn rewriteFunc) error {
+	if len(tail) == 0 {
+		return rewriteExposition(r, w, fn)
+	}
+	eof := false
+	withTail := func(l *line) bool {
+		switch l.kind {
+		case lineEOF:
+			eof = true
+			return false
+		case lineBlank:
+			// such as the one separating r from tail.
+			return false
+		}
+		return fn(l)
+	}
+	if err := rewriteExposition(io.MultiReader(r, strings.NewReader("\n"), bytes.NewReader(tail)), w, withTail); err != nil {
+		return err
+	}
+	if eof {
+		_, err := io.WriteString(w, eofLine)
+		return err
+	}
+	return nil
+}
+
+// chainRewrites combines rewrite funcs, stopping at the first that drops the
+// line.
+func chainRewrites(fns ...rewriteFunc) rewriteFunc {
+	return func(l *line) bool {
+		for _, fn := range fns {
+			if !fn(l) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// textAccept narrows an Accept header to the text based formats the
+// rewriter understands, keeping the client's preference between the
+// prometheus text format and OpenMetrics.
+func textAccept(accept string) string {
+	var keep []string
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/openmetrics-text", "text/plain":
+			keep = append(keep, strings.TrimSpace(part))
+		}
+	}
+	if len(keep) == 0 {
+		return "text/plain;version=0.0.4"
+	}
+	return strings.Join(keep, ",")
+}
+
+// expositionFormat names the format an upstream is expected to answer an
+// Accept header with: "openmetrics" if that is preferred, "text" otherwise.
+func expositionFormat(accept string) string {
+	first, _, _ := strings.Cut(textAccept(accept), ",")
+	if strings.HasPrefix(strings.ToLower(first), "application/openmetrics-text") {
+		return "openmetrics"
+	}
+	return "text"
+}
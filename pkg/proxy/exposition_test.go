@@ -0,0 +1,530 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    line
+		wantErr bool
+	}{
+		{
+			name: "blank",
+			in:   "  ",
+			want: line{kind: lineBlank},
+		},
+		{
+			name: "comment",
+			in:   "# scraped from etcd",
+			want: line{kind: lineComment},
+		},
+		{
+			name: "help",
+			in:   "# HELP etcd_server_has_leader Whether or not a leader exists.",
+			want: line{kind: lineHelp, name: "etcd_server_has_leader", family: "etcd_server_has_leader", rest: "Whether or not a leader exists."},
+		},
+		{
+			name: "type",
+			in:   "# TYPE etcd_server_has_leader gauge",
+			want: line{kind: lineType, name: "etcd_server_has_leader", family: "etcd_server_has_leader", rest: "gauge"},
+		},
+		{
+			name: "unit",
+			in:   "# UNIT etcd_disk_wal_fsync_duration_seconds seconds",
+			want: line{kind: lineUnit, name: "etcd_disk_wal_fsync_duration_seconds", family: "etcd_disk_wal_fsync_duration_seconds", rest: "seconds"},
+		},
+		{
+			name: "openmetrics eof",
+			in:   "# EOF",
+			want: line{kind: lineEOF},
+		},
+		{
+			name: "sample without labels",
+			in:   "etcd_server_has_leader 1",
+			want: line{kind: lineSample, name: "etcd_server_has_leader", rest: " 1"},
+		},
+		{
+			name: "sample with labels",
+			in:   `etcd_server_go_version{server_go_version="go1.22.0"} 1`,
+			want: line{kind: lineSample, name: "etcd_server_go_version", labels: []label{{"server_go_version", "go1.22.0"}}, rest: " 1"},
+		},
+		{
+			name: "escaped label values",
+			in:   `grpc_server_handled_total{grpc_method="a\"b",path="C:\\etcd",msg="line\nbreak"} 3`,
+			want: line{kind: lineSample, name: "grpc_server_handled_total", labels: []label{{"grpc_method", `a"b`}, {"path", `C:\etcd`}, {"msg", "line\nbreak"}}, rest: " 3"},
+		},
+		{
+			name: "closing brace in label value",
+			in:   `foo{a="}",b=""} 1`,
+			want: line{kind: lineSample, name: "foo", labels: []label{{"a", "}"}, {"b", ""}}, rest: " 1"},
+		},
+		{
+			name: "timestamp",
+			in:   `etcd_debugging_mvcc_keys_total{a="b"} 42 1700000000000`,
+			want: line{kind: lineSample, name: "etcd_debugging_mvcc_keys_total", labels: []label{{"a", "b"}}, rest: " 42 1700000000000"},
+		},
+		{
+			name: "exemplar",
+			in:   `etcd_request_duration_seconds_bucket{le="0.1"} 8 # {trace_id="4bf92f3577b34da6"} 0.05 1700000000.123`,
+			want: line{kind: lineSample, name: "etcd_request_duration_seconds_bucket", labels: []label{{"le", "0.1"}}, rest: ` 8 # {trace_id="4bf92f3577b34da6"} 0.05 1700000000.123`},
+		},
+		{
+			name: "trailing comma",
+			in:   `foo{a="b",} 1`,
+			want: line{kind: lineSample, name: "foo", labels: []label{{"a", "b"}}, rest: " 1"},
+		},
+		{
+			name:    "unterminated label value",
+			in:      `foo{a="b} 1`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated label set",
+			in:      `foo{a="b"`,
+			wantErr: true,
+		},
+		{
+			name:    "unquoted label value",
+			in:      `foo{a=b} 1`,
+			wantErr: true,
+		},
+		{
+			name:    "no name",
+			in:      `{a="b"} 1`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLine(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseLine(%q) = %+v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLine(%q): %v", tt.in, err)
+			}
+			tt.want.raw = tt.in
+			if len(got.labels) == 0 {
+				got.labels = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLine(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineString(t *testing.T) {
+	tests := []string{
+		"# HELP etcd_server_has_leader Whether or not a leader exists.",
+		"# TYPE etcd_server_has_leader gauge",
+		"# UNIT etcd_disk_wal_fsync_duration_seconds seconds",
+		"# EOF",
+		"# a comment",
+		`grpc_server_handled_total{grpc_method="a\"b",path="C:\\etcd",msg="line\nbreak"} 3`,
+		`etcd_request_duration_seconds_bucket{le="0.1"} 8 # {trace_id="4bf92f3577b34da6"} 0.05 1700000000.123`,
+		`etcd_debugging_mvcc_keys_total 42 1700000000000`,
+	}
+	for _, in := range tests {
+		l, err := parseLine(in)
+		if err != nil {
+			t.Fatalf("parseLine(%q): %v", in, err)
+		}
+		if got := l.String(); got != in {
+			t.Errorf("parseLine(%q).String() = %q", in, got)
+		}
+	}
+}
+
+func TestFamilyOf(t *testing.T) {
+	tests := []struct {
+		name, current, want string
+	}{
+		{"etcd_server_has_leader", "", "etcd_server_has_leader"},
+		{"etcd_server_has_leader", "etcd_server_has_leader", "etcd_server_has_leader"},
+		{"etcd_disk_wal_fsync_duration_seconds_bucket", "etcd_disk_wal_fsync_duration_seconds", "etcd_disk_wal_fsync_duration_seconds"},
+		{"etcd_disk_wal_fsync_duration_seconds_count", "etcd_disk_wal_fsync_duration_seconds", "etcd_disk_wal_fsync_duration_seconds"},
+		{"etcd_disk_wal_fsync_duration_seconds_created", "etcd_disk_wal_fsync_duration_seconds", "etcd_disk_wal_fsync_duration_seconds"},
+		// a family without HELP or TYPE after another one.
+		{"etcd_server_has_leader_changes", "etcd_server_has_leader", "etcd_server_has_leader_changes"},
+		{"process_open_fds", "etcd_server_has_leader", "process_open_fds"},
+	}
+	for _, tt := range tests {
+		if got := familyOf(tt.name, tt.current); got != tt.want {
+			t.Errorf("familyOf(%q, %q) = %q, want %q", tt.name, tt.current, got, tt.want)
+		}
+	}
+}
+
+const testExposition = `# HELP etcd_server_has_leader Whether or not a leader exists.
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+# HELP etcd_disk_wal_fsync_duration_seconds The latency distributions of fsync called by WAL.
+# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.001"} 2 # {trace_id="4bf92f3577b34da6"} 0.0005 1700000000.123
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.002"} 5
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf"} 9
+etcd_disk_wal_fsync_duration_seconds_sum 0.0123
+etcd_disk_wal_fsync_duration_seconds_count 9
+# HELP grpc_server_handled_total Total number of RPCs completed on the server.
+# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_code="OK",grpc_method="Range",grpc_service="etcdserverpb.KV",grpc_type="unary"} 1234 1700000000000
+grpc_server_handled_total{grpc_code="Unknown",grpc_method="a\"b\\c\nd",grpc_service="etcdserverpb.KV",grpc_type="unary"} 1
+not{valid 1
+# EOF
+`
+
+func TestRewriteExposition(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		fn   rewriteFunc
+		want string
+	}{
+		{
+			name: "unchanged",
+			in:   testExposition,
+			fn:   func(*line) bool { return true },
+			want: testExposition,
+		},
+		{
+			name: "no trailing newline",
+			in:   "foo 1\nbar 2",
+			fn:   func(*line) bool { return true },
+			want: "foo 1\nbar 2\n",
+		},
+		{
+			name: "drop a family",
+			in:   testExposition,
+			fn:   func(l *line) bool { return l.family != "etcd_disk_wal_fsync_duration_seconds" },
+			want: `# HELP etcd_server_has_leader Whether or not a leader exists.
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+# HELP grpc_server_handled_total Total number of RPCs completed on the server.
+# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_code="OK",grpc_method="Range",grpc_service="etcdserverpb.KV",grpc_type="unary"} 1234 1700000000000
+grpc_server_handled_total{grpc_code="Unknown",grpc_method="a\"b\\c\nd",grpc_service="etcdserverpb.KV",grpc_type="unary"} 1
+not{valid 1
+# EOF
+`,
+		},
+		{
+			name: "modify labels",
+			in:   "# TYPE foo counter\nfoo_total{a=\"x\\\"y\"} 1\n",
+			fn: func(l *line) bool {
+				if l.kind == lineSample {
+					l.labels = append(l.labels, label{"b", "new\nline"})
+				}
+				return true
+			},
+			want: "# TYPE foo counter\nfoo_total{a=\"x\\\"y\",b=\"new\\nline\"} 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := rewriteExposition(strings.NewReader(tt.in), &b, tt.fn); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// chunkReader returns the contents of r in reads of at most n bytes, so the
+// boundaries land in the middle of lines.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func TestRewriteExpositionChunked(t *testing.T) {
+	// a chunk boundary mid label set, mid escape and mid exemplar.
+	for _, n := range []int{1, 7, 64, 173} {
+		var families []string
+		var b strings.Builder
+		err := rewriteExposition(&chunkReader{r: strings.NewReader(testExposition), n: n}, &b, func(l *line) bool {
+			if l.kind == lineSample {
+				families = append(families, l.family)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("chunks of %d bytes: %v", n, err)
+		}
+		if got := b.String(); got != testExposition {
+			t.Errorf("chunks of %d bytes: got\n%s\nwant\n%s", n, got, testExposition)
+		}
+		want := []string{
+			"etcd_server_has_leader",
+			"etcd_disk_wal_fsync_duration_seconds", "etcd_disk_wal_fsync_duration_seconds", "etcd_disk_wal_fsync_duration_seconds",
+			"etcd_disk_wal_fsync_duration_seconds", "etcd_disk_wal_fsync_duration_seconds",
+			"grpc_server_handled_total", "grpc_server_handled_total",
+		}
+		if !reflect.DeepEqual(families, want) {
+			t.Errorf("chunks of %d bytes: families %q, want %q", n, families, want)
+		}
+	}
+}
+
+func TestRewriteExpositionReadError(t *testing.T) {
+	r := io.MultiReader(strings.NewReader("foo 1\nbar"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	err := rewriteExposition(r, io.Discard, func(*line) bool { return true })
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestStreamExposition(t *testing.T) {
+	keep := func(*line) bool { return true }
+	tests := []struct {
+		name string
+		in   string
+		tail string
+		want string
+	}{
+		{
+			name: "no tail",
+			in:   "foo 1\n# EOF\n",
+			want: "foo 1\n# EOF\n",
+		},
+		{
+			name: "tail after text format",
+			in:   "foo 1\n",
+			tail: "bar 2\n",
+			want: "foo 1\nbar 2\n",
+		},
+		{
+			name: "tail before openmetrics eof",
+			in:   "# TYPE foo gauge\nfoo 1\n# EOF\n",
+			tail: "# TYPE bar gauge\nbar 2\n",
+			want: "# TYPE foo gauge\nfoo 1\n# TYPE bar gauge\nbar 2\n# EOF\n",
+		},
+		{
+			name: "upstream without trailing newline",
+			in:   "foo 1",
+			tail: "bar 2\n",
+			want: "foo 1\nbar 2\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			r := &chunkReader{r: strings.NewReader(tt.in), n: 3}
+			if err := streamExposition(&b, r, []byte(tt.tail), keep); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainRewrites(t *testing.T) {
+	var calls []string
+	fn := chainRewrites(
+		func(l *line) bool { calls = append(calls, "first"); return true },
+		func(l *line) bool { calls = append(calls, "second"); return l.name != "drop" },
+		func(l *line) bool { calls = append(calls, "third"); return true },
+	)
+	if !fn(&line{name: "keep"}) {
+		t.Error("keep was dropped")
+	}
+	if fn(&line{name: "drop"}) {
+		t.Error("drop was kept")
+	}
+	want := []string{"first", "second", "third", "first", "second"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %q, want %q", calls, want)
+	}
+}
+
+// benchmarkExposition is an etcd exposition of about 1.6MB and 18k lines.
+var benchmarkExposition = func() []byte {
+	var b strings.Builder
+	methods := []string{"Range", "Put", "DeleteRange", "Txn", "Compact", "LeaseGrant", "Watch", "MemberList"}
+	codes := []string{"OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded", "NotFound", "Unavailable"}
+	for f := 0; f < 40; f++ {
+		fmt.Fprintf(&b, "# HELP grpc_server_handled_total_%d Total number of RPCs completed on the server, regardless of success or failure.\n", f)
+		fmt.Fprintf(&b, "# TYPE grpc_server_handled_total_%d counter\n", f)
+		for i := 0; i < 3; i++ {
+			for _, m := range methods {
+				for _, c := range codes {
+					fmt.Fprintf(&b, "grpc_server_handled_total_%d{grpc_code=%q,grpc_method=%q,grpc_service=\"etcdserverpb.KV\",grpc_type=\"unary\",shard=\"%d\"} %d\n", f, c, m, i, f*i+len(m))
+				}
+			}
+		}
+		fmt.Fprintf(&b, "# HELP etcd_disk_duration_seconds_%d The latency distributions of a disk operation.\n", f)
+		fmt.Fprintf(&b, "# TYPE etcd_disk_duration_seconds_%d histogram\n", f)
+		for i := 0; i < 16; i++ {
+			for _, le := range []string{"0.001", "0.002", "0.004", "0.008", "0.016", "0.032", "0.064", "0.128", "0.256", "0.512", "1.024", "2.048", "4.096", "8.192", "+Inf"} {
+				fmt.Fprintf(&b, "etcd_disk_duration_seconds_%d_bucket{disk=\"wal-%d\",le=%q} %d\n", f, i, le, i*7)
+			}
+			fmt.Fprintf(&b, "etcd_disk_duration_seconds_%d_sum{disk=\"wal-%d\"} 0.%d\n", f, i, i)
+			fmt.Fprintf(&b, "etcd_disk_duration_seconds_%d_count{disk=\"wal-%d\"} %d\n", f, i, i*7)
+		}
+	}
+	return []byte(b.String())
+}()
+
+// benchmarkRewrite adds a label to every sample and drops a family, like
+// relabeling and --metric-deny would.
+func benchmarkRewrite(l *line) bool {
+	if l.family == "etcd_disk_duration_seconds_0" {
+		return false
+	}
+	if l.kind == lineSample {
+		l.labels = append(l.labels, label{"cluster", "prod"})
+	}
+	return true
+}
+
+func BenchmarkRewriteExposition(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkExposition)))
+	for range b.N {
+		if err := rewriteExposition(bytes.NewReader(benchmarkExposition), io.Discard, benchmarkRewrite); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamExposition(b *testing.B) {
+	tail := []byte("# TYPE etcd_metrics_proxy_up gauge\netcd_metrics_proxy_up 1\n")
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkExposition)))
+	for range b.N {
+		if err := streamExposition(io.Discard, bytes.NewReader(benchmarkExposition), tail, benchmarkRewrite); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTextAccept(t *testing.T) {
+	tests := []struct {
+		name, accept, want, wantFormat string
+	}{
+		{"empty", "", "text/plain;version=0.0.4", "text"},
+		{"text", "text/plain;version=0.0.4", "text/plain;version=0.0.4", "text"},
+		{"openmetrics", "application/openmetrics-text;version=1.0.0", "application/openmetrics-text;version=1.0.0", "openmetrics"},
+		{
+			name:       "prometheus",
+			accept:     "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.4,*/*;q=0.1",
+			want:       "application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.4",
+			wantFormat: "openmetrics",
+		},
+		{"text preferred", "text/plain;version=0.0.4, application/openmetrics-text", "text/plain;version=0.0.4,application/openmetrics-text", "text"},
+		{"case insensitive", "Application/OpenMetrics-Text", "Application/OpenMetrics-Text", "openmetrics"},
+		{"only protobuf", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily", "text/plain;version=0.0.4", "text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := textAccept(tt.accept); got != tt.want {
+				t.Errorf("textAccept(%q) = %q, want %q", tt.accept, got, tt.want)
+			}
+			if got := expositionFormat(tt.accept); got != tt.wantFormat {
+				t.Errorf("expositionFormat(%q) = %q, want %q", tt.accept, got, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestOpenMetricsNegotiation(t *testing.T) {
+	const (
+		openMetrics = "application/openmetrics-text;version=1.0.0"
+		protobuf    = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+	)
+	// the upstream answers in the format asked for, echoing the Accept header.
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept", r.Header.Get("Accept"))
+		if expositionFormat(r.Header.Get("Accept")) == "openmetrics" {
+			w.Header().Set("Content-Type", openMetrics+"; charset=utf-8")
+			w.Write([]byte("# TYPE grpc_server_handled counter\ngrpc_server_handled_total{grpc_code=\"OK\"} 42 # {trace_id=\"abc\"} 1 1700000000.000\n# EOF\n"))
+			return
+		}
+		w.Write([]byte("# TYPE grpc_server_handled_total counter\ngrpc_server_handled_total{grpc_code=\"OK\"} 42\n"))
+	})
+	tests := []struct {
+		name       string
+		rewrite    bool
+		accept     string
+		wantAccept string
+		wantBody   string
+	}{
+		{
+			name:       "passthrough",
+			accept:     protobuf + "," + openMetrics + ";q=0.5",
+			wantAccept: protobuf + "," + openMetrics + ";q=0.5",
+			wantBody:   "grpc_server_handled_total{grpc_code=\"OK\"} 42 # {trace_id=\"abc\"} 1 1700000000.000\n# EOF\n",
+		},
+		{
+			name:       "rewritten openmetrics keeps exemplars and eof",
+			rewrite:    true,
+			accept:     protobuf + "," + openMetrics + ";q=0.5",
+			wantAccept: openMetrics + ";q=0.5",
+			wantBody:   "# TYPE etcd_grpc_server_handled counter\netcd_grpc_server_handled_total{grpc_code=\"OK\"} 42 # {trace_id=\"abc\"} 1 1700000000.000\n# EOF\n",
+		},
+		{
+			name:       "rewritten text",
+			rewrite:    true,
+			accept:     "text/plain;version=0.0.4",
+			wantAccept: "text/plain;version=0.0.4",
+			wantBody:   "# TYPE etcd_grpc_server_handled_total counter\netcd_grpc_server_handled_total{grpc_code=\"OK\"} 42\n",
+		},
+		{
+			name:       "rewritten protobuf falls back to text",
+			rewrite:    true,
+			accept:     protobuf,
+			wantAccept: "text/plain;version=0.0.4",
+			wantBody:   "etcd_grpc_server_handled_total{grpc_code=\"OK\"} 42\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, upstream, func(c *Config) {
+				if tt.rewrite {
+					c.ConfigFile = filepath.Join(t.TempDir(), "config.yaml")
+					if err := os.WriteFile(c.ConfigFile, []byte("metric_prefix: etcd_\n"), 0o600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			p.MetricsHandler().ServeHTTP(rec, req)
+			if got := rec.Header().Get("X-Accept"); got != tt.wantAccept {
+				t.Errorf("upstream got Accept %q, want %q", got, tt.wantAccept)
+			}
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d\n%s\nwant\n%s", rec.Code, rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
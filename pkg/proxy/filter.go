@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// metricFilter decides which metric families are returned to the scraper.
+// A family is kept if it matches any allow pattern (or no allow patterns are
+// configured) and matches none of the deny patterns.
+type metricFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func newMetricFilter(allow, deny []string) (*metricFilter, error) {
+	f := &metricFilter{}
+	var err error
+	if f.allow, err = compileAnchored(allow); err != nil {
+		return nil, fmt.Errorf("invalid --metric-allow: %w", err)
+	}
+	if f.deny, err = compileAnchored(deny); err != nil {
+		return nil, fmt.Errorf("invalid --metric-deny: %w", err)
+	}
+	return f, nil
+}
+
+// compileAnchored compiles patterns so that they must match the whole name,
+// following the prometheus relabeling convention.
+func compileAnchored(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func (f *metricFilter) enabled() bool {
+	return len(f.allow) > 0 || len(f.deny) > 0
+}
+
+func (f *metricFilter) keep(family string) bool {
+	if len(f.allow) > 0 && !matchAny(f.allow, family) {
+		return false
+	}
+	return !matchAny(f.deny, family)
+}
+
+func (f *metricFilter) rewrite(l *line) bool {
+	switch l.kind {
+	case lineHelp, lineType, lineUnit, lineSample:
+		return f.keep(l.family)
+	}
+	return true
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+)
+
+// defaultForwardHeaders are the inbound headers forwarded to etcd: the ones
+// negotiating the response, the Prometheus scrape timeout and the trace
+// context.
+var defaultForwardHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"User-Agent",
+	"X-Prometheus-Scrape-Timeout-Seconds",
+	"Traceparent",
+	"Tracestate",
+	"Baggage",
+}
+
+// scrubbedResponseHeaders are removed from upstream responses: cookies and
+// authentication challenges of etcd, or a gateway in front of it, concern
+// the proxy's own credentials rather than the scraper's, and the forwarding
+// headers describe requests to etcd.
+var scrubbedResponseHeaders = []string{
+	"Set-Cookie",
+	"Www-Authenticate",
+	"Proxy-Authenticate",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+}
+
+// headerScrubber removes every inbound header not in the passthrough list
+// from requests to etcd, so credentials meant for the proxy or something in
+// front of it, such as Authorization or cookies, never reach etcd. It sets
+// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host, keeping the
+// inbound values only from trusted proxies, and removes the
+// scrubbedResponseHeaders from the answers of etcd.
+type headerScrubber struct {
+	keep    map[string]bool
+	trusted []netip.Prefix
+}
+
+func newHeaderScrubber(extra []string, trusted []netip.Prefix) *headerScrubber {
+	s := &headerScrubber{keep: map[string]bool{}, trusted: trusted}
+	for _, h := range slices.Concat(defaultForwardHeaders, extra) {
+		s.keep[http.CanonicalHeaderKey(h)] = true
+	}
+	return s
+}
+
+// fromTrustedProxy reports whether the peer of r is a trusted proxy.
+func (s *headerScrubber) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	return err == nil && containsAddr(s.trusted, peer)
+}
+
+// scrub rewrites the headers of the outgoing request req. The reverse proxy
+// then removes the hop-by-hop headers and appends the peer address to
+// X-Forwarded-For.
+func (s *headerScrubber) scrub(req *http.Request) {
+	trusted := s.fromTrustedProxy(req)
+	proto, host := req.Header.Get("X-Forwarded-Proto"), req.Header.Get("X-Forwarded-Host")
+	if !trusted || proto == "" {
+		proto = "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+	}
+	if !trusted || host == "" {
+		host = req.Host
+	}
+	forwardedFor := req.Header.Values("X-Forwarded-For")
+
+	for name := range req.Header {
+		if !s.keep[name] {
+			delete(req.Header, name)
+		}
+	}
+	if trusted && len(forwardedFor) > 0 {
+		req.Header["X-Forwarded-For"] = forwardedFor
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", host)
+	// address etcd by the upstream host rather than the proxy's.
+	req.Host = ""
+}
+
+// scrubResponse removes the scrubbedResponseHeaders from the upstream
+// response resp.
+func (s *headerScrubber) scrubResponse(resp *http.Response) {
+	for _, name := range scrubbedResponseHeaders {
+		resp.Header.Del(name)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readyRetryMax caps the backoff between connection attempts while waiting
+// for the upstream at startup.
+const readyRetryMax = 30 * time.Second
+
+// upstreamChecker verifies that the upstream etcd endpoint is reachable. When
+// tls is configured, the client certificate is presented so that readiness
+// reflects whether scrapes can actually succeed.
+type upstreamChecker struct {
+	targets   *upstreamTargets
+	transport *transportSwitcher
+	auth      *httpAuth
+	path      string
+	timeout   time.Duration
+
+	// ready is set once a check has succeeded.
+	ready atomic.Bool
+}
+
+func (u *upstreamChecker) check(ctx context.Context) error {
+	err := u.checkWith(ctx, u.transport.Load().TLSClientConfig)
+	if err == nil && u.ready.CompareAndSwap(false, true) {
+		slog.Info("upstream etcd reachable, ready to serve")
+	} else if err != nil && !u.ready.Load() {
+		return fmt.Errorf("no successful upstream connection yet: %w", err)
+	}
+	return err
+}
+
+// waitReady checks the upstream with backoff until the first check
+// succeeds or ctx is done, so readiness is logged without waiting for a
+// probe.
+func (u *upstreamChecker) waitReady(ctx context.Context) {
+	backoff := time.Second
+	for !u.ready.Load() {
+		err := u.check(ctx)
+		if err == nil {
+			return
+		}
+		slog.Warn("upstream etcd not reachable yet", "err", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, readyRetryMax)
+	}
+}
+
+// checkWith performs the check using tlsConfig rather than the current
+// transport's, or plain http if tlsConfig is nil.
+func (u *upstreamChecker) checkWith(ctx context.Context, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	addrs := u.targets.all()
+	if len(addrs) == 0 {
+		return errors.New("no upstream targets")
+	}
+	// a one-off copy of the current transport, so the same dialer (e.g. a
+	// unix socket) and timeouts are used without sharing connections.
+	t := u.transport.Load().Clone()
+	t.TLSClientConfig = tlsConfig
+	t.DisableKeepAlives = true
+	defer t.CloseIdleConnections()
+
+	// the proxy fails over between targets, so any reachable one is enough.
+	var err error
+	for _, addr := range addrs {
+		if err = checkAddr(ctx, t, u.auth, addr, u.path); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkAddr sends a HEAD request for the metrics path to addr, failing
+// unless it is answered with a 2xx status. A tls handshake alone is not
+// enough: with TLS 1.3 the server only rejects a client certificate after
+// the client considers the handshake complete.
+func checkAddr(ctx context.Context, t *http.Transport, auth *httpAuth, addr, path string) error {
+	scheme := "http"
+	if t.TLSClientConfig != nil {
+		scheme = "https"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, scheme+"://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if err := auth.authorize(req); err != nil {
+		return err
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// a 401 or 403 means every scrape fails too, e.g. with wrong
+	// --upstream-username or bearer token.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", addr, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestProxy returns a proxy of upstream, with the configuration changed
+// by configure if it isn't nil.
+func newTestProxy(t *testing.T, upstream http.Handler, configure func(*Config)) (*Proxy, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(upstream)
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { forgetEndpoints([]string{srv.Listener.Addr().String()}) })
+	c := DefaultConfig()
+	c.UpstreamURL = srv.URL + "/metrics"
+	c.AccessLogFormat = "none"
+	if configure != nil {
+		configure(&c)
+	}
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, srv
+}
+
+// getPath serves a GET of path with h.
+func getPath(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	p, srv := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}), nil)
+
+	tests := []struct {
+		name      string
+		status    int
+		closed    bool
+		wantReady int
+	}{
+		{"upstream ready", http.StatusOK, false, http.StatusOK},
+		{"upstream failing", http.StatusInternalServerError, false, http.StatusServiceUnavailable},
+		{"upstream recovered", http.StatusOK, false, http.StatusOK},
+		{"upstream unreachable", http.StatusOK, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status.Store(int32(tt.status))
+			if tt.closed {
+				srv.Close()
+			}
+			// the proxy itself is healthy whatever the upstream does.
+			if rec := getPath(p.Handler(), "/healthz"); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+				t.Errorf("/healthz: %d %q, want 200 ok", rec.Code, rec.Body.String())
+			}
+			if rec := getPath(p.Handler(), "/readyz"); rec.Code != tt.wantReady {
+				t.Errorf("/readyz: %d %q, want %d", rec.Code, rec.Body.String(), tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNoContent, false},
+		{http.StatusMovedPermanently, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusForbidden, true},
+		{http.StatusNotFound, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead || r.URL.Path != "/metrics" {
+					t.Errorf("got %s %s, want HEAD /metrics", r.Method, r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			err := checkAddr(context.Background(), &http.Transport{}, nil, strings.TrimPrefix(srv.URL, "http://"), "/metrics")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAddr() = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Healthcheck requests /readyz from the scrape listener of the proxy
+// running with the configuration c, for container health checks and exec
+// probes in images without curl. The listener's tls certificate isn't
+// verified; the check only cares whether the local proxy answers.
+func Healthcheck(ctx context.Context, c Config) error {
+	addr := fmt.Sprintf(":%d", c.Port)
+	if len(c.ListenAddresses) > 0 {
+		addr = c.ListenAddresses[0]
+	}
+	t := &http.Transport{DisableKeepAlives: true}
+	defer t.CloseIdleConnections()
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		addr = "localhost"
+	} else {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	scheme := "http"
+	if c.scrapeTLS().enabled() {
+		scheme = "https"
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+addr+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/readyz returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// CheckUpstream checks that the upstream answers like /readyz does, but
+// without a running proxy.
+func (p *Proxy) CheckUpstream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := p.startDiscovery(ctx); err != nil {
+		return err
+	}
+	if len(p.targets.all()) == 0 {
+		return errors.New("no upstream members discovered")
+	}
+	return p.reload.checker.check(ctx)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthcheck(t *testing.T) {
+	ready := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	})
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	tests := []struct {
+		name     string
+		upstream http.Handler
+		tls      bool
+		// listen is the listen address of the proxy given the address of
+		// its listener, or "" to use --port.
+		listen  func(addr string) string
+		wantErr string
+	}{
+		{name: "ready", upstream: ready, listen: func(addr string) string { return addr }},
+		{name: "port", upstream: ready},
+		{
+			name:     "unspecified address",
+			upstream: ready,
+			listen: func(addr string) string {
+				_, port, _ := net.SplitHostPort(addr)
+				return "0.0.0.0:" + port
+			},
+		},
+		{name: "tls", upstream: ready, tls: true, listen: func(addr string) string { return addr }},
+		{name: "not ready", upstream: failing, listen: func(addr string) string { return addr }, wantErr: "/readyz returned 503 Service Unavailable"},
+		{name: "invalid listen address", upstream: ready, listen: func(string) string { return "localhost" }, wantErr: `invalid listen address "localhost"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, tt.upstream, nil)
+			srv := httptest.NewUnstartedServer(p.Handler())
+			if tt.tls {
+				srv.StartTLS()
+			} else {
+				srv.Start()
+			}
+			defer srv.Close()
+
+			c := DefaultConfig()
+			_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+			c.Port, _ = strconv.Atoi(port)
+			if tt.listen != nil {
+				c.ListenAddresses = []string{tt.listen(srv.Listener.Addr().String())}
+			}
+			if tt.tls {
+				// only whether tls is enabled matters, the certificate isn't
+				// verified.
+				c.ListenTLSCert, c.ListenTLSKey = "tls.crt", "tls.key"
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := Healthcheck(ctx, c)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Healthcheck() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Healthcheck() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHealthcheckUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	p, _ := newTestProxy(t, okHandler, func(c *Config) { c.ListenAddresses = []string{"unix://" + socket} })
+	stop, errc := startRun(t, p, socket)
+	defer func() {
+		stop()
+		<-errc
+	}()
+	c := DefaultConfig()
+	c.ListenAddresses = []string{"unix://" + socket}
+	if err := Healthcheck(context.Background(), c); err != nil {
+		t.Errorf("Healthcheck() = %v", err)
+	}
+}
+
+func TestCheckUpstream(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream http.Handler
+		wantErr  bool
+	}{
+		{name: "ready", upstream: okHandler},
+		{name: "failing", upstream: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, tt.upstream, nil)
+			if err := p.CheckUpstream(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("CheckUpstream() = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// histogramRule reduces the buckets of the histogram families matching
+// Metric, an anchored regular expression. Buckets are cumulative, so
+// dropping some of them re-buckets the histogram into the remaining ones
+// without changing their counts. _sum and _count are always kept.
+//
+//	buckets:      keep only the buckets with these upper bounds; le="+Inf"
+//	              is always kept.
+//	drop_buckets: drop every bucket; the family is retyped as a summary
+//	              without quantiles.
+type histogramRule struct {
+	Metric      string    `yaml:"metric"`
+	Buckets     []float64 `yaml:"buckets,omitempty"`
+	DropBuckets bool      `yaml:"drop_buckets,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (r *histogramRule) validate() error {
+	res, err := compileAnchored([]string{r.Metric})
+	if err != nil {
+		return fmt.Errorf("invalid metric %q: %w", r.Metric, err)
+	}
+	r.re = res[0]
+	if r.DropBuckets == (len(r.Buckets) > 0) {
+		return errors.New("exactly one of buckets and drop_buckets must be set")
+	}
+	return nil
+}
+
+// keepBucket reports whether the bucket with upper bound le is kept.
+func (r *histogramRule) keepBucket(le string) bool {
+	if r.DropBuckets {
+		return false
+	}
+	bound, err := strconv.ParseFloat(le, 64)
+	if err != nil {
+		// not ours to judge, leave it alone.
+		return true
+	}
+	if math.IsInf(bound, 1) {
+		return true
+	}
+	for _, b := range r.Buckets {
+		if b == bound {
+			return true
+		}
+	}
+	return false
+}
+
+// histogramReducer applies the first matching histogram rule to the bucket
+// samples of each family.
+type histogramReducer struct {
+	rules []histogramRule
+}
+
+func (h *histogramReducer) rewrite(l *line) bool {
+	switch {
+	case l.kind == lineType && l.rest == "histogram":
+		// a histogram needs at least the +Inf bucket.
+		if r := h.rule(l.family); r != nil && r.DropBuckets {
+			l.rest = "summary"
+		}
+	case l.kind == lineSample && l.name == l.family+"_bucket":
+		if r := h.rule(l.family); r != nil {
+			le, ok := getLabel(l.labels, "le")
+			return !ok || r.keepBucket(le)
+		}
+	}
+	return true
+}
+
+func (h *histogramReducer) rule(family string) *histogramRule {
+	for i := range h.rules {
+		if h.rules[i].re.MatchString(family) {
+			return &h.rules[i]
+		}
+	}
+	return nil
+}
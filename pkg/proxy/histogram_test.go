@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistogramRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    histogramRule
+		wantErr bool
+	}{
+		{"buckets", histogramRule{Metric: "etcd_.*", Buckets: []float64{0.1, 1}}, false},
+		{"drop buckets", histogramRule{Metric: "etcd_.*", DropBuckets: true}, false},
+		{"neither", histogramRule{Metric: "etcd_.*"}, true},
+		{"both", histogramRule{Metric: "etcd_.*", Buckets: []float64{1}, DropBuckets: true}, true},
+		{"invalid metric", histogramRule{Metric: "etcd_(", DropBuckets: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+const testHistogram = `# HELP etcd_disk_wal_fsync_duration_seconds The latency distributions of fsync called by WAL.
+# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.001"} 2
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.01"} 5
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.1"} 8
+etcd_disk_wal_fsync_duration_seconds_bucket{le="1"} 9
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf"} 9
+etcd_disk_wal_fsync_duration_seconds_sum 0.123
+etcd_disk_wal_fsync_duration_seconds_count 9
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+`
+
+func TestHistogramReducer(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []histogramRule
+		in    string
+		want  string
+	}{
+		{
+			name:  "keep buckets",
+			rules: []histogramRule{{Metric: "etcd_disk_.*", Buckets: []float64{0.01, 1}}},
+			in:    testHistogram,
+			want: `# HELP etcd_disk_wal_fsync_duration_seconds The latency distributions of fsync called by WAL.
+# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.01"} 5
+etcd_disk_wal_fsync_duration_seconds_bucket{le="1"} 9
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf"} 9
+etcd_disk_wal_fsync_duration_seconds_sum 0.123
+etcd_disk_wal_fsync_duration_seconds_count 9
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+`,
+		},
+		{
+			name:  "bounds are compared as numbers",
+			rules: []histogramRule{{Metric: "foo", Buckets: []float64{0.5}}},
+			in: `# TYPE foo histogram
+foo_bucket{le="0.50"} 1
+foo_bucket{le="5e-01"} 1
+foo_bucket{le="1"} 2
+foo_bucket{le="+Inf"} 2
+`,
+			want: `# TYPE foo histogram
+foo_bucket{le="0.50"} 1
+foo_bucket{le="5e-01"} 1
+foo_bucket{le="+Inf"} 2
+`,
+		},
+		{
+			name:  "drop buckets",
+			rules: []histogramRule{{Metric: "etcd_disk_.*", DropBuckets: true}},
+			in:    testHistogram,
+			want: `# HELP etcd_disk_wal_fsync_duration_seconds The latency distributions of fsync called by WAL.
+# TYPE etcd_disk_wal_fsync_duration_seconds summary
+etcd_disk_wal_fsync_duration_seconds_sum 0.123
+etcd_disk_wal_fsync_duration_seconds_count 9
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+`,
+		},
+		{
+			name: "first matching rule",
+			rules: []histogramRule{
+				{Metric: "etcd_disk_wal_.*", Buckets: []float64{0.1}},
+				{Metric: "etcd_.*", DropBuckets: true},
+			},
+			in: testHistogram,
+			want: `# HELP etcd_disk_wal_fsync_duration_seconds The latency distributions of fsync called by WAL.
+# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.1"} 8
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf"} 9
+etcd_disk_wal_fsync_duration_seconds_sum 0.123
+etcd_disk_wal_fsync_duration_seconds_count 9
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+`,
+		},
+		{
+			name:  "no matching rule",
+			rules: []histogramRule{{Metric: "grpc_.*", DropBuckets: true}},
+			in:    testHistogram,
+			want:  testHistogram,
+		},
+		{
+			name:  "unparseable bound is kept",
+			rules: []histogramRule{{Metric: "foo", Buckets: []float64{1}}},
+			in: `# TYPE foo histogram
+foo_bucket{le="soon"} 1
+foo_bucket{le="0.5"} 1
+foo_bucket{le="+Inf"} 2
+`,
+			want: `# TYPE foo histogram
+foo_bucket{le="soon"} 1
+foo_bucket{le="+Inf"} 2
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.rules {
+				if err := tt.rules[i].validate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			h := &histogramReducer{rules: tt.rules}
+			var b strings.Builder
+			if err := rewriteExposition(strings.NewReader(tt.in), &b, h.rewrite); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksMinRefresh rate limits refetching the JWKS for tokens signed with an
+// unknown key, e.g. right after the issuer rotated its keys.
+const jwksMinRefresh = 10 * time.Second
+
+// jwtLeeway is the clock skew allowed when checking exp, nbf and iat.
+const jwtLeeway = time.Minute
+
+// jwtAlgorithms are the accepted signature algorithms; the asymmetric ones,
+// as the keys come from a JWKS.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// jwtAuthenticator only passes requests carrying a bearer JWT signed by a
+// key of the JWKS, issued by issuer for audience and, if subjects is set,
+// to one of them. Other requests are answered with 401.
+type jwtAuthenticator struct {
+	next     http.Handler
+	keys     *jwksCache
+	issuer   string
+	audience string
+	subjects map[string]bool
+}
+
+func newJWTAuthenticator(next http.Handler, c *Config) *jwtAuthenticator {
+	a := &jwtAuthenticator{
+		next:     next,
+		keys:     &jwksCache{url: c.JWTJWKSURL, refresh: c.JWTJWKSRefreshInterval, client: &http.Client{Timeout: 10 * time.Second}},
+		issuer:   c.JWTIssuer,
+		audience: c.JWTAudience,
+	}
+	if len(c.JWTSubjects) > 0 {
+		a.subjects = map[string]bool{}
+		for _, s := range c.JWTSubjects {
+			a.subjects[s] = true
+		}
+	}
+	return a
+}
+
+func (a *jwtAuthenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || raw == "" {
+		a.reject(w, r, "missing", errors.New("no bearer token"))
+		return
+	}
+	claims, err := a.verify(r.Context(), strings.TrimSpace(raw))
+	if err != nil {
+		a.reject(w, r, "invalid", err)
+		return
+	}
+	noteIdentity(r.Context(), "jwt", claims.Subject, claims.Issuer)
+	a.next.ServeHTTP(w, r.WithContext(withScraperSubject(r.Context(), claims.Subject)))
+}
+
+func (a *jwtAuthenticator) reject(w http.ResponseWriter, r *http.Request, reason string, err error) {
+	jwtRejections.WithLabelValues(reason).Inc()
+	noteRejection(r.Context(), err.Error())
+	slog.Warn("rejected scrape without a valid token", "remote", r.RemoteAddr, "err", err)
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// verify checks the signature and claims of the token raw and returns the
+// claims.
+func (a *jwtAuthenticator) verify(ctx context.Context, raw string) (*jwt.Claims, error) {
+	tok, err := jwt.ParseSigned(raw, jwtAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("token must have exactly one signature")
+	}
+	key, err := a.keys.key(ctx, tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+	var claims jwt.Claims
+	if err := tok.Claims(key, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	expected := jwt.Expected{Issuer: a.issuer, AnyAudience: jwt.Audience{a.audience}, Time: time.Now()}
+	if err := claims.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return nil, err
+	}
+	if a.subjects != nil && !a.subjects[claims.Subject] {
+		return nil, fmt.Errorf("subject %q is not allowed", claims.Subject)
+	}
+	return &claims, nil
+}
+
+// jwksCache holds the keys of a JWKS URL, fetching them again after
+// refresh, or earlier for a key id it doesn't know. If a fetch fails the
+// keys fetched before stay in use. Concurrent requests share a fetch, which
+// is done without holding mu so that tokens signed with known keys are
+// verified meanwhile.
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+	group   singleflight.Group
+
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+func (c *jwksCache) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	c.mu.Lock()
+	stale := c.fetched.IsZero() || time.Since(c.fetched) > c.refresh
+	c.mu.Unlock()
+	if stale {
+		c.update(ctx)
+	}
+	c.mu.Lock()
+	key := c.lookup(kid)
+	unknown := key == nil && time.Since(c.fetched) > jwksMinRefresh
+	c.mu.Unlock()
+	if unknown {
+		c.update(ctx)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key == nil {
+		key = c.lookup(kid)
+	}
+	if key == nil {
+		if c.keys == nil {
+			return nil, fmt.Errorf("no keys fetched from %s yet", c.url)
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// lookup returns the key with id kid, or the only key when the token names
+// none. c.mu is held.
+func (c *jwksCache) lookup(kid string) *jose.JSONWebKey {
+	if c.keys == nil {
+		return nil
+	}
+	if kid == "" {
+		if len(c.keys.Keys) == 1 {
+			return &c.keys.Keys[0]
+		}
+		return nil
+	}
+	if keys := c.keys.Key(kid); len(keys) > 0 {
+		return &keys[0]
+	}
+	return nil
+}
+
+// update fetches the JWKS, or waits for the fetch in progress, until ctx is
+// done. The fetch isn't cancelled with ctx, as others may be waiting for it.
+func (c *jwksCache) update(ctx context.Context) {
+	done := c.group.DoChan("", func() (any, error) {
+		keys, err := c.fetch(context.WithoutCancel(ctx))
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// failures are retried no sooner than jwksMinRefresh either.
+		c.fetched = time.Now()
+		if err != nil {
+			jwksFetchFailures.Inc()
+			slog.Error("failed to fetch the jwks, keeping the current keys", "url", c.url, "err", err)
+			return nil, err
+		}
+		c.keys = keys
+		return nil, nil
+	})
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&keys); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// testIssuer signs tokens and serves its keys as a JWKS.
+type testIssuer struct {
+	t       *testing.T
+	server  *httptest.Server
+	fetches atomic.Int32
+	// block, if set, holds the JWKS responses until it is closed.
+	block chan struct{}
+
+	mu   sync.Mutex
+	keys map[string]*ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T, kids ...string) *testIssuer {
+	iss := &testIssuer{t: t, keys: map[string]*ecdsa.PrivateKey{}}
+	for _, kid := range kids {
+		iss.addKey(kid)
+	}
+	iss.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches.Add(1)
+		if iss.block != nil {
+			<-iss.block
+		}
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		var set jose.JSONWebKeySet
+		for kid, key := range iss.keys {
+			set.Keys = append(set.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(iss.server.Close)
+	return iss
+}
+
+func (iss *testIssuer) addKey(kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		iss.t.Fatal(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys[kid] = key
+}
+
+// token returns a token for claims signed with the key kid, which the JWKS
+// needn't serve.
+func (iss *testIssuer) token(kid string, claims jwt.Claims) string {
+	iss.mu.Lock()
+	key, ok := iss.keys[kid]
+	iss.mu.Unlock()
+	if !ok {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			iss.t.Fatal(err)
+		}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: kid}}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		iss.t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		iss.t.Fatal(err)
+	}
+	return raw
+}
+
+func (iss *testIssuer) config() *Config {
+	return &Config{
+		JWTJWKSURL:             iss.server.URL,
+		JWTJWKSRefreshInterval: time.Hour,
+		JWTIssuer:              "https://issuer.example.com",
+		JWTAudience:            "etcd-metrics-proxy",
+		JWTSubjects:            []string{"system:serviceaccount:monitoring:prometheus"},
+	}
+}
+
+func validClaims() jwt.Claims {
+	now := time.Now()
+	return jwt.Claims{
+		Issuer:   "https://issuer.example.com",
+		Audience: jwt.Audience{"etcd-metrics-proxy"},
+		Subject:  "system:serviceaccount:monitoring:prometheus",
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+}
+
+func serveWithToken(h http.Handler, token string) int {
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Code
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("etcd_server_has_leader 1\n"))
+})
+
+func TestJWTAuthenticator(t *testing.T) {
+	iss := newTestIssuer(t, "a")
+	a := newJWTAuthenticator(okHandler, iss.config())
+
+	claims := func(modify func(*jwt.Claims)) jwt.Claims {
+		c := validClaims()
+		modify(&c)
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", iss.token("a", validClaims()), http.StatusOK},
+		{"no token", "", http.StatusUnauthorized},
+		{"not a jwt", "not-a-token", http.StatusUnauthorized},
+		{"unknown key", iss.token("b", validClaims()), http.StatusUnauthorized},
+		{"wrong issuer", iss.token("a", claims(func(c *jwt.Claims) { c.Issuer = "https://other.example.com" })), http.StatusUnauthorized},
+		{"wrong audience", iss.token("a", claims(func(c *jwt.Claims) { c.Audience = jwt.Audience{"etcd"} })), http.StatusUnauthorized},
+		{"subject not allowed", iss.token("a", claims(func(c *jwt.Claims) { c.Subject = "system:serviceaccount:default:default" })), http.StatusUnauthorized},
+		{"expired", iss.token("a", claims(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-2 * jwtLeeway)) })), http.StatusUnauthorized},
+		{"expiry within the leeway", iss.token("a", claims(func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-jwtLeeway / 2)) })), http.StatusOK},
+		{"no expiry", iss.token("a", claims(func(c *jwt.Claims) { c.Expiry = nil })), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveWithToken(a, tt.token); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWKSCacheUnknownKey(t *testing.T) {
+	iss := newTestIssuer(t, "a")
+	a := newJWTAuthenticator(okHandler, iss.config())
+	if got := serveWithToken(a, iss.token("a", validClaims())); got != http.StatusOK {
+		t.Fatalf("got %d, want 200", got)
+	}
+
+	// tokens naming an unknown key refetch the keys at most every
+	// jwksMinRefresh.
+	iss.addKey("b")
+	for range 5 {
+		if got := serveWithToken(a, iss.token("b", validClaims())); got != http.StatusUnauthorized {
+			t.Errorf("got %d within jwksMinRefresh of the last fetch, want 401", got)
+		}
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Errorf("%d jwks fetches, want 1", n)
+	}
+
+	// once it passed, the rotated key is fetched.
+	a.keys.mu.Lock()
+	a.keys.fetched = time.Now().Add(-jwksMinRefresh - time.Second)
+	a.keys.mu.Unlock()
+	if got := serveWithToken(a, iss.token("b", validClaims())); got != http.StatusOK {
+		t.Errorf("got %d for a token signed with the rotated key, want 200", got)
+	}
+	if n := iss.fetches.Load(); n != 2 {
+		t.Errorf("%d jwks fetches, want 2", n)
+	}
+}
+
+func TestJWKSCacheSharesFetch(t *testing.T) {
+	iss := newTestIssuer(t, "a")
+	iss.block = make(chan struct{})
+	a := newJWTAuthenticator(okHandler, iss.config())
+	token := iss.token("a", validClaims())
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := serveWithToken(a, token); got != http.StatusOK {
+				t.Errorf("got %d, want 200", got)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(iss.block)
+	wg.Wait()
+	if n := iss.fetches.Load(); n != 1 {
+		t.Errorf("%d jwks fetches for concurrent scrapes, want 1", n)
+	}
+}
+
+func TestJWKSCacheFetchDoesNotBlockKnownKeys(t *testing.T) {
+	iss := newTestIssuer(t, "a")
+	a := newJWTAuthenticator(okHandler, iss.config())
+	token := iss.token("a", validClaims())
+	if got := serveWithToken(a, token); got != http.StatusOK {
+		t.Fatalf("got %d, want 200", got)
+	}
+
+	// a token naming an unknown key refetches the keys from a stuck jwks
+	// endpoint.
+	iss.block = make(chan struct{})
+	defer close(iss.block)
+	a.keys.mu.Lock()
+	a.keys.fetched = time.Now().Add(-jwksMinRefresh - time.Second)
+	a.keys.mu.Unlock()
+	go serveWithToken(a, iss.token("b", validClaims()))
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan int)
+	go func() { done <- serveWithToken(a, token) }()
+	select {
+	case got := <-done:
+		if got != http.StatusOK {
+			t.Errorf("got %d, want 200", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a token signed with a known key waited for the jwks fetch")
+	}
+}
+
+func TestAllowlistRunsBeforeJWT(t *testing.T) {
+	iss := newTestIssuer(t, "a")
+	c := DefaultConfig()
+	c.UpstreamURL = "http://127.0.0.1:2379/metrics"
+	c.AllowedCIDRs = []string{"10.0.0.0/8"}
+	c.JWTJWKSURL = iss.server.URL
+	c.JWTIssuer = "https://issuer.example.com"
+	c.JWTAudience = "etcd-metrics-proxy"
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.RemoteAddr = "192.0.2.1:41234"
+	r.Header.Set("Authorization", "Bearer "+iss.token("a", validClaims()))
+	rec := httptest.NewRecorder()
+	p.MetricsHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403", rec.Code)
+	}
+	if n := iss.fetches.Load(); n != 0 {
+		t.Errorf("a client outside --allowed-cidrs made the proxy fetch the jwks %d times", n)
+	}
+}
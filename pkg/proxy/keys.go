@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// loadClientCertificate reads the etcd client certificate and key, either
+// from --etcd-cert and --etcd-key or from the --etcd-pkcs12 bundle,
+// decrypting the key with --etcd-key-password-file when given.
+func loadClientCertificate(c *Config) (tls.Certificate, error) {
+	var password []byte
+	if c.EtcdKeyPasswordFile != "" {
+		data, err := os.ReadFile(c.EtcdKeyPasswordFile)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		password = bytes.TrimRight(data, "\r\n")
+	}
+	if c.EtcdPKCS12 != "" {
+		return loadPKCS12(c.EtcdPKCS12, password)
+	}
+
+	certPEM, err := os.ReadFile(c.EtcdCert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := os.ReadFile(c.EtcdKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if bytes.Contains(keyPEM, []byte("ENCRYPTED")) {
+		if password == nil {
+			return tls.Certificate{}, fmt.Errorf("%s is encrypted, set --etcd-key-password-file", c.EtcdKey)
+		}
+		if keyPEM, err = decryptKeyPEM(keyPEM, password); err != nil {
+			return tls.Certificate{}, fmt.Errorf("%s: %w", c.EtcdKey, err)
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// decryptKeyPEM returns the first private key in data as an unencrypted
+// PKCS#8 PEM block. Both PKCS#8 "ENCRYPTED PRIVATE KEY" blocks and legacy
+// OpenSSL encrypted PEM blocks are supported.
+func decryptKeyPEM(data, password []byte) ([]byte, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+		var der []byte
+		switch {
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, password)
+			if err != nil {
+				return nil, fmt.Errorf("decrypt key: %w", err)
+			}
+			if der, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+				return nil, err
+			}
+		case x509.IsEncryptedPEMBlock(block):
+			// legacy encryption, still produced by e.g. openssl rsa -aes256.
+			b, err := x509.DecryptPEMBlock(block, password)
+			if err != nil {
+				return nil, fmt.Errorf("decrypt key: %w", err)
+			}
+			key, err := parsePrivateKey(b)
+			if err != nil {
+				return nil, err
+			}
+			if der, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+}
+
+func parsePrivateKey(der []byte) (any, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
+
+// loadPKCS12 reads the client certificate, its key and any intermediate
+// certificates from a PKCS#12 bundle.
+func loadPKCS12(path string, password []byte) (tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, string(password))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", path, err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, ca := range chain {
+		cert.Certificate = append(cert.Certificate, ca.Raw)
+	}
+	return cert, nil
+}
+
+// clientCertFile is the file holding the client certificate.
+func (c *Config) clientCertFile() string {
+	if c.EtcdPKCS12 != "" {
+		return c.EtcdPKCS12
+	}
+	return c.EtcdCert
+}
+
+// clientFiles are the files the client certificate and key are read from.
+func (c *Config) clientFiles() []string {
+	files := []string{c.EtcdCert, c.EtcdKey}
+	if c.EtcdPKCS12 != "" {
+		files = []string{c.EtcdPKCS12}
+	}
+	if c.EtcdKeyPasswordFile != "" {
+		files = append(files, c.EtcdKeyPasswordFile)
+	}
+	return files
+}
+
+// readCertificates returns the certificates in path, a PEM file or the
+// --etcd-pkcs12 bundle.
+func readCertificates(c *Config, path string) ([]*x509.Certificate, error) {
+	if path != c.EtcdPKCS12 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parsePEMCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return certs, nil
+	}
+	cert, err := loadClientCertificate(c)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, der := range cert.Certificate {
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		certs = append(certs, parsed)
+	}
+	return certs, nil
+}
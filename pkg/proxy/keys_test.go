@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestLoadClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, cert, key, "client")
+	leaf := readTestCertificate(t, cert)
+	keyPEM, err := os.ReadFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	priv, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// a trailing newline, as most editors leave, isn't part of the password.
+	password := write("password", []byte("s3cret\n"))
+	wrongPassword := write("wrong-password", []byte("wrong"))
+
+	pkcs8DER, err := pkcs8.MarshalPrivateKey(priv, []byte("s3cret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8Key := write("pkcs8.key", pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: pkcs8DER}))
+	legacyBlock, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", block.Bytes, []byte("s3cret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyKey := write("legacy.key", pem.EncodeToMemory(legacyBlock))
+	bundle, err := pkcs12.Modern.Encode(priv, leaf, []*x509.Certificate{leaf}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12 := write("client.p12", bundle)
+
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantChain int
+		wantErr   string
+	}{
+		{name: "plain key", configure: func(c *Config) { c.EtcdCert, c.EtcdKey = cert, key }, wantChain: 1},
+		{name: "pkcs8 encrypted key", configure: func(c *Config) { c.EtcdCert, c.EtcdKey, c.EtcdKeyPasswordFile = cert, pkcs8Key, password }, wantChain: 1},
+		{name: "legacy encrypted key", configure: func(c *Config) { c.EtcdCert, c.EtcdKey, c.EtcdKeyPasswordFile = cert, legacyKey, password }, wantChain: 1},
+		{
+			name:      "encrypted key without a password",
+			configure: func(c *Config) { c.EtcdCert, c.EtcdKey = cert, pkcs8Key },
+			wantErr:   "is encrypted, set --etcd-key-password-file",
+		},
+		{
+			name:      "wrong password",
+			configure: func(c *Config) { c.EtcdCert, c.EtcdKey, c.EtcdKeyPasswordFile = cert, pkcs8Key, wrongPassword },
+			wantErr:   "decrypt key",
+		},
+		{name: "pkcs12 bundle with its chain", configure: func(c *Config) { c.EtcdPKCS12, c.EtcdKeyPasswordFile = p12, password }, wantChain: 2},
+		{
+			name:      "pkcs12 bundle with the wrong password",
+			configure: func(c *Config) { c.EtcdPKCS12, c.EtcdKeyPasswordFile = p12, wrongPassword },
+			wantErr:   "client.p12",
+		},
+		{
+			name:      "missing password file",
+			configure: func(c *Config) { c.EtcdPKCS12, c.EtcdKeyPasswordFile = p12, filepath.Join(dir, "missing") },
+			wantErr:   "no such file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.configure(&c)
+			got, err := loadClientCertificate(&c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadClientCertificate() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Certificate) != tt.wantChain {
+				t.Errorf("got %d certificates, want %d", len(got.Certificate), tt.wantChain)
+			}
+			if k, ok := got.PrivateKey.(*ecdsa.PrivateKey); !ok || !k.Equal(priv) {
+				t.Errorf("got key %T, want the client key", got.PrivateKey)
+			}
+			certs, err := readCertificates(&c, c.clientCertFile())
+			if err != nil || len(certs) == 0 || !certs[0].Equal(leaf) {
+				t.Errorf("readCertificates() = %v, %v, want the client certificate first", certs, err)
+			}
+		})
+	}
+}
+
+func TestClientFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		want      []string
+	}{
+		{"cert and key", func(c *Config) { c.EtcdCert, c.EtcdKey = "c.crt", "c.key" }, []string{"c.crt", "c.key"}},
+		{"with a password", func(c *Config) { c.EtcdCert, c.EtcdKey, c.EtcdKeyPasswordFile = "c.crt", "c.key", "pw" }, []string{"c.crt", "c.key", "pw"}},
+		{"pkcs12", func(c *Config) { c.EtcdPKCS12, c.EtcdKeyPasswordFile = "c.p12", "pw" }, []string{"c.p12", "pw"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.configure(&c)
+			if got := c.clientFiles(); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
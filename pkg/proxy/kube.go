@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal in-cluster Kubernetes API client authenticating
+// with the pod's service account.
+type kubeClient struct {
+	baseURL   string
+	client    *http.Client
+	tokenFile string
+}
+
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	capem, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(capem) {
+		return nil, errors.New("failed to add kubernetes ca to cert pool")
+	}
+	return &kubeClient{
+		baseURL: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		tokenFile: serviceAccountDir + "/token",
+	}, nil
+}
+
+// inClusterNamespace returns the namespace of the pod's service account.
+func inClusterNamespace() (string, error) {
+	ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// get decodes the JSON object at path into out.
+func (k *kubeClient) get(ctx context.Context, path string, query url.Values, out any) error {
+	resp, err := k.do(ctx, k.client, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream returns the body of a long running request such as a watch, which
+// isn't bound by the client timeout.
+func (k *kubeClient) stream(ctx context.Context, path string, query url.Values) (io.ReadCloser, error) {
+	client := *k.client
+	client.Timeout = 0
+	resp, err := k.do(ctx, &client, path, query)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// do sends a GET request for path, failing on any status but 200. The token
+// is re-read on every request, as projected service account tokens are
+// rotated.
+func (k *kubeClient) do(ctx context.Context, client *http.Client, path string, query url.Values) (*http.Response, error) {
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	u := k.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("kubernetes api %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
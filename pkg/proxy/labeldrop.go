@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// labelDropRule removes Labels from every sample of the families matching
+// Metric, an anchored regular expression. Samples left with the same name
+// and labels are merged into one, see sampleMerger.
+type labelDropRule struct {
+	Metric string   `yaml:"metric"`
+	Labels []string `yaml:"labels"`
+
+	re *regexp.Regexp
+}
+
+func (r *labelDropRule) validate() error {
+	res, err := compileAnchored([]string{r.Metric})
+	if err != nil {
+		return fmt.Errorf("invalid metric %q: %w", r.Metric, err)
+	}
+	r.re = res[0]
+	if len(r.Labels) == 0 {
+		return errors.New("no labels to drop")
+	}
+	for _, name := range r.Labels {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if name == "le" || name == "quantile" {
+			return fmt.Errorf("label %q can't be dropped", name)
+		}
+	}
+	return nil
+}
+
+// labelDropper applies every matching label drop rule to sample lines.
+type labelDropper struct {
+	rules []labelDropRule
+}
+
+func (d *labelDropper) rewrite(l *line) bool {
+	if l.kind != lineSample {
+		return true
+	}
+	for _, rule := range d.rules {
+		if !rule.re.MatchString(l.family) {
+			continue
+		}
+		for _, name := range rule.Labels {
+			l.labels = deleteLabel(l.labels, name)
+		}
+		l.merge = true
+	}
+	return true
+}
+
+// mergedSample is a sample and the number of samples merged into it.
+type mergedSample struct {
+	line  line
+	value float64
+	n     int
+}
+
+// sampleMerger merges the samples of a family marked for merging that have
+// the same name and labels. Counter, gauge, histogram and summary _sum and
+// _count values are summed; OpenMetrics _created timestamps take the
+// earliest. Summary quantiles can't be combined, so a quantile is dropped
+// once a second sample is merged into it. Timestamps and exemplars of merged
+// samples are dropped.
+//
+// Samples are buffered until the family ends, then written in the order
+// they were first seen.
+type sampleMerger struct {
+	family  string
+	keys    []string
+	samples map[string]*mergedSample
+}
+
+// add buffers l, reporting false if its value can't be parsed and it should
+// be written as is.
+func (m *sampleMerger) add(l line) bool {
+	value, ok := sampleValue(l.rest)
+	if !ok {
+		return false
+	}
+	if m.samples == nil {
+		m.samples = make(map[string]*mergedSample)
+	}
+	m.family = l.family
+	key := l.name
+	for _, lb := range l.labels {
+		key += "\xff" + lb.name + "\xff" + lb.value
+	}
+	s, ok := m.samples[key]
+	if !ok {
+		m.keys = append(m.keys, key)
+		m.samples[key] = &mergedSample{line: l, value: value, n: 1}
+		return true
+	}
+	s.n++
+	if l.name == l.family+"_created" {
+		s.value = math.Min(s.value, value)
+	} else {
+		s.value += value
+	}
+	return true
+}
+
+// pending reports whether samples are buffered.
+func (m *sampleMerger) pending() bool {
+	return len(m.keys) > 0
+}
+
+// flush writes the buffered samples to w.
+func (m *sampleMerger) flush(w lineWriter) error {
+	for _, key := range m.keys {
+		s := m.samples[key]
+		if s.n > 1 {
+			if _, quantile := getLabel(s.line.labels, "quantile"); quantile && s.line.name == s.line.family {
+				continue
+			}
+			s.line.rest = " " + strconv.FormatFloat(s.value, 'g', -1, 64)
+		}
+		if err := s.line.writeTo(w); err != nil {
+			return err
+		}
+	}
+	m.keys = m.keys[:0]
+	clear(m.samples)
+	return nil
+}
+
+// sampleValue parses the value at the start of the rest of a sample line.
+func sampleValue(rest string) (float64, bool) {
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	return v, err == nil
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelDropRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    labelDropRule
+		wantErr bool
+	}{
+		{"valid", labelDropRule{Metric: "grpc_.*", Labels: []string{"grpc_method"}}, false},
+		{"invalid metric", labelDropRule{Metric: "grpc_(", Labels: []string{"grpc_method"}}, true},
+		{"no labels", labelDropRule{Metric: "grpc_.*"}, true},
+		{"invalid label", labelDropRule{Metric: "grpc_.*", Labels: []string{"grpc-method"}}, true},
+		{"le", labelDropRule{Metric: "grpc_.*", Labels: []string{"le"}}, true},
+		{"quantile", labelDropRule{Metric: "grpc_.*", Labels: []string{"quantile"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLabelDropper(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []labelDropRule
+		in    string
+		want  string
+	}{
+		{
+			name:  "counter",
+			rules: []labelDropRule{{Metric: "grpc_server_handled_total", Labels: []string{"grpc_code"}}},
+			in: `# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_code="OK",grpc_method="Range"} 10
+grpc_server_handled_total{grpc_code="OK",grpc_method="Put"} 3
+grpc_server_handled_total{grpc_code="Unavailable",grpc_method="Range"} 2.5
+`,
+			want: `# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_method="Range"} 12.5
+grpc_server_handled_total{grpc_method="Put"} 3
+`,
+		},
+		{
+			name:  "gauge without remaining labels",
+			rules: []labelDropRule{{Metric: "etcd_.*", Labels: []string{"member"}}},
+			in: `# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader{member="a"} 1
+etcd_server_has_leader{member="b"} 1
+`,
+			want: `# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 2
+`,
+		},
+		{
+			name:  "histogram",
+			rules: []labelDropRule{{Metric: "etcd_disk_wal_fsync_duration_seconds", Labels: []string{"disk"}}},
+			in: `# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="a",le="0.001"} 2
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="a",le="+Inf"} 4
+etcd_disk_wal_fsync_duration_seconds_sum{disk="a"} 0.5
+etcd_disk_wal_fsync_duration_seconds_count{disk="a"} 4
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="b",le="0.001"} 1
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="b",le="+Inf"} 6
+etcd_disk_wal_fsync_duration_seconds_sum{disk="b"} 0.25
+etcd_disk_wal_fsync_duration_seconds_count{disk="b"} 6
+`,
+			want: `# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.001"} 3
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf"} 10
+etcd_disk_wal_fsync_duration_seconds_sum 0.75
+etcd_disk_wal_fsync_duration_seconds_count 10
+`,
+		},
+		{
+			name:  "openmetrics created takes the earliest",
+			rules: []labelDropRule{{Metric: "grpc_server_started", Labels: []string{"grpc_method"}}},
+			in: `# TYPE grpc_server_started counter
+grpc_server_started_total{grpc_method="Range"} 5
+grpc_server_started_created{grpc_method="Range"} 1700000100
+grpc_server_started_total{grpc_method="Put"} 1
+grpc_server_started_created{grpc_method="Put"} 1700000000
+# EOF
+`,
+			want: `# TYPE grpc_server_started counter
+grpc_server_started_total 6
+grpc_server_started_created 1.7e+09
+# EOF
+`,
+		},
+		{
+			name:  "summary quantiles can't be merged",
+			rules: []labelDropRule{{Metric: "go_gc_duration_seconds", Labels: []string{"instance"}}},
+			in: `# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{instance="a",quantile="0.5"} 0.001
+go_gc_duration_seconds{instance="b",quantile="0.5"} 0.003
+go_gc_duration_seconds{instance="a",quantile="0.9"} 0.002
+go_gc_duration_seconds_sum{instance="a"} 1
+go_gc_duration_seconds_sum{instance="b"} 2
+go_gc_duration_seconds_count{instance="a"} 10
+go_gc_duration_seconds_count{instance="b"} 20
+`,
+			// a quantile coming from a single sample is still exact.
+			want: `# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.9"} 0.002
+go_gc_duration_seconds_sum 3
+go_gc_duration_seconds_count 30
+`,
+		},
+		{
+			name:  "unparseable value is written as is",
+			rules: []labelDropRule{{Metric: "foo", Labels: []string{"a"}}},
+			in: `foo{a="1"} 1
+foo{a="2"} not-a-number
+foo{a="3"} 2
+`,
+			// ahead of the samples buffered for merging.
+			want: `foo not-a-number
+foo 3
+`,
+		},
+		{
+			name:  "timestamps and exemplars of merged samples are dropped",
+			rules: []labelDropRule{{Metric: "foo", Labels: []string{"a"}}},
+			in: `# TYPE foo histogram
+foo_bucket{a="1",le="+Inf"} 1 # {trace_id="x"} 0.1 1700000000
+foo_bucket{a="2",le="+Inf"} 2 1700000000000
+bar{a="1"} 7 1700000000000
+`,
+			want: `# TYPE foo histogram
+foo_bucket{le="+Inf"} 3
+bar{a="1"} 7 1700000000000
+`,
+		},
+		{
+			name:  "a single sample keeps its timestamp",
+			rules: []labelDropRule{{Metric: "foo", Labels: []string{"a"}}},
+			in: `foo{a="1"} 1 1700000000000
+`,
+			want: `foo 1 1700000000000
+`,
+		},
+		{
+			name:  "families are merged separately",
+			rules: []labelDropRule{{Metric: "foo|bar", Labels: []string{"a"}}},
+			in: `# TYPE foo gauge
+foo{a="1"} 1
+foo{a="2"} 2
+# TYPE bar gauge
+bar{a="1"} 3
+bar{a="2"} 4
+`,
+			want: `# TYPE foo gauge
+foo 3
+# TYPE bar gauge
+bar 7
+`,
+		},
+		{
+			name:  "other families are left alone",
+			rules: []labelDropRule{{Metric: "foo", Labels: []string{"a"}}},
+			in: `foobar{a="1"} 1
+foobar{a="2"} 2
+`,
+			want: `foobar{a="1"} 1
+foobar{a="2"} 2
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.rules {
+				if err := tt.rules[i].validate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := &labelDropper{rules: tt.rules}
+			var b strings.Builder
+			if err := rewriteExposition(strings.NewReader(tt.in), &b, d.rewrite); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// leaderLabel is added to every proxied series with --leader-label.
+const leaderLabel = "is_leader"
+
+// The labels added to every proxied series with --member-role-labels.
+const (
+	roleLabel       = "role"
+	memberIDLabel   = "member_id"
+	memberNameLabel = "member_name"
+)
+
+// leaderTracker periodically asks every upstream member whether it is the
+// raft leader, through the maintenance status endpoint of the etcd gRPC
+// gateway. With roles it also looks the members up in the cluster member
+// list, for their names and whether they are learners.
+type leaderTracker struct {
+	targets   *upstreamTargets
+	transport http.RoundTripper
+	scheme    string
+	timeout   time.Duration
+	interval  time.Duration
+	roles     bool
+
+	mu sync.RWMutex
+	// leader holds the last known leadership of each member address.
+	leader map[string]bool
+	// members holds the last known role of each member address.
+	members map[string]memberRole
+}
+
+// memberRole is the role of a member in the cluster: leader, follower or
+// learner.
+type memberRole struct {
+	role string
+	id   string
+	name string
+}
+
+// maintenanceStatus is the response of the maintenance status endpoint. The
+// gateway encodes 64 bit integers as strings.
+type maintenanceStatus struct {
+	Header struct {
+		MemberID string `json:"member_id"`
+	} `json:"header"`
+	Leader      string `json:"leader"`
+	IsLearner   bool   `json:"isLearner"`
+	DBSize      int64  `json:"dbSize,string"`
+	DBSizeInUse int64  `json:"dbSizeInUse,string"`
+}
+
+// status returns the maintenance status of the member at addr.
+func (t *leaderTracker) status(ctx context.Context, addr string) (maintenanceStatus, error) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	var status maintenanceStatus
+	err := postGateway(ctx, t.transport, t.scheme, addr, "/v3/maintenance/status", "{}", &status)
+	return status, err
+}
+
+// memberList returns the cluster member list as seen by the member at addr.
+func (t *leaderTracker) memberList(ctx context.Context, addr string) (memberList, error) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	var members memberList
+	err := postGateway(ctx, t.transport, t.scheme, addr, "/v3/cluster/member/list", "{}", &members)
+	return members, err
+}
+
+// isLeader reports whether status is that of the leader.
+func (s *maintenanceStatus) isLeader() bool {
+	// 0 means no leader.
+	leader, _ := strconv.ParseUint(s.Leader, 10, 64)
+	return leader != 0 && s.Leader == s.Header.MemberID
+}
+
+// refresh queries every member. A member that can't be queried keeps its
+// last known leadership and role.
+func (t *leaderTracker) refresh(ctx context.Context) {
+	addrs := t.targets.all()
+	results := make(map[string]bool, len(addrs))
+	statuses := make(map[string]maintenanceStatus, len(addrs))
+	for _, addr := range addrs {
+		status, err := t.status(ctx, addr)
+		if err != nil {
+			slog.Warn("failed to get leadership of etcd member", "endpoint", addr, "err", err)
+			t.mu.RLock()
+			known, ok := t.leader[addr]
+			t.mu.RUnlock()
+			if ok {
+				results[addr] = known
+			}
+			continue
+		}
+		results[addr] = status.isLeader()
+		statuses[addr] = status
+	}
+	var members map[string]memberRole
+	if t.roles {
+		members = t.refreshRoles(ctx, statuses)
+	}
+	t.mu.Lock()
+	for addr, isLeader := range results {
+		if t.leader[addr] != isLeader && isLeader {
+			slog.Info("etcd leader changed", "endpoint", addr)
+		}
+	}
+	t.leader = results
+	if t.roles {
+		t.members = members
+	}
+	t.mu.Unlock()
+}
+
+// refreshRoles works out the role of every member that answered with its
+// status, naming it after its entry in the member list of the first member
+// that returns one. Members whose status or entry is missing keep their
+// last known role.
+func (t *leaderTracker) refreshRoles(ctx context.Context, statuses map[string]maintenanceStatus) map[string]memberRole {
+	var list memberList
+	listed := false
+	for _, addr := range t.targets.all() {
+		if _, ok := statuses[addr]; !ok {
+			continue
+		}
+		var err error
+		if list, err = t.memberList(ctx, addr); err != nil {
+			slog.Warn("failed to get the member list of etcd member", "endpoint", addr, "err", err)
+			continue
+		}
+		listed = true
+		break
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	members := make(map[string]memberRole, len(t.members))
+	for _, addr := range t.targets.all() {
+		status, ok := statuses[addr]
+		if !ok || !listed {
+			if known, ok := t.members[addr]; ok {
+				members[addr] = known
+			}
+			continue
+		}
+		role := memberRole{role: "follower", id: memberID(status.Header.MemberID)}
+		for _, m := range list.Members {
+			if m.ID == status.Header.MemberID {
+				role.name = m.Name
+				if m.IsLearner {
+					role.role = "learner"
+				}
+			}
+		}
+		switch {
+		case status.isLeader():
+			role.role = "leader"
+		case status.IsLearner:
+			role.role = "learner"
+		}
+		if known, ok := t.members[addr]; ok && known.role != role.role {
+			slog.Info("etcd member role changed", "endpoint", addr, "member", role.name, "from", known.role, "to", role.role)
+		}
+		members[addr] = role
+	}
+	return members
+}
+
+// role returns the role of the member at addr when last checked, and
+// whether it is known at all.
+func (t *leaderTracker) role(addr string) (memberRole, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	role, known := t.members[addr]
+	return role, known
+}
+
+// isLeader reports whether addr was the leader when last checked, and
+// whether its leadership is known at all.
+func (t *leaderTracker) isLeader(addr string) (isLeader, known bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	isLeader, known = t.leader[addr]
+	return isLeader, known
+}
+
+// leaderAddr returns the address of the current leader, or "" if none is
+// known.
+func (t *leaderTracker) leaderAddr() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, addr := range t.targets.all() {
+		if t.leader[addr] {
+			return addr
+		}
+	}
+	return ""
+}
+
+// run refreshes the leadership every interval until ctx is done.
+func (t *leaderTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.refresh(ctx)
+		}
+	}
+}
+
+// leaderRewrite labels every sample with whether the member at addr is the
+// leader. It returns nil while the leadership of addr is unknown.
+func (t *leaderTracker) leaderRewrite(addr string) rewriteFunc {
+	isLeader, known := t.isLeader(addr)
+	if !known {
+		return nil
+	}
+	value := strconv.FormatBool(isLeader)
+	return func(l *line) bool {
+		if l.kind == lineSample {
+			l.labels = setLabel(l.labels, leaderLabel, value)
+		}
+		return true
+	}
+}
+
+// roleRewrite labels every sample with the role, id and name of the member
+// at addr. Labels a sample already has, such as the member_id of the
+// synthesized maintenance series, are kept. It returns nil while the role
+// of addr is unknown.
+func (t *leaderTracker) roleRewrite(addr string) rewriteFunc {
+	role, known := t.role(addr)
+	if !known {
+		return nil
+	}
+	labels := []label{{roleLabel, role.role}, {memberIDLabel, role.id}}
+	if role.name != "" {
+		labels = append(labels, label{memberNameLabel, role.name})
+	}
+	return func(l *line) bool {
+		if l.kind != lineSample {
+			return true
+		}
+		for _, lb := range labels {
+			if _, ok := getLabel(l.labels, lb.name); !ok {
+				l.labels = append(l.labels, lb)
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeCluster runs n members answering the maintenance status and member
+// list as members of one cluster, with leader as the leader id, and serving
+// metrics naming the member.
+type fakeCluster struct {
+	addrs []string
+	ids   []string
+	// leader is the member id the members report as leader, "0" for none.
+	leader atomic.Value
+	// failing is the index of a member whose status fails, or -1.
+	failing atomic.Int32
+	// learner is the index of the member that is a learner, or -1.
+	learner atomic.Int32
+}
+
+func newFakeCluster(t *testing.T, n int) *fakeCluster {
+	t.Helper()
+	fc := &fakeCluster{}
+	fc.leader.Store("0")
+	fc.failing.Store(-1)
+	fc.learner.Store(-1)
+	for i := range n {
+		id := fmt.Sprint(1000 + i)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v3/maintenance/status":
+				if fc.failing.Load() == int32(i) {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprintf(w, `{"header":{"member_id":%q},"leader":%q,"isLearner":%t}`, id, fc.leader.Load(), fc.learner.Load() == int32(i))
+			case "/v3/cluster/member/list":
+				var members []string
+				for j := range n {
+					members = append(members, fmt.Sprintf(`{"ID":"%d","name":"etcd-%d","isLearner":%t}`, 1000+j, j, fc.learner.Load() == int32(j)))
+				}
+				fmt.Fprintf(w, `{"members":[%s]}`, strings.Join(members, ","))
+			case "/metrics":
+				fmt.Fprintf(w, "etcd_server_has_leader{member=\"etcd-%d\"} 1\n", i)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		fc.addrs = append(fc.addrs, srv.Listener.Addr().String())
+		fc.ids = append(fc.ids, id)
+	}
+	t.Cleanup(func() { forgetEndpoints(fc.addrs) })
+	return fc
+}
+
+func TestMaintenanceStatusIsLeader(t *testing.T) {
+	tests := []struct {
+		name, memberID, leader string
+		want                   bool
+	}{
+		{"leader", "1000", "1000", true},
+		{"follower", "1000", "1001", false},
+		{"no leader", "0", "0", false},
+		{"missing leader", "1000", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s maintenanceStatus
+			s.Header.MemberID, s.Leader = tt.memberID, tt.leader
+			if got := s.isLeader(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaderTracker(t *testing.T) {
+	fc := newFakeCluster(t, 3)
+	tr := &leaderTracker{targets: newUpstreamTargets(fc.addrs...), transport: http.DefaultTransport, scheme: "http"}
+	if addr := tr.leaderAddr(); addr != "" {
+		t.Fatalf("got leader %s before the first refresh", addr)
+	}
+	tests := []struct {
+		name    string
+		leader  int
+		failing int
+		// wantLeader is the index of the known leader, or -1.
+		wantLeader int
+	}{
+		{name: "elected", leader: 1, failing: -1, wantLeader: 1},
+		{name: "moved", leader: 2, failing: -1, wantLeader: 2},
+		{name: "unreachable leader keeps its leadership", leader: 2, failing: 2, wantLeader: 2},
+		{name: "election", leader: -1, failing: -1, wantLeader: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc.leader.Store("0")
+			if tt.leader >= 0 {
+				fc.leader.Store(fc.ids[tt.leader])
+			}
+			fc.failing.Store(int32(tt.failing))
+			tr.refresh(context.Background())
+
+			want := ""
+			if tt.wantLeader >= 0 {
+				want = fc.addrs[tt.wantLeader]
+			}
+			if got := tr.leaderAddr(); got != want {
+				t.Errorf("got leader %q, want %q", got, want)
+			}
+			for i, addr := range fc.addrs {
+				if isLeader, known := tr.isLeader(addr); !known || isLeader != (i == tt.wantLeader) {
+					t.Errorf("member %d: leader %v, known %v", i, isLeader, known)
+				}
+			}
+		})
+	}
+}
+
+func TestMemberRoles(t *testing.T) {
+	fc := newFakeCluster(t, 3)
+	tr := &leaderTracker{targets: newUpstreamTargets(fc.addrs...), transport: http.DefaultTransport, scheme: "http", roles: true}
+	if _, known := tr.role(fc.addrs[0]); known {
+		t.Fatal("got a role before the first refresh")
+	}
+	tests := []struct {
+		name    string
+		leader  int
+		learner int
+		failing int
+		want    []string
+	}{
+		{name: "leader and followers", leader: 0, learner: -1, failing: -1, want: []string{"leader", "follower", "follower"}},
+		{name: "learner", leader: 0, learner: 2, failing: -1, want: []string{"leader", "follower", "learner"}},
+		{name: "promoted learner", leader: 2, learner: -1, failing: -1, want: []string{"follower", "follower", "leader"}},
+		{name: "unreachable member keeps its role", leader: 1, learner: -1, failing: 2, want: []string{"follower", "leader", "leader"}},
+		{name: "election", leader: -1, learner: -1, failing: -1, want: []string{"follower", "follower", "follower"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc.leader.Store("0")
+			if tt.leader >= 0 {
+				fc.leader.Store(fc.ids[tt.leader])
+			}
+			fc.learner.Store(int32(tt.learner))
+			fc.failing.Store(int32(tt.failing))
+			tr.refresh(context.Background())
+			for i, addr := range fc.addrs {
+				want := memberRole{role: tt.want[i], id: memberID(fc.ids[i]), name: fmt.Sprintf("etcd-%d", i)}
+				if got, known := tr.role(addr); !known || got != want {
+					t.Errorf("member %d: got %+v, known %v, want %+v", i, got, known, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleRewrite(t *testing.T) {
+	tr := &leaderTracker{members: map[string]memberRole{
+		"10.0.0.1:2379": {role: "leader", id: "3e8", name: "etcd-0"},
+		"10.0.0.2:2379": {role: "follower", id: "3e9"},
+	}}
+	tests := []struct {
+		name, addr, in, want string
+	}{
+		{"every label", "10.0.0.1:2379", "etcd_server_has_leader 1\n", "etcd_server_has_leader{role=\"leader\",member_id=\"3e8\",member_name=\"etcd-0\"} 1\n"},
+		{"without a name", "10.0.0.2:2379", "etcd_server_has_leader 1\n", "etcd_server_has_leader{role=\"follower\",member_id=\"3e9\"} 1\n"},
+		{
+			name: "labels of the sample are kept",
+			addr: "10.0.0.1:2379",
+			in:   "# TYPE etcd_maintenance_alarm_active gauge\netcd_maintenance_alarm_active{member_id=\"3e9\",alarm=\"NOSPACE\"} 1\n",
+			want: "# TYPE etcd_maintenance_alarm_active gauge\netcd_maintenance_alarm_active{member_id=\"3e9\",alarm=\"NOSPACE\",role=\"leader\",member_name=\"etcd-0\"} 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if err := rewriteExposition(strings.NewReader(tt.in), &out, tr.roleRewrite(tt.addr)); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+	if tr.roleRewrite("10.0.0.3:2379") != nil {
+		t.Error("got a rewrite for a member of unknown role")
+	}
+}
+
+func TestLeaderAwareScraping(t *testing.T) {
+	fc := newFakeCluster(t, 3)
+	fc.leader.Store(fc.ids[1])
+	tests := []struct {
+		name               string
+		label, only, roles bool
+		// refreshed is whether the leadership was checked before the scrape.
+		refreshed bool
+		want      string
+	}{
+		{name: "leader label on a follower", label: true, refreshed: true, want: `etcd_server_has_leader{member="etcd-0",is_leader="false"} 1`},
+		{name: "leader label before the first check", label: true, want: `etcd_server_has_leader{member="etcd-0"} 1`},
+		{name: "leader only", only: true, refreshed: true, want: `etcd_server_has_leader{member="etcd-1"} 1`},
+		{name: "leader only before the first check", only: true, want: `etcd_server_has_leader{member="etcd-0"} 1`},
+		{name: "leader only with the leader label", label: true, only: true, refreshed: true, want: `etcd_server_has_leader{member="etcd-1",is_leader="true"} 1`},
+		{name: "member role labels", roles: true, refreshed: true, want: `etcd_server_has_leader{member="etcd-0",role="follower",member_id="3e8",member_name="etcd-0"} 1`},
+		{name: "member role labels before the first check", roles: true, want: `etcd_server_has_leader{member="etcd-0"} 1`},
+		{
+			name:      "member role labels with the leader label",
+			label:     true,
+			only:      true,
+			roles:     true,
+			refreshed: true,
+			want:      `etcd_server_has_leader{member="etcd-1",is_leader="true",role="leader",member_id="3e9",member_name="etcd-1"} 1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme, c.UpstreamEndpoints = "http", fc.addrs
+			c.LeaderLabel, c.LeaderOnly, c.MemberRoleLabels = tt.label, tt.only, tt.roles
+			c.AccessLogFormat = "none"
+			p, err := NewProxy(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.refreshed {
+				p.leader.refresh(context.Background())
+			}
+			if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != http.StatusOK || rec.Body.String() != tt.want+"\n" {
+				t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
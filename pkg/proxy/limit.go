@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimited rejects requests beyond the token bucket limiter with 429.
+func rateLimited(next http.Handler, limiter *rate.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow() {
+			slog.Debug("rate limit exceeded", "remote", r.RemoteAddr)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		rps          float64
+		burst        int
+		requests     int
+		wantRejected int
+	}{
+		{name: "disabled", requests: 20},
+		{name: "within the burst", rps: 0.1, burst: 5, requests: 5},
+		{name: "beyond the burst", rps: 0.1, burst: 5, requests: 8, wantRejected: 3},
+		{name: "burst of one", rps: 0.1, burst: 1, requests: 4, wantRejected: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("etcd_server_has_leader 1\n"))
+			}), func(c *Config) {
+				c.MaxRequestsPerSecond = tt.rps
+				c.Burst = tt.burst
+			})
+			rejected := 0
+			for i := range tt.requests {
+				rec := getPath(p.Handler(), "/metrics")
+				switch rec.Code {
+				case http.StatusOK:
+					if rejected > 0 {
+						t.Errorf("request %d served after one was rejected", i)
+					}
+				case http.StatusTooManyRequests:
+					rejected++
+					if got := rec.Header().Get("Retry-After"); got != "1" {
+						t.Errorf("got Retry-After %q, want 1", got)
+					}
+				default:
+					t.Fatalf("request %d got %d", i, rec.Code)
+				}
+			}
+			if rejected != tt.wantRejected {
+				t.Errorf("%d requests rejected, want %d", rejected, tt.wantRejected)
+			}
+			// only scrapes are limited.
+			if rec := getPath(p.Handler(), "/healthz"); rec.Code == http.StatusTooManyRequests {
+				t.Error("/healthz was rate limited")
+			}
+		})
+	}
+}
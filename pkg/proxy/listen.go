@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// listen opens a listener for addr, which is either a tcp host:port or a
+// unix:///path socket. Tcp listeners get the tcp keepalive period of
+// --listen-keepalive and, with --listen-reuse-port, SO_REUSEPORT. A stale
+// socket left behind by a previous process is removed, and the socket file
+// mode is set to --listen-socket-mode.
+func listen(addr string, c *Config) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		lc := net.ListenConfig{KeepAlive: c.ListenKeepAlive}
+		if c.ListenReusePort {
+			lc.Control = func(_, _ string, conn syscall.RawConn) error {
+				var sockErr error
+				if err := conn.Control(func(fd uintptr) { sockErr = setReusePort(fd) }); err != nil {
+					return err
+				}
+				return sockErr
+			}
+		}
+		return lc.Listen(context.Background(), "tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, c.SocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// enableH2C makes srv accept HTTP/2 without tls next to HTTP/1.1, either by
+// prior knowledge or through an Upgrade: h2c request. Configuring the http2
+// server on srv lets Shutdown send GOAWAY on the h2c connections too.
+func enableH2C(srv *http.Server) error {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return err
+	}
+	srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	return nil
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// freeAddr returns a tcp address on host that is free to listen on.
+func freeAddr(t *testing.T, host string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", host, err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListenAddressFlag(t *testing.T) {
+	var c Config
+	set := flag.NewFlagSet("", flag.ContinueOnError)
+	RegisterFlags(set, &c)
+	if err := set.Parse([]string{"--listen-address=127.0.0.1:2381", "--listen-address=[::1]:2381"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(c.ListenAddresses, " "), "127.0.0.1:2381 [::1]:2381"; got != want {
+		t.Errorf("got listen addresses %q, want %q", got, want)
+	}
+}
+
+func TestRunListensOnEveryAddress(t *testing.T) {
+	v4, v6 := freeAddr(t, "127.0.0.1"), freeAddr(t, "::1")
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}), func(c *Config) {
+		c.ListenAddresses = []string{v4, v6, "unix://" + socket}
+	})
+	stop, errc := startRun(t, p, socket)
+	defer func() {
+		stop()
+		if err := <-errc; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	}()
+
+	for _, addr := range []string{v4, v6} {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			t.Errorf("scrape of %s: %v", addr, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "etcd_server_has_leader 1\n" {
+			t.Errorf("scrape of %s got %d %q, want the upstream metrics", addr, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		wantErr string
+	}{
+		{name: "new socket"},
+		{
+			name: "stale socket",
+			setup: func(t *testing.T, path string) {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// leaves the socket file behind, like a killed process.
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				l.Close()
+			},
+		},
+		{
+			name: "regular file",
+			setup: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "exists and is not a socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.sock")
+			if tt.setup != nil {
+				tt.setup(t, path)
+			}
+			l, err := listen("unix://"+path, &Config{SocketMode: 0o640})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("listen() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode()&fs.ModeSocket == 0 || fi.Mode().Perm() != 0o640 {
+				t.Errorf("got mode %v, want a socket with mode 0640", fi.Mode())
+			}
+		})
+	}
+}
+
+func TestUnixSocketUpstream(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "etcd.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	}))
+	upstream.Listener.Close()
+	upstream.Listener = l
+	upstream.Start()
+	defer upstream.Close()
+	defer forgetEndpoints([]string{"localhost"})
+
+	c := DefaultConfig()
+	c.UpstreamURL = "unix://" + socket
+	c.AccessLogFormat = "none"
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the socket path isn't sent as the request path.
+	rec := getPath(p.MetricsHandler(), "/metrics")
+	if want := "localhost /metrics"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	tests := []struct {
+		name      string
+		h2c       bool
+		http2     bool
+		wantProto int
+	}{
+		{name: "http/1.1", wantProto: 1},
+		{name: "prior knowledge without h2c", http2: true},
+		{name: "prior knowledge", h2c: true, http2: true, wantProto: 2},
+		{name: "http/1.1 with h2c", h2c: true, wantProto: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "proxy.sock")
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("etcd_server_has_leader 1\n"))
+			}), func(c *Config) {
+				c.ListenAddresses = []string{"unix://" + socket}
+				c.H2C = tt.h2c
+			})
+			stop, errc := startRun(t, p, socket)
+			defer func() {
+				stop()
+				if err := <-errc; err != nil {
+					t.Errorf("Run() = %v", err)
+				}
+			}()
+
+			client := unixClient(socket)
+			if tt.http2 {
+				client.Transport = &http2.Transport{
+					AllowHTTP: true,
+					DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+					},
+				}
+			}
+			resp, err := client.Get("http://proxy/metrics")
+			if tt.wantProto == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got %s, want the http/2 connection refused", resp.Proto)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != tt.wantProto {
+				t.Errorf("got %d over %s, want 200 over http/%d", resp.StatusCode, resp.Proto, tt.wantProto)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// postGateway sends a JSON request to an endpoint of the etcd gRPC gateway
+// on the member at addr and decodes the response into out.
+func postGateway(ctx context.Context, transport http.RoundTripper, scheme, addr, path, body string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+"://"+addr+path, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// maintenanceMetrics synthesizes series from the maintenance and cluster
+// APIs of the etcd gRPC gateway that the exposition format lacks: active
+// alarms, the size in use and fragmentation of the backend database and the
+// member list. Every member is queried on an interval in the background and
+// its last series are appended to the scrapes it serves, so scrapes don't
+// wait for the gateway.
+type maintenanceMetrics struct {
+	targets   *upstreamTargets
+	transport http.RoundTripper
+	scheme    string
+	timeout   time.Duration
+	interval  time.Duration
+
+	mu sync.RWMutex
+	// series holds the synthesized series of each member address, in the
+	// text format, from the last refresh that could query it.
+	series map[string][]byte
+}
+
+type maintenanceAlarms struct {
+	Alarms []struct {
+		MemberID string `json:"memberID"`
+		Alarm    string `json:"alarm"`
+	} `json:"alarms"`
+}
+
+type memberList struct {
+	Members []struct {
+		ID        string `json:"ID"`
+		Name      string `json:"name"`
+		IsLearner bool   `json:"isLearner"`
+	} `json:"members"`
+}
+
+// memberID formats a member id the way etcdctl prints it, in hex.
+func memberID(id string) string {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return id
+	}
+	return strconv.FormatUint(n, 16)
+}
+
+// write queries the member at addr and writes the synthesized series in the
+// text format to w.
+func (m *maintenanceMetrics) write(ctx context.Context, w io.Writer, addr string) error {
+	var status maintenanceStatus
+	if err := postGateway(ctx, m.transport, m.scheme, addr, "/v3/maintenance/status", "{}", &status); err != nil {
+		return err
+	}
+	var alarms maintenanceAlarms
+	if err := postGateway(ctx, m.transport, m.scheme, addr, "/v3/maintenance/alarm", `{"action":"GET"}`, &alarms); err != nil {
+		return err
+	}
+	var members memberList
+	if err := postGateway(ctx, m.transport, m.scheme, addr, "/v3/cluster/member/list", "{}", &members); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# HELP etcd_maintenance_db_size_bytes Size of the backend database of the member, as reported by the maintenance status.\n")
+	fmt.Fprintf(w, "# TYPE etcd_maintenance_db_size_bytes gauge\n")
+	fmt.Fprintf(w, "etcd_maintenance_db_size_bytes %d\n", status.DBSize)
+	fmt.Fprintf(w, "# HELP etcd_maintenance_db_size_in_use_bytes Size of the backend database of the member that is in use; the rest is reclaimed by a defragmentation.\n")
+	fmt.Fprintf(w, "# TYPE etcd_maintenance_db_size_in_use_bytes gauge\n")
+	fmt.Fprintf(w, "etcd_maintenance_db_size_in_use_bytes %d\n", status.DBSizeInUse)
+	var fragmentation float64
+	if status.DBSize > 0 && status.DBSizeInUse > 0 {
+		fragmentation = 1 - float64(status.DBSizeInUse)/float64(status.DBSize)
+	}
+	fmt.Fprintf(w, "# HELP etcd_maintenance_db_fragmentation_ratio Share of the backend database of the member that is not in use.\n")
+	fmt.Fprintf(w, "# TYPE etcd_maintenance_db_fragmentation_ratio gauge\n")
+	fmt.Fprintf(w, "etcd_maintenance_db_fragmentation_ratio %s\n", strconv.FormatFloat(fragmentation, 'g', -1, 64))
+
+	fmt.Fprintf(w, "# HELP etcd_maintenance_alarms Number of active alarms in the cluster.\n")
+	fmt.Fprintf(w, "# TYPE etcd_maintenance_alarms gauge\n")
+	fmt.Fprintf(w, "etcd_maintenance_alarms %d\n", len(alarms.Alarms))
+	fmt.Fprintf(w, "# HELP etcd_maintenance_alarm_active An active alarm, labeled by the member that raised it and the alarm type.\n")
+	fmt.Fprintf(w, "# TYPE etcd_maintenance_alarm_active gauge\n")
+	for _, a := range alarms.Alarms {
+		fmt.Fprintf(w, "etcd_maintenance_alarm_active{member_id=%q,alarm=%q} 1\n", memberID(a.MemberID), a.Alarm)
+	}
+
+	sort.Slice(members.Members, func(i, j int) bool { return members.Members[i].Name < members.Members[j].Name })
+	fmt.Fprintf(w, "# HELP etcd_cluster_members Number of members in the cluster, including learners.\n")
+	fmt.Fprintf(w, "# TYPE etcd_cluster_members gauge\n")
+	fmt.Fprintf(w, "etcd_cluster_members %d\n", len(members.Members))
+	fmt.Fprintf(w, "# HELP etcd_cluster_member_info A member of the cluster, labeled by its id, name and whether it is a learner.\n")
+	fmt.Fprintf(w, "# TYPE etcd_cluster_member_info gauge\n")
+	for _, member := range members.Members {
+		fmt.Fprintf(w, "etcd_cluster_member_info{member_id=%q,name=%q,learner=%q} 1\n", memberID(member.ID), member.Name, strconv.FormatBool(member.IsLearner))
+	}
+	return nil
+}
+
+// refresh queries every member. A member that can't be queried is served
+// without the series until it can again.
+func (m *maintenanceMetrics) refresh(ctx context.Context) {
+	addrs := m.targets.all()
+	series := make(map[string][]byte, len(addrs))
+	for _, addr := range addrs {
+		var b bytes.Buffer
+		if err := m.query(ctx, &b, addr); err != nil {
+			maintenanceFailures.Inc()
+			slog.Warn("failed to get maintenance metrics", "endpoint", addr, "err", err)
+			continue
+		}
+		series[addr] = b.Bytes()
+	}
+	m.mu.Lock()
+	m.series = series
+	m.mu.Unlock()
+}
+
+// query writes the series of the member at addr to w, within m.timeout.
+func (m *maintenanceMetrics) query(ctx context.Context, w io.Writer, addr string) error {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+	return m.write(ctx, w, addr)
+}
+
+// run refreshes the series every interval until ctx is done.
+func (m *maintenanceMetrics) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.refresh(ctx)
+		}
+	}
+}
+
+// appendTo adds the last series of the member at addr to the exposition in
+// buf, before the OpenMetrics "# EOF" terminator if there is one. Without
+// any, buf is left as is.
+func (m *maintenanceMetrics) appendTo(buf *bytes.Buffer, addr string) {
+	m.mu.RLock()
+	extra := m.series[addr]
+	m.mu.RUnlock()
+	if extra == nil {
+		return
+	}
+	eof := bytes.HasSuffix(buf.Bytes(), []byte("# EOF\n"))
+	if eof {
+		buf.Truncate(buf.Len() - len("# EOF\n"))
+	}
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.Write(extra)
+	if eof {
+		buf.WriteString("# EOF\n")
+	}
+}
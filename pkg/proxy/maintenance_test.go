@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeGateway answers the maintenance and cluster endpoints of the etcd
+// gRPC gateway like a member of a three member cluster with a NOSPACE alarm.
+func fakeGateway(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	responses := map[string]string{
+		"/v3/maintenance/status": `{"header":{"member_id":"10276657743932975437"},"leader":"10276657743932975437","dbSize":"4194304","dbSizeInUse":"1048576"}`,
+		"/v3/maintenance/alarm":  `{"alarms":[{"memberID":"10276657743932975437","alarm":"NOSPACE"}]}`,
+		"/v3/cluster/member/list": `{"members":[
+			{"ID":"10276657743932975437","name":"etcd-0"},
+			{"ID":"9372538179322589801","name":"etcd-2","isLearner":true},
+			{"ID":"10501334649042878790","name":"etcd-1"}]}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, ok := responses[r.URL.Path]
+		if !ok || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+const testMaintenanceSeries = `# HELP etcd_maintenance_db_size_bytes Size of the backend database of the member, as reported by the maintenance status.
+# TYPE etcd_maintenance_db_size_bytes gauge
+etcd_maintenance_db_size_bytes 4194304
+# HELP etcd_maintenance_db_size_in_use_bytes Size of the backend database of the member that is in use; the rest is reclaimed by a defragmentation.
+# TYPE etcd_maintenance_db_size_in_use_bytes gauge
+etcd_maintenance_db_size_in_use_bytes 1048576
+# HELP etcd_maintenance_db_fragmentation_ratio Share of the backend database of the member that is not in use.
+# TYPE etcd_maintenance_db_fragmentation_ratio gauge
+etcd_maintenance_db_fragmentation_ratio 0.75
+# HELP etcd_maintenance_alarms Number of active alarms in the cluster.
+# TYPE etcd_maintenance_alarms gauge
+etcd_maintenance_alarms 1
+# HELP etcd_maintenance_alarm_active An active alarm, labeled by the member that raised it and the alarm type.
+# TYPE etcd_maintenance_alarm_active gauge
+etcd_maintenance_alarm_active{member_id="8e9e05c52164694d",alarm="NOSPACE"} 1
+# HELP etcd_cluster_members Number of members in the cluster, including learners.
+# TYPE etcd_cluster_members gauge
+etcd_cluster_members 3
+# HELP etcd_cluster_member_info A member of the cluster, labeled by its id, name and whether it is a learner.
+# TYPE etcd_cluster_member_info gauge
+etcd_cluster_member_info{member_id="8e9e05c52164694d",name="etcd-0",learner="false"} 1
+etcd_cluster_member_info{member_id="91bc3c398fb3c146",name="etcd-1",learner="false"} 1
+etcd_cluster_member_info{member_id="8211f1d0f64f3269",name="etcd-2",learner="true"} 1
+`
+
+func TestMaintenanceMetrics(t *testing.T) {
+	var requests atomic.Int32
+	gw := fakeGateway(t, &requests)
+	addr := gw.Listener.Addr().String()
+	m := &maintenanceMetrics{targets: newUpstreamTargets(addr), transport: http.DefaultTransport, scheme: "http"}
+
+	buf := bytes.NewBufferString("etcd_server_has_leader 1\n")
+	m.appendTo(buf, addr)
+	if got := buf.String(); got != "etcd_server_has_leader 1\n" {
+		t.Errorf("series appended before the first refresh:\n%s", got)
+	}
+
+	m.refresh(context.Background())
+	tests := []struct {
+		name, in, want string
+	}{
+		{"text", "etcd_server_has_leader 1\n", "etcd_server_has_leader 1\n" + testMaintenanceSeries},
+		{"no trailing newline", "etcd_server_has_leader 1", "etcd_server_has_leader 1\n" + testMaintenanceSeries},
+		{"openmetrics", "etcd_server_has_leader 1\n# EOF\n", "etcd_server_has_leader 1\n" + testMaintenanceSeries + "# EOF\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBufferString(tt.in)
+			m.appendTo(buf, addr)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+	// scrapes are served the series of the last refresh.
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d gateway requests, want the 3 of the refresh", n)
+	}
+
+	// a member the scrape wasn't served by gets nothing.
+	buf = bytes.NewBufferString("etcd_server_has_leader 1\n")
+	m.appendTo(buf, "10.0.0.1:2379")
+	if strings.Contains(buf.String(), "etcd_maintenance") {
+		t.Errorf("series of another member appended:\n%s", buf.String())
+	}
+}
+
+func TestMaintenanceMetricsFailedRefresh(t *testing.T) {
+	var requests atomic.Int32
+	gw := fakeGateway(t, &requests)
+	addr := gw.Listener.Addr().String()
+	m := &maintenanceMetrics{targets: newUpstreamTargets(addr), transport: http.DefaultTransport, scheme: "http"}
+	m.refresh(context.Background())
+
+	gw.Close()
+	failures := testutil.ToFloat64(maintenanceFailures)
+	m.refresh(context.Background())
+	if got := testutil.ToFloat64(maintenanceFailures) - failures; got != 1 {
+		t.Errorf("%v failures counted, want 1", got)
+	}
+	buf := bytes.NewBufferString("etcd_server_has_leader 1\n")
+	m.appendTo(buf, addr)
+	if got := buf.String(); got != "etcd_server_has_leader 1\n" {
+		t.Errorf("series of a member that can't be queried appended:\n%s", got)
+	}
+}
@@ -0,0 +1,458 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsListenerMerger adds the series of etcd's dedicated metrics
+// listener (--listen-metrics-urls) to those of its client port. The
+// listeners share most series, but some only appear on one of them. The
+// listener is either at port on every member, reached with scheme or the
+// one probe detects, or, with discovery set, found from each member's
+// command line.
+type metricsListenerMerger struct {
+	transport http.RoundTripper
+	scheme    string
+	port      int
+	probe     *schemeProber
+	discovery *metricsListenerDiscovery
+}
+
+// mergeInto fetches the metrics listener of the member at addr, the one
+// that answered the scrape, and merges its series into the exposition in
+// buf. On failure buf is left as is, so the scrape still succeeds with the
+// client port's series.
+func (m *metricsListenerMerger) mergeInto(ctx context.Context, buf *bytes.Buffer, addr, accept string) {
+	u, err := m.url(ctx, addr)
+	if err == nil && u == "" {
+		// the member has no metrics listener.
+		return
+	}
+	var other []byte
+	if err == nil {
+		other, err = m.fetch(ctx, u, accept)
+		if m.probe != nil {
+			m.probe.result(m.listenerAddr(addr), err)
+		}
+	}
+	if err != nil {
+		metricsMergeFailures.Inc()
+		slog.Warn("failed to get the metrics of the etcd metrics listener", "endpoint", addr, "url", u, "err", err)
+		return
+	}
+	merged := mergeExpositions(buf.Bytes(), other)
+	buf.Reset()
+	buf.Write(merged)
+}
+
+// url returns the metrics url of the listener of the member at addr, or ""
+// if discovery found it has none.
+func (m *metricsListenerMerger) url(ctx context.Context, addr string) (string, error) {
+	if m.discovery != nil {
+		return m.discovery.url(ctx, addr)
+	}
+	scheme := m.scheme
+	if m.probe != nil {
+		var err error
+		if scheme, err = m.probe.scheme(ctx, m.listenerAddr(addr)); err != nil {
+			return "", err
+		}
+	}
+	return scheme + "://" + m.listenerAddr(addr) + "/metrics", nil
+}
+
+// listenerAddr is the address of the metrics listener of the member at
+// addr.
+func (m *metricsListenerMerger) listenerAddr(addr string) string {
+	return net.JoinHostPort(hostOf(addr), strconv.Itoa(m.port))
+}
+
+// forget drops what was probed or discovered about the metrics listeners of
+// addrs, which are no longer upstream targets.
+func (m *metricsListenerMerger) forget(addrs []string) {
+	if m == nil {
+		return
+	}
+	for _, addr := range addrs {
+		if m.probe != nil {
+			m.probe.mu.Lock()
+			delete(m.probe.schemes, m.listenerAddr(addr))
+			m.probe.mu.Unlock()
+		}
+		if m.discovery != nil {
+			m.discovery.mu.Lock()
+			delete(m.discovery.found, addr)
+			m.discovery.mu.Unlock()
+		}
+	}
+}
+
+// probeAll detects the scheme of the metrics listener of each member in
+// addrs ahead of their first scrape.
+func (m *metricsListenerMerger) probeAll(ctx context.Context, addrs []string) {
+	for _, addr := range addrs {
+		if _, err := m.probe.scheme(ctx, m.listenerAddr(addr)); err != nil {
+			slog.Warn("failed to probe the scheme of the etcd metrics listener", "endpoint", addr, "err", err)
+		}
+	}
+}
+
+// metricsSchemeReprobe is the number of consecutive failed fetches from a
+// metrics listener after which its scheme is probed again, e.g. after the
+// member was moved to tls.
+const metricsSchemeReprobe = 3
+
+// schemeProber detects whether a metrics listener speaks tls, for
+// --upstream-metrics-scheme=auto in fleets where some members still serve
+// their metrics listener over plain http.
+type schemeProber struct {
+	timeout time.Duration
+	// dial connects to the listener, through --upstream-proxy-url if set.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu      sync.Mutex
+	schemes map[string]*probedScheme
+}
+
+type probedScheme struct {
+	scheme   string
+	failures int
+}
+
+// scheme returns the scheme of the listener at addr, probing it unless a
+// previous probe still holds.
+func (s *schemeProber) scheme(ctx context.Context, addr string) (string, error) {
+	s.mu.Lock()
+	probed, ok := s.schemes[addr]
+	s.mu.Unlock()
+	if ok {
+		return probed.scheme, nil
+	}
+	scheme, err := probeScheme(ctx, s.dial, addr, s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("probing the scheme of %s: %w", addr, err)
+	}
+	slog.Info("probed the scheme of the etcd metrics listener", "addr", addr, "scheme", scheme)
+	s.mu.Lock()
+	if s.schemes == nil {
+		s.schemes = map[string]*probedScheme{}
+	}
+	s.schemes[addr] = &probedScheme{scheme: scheme}
+	s.mu.Unlock()
+	return scheme, nil
+}
+
+// result records whether a fetch from the listener at addr failed, and
+// forgets its scheme once it failed metricsSchemeReprobe times in a row.
+func (s *schemeProber) result(addr string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	probed, ok := s.schemes[addr]
+	if !ok {
+		return
+	}
+	if err == nil {
+		probed.failures = 0
+		return
+	}
+	if probed.failures++; probed.failures >= metricsSchemeReprobe {
+		delete(s.schemes, addr)
+		slog.Warn("etcd metrics listener keeps failing, probing its scheme again", "addr", addr, "scheme", probed.scheme)
+	}
+}
+
+// probeScheme starts a tls handshake with addr: a listener answering it
+// with anything but tls speaks plain http. The server certificate isn't
+// verified, only the protocol matters; the fetch verifies it.
+func probeScheme(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), addr string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	err = tc.HandshakeContext(ctx)
+	tc.Close()
+	if err == nil {
+		return "https", nil
+	}
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &recordErr):
+		return "http", nil
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, io.EOF):
+		return "", err
+	}
+	// the listener speaks tls but failed the handshake, e.g. without a
+	// client certificate.
+	return "https", nil
+}
+
+func (m *metricsListenerMerger) fetch(ctx context.Context, u, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the same format as the client port's answer, for the series to merge.
+	req.Header.Set("Accept", accept)
+	resp, err := m.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// hostOf returns the host of addr, or addr itself if it has no port.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// metricsListenerRediscover is how long the metrics listener found for a
+// member is used before its command line is read again, to follow changes
+// to the etcd manifest.
+const metricsListenerRediscover = 5 * time.Minute
+
+// metricsListenerDiscovery finds the metrics listener of a member from the
+// --listen-metrics-urls flag in the command line etcd publishes through
+// expvar on /debug/vars of its client port. A listener configured through
+// ETCD_LISTEN_METRICS_URLS isn't visible there.
+type metricsListenerDiscovery struct {
+	transport http.RoundTripper
+	scheme    string
+
+	mu    sync.Mutex
+	found map[string]discoveredListener
+}
+
+type discoveredListener struct {
+	url string
+	at  time.Time
+}
+
+func (d *metricsListenerDiscovery) url(ctx context.Context, addr string) (string, error) {
+	d.mu.Lock()
+	cached, ok := d.found[addr]
+	d.mu.Unlock()
+	if ok && time.Since(cached.at) < metricsListenerRediscover {
+		return cached.url, nil
+	}
+	args, err := d.cmdline(ctx, addr)
+	if err != nil {
+		// a listener found before stays in use.
+		if ok {
+			return cached.url, nil
+		}
+		return "", fmt.Errorf("reading the command line of %s: %w", addr, err)
+	}
+	u := metricsListenerURL(args, hostOf(addr))
+	if !ok || u != cached.url {
+		if u == "" {
+			slog.Info("etcd member has no metrics listener", "endpoint", addr)
+		} else {
+			slog.Info("discovered the etcd metrics listener", "endpoint", addr, "url", u)
+		}
+	}
+	d.mu.Lock()
+	if d.found == nil {
+		d.found = map[string]discoveredListener{}
+	}
+	d.found[addr] = discoveredListener{url: u, at: time.Now()}
+	d.mu.Unlock()
+	return u, nil
+}
+
+// cmdline fetches the command line of the member at addr.
+func (d *metricsListenerDiscovery) cmdline(ctx context.Context, addr string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.scheme+"://"+addr+"/debug/vars", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("/debug/vars returned %s", resp.Status)
+	}
+	var vars struct {
+		Cmdline []string `json:"cmdline"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&vars); err != nil {
+		return nil, err
+	}
+	if len(vars.Cmdline) == 0 {
+		return nil, errors.New("/debug/vars has no cmdline")
+	}
+	return vars.Cmdline, nil
+}
+
+// metricsListenerURL returns the metrics url of the --listen-metrics-urls
+// in args, preferring a listener on host, the host the member was reached
+// at. A listener on an unspecified address is reached at host too. It
+// returns "" if args have no such flag or only unix socket listeners.
+func metricsListenerURL(args []string, host string) string {
+	var value string
+	for i := 1; i < len(args); i++ {
+		name, v, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || name != "listen-metrics-urls" {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			v = args[i]
+		}
+		// the last one wins, as with flag parsing.
+		value = v
+	}
+	var candidates []*url.URL
+	for _, raw := range strings.Split(value, ",") {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Port() == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(u.Hostname()); u.Hostname() == "" || (err == nil && ip.IsUnspecified()) {
+			u.Host = net.JoinHostPort(host, u.Port())
+		}
+		if u.Hostname() == host {
+			return u.Scheme + "://" + u.Host + "/metrics"
+		}
+		candidates = append(candidates, u)
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].Scheme + "://" + candidates[0].Host + "/metrics"
+}
+
+// metricFamily is a metric family of an exposition: its HELP, TYPE, UNIT
+// and other comment lines, followed by its samples.
+type metricFamily struct {
+	name    string
+	meta    []line
+	samples []line
+}
+
+// parseFamilies splits an exposition into its families, in order, and
+// reports whether it ended with the OpenMetrics "# EOF" terminator.
+func parseFamilies(data []byte) ([]*metricFamily, bool) {
+	var families []*metricFamily
+	var cur *metricFamily
+	eof := false
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, len(data)+1)
+	for sc.Scan() {
+		l, err := parseLine(sc.Text())
+		if err != nil {
+			// kept verbatim with the family it appears in.
+			l = line{kind: lineComment, raw: sc.Text()}
+		}
+		switch l.kind {
+		case lineBlank:
+			continue
+		case lineEOF:
+			eof = true
+			continue
+		case lineHelp, lineType, lineUnit:
+			if cur == nil || cur.name != l.name {
+				cur = &metricFamily{name: l.name}
+				families = append(families, cur)
+			}
+			cur.meta = append(cur.meta, l)
+			continue
+		case lineSample:
+			current := ""
+			if cur != nil {
+				current = cur.name
+			}
+			if l.family = familyOf(l.name, current); cur == nil || l.family != cur.name {
+				cur = &metricFamily{name: l.family}
+				families = append(families, cur)
+			}
+			cur.samples = append(cur.samples, l)
+			continue
+		}
+		if cur == nil {
+			cur = &metricFamily{}
+			families = append(families, cur)
+		}
+		cur.meta = append(cur.meta, l)
+	}
+	return families, eof
+}
+
+// mergeExpositions merges the series of other into primary: samples of a
+// family both have are added unless primary already has the series, and
+// families only other has are appended. Where both differ, e.g. in the
+// HELP text or the value of a series, primary wins.
+func mergeExpositions(primary, other []byte) []byte {
+	families, eof := parseFamilies(primary)
+	byName := make(map[string]*metricFamily, len(families))
+	seen := map[string]bool{}
+	for _, f := range families {
+		if _, ok := byName[f.name]; !ok {
+			byName[f.name] = f
+		}
+		for _, s := range f.samples {
+			seen[s.name+"\x00"+seriesKey(s.labels, "")] = true
+		}
+	}
+	others, _ := parseFamilies(other)
+	for _, o := range others {
+		f, ok := byName[o.name]
+		if !ok {
+			families = append(families, o)
+			byName[o.name] = o
+			continue
+		}
+		for _, s := range o.samples {
+			key := s.name + "\x00" + seriesKey(s.labels, "")
+			if !seen[key] {
+				seen[key] = true
+				f.samples = append(f.samples, s)
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.Grow(len(primary) + len(other))
+	for _, f := range families {
+		for _, l := range f.meta {
+			l.writeTo(&b)
+		}
+		for _, l := range f.samples {
+			l.writeTo(&b)
+		}
+	}
+	if eof {
+		b.WriteString(eofLine)
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMergeExpositions(t *testing.T) {
+	tests := []struct {
+		name           string
+		primary, other string
+		want           string
+	}{
+		{
+			name: "families only the other has are appended",
+			primary: `# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+`,
+			other: `# HELP process_open_fds Number of open file descriptors.
+# TYPE process_open_fds gauge
+process_open_fds 42
+`,
+			want: `# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+# HELP process_open_fds Number of open file descriptors.
+# TYPE process_open_fds gauge
+process_open_fds 42
+`,
+		},
+		{
+			name: "series of a shared family are added",
+			primary: `# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_code="OK"} 42
+`,
+			other: `# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_code="OK"} 7
+grpc_server_handled_total{grpc_code="Unavailable"} 1
+`,
+			want: `# TYPE grpc_server_handled_total counter
+grpc_server_handled_total{grpc_code="OK"} 42
+grpc_server_handled_total{grpc_code="Unavailable"} 1
+`,
+		},
+		{
+			name:    "primary wins on the help text",
+			primary: "# HELP etcd_server_has_leader Whether or not a leader exists.\netcd_server_has_leader 1\n",
+			other:   "# HELP etcd_server_has_leader Leader.\netcd_server_has_leader 0\n",
+			want:    "# HELP etcd_server_has_leader Whether or not a leader exists.\netcd_server_has_leader 1\n",
+		},
+		{
+			name:    "openmetrics keeps a single eof at the end",
+			primary: "# TYPE etcd_server_has_leader gauge\netcd_server_has_leader 1\n# EOF\n",
+			other:   "# TYPE process_open_fds gauge\nprocess_open_fds 42\n# EOF\n",
+			want:    "# TYPE etcd_server_has_leader gauge\netcd_server_has_leader 1\n# TYPE process_open_fds gauge\nprocess_open_fds 42\n# EOF\n",
+		},
+		{
+			name:    "nothing to merge",
+			primary: "etcd_server_has_leader 1\n",
+			want:    "etcd_server_has_leader 1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(mergeExpositions([]byte(tt.primary), []byte(tt.other))); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsListenerMerge(t *testing.T) {
+	client := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	defer client.Close()
+	defer forgetEndpoints([]string{client.Listener.Addr().String()})
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("etcd_server_has_leader 1\nprocess_open_fds 42\n"))
+	}))
+	defer listener.Close()
+	_, listenerPort, _ := net.SplitHostPort(listener.Listener.Addr().String())
+	_, downPort, _ := net.SplitHostPort(freeAddr(t, "127.0.0.1"))
+
+	tests := []struct {
+		name         string
+		port         string
+		want         string
+		wantFailures float64
+	}{
+		{name: "merged", port: listenerPort, want: "etcd_server_has_leader 1\nprocess_open_fds 42\n"},
+		{name: "listener down", port: downPort, want: "etcd_server_has_leader 1\n", wantFailures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme, c.UpstreamEndpoints = "http", []string{client.Listener.Addr().String()}
+			c.UpstreamMetricsPort, _ = strconv.Atoi(tt.port)
+			c.AccessLogFormat = "none"
+			p, err := NewProxy(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failures := testutil.ToFloat64(metricsMergeFailures)
+			if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+				t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), tt.want)
+			}
+			if got := testutil.ToFloat64(metricsMergeFailures) - failures; got != tt.wantFailures {
+				t.Errorf("got %v merge failures, want %v", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestProbeScheme(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	withTLS := httptest.NewTLSServer(handler)
+	defer withTLS.Close()
+	mtls := httptest.NewUnstartedServer(handler)
+	mtls.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	mtls.StartTLS()
+	defer mtls.Close()
+
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{name: "http", addr: plain.Listener.Addr().String(), want: "http"},
+		{name: "https", addr: withTLS.Listener.Addr().String(), want: "https"},
+		{name: "https requiring a client certificate", addr: mtls.Listener.Addr().String(), want: "https"},
+		{name: "down", addr: freeAddr(t, "127.0.0.1"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := probeScheme(context.Background(), (&net.Dialer{}).DialContext, tt.addr, 5*time.Second)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("probeScheme() = %q, %v, want %q, an error: %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemeProber(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	s := &schemeProber{timeout: 5 * time.Second, dial: (&net.Dialer{}).DialContext}
+	if got, err := s.scheme(context.Background(), addr); err != nil || got != "http" {
+		t.Fatalf("scheme() = %q, %v, want http", got, err)
+	}
+	probed := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.schemes[addr]
+		return ok
+	}
+	// a success resets the failures, so only consecutive ones count.
+	fail := errors.New("connection reset")
+	for _, err := range []error{fail, fail, nil, fail, fail} {
+		s.result(addr, err)
+	}
+	if !probed() {
+		t.Fatal("the scheme was forgotten before failing consecutively")
+	}
+	s.result(addr, fail)
+	if probed() {
+		t.Error("the scheme is kept after failing consecutively")
+	}
+	if _, err := s.scheme(context.Background(), freeAddr(t, "127.0.0.1")); err == nil || !strings.Contains(err.Error(), "probing the scheme of") {
+		t.Errorf("scheme() = %v, want an error containing %q", err, "probing the scheme of")
+	}
+}
+
+func TestMetricsListenerAutoScheme(t *testing.T) {
+	client := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	defer client.Close()
+	defer forgetEndpoints([]string{client.Listener.Addr().String()})
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("process_open_fds 42\n"))
+	}))
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Listener.Addr().String())
+
+	c := DefaultConfig()
+	c.UpstreamScheme, c.UpstreamEndpoints = "http", []string{client.Listener.Addr().String()}
+	c.UpstreamMetricsPort, _ = strconv.Atoi(port)
+	c.UpstreamMetricsScheme = "auto"
+	c.AccessLogFormat = "none"
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.metricsListener.probeAll(context.Background(), p.targets.all())
+	if got, err := p.metricsListener.url(context.Background(), client.Listener.Addr().String()); err != nil || got != listener.URL+"/metrics" {
+		t.Errorf("url() = %q, %v, want %q", got, err, listener.URL+"/metrics")
+	}
+	if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Body.String() != "etcd_server_has_leader 1\nprocess_open_fds 42\n" {
+		t.Errorf("got %d %q, want the series of both listeners", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMetricsListenerURL(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "flag with a value",
+			args: []string{"etcd", "--name=etcd-0", "--listen-metrics-urls=http://10.0.0.1:2381"},
+			want: "http://10.0.0.1:2381/metrics",
+		},
+		{
+			name: "value in the next argument",
+			args: []string{"etcd", "-listen-metrics-urls", "https://10.0.0.1:2381"},
+			want: "https://10.0.0.1:2381/metrics",
+		},
+		{
+			name: "prefers the listener on the host the member was reached at",
+			args: []string{"etcd", "--listen-metrics-urls=http://127.0.0.1:2381,http://10.0.0.1:2381"},
+			want: "http://10.0.0.1:2381/metrics",
+		},
+		{
+			name: "falls back to the first listener",
+			args: []string{"etcd", "--listen-metrics-urls=http://127.0.0.1:2381,http://192.0.2.1:2381"},
+			want: "http://127.0.0.1:2381/metrics",
+		},
+		{
+			name: "unspecified address",
+			args: []string{"etcd", "--listen-metrics-urls=http://0.0.0.0:2381"},
+			want: "http://10.0.0.1:2381/metrics",
+		},
+		{
+			name: "the last flag wins",
+			args: []string{"etcd", "--listen-metrics-urls=http://10.0.0.1:2381", "--listen-metrics-urls=http://10.0.0.1:2382"},
+			want: "http://10.0.0.1:2382/metrics",
+		},
+		{name: "unix socket listener", args: []string{"etcd", "--listen-metrics-urls=unix://localhost:2381"}},
+		{name: "no listener", args: []string{"etcd", "--listen-client-urls=https://10.0.0.1:2379"}},
+		{name: "value of another flag", args: []string{"etcd", "--name", "--listen-metrics-urls=http://10.0.0.1:2381"}, want: "http://10.0.0.1:2381/metrics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metricsListenerURL(tt.args, "10.0.0.1"); got != tt.want {
+				t.Errorf("metricsListenerURL(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsListenerDiscovery(t *testing.T) {
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("process_open_fds 42\n"))
+	}))
+	defer listener.Close()
+	var fail atomic.Bool
+	var reads atomic.Int32
+	client := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debug/vars" {
+			w.Write([]byte("etcd_server_has_leader 1\n"))
+			return
+		}
+		reads.Add(1)
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"cmdline": []string{"etcd", "--listen-metrics-urls=" + listener.URL}})
+	}))
+	defer client.Close()
+	addr := client.Listener.Addr().String()
+	defer forgetEndpoints([]string{addr})
+
+	c := DefaultConfig()
+	c.UpstreamScheme, c.UpstreamEndpoints = "http", []string{addr}
+	c.UpstreamMetricsDiscover = true
+	c.AccessLogFormat = "none"
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Body.String() != "etcd_server_has_leader 1\nprocess_open_fds 42\n" {
+			t.Errorf("got %d %q, want the series of both listeners", rec.Code, rec.Body.String())
+		}
+	}
+	if n := reads.Load(); n != 1 {
+		t.Errorf("read the command line %d times, want it cached", n)
+	}
+
+	// a listener found before stays in use when the command line can't be
+	// read again.
+	d := p.metricsListener.discovery
+	d.mu.Lock()
+	d.found[addr] = discoveredListener{url: d.found[addr].url, at: time.Now().Add(-metricsListenerRediscover)}
+	d.mu.Unlock()
+	fail.Store(true)
+	if u, err := d.url(context.Background(), addr); err != nil || u != listener.URL+"/metrics" {
+		t.Errorf("url() = %q, %v, want %q", u, err, listener.URL+"/metrics")
+	}
+	if n := reads.Load(); n != 2 {
+		t.Errorf("read the command line %d times, want it read again once stale", n)
+	}
+	p.metricsListener.forget([]string{addr})
+	if _, err := d.url(context.Background(), addr); err == nil || !strings.Contains(err.Error(), "/debug/vars returned 503") {
+		t.Errorf("url() = %v, want an error containing %q", err, "/debug/vars returned 503")
+	}
+}
+
+func TestMetricsListenerFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "port", configure: func(c *Config) { c.UpstreamMetricsPort = 2381 }},
+		{name: "port and scheme", configure: func(c *Config) { c.UpstreamMetricsPort, c.UpstreamMetricsScheme = 2381, "http" }},
+		{name: "invalid port", configure: func(c *Config) { c.UpstreamMetricsPort = 65536 }, wantErr: "invalid --upstream-metrics-port 65536"},
+		{
+			name:      "with a unix socket upstream",
+			configure: func(c *Config) { c.UpstreamMetricsPort, c.UpstreamURL = 2381, "unix:///run/etcd.sock" },
+			wantErr:   "--upstream-metrics-port can't be used with a unix socket --upstream-url",
+		},
+		{
+			name:      "invalid scheme",
+			configure: func(c *Config) { c.UpstreamMetricsPort, c.UpstreamMetricsScheme = 2381, "unix" },
+			wantErr:   `--upstream-metrics-scheme must be http, https or auto, got "unix"`,
+		},
+		{name: "auto scheme", configure: func(c *Config) { c.UpstreamMetricsPort, c.UpstreamMetricsScheme = 2381, "auto" }},
+		{name: "discover", configure: func(c *Config) { c.UpstreamMetricsDiscover = true }},
+		{
+			name:      "discover and port",
+			configure: func(c *Config) { c.UpstreamMetricsDiscover, c.UpstreamMetricsPort = true, 2381 },
+			wantErr:   "--upstream-metrics-discover and --upstream-metrics-port are mutually exclusive",
+		},
+		{
+			name:      "discover with a unix socket upstream",
+			configure: func(c *Config) { c.UpstreamMetricsDiscover, c.UpstreamURL = true, "unix:///run/etcd.sock" },
+			wantErr:   "--upstream-metrics-discover can't be used with a unix socket --upstream-url",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			tt.configure(&c)
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
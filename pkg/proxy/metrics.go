@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/openinsight-proj/etcd-metrics-proxy/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// selfRegistry holds the proxy's own metrics, kept apart from the proxied
+// etcd metrics.
+var selfRegistry = prometheus.NewRegistry()
+
+var (
+	tlsReloadAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_tls_reload_attempts_total",
+		Help: "Number of attempts to reload the etcd tls material, by cluster.",
+	}, []string{"cluster"})
+	tlsReloadSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_tls_reload_successes_total",
+		Help: "Number of successful reloads of the etcd tls material, by cluster.",
+	}, []string{"cluster"})
+	tlsReloadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_tls_reload_failures_total",
+		Help: "Number of failed reloads of the etcd tls material, by cluster.",
+	}, []string{"cluster"})
+	tlsLastSuccessfulReload = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_metrics_proxy_tls_last_successful_reload_timestamp_seconds",
+		Help: "Unix time the etcd tls material of the cluster was last loaded successfully, including at startup.",
+	}, []string{"cluster"})
+	tlsWatcherRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_tls_watcher_restarts_total",
+		Help: "Number of times the tls file watcher of the cluster failed and was recreated.",
+	}, []string{"cluster"})
+	certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_metrics_proxy_cert_expiry_timestamp_seconds",
+		Help: "Unix time the earliest expiring certificate in each loaded tls file expires.",
+	}, []string{"file"})
+	tlsHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_upstream_tls_handshakes_total",
+		Help: "Number of tls handshakes with the upstream by result: full, resumed or failed.",
+	}, []string{"result"})
+	tlsHandshakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "etcd_metrics_proxy_upstream_tls_handshake_duration_seconds",
+		Help:    "Duration of successful tls handshakes with the upstream, full or resumed.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"result"})
+	revocationChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_upstream_revocation_checks_total",
+		Help: "Number of revocation checks of the upstream certificate by method, crl or ocsp, and result: good, revoked or unknown.",
+	}, []string{"method", "result"})
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_upstream_retries_total",
+		Help: "Number of upstream requests retried after failing on every endpoint, by error class.",
+	}, []string{"class"})
+	upstreamAborted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_upstream_requests_aborted_total",
+		Help: "Number of upstream requests abandoned because the scraper went away (reason=\"cancelled\") or --upstream-timeout passed (reason=\"deadline\").",
+	}, []string{"reason"})
+	snapshotFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_snapshot_failures_total",
+		Help: "Number of background scrapes with --background-scrape-interval that failed, keeping the previous snapshot.",
+	})
+	snapshotAges = &snapshotAgeCollector{desc: prometheus.NewDesc(
+		"etcd_metrics_proxy_snapshot_age_seconds",
+		"Age of the snapshot served with --background-scrape-interval, by cluster, pinned member and exposition format.",
+		[]string{"cluster", "member", "format"}, nil,
+	)}
+	metricsMergeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_metrics_listener_failures_total",
+		Help: "Number of scrapes served without the series of --upstream-metrics-port because fetching them failed.",
+	})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "etcd_metrics_proxy_upstream_request_duration_seconds",
+		Help:    "Duration of upstream requests, until the response headers arrived or the request failed, by endpoint.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"endpoint"})
+	upstreamFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_upstream_failures_total",
+		Help: "Number of failed upstream requests by endpoint and class: dns, connect, tls, timeout, reset, 5xx or other.",
+	}, []string{"endpoint", "class"})
+	upstreamConnsOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "etcd_metrics_proxy_upstream_connections_open",
+		Help: "Number of open connections to the upstream endpoints.",
+	})
+	upstreamConnsIdle = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "etcd_metrics_proxy_upstream_connections_idle",
+		Help: "Number of open upstream connections idle in the pool, waiting to be reused.",
+	})
+	expositionValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_exposition_validation_failures_total",
+		Help: "Number of malformed upstream expositions found by --validate-exposition, by the first problem: truncated, malformed or missing_eof.",
+	}, []string{"reason"})
+	scraperRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_scraper_requests_total",
+		Help: "Number of /metrics requests by scraper and status code, with --scraper-metrics.",
+	}, []string{"scraper", "code"})
+	scraperBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_scraper_response_bytes_total",
+		Help: "Number of /metrics response bytes served by scraper, with --scraper-metrics.",
+	}, []string{"scraper"})
+	scraperQuotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_scraper_quota_rejections_total",
+		Help: "Number of /metrics requests rejected for exceeding --scraper-requests-per-second, by scraper.",
+	}, []string{"scraper"})
+	jwtRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_jwt_rejections_total",
+		Help: "Number of scrapes rejected for a missing or invalid JWT.",
+	}, []string{"reason"})
+	jwksFetchFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_jwks_fetch_failures_total",
+		Help: "Number of failed fetches of --jwt-jwks-url.",
+	})
+	circuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_metrics_proxy_circuit_breaker_state",
+		Help: "State of the circuit breaker of the upstream endpoint: 0 closed, 1 half-open, 2 open.",
+	}, []string{"endpoint"})
+	upstreamResponsesTooLarge = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_upstream_responses_too_large_total",
+		Help: "Number of upstream responses rejected for exceeding --max-response-bytes.",
+	})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_metrics_proxy_build_info",
+		Help: "A metric with a constant '1' value labeled by the version, commit, build date and go version of the proxy.",
+	}, []string{"version", "commit", "build_date", "goversion"})
+	memberHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_member_healthy",
+		Help: "Whether the /health endpoint of the upstream member reported it healthy in the last --member-health-interval probe.",
+	}, []string{"endpoint"})
+	memberProbeDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_member_health_probe_duration_seconds",
+		Help: "Duration of the last health probe of the upstream member.",
+	}, []string{"endpoint"})
+	maintenanceFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_maintenance_failures_total",
+		Help: "Number of times the --maintenance-metrics series of a member could not be queried from the etcd gateway.",
+	})
+	remoteWriteSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_remote_write_samples_total",
+		Help: "Number of samples sent to the --remote-write-url.",
+	})
+	remoteWriteFailedSamples = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "etcd_metrics_proxy_remote_write_failed_samples_total",
+		Help: "Number of samples that could not be sent to the --remote-write-url.",
+	})
+)
+
+func init() {
+	selfRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		tlsReloadAttempts,
+		tlsReloadSuccesses,
+		tlsReloadFailures,
+		tlsLastSuccessfulReload,
+		tlsWatcherRestarts,
+		certExpiry,
+		upstreamResponsesTooLarge,
+		upstreamRetries,
+		upstreamAborted,
+		jwtRejections,
+		jwksFetchFailures,
+		circuitBreakerState,
+		maintenanceFailures,
+		metricsMergeFailures,
+		snapshotFailures,
+		snapshotAges,
+		expositionValidationFailures,
+		upstreamDuration,
+		revocationChecks,
+		tlsHandshakes,
+		scraperRequests,
+		scraperBytes,
+		scraperQuotaRejections,
+		tlsHandshakeDuration,
+		upstreamFailures,
+		upstreamConnsOpen,
+		upstreamConnsIdle,
+		memberHealthy,
+		memberProbeDuration,
+		remoteWriteSamples,
+		remoteWriteFailedSamples,
+		buildInfo,
+	)
+	info := version.Get()
+	buildInfo.WithLabelValues(info.Version, info.Commit, info.BuildDate, info.GoVersion).Set(1)
+}
+
+// initTLSReloadMetrics exports the tls reload counters of cluster from
+// startup, so its first failed reload shows as an increase.
+func initTLSReloadMetrics(cluster string) {
+	for _, m := range []*prometheus.CounterVec{tlsReloadAttempts, tlsReloadSuccesses, tlsReloadFailures, tlsWatcherRestarts} {
+		m.WithLabelValues(cluster)
+	}
+}
+
+// selfMetricsHandler serves the proxy's own metrics.
+func selfMetricsHandler() http.Handler {
+	return promhttp.HandlerFor(selfRegistry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpExporter periodically scrapes the proxied metrics, converts them to
+// OTLP and pushes them to an OpenTelemetry collector over http or grpc.
+type otlpExporter struct {
+	endpoint string
+	protocol string
+	interval time.Duration
+
+	source http.Handler
+	client *http.Client
+	grpc   collectorpb.MetricsServiceClient
+	// conn is the connection of the grpc client, closed once run returns.
+	conn *grpc.ClientConn
+	// start is reported as the start time of cumulative points, since the
+	// exposition format doesn't carry one.
+	start time.Time
+}
+
+func newOTLPExporter(endpoint, protocol string, interval time.Duration, source http.Handler) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q, must be an http or https url", endpoint)
+	}
+	e := &otlpExporter{protocol: protocol, interval: interval, source: source, start: time.Now()}
+	switch protocol {
+	case "http":
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		e.endpoint = u.String()
+		e.client = &http.Client{}
+	case "grpc":
+		creds := insecure.NewCredentials()
+		if u.Scheme == "https" {
+			creds = credentials.NewTLS(&tls.Config{})
+		}
+		conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		e.endpoint = u.Host
+		e.conn, e.grpc = conn, collectorpb.NewMetricsServiceClient(conn)
+	default:
+		return nil, fmt.Errorf("invalid protocol %q, must be http or grpc", protocol)
+	}
+	return e, nil
+}
+
+func (e *otlpExporter) run(ctx context.Context) {
+	if e.conn != nil {
+		defer e.conn.Close()
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		if err := e.export(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("otlp metrics export failed", "endpoint", e.endpoint, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *otlpExporter) export(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, e.interval)
+	defer cancel()
+	samples, err := scrapeSamples(ctx, e.source)
+	if err != nil {
+		return fmt.Errorf("scrape: %w", err)
+	}
+	req := &collectorpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", "etcd-metrics-proxy")}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: tracerName},
+				Metrics: toOTLPMetrics(samples, e.start),
+			}},
+		}},
+	}
+	if e.grpc != nil {
+		_, err := e.grpc.Export(ctx, req)
+		return err
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// toOTLPMetrics converts scraped samples to OTLP metrics, one per family:
+// counters become monotonic cumulative sums, gauges and untyped families
+// gauges, and histograms and summaries are reassembled from their series.
+func toOTLPMetrics(samples []sample, start time.Time) []*metricspb.Metric {
+	var metrics []*metricspb.Metric
+	byFamily := map[string]*metricspb.Metric{}
+	histograms := map[string]*metricspb.HistogramDataPoint{}
+	summaries := map[string]*metricspb.SummaryDataPoint{}
+	startNano := uint64(start.UnixNano())
+
+	for _, s := range samples {
+		m, ok := byFamily[s.family]
+		if !ok {
+			m = &metricspb.Metric{Name: s.family, Description: s.help}
+			switch s.typ {
+			case "counter":
+				m.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					IsMonotonic:            true,
+				}}
+			case "histogram":
+				m.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				}}
+			case "summary":
+				m.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{}}
+			default:
+				m.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+			}
+			byFamily[s.family] = m
+			metrics = append(metrics, m)
+		}
+		ts := uint64(s.timestamp.UnixNano())
+
+		switch data := m.Data.(type) {
+		case *metricspb.Metric_Sum:
+			data.Sum.DataPoints = append(data.Sum.DataPoints, &metricspb.NumberDataPoint{
+				Attributes:        labelAttrs(s.labels, ""),
+				StartTimeUnixNano: startNano,
+				TimeUnixNano:      ts,
+				Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: s.value},
+			})
+		case *metricspb.Metric_Gauge:
+			data.Gauge.DataPoints = append(data.Gauge.DataPoints, &metricspb.NumberDataPoint{
+				Attributes:   labelAttrs(s.labels, ""),
+				TimeUnixNano: ts,
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: s.value},
+			})
+		case *metricspb.Metric_Histogram:
+			key := s.family + "\x00" + seriesKey(s.labels, "le")
+			p, ok := histograms[key]
+			if !ok {
+				p = &metricspb.HistogramDataPoint{Attributes: labelAttrs(s.labels, "le"), StartTimeUnixNano: startNano, TimeUnixNano: ts}
+				histograms[key] = p
+				data.Histogram.DataPoints = append(data.Histogram.DataPoints, p)
+			}
+			switch s.name {
+			case s.family + "_bucket":
+				le, ok := getLabel(s.labels, "le")
+				if !ok {
+					continue
+				}
+				bound, err := strconv.ParseFloat(le, 64)
+				if err != nil {
+					continue
+				}
+				// buckets are cumulative until the point is finalized.
+				if !math.IsInf(bound, 1) {
+					p.ExplicitBounds = append(p.ExplicitBounds, bound)
+				}
+				p.BucketCounts = append(p.BucketCounts, uint64(s.value))
+			case s.family + "_sum":
+				sum := s.value
+				p.Sum = &sum
+			case s.family + "_count":
+				p.Count = uint64(s.value)
+			}
+		case *metricspb.Metric_Summary:
+			key := s.family + "\x00" + seriesKey(s.labels, "quantile")
+			p, ok := summaries[key]
+			if !ok {
+				p = &metricspb.SummaryDataPoint{Attributes: labelAttrs(s.labels, "quantile"), StartTimeUnixNano: startNano, TimeUnixNano: ts}
+				summaries[key] = p
+				data.Summary.DataPoints = append(data.Summary.DataPoints, p)
+			}
+			switch s.name {
+			case s.family:
+				q, _ := getLabel(s.labels, "quantile")
+				quantile, err := strconv.ParseFloat(q, 64)
+				if err != nil {
+					continue
+				}
+				p.QuantileValues = append(p.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{Quantile: quantile, Value: s.value})
+			case s.family + "_sum":
+				p.Sum = s.value
+			case s.family + "_count":
+				p.Count = uint64(s.value)
+			}
+		}
+	}
+
+	for _, p := range histograms {
+		finalizeBuckets(p)
+	}
+	return metrics
+}
+
+// finalizeBuckets turns the cumulative prometheus bucket counts into the
+// per-bucket counts OTLP expects, adding the +Inf bucket if it was missing.
+func finalizeBuckets(p *metricspb.HistogramDataPoint) {
+	if len(p.BucketCounts) == len(p.ExplicitBounds) {
+		p.BucketCounts = append(p.BucketCounts, p.Count)
+	}
+	for i := len(p.BucketCounts) - 1; i > 0; i-- {
+		p.BucketCounts[i] -= min(p.BucketCounts[i], p.BucketCounts[i-1])
+	}
+}
+
+// seriesKey identifies a series by its labels, ignoring the named label.
+func seriesKey(labels []label, ignore string) string {
+	var b strings.Builder
+	for _, l := range labels {
+		if l.name == ignore {
+			continue
+		}
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func labelAttrs(labels []label, ignore string) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, l := range labels {
+		if l.name != ignore {
+			attrs = append(attrs, stringAttr(l.name, l.value))
+		}
+	}
+	slices.SortFunc(attrs, func(a, b *commonpb.KeyValue) int { return strings.Compare(a.Key, b.Key) })
+	return attrs
+}
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestToOTLPMetrics(t *testing.T) {
+	source := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`# HELP etcd_server_proposals_committed_total The total number of consensus proposals committed.
+# TYPE etcd_server_proposals_committed_total counter
+etcd_server_proposals_committed_total 42 1700000000000
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader{member="etcd-0"} 1 1700000000000
+# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="a",le="0.001"} 2 1700000000000
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="a",le="0.002"} 5 1700000000000
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="a",le="+Inf"} 9 1700000000000
+etcd_disk_wal_fsync_duration_seconds_sum{disk="a"} 0.0123 1700000000000
+etcd_disk_wal_fsync_duration_seconds_count{disk="a"} 9 1700000000000
+etcd_disk_wal_fsync_duration_seconds_bucket{disk="b",le="0.001"} 1 1700000000000
+etcd_disk_wal_fsync_duration_seconds_sum{disk="b"} 0.5 1700000000000
+etcd_disk_wal_fsync_duration_seconds_count{disk="b"} 3 1700000000000
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0.5"} 0.001 1700000000000
+go_gc_duration_seconds{quantile="1"} 0.004 1700000000000
+go_gc_duration_seconds_sum 1.5 1700000000000
+go_gc_duration_seconds_count 10 1700000000000
+process_open_fds 12 1700000000000
+`))
+	})
+	samples, err := scrapeSamples(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1699999000, 0)
+	startNano, ts := uint64(start.UnixNano()), uint64(time.UnixMilli(1700000000000).UnixNano())
+	sum := func(v float64) *float64 { return &v }
+	double := func(v float64) *metricspb.NumberDataPoint_AsDouble {
+		return &metricspb.NumberDataPoint_AsDouble{AsDouble: v}
+	}
+	want := []*metricspb.Metric{
+		{
+			Name:        "etcd_server_proposals_committed_total",
+			Description: "The total number of consensus proposals committed.",
+			Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+				DataPoints: []*metricspb.NumberDataPoint{
+					{Attributes: []*commonpb.KeyValue{}, StartTimeUnixNano: startNano, TimeUnixNano: ts, Value: double(42)},
+				},
+			}},
+		},
+		{
+			Name: "etcd_server_has_leader",
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{
+					{Attributes: []*commonpb.KeyValue{stringAttr("member", "etcd-0")}, TimeUnixNano: ts, Value: double(1)},
+				},
+			}},
+		},
+		{
+			Name: "etcd_disk_wal_fsync_duration_seconds",
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints: []*metricspb.HistogramDataPoint{
+					{
+						Attributes:        []*commonpb.KeyValue{stringAttr("disk", "a")},
+						StartTimeUnixNano: startNano,
+						TimeUnixNano:      ts,
+						Count:             9,
+						Sum:               sum(0.0123),
+						ExplicitBounds:    []float64{0.001, 0.002},
+						BucketCounts:      []uint64{2, 3, 4},
+					},
+					{
+						// without a +Inf bucket, the count fills it.
+						Attributes:        []*commonpb.KeyValue{stringAttr("disk", "b")},
+						StartTimeUnixNano: startNano,
+						TimeUnixNano:      ts,
+						Count:             3,
+						Sum:               sum(0.5),
+						ExplicitBounds:    []float64{0.001},
+						BucketCounts:      []uint64{1, 2},
+					},
+				},
+			}},
+		},
+		{
+			Name: "go_gc_duration_seconds",
+			Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+				DataPoints: []*metricspb.SummaryDataPoint{
+					{
+						Attributes:        []*commonpb.KeyValue{},
+						StartTimeUnixNano: startNano,
+						TimeUnixNano:      ts,
+						Count:             10,
+						Sum:               1.5,
+						QuantileValues: []*metricspb.SummaryDataPoint_ValueAtQuantile{
+							{Quantile: 0.5, Value: 0.001},
+							{Quantile: 1, Value: 0.004},
+						},
+					},
+				},
+			}},
+		},
+		{
+			Name: "process_open_fds",
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{
+					{Attributes: []*commonpb.KeyValue{}, TimeUnixNano: ts, Value: double(12)},
+				},
+			}},
+		},
+	}
+
+	got := toOTLPMetrics(samples, start)
+	if len(got) != len(want) {
+		t.Fatalf("got %d metrics, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !proto.Equal(got[i], want[i]) {
+			t.Errorf("metric %d:\ngot  %v\nwant %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestOTLPExporterClosesGRPCConnection(t *testing.T) {
+	e, err := newOTLPExporter("http://127.0.0.1:4317", "grpc", time.Minute, okHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.run(ctx)
+	if state := e.conn.GetState(); state != connectivity.Shutdown {
+		t.Errorf("grpc connection %v after the exporter stopped, want %v", state, connectivity.Shutdown)
+	}
+}
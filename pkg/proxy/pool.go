@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Every scrape needs buffers for copying, rewriting and merging its
+// exposition. They are pooled, so many concurrent scrapes don't keep the
+// garbage collector busy with buffers that are dropped right away.
+
+// copyBufferSize is the size of the buffers responses are copied and
+// rewritten with.
+const copyBufferSize = 32 << 10
+
+// maxPooledBuffer is the capacity beyond which a bytes.Buffer isn't put back
+// into the pool, so one huge exposition doesn't pin its memory.
+const maxPooledBuffer = 4 << 20
+
+var (
+	copyBuffers = sync.Pool{New: func() any { return new([copyBufferSize]byte) }}
+	byteBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	readers     = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, copyBufferSize) }}
+	writers     = sync.Pool{New: func() any { return bufio.NewWriterSize(nil, copyBufferSize) }}
+)
+
+// copyBufferPool is the httputil.BufferPool of the reverse proxies.
+type copyBufferPool struct{}
+
+func (copyBufferPool) Get() []byte {
+	return copyBuffers.Get().(*[copyBufferSize]byte)[:]
+}
+
+func (copyBufferPool) Put(b []byte) {
+	if len(b) == copyBufferSize {
+		copyBuffers.Put((*[copyBufferSize]byte)(b))
+	}
+}
+
+// getBuffer returns an empty buffer, to be handed back with putBuffer once
+// nothing refers to its contents anymore.
+func getBuffer() *bytes.Buffer {
+	return byteBuffers.Get().(*bytes.Buffer)
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	byteBuffers.Put(b)
+}
+
+func getReader(r io.Reader) *bufio.Reader {
+	br := readers.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readers.Put(br)
+}
+
+func getWriter(w io.Writer) *bufio.Writer {
+	bw := writers.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	writers.Put(bw)
+}
+
+// pooledBody is a response body buffered in a pooled buffer, which is put
+// back when the body is closed.
+type pooledBody struct {
+	*bytes.Reader
+	buf *bytes.Buffer
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	return &pooledBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}
+}
+
+func (b *pooledBody) Close() error {
+	if b.buf != nil {
+		b.Reader.Reset(nil)
+		putBuffer(b.buf)
+		b.buf = nil
+	}
+	return nil
+}
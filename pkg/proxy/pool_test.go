@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPooledBody(t *testing.T) {
+	buf := getBuffer()
+	if buf.Len() != 0 {
+		t.Fatalf("got a buffer holding %q, want an empty one", buf.String())
+	}
+	buf.WriteString("etcd_server_has_leader 1\n")
+	body := newPooledBody(buf)
+	got, err := io.ReadAll(body)
+	if err != nil || string(got) != "etcd_server_has_leader 1\n" {
+		t.Errorf("got %q, %v, want the buffered body", got, err)
+	}
+	// closing twice puts the buffer back once.
+	body.Close()
+	body.Close()
+	if n, err := body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read() after Close() = %d, %v, want EOF", n, err)
+	}
+}
+
+func TestCopyBufferPool(t *testing.T) {
+	var pool copyBufferPool
+	b := pool.Get()
+	if len(b) != copyBufferSize {
+		t.Errorf("got a %d byte buffer, want %d", len(b), copyBufferSize)
+	}
+	pool.Put(b)
+	// a buffer of another size isn't pooled.
+	pool.Put(make([]byte, 1024))
+	if b := pool.Get(); len(b) != copyBufferSize {
+		t.Errorf("got a %d byte buffer, want %d", len(b), copyBufferSize)
+	}
+}
+
+func TestConcurrentRewrites(t *testing.T) {
+	// the rewrite keeps a label value sliced from the line, so a line or
+	// buffer shared between scrapes would garble the output.
+	in := `# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.001"} 1
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf"} 3
+etcd_disk_wal_fsync_duration_seconds_count 3
+`
+	rewrite := func(l *line) bool {
+		if l.kind == lineSample && len(l.labels) > 0 {
+			l.labels = append(l.labels, label{"bucket", l.labels[0].value})
+		}
+		return true
+	}
+	want := `# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+etcd_disk_wal_fsync_duration_seconds_bucket{le="0.001",bucket="0.001"} 1
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf",bucket="+Inf"} 3
+etcd_disk_wal_fsync_duration_seconds_count 3
+`
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				var out bytes.Buffer
+				if err := rewriteExposition(strings.NewReader(in), &out, rewrite); err != nil {
+					t.Error(err)
+					return
+				}
+				if out.String() != want {
+					t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
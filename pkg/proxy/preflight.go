@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Preflight checks that the proxy can actually scrape etcd: it reports the
+// loaded certificates, then requests /metrics from every upstream target
+// and reports the negotiated tls parameters, server certificate chain,
+// status and size of the response. An error is returned if any certificate
+// is invalid or any target fails. Additional clusters are checked the same
+// way.
+func (p *Proxy) Preflight(ctx context.Context, w io.Writer) error {
+	c := &p.cfg
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := p.startDiscovery(ctx); err != nil {
+		return err
+	}
+
+	var failed []error
+	if p.reload.tls && c.InsecureSkipVerify {
+		fmt.Fprintln(w, "WARNING: --insecure-skip-verify is set, the server certificate is not verified")
+	}
+	if p.spiffe != nil {
+		if err := describeSVID(w, p.spiffe); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if p.vault != nil || p.secret != nil {
+		if p.vault != nil {
+			fmt.Fprintf(w, "client certificate from vault %s/issue/%s:\n", c.VaultPKIPath, c.VaultRole)
+		} else {
+			fmt.Fprintf(w, "client certificate from secret %s:\n", p.secret)
+		}
+		for _, der := range p.switcher.Load().TLSClientConfig.Certificates[0].Certificate {
+			if cert, err := x509.ParseCertificate(der); err == nil {
+				describeCert(w, cert)
+			}
+		}
+	}
+	if p.reload.tls {
+		files, err := caFiles(c.EtcdCA)
+		if err != nil {
+			failed = append(failed, err)
+		}
+		for _, f := range files {
+			if err := describeCertFile(w, c, "ca", f); err != nil {
+				failed = append(failed, err)
+			}
+		}
+		if err := describeCertFile(w, c, "client certificate", c.clientCertFile()); err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	addrs := p.targets.all()
+	if len(addrs) == 0 {
+		fmt.Fprintln(w, "upstream: no targets")
+		failed = append(failed, errors.New("no upstream targets"))
+	}
+	t := p.switcher.Load().Clone()
+	t.DisableKeepAlives = true
+	defer t.CloseIdleConnections()
+	for _, addr := range addrs {
+		if err := preflightAddr(ctx, w, t, newUpstreamAuth(c), c.UpstreamScheme, addr, c.metricsPath(), c.UpstreamTimeout); err != nil {
+			fmt.Fprintf(w, "  FAILED: %v\n", err)
+			failed = append(failed, fmt.Errorf("%s: %w", addr, err))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(p.clusters)) {
+		cluster := p.clusters[name]
+		fmt.Fprintf(w, "cluster %s:\n", name)
+		if err := cluster.Preflight(ctx, w); err != nil {
+			failed = append(failed, fmt.Errorf("cluster %q: %w", name, err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// describeCertFile prints every certificate in a PEM file or PKCS#12 bundle
+// and fails if one isn't currently valid.
+func describeCertFile(w io.Writer, c *Config, name, path string) error {
+	certs, err := readCertificates(c, path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s %s:\n", name, path)
+	var invalid error
+	now := time.Now()
+	for _, cert := range certs {
+		describeCert(w, cert)
+		if err := checkValidity(cert, now); err != nil && invalid == nil {
+			invalid = fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return invalid
+}
+
+func describeCert(w io.Writer, cert *x509.Certificate) {
+	fmt.Fprintf(w, "  subject=%q issuer=%q not_after=%s\n", cert.Subject.String(), cert.Issuer.String(), cert.NotAfter.Format(time.RFC3339))
+}
+
+func preflightAddr(ctx context.Context, w io.Writer, t *http.Transport, auth *httpAuth, scheme, addr, path string, timeout time.Duration) error {
+	u := scheme + "://" + addr + path
+	fmt.Fprintf(w, "GET %s\n", u)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if err := auth.authorize(req); err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.TLS != nil {
+		fmt.Fprintf(w, "  tls: version=%s cipher=%s server_name=%q\n", tls.VersionName(resp.TLS.Version), tls.CipherSuiteName(resp.TLS.CipherSuite), resp.TLS.ServerName)
+		for _, cert := range resp.TLS.PeerCertificates {
+			describeCert(w, cert)
+		}
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		return err
+	}
+	families, samples := 0, 0
+	rewriteExposition(bytes.NewReader(body.Bytes()), io.Discard, func(l *line) bool {
+		switch l.kind {
+		case lineType:
+			families++
+		case lineSample:
+			samples++
+		}
+		return false
+	})
+	fmt.Fprintf(w, "  status=%q content_type=%q bytes=%d families=%d samples=%d duration=%s\n",
+		resp.Status, resp.Header.Get("Content-Type"), body.Len(), families, samples, time.Since(start).Round(time.Millisecond))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(body.String()))
+	}
+	return nil
+}
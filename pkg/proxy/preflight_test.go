@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreflight(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("# TYPE etcd_server_has_leader gauge\netcd_server_has_leader 1\n"))
+	}))
+	defer srv.Close()
+	defer forgetEndpoints([]string{srv.Listener.Addr().String()})
+
+	now := time.Now()
+	tests := []struct {
+		name      string
+		notAfter  time.Time
+		path      string
+		wantErr   string
+		wantLines []string
+	}{
+		{
+			name:     "ok",
+			notAfter: now.Add(time.Hour),
+			path:     "/metrics",
+			wantLines: []string{
+				"ca ", "client certificate ", `subject="CN=client"`,
+				"GET https://" + srv.Listener.Addr().String() + "/metrics",
+				"tls: version=TLS 1.3",
+				`status="200 OK"`, "families=1 samples=1",
+			},
+		},
+		{
+			name:      "expired client certificate",
+			notAfter:  now.Add(-time.Minute),
+			path:      "/metrics",
+			wantErr:   `"client" expired at`,
+			wantLines: []string{`status="200 OK"`},
+		},
+		{
+			name:      "upstream error",
+			notAfter:  now.Add(time.Hour),
+			path:      "/not-metrics",
+			wantErr:   "status 404 Not Found: not found",
+			wantLines: []string{`status="404 Not Found"`, "FAILED: status 404 Not Found"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca, cert, key := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+			if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			writeTestCertificateValidity(t, cert, key, "client", now.Add(-2*time.Hour), tt.notAfter)
+			c := DefaultConfig()
+			c.UpstreamURL = srv.URL + tt.path
+			c.EtcdCA, c.EtcdCert, c.EtcdKey = []string{ca}, cert, key
+			c.UpstreamServerName = "example.com"
+			defer certExpiry.DeleteLabelValues(ca)
+			defer certExpiry.DeleteLabelValues(cert)
+			p, err := NewProxy(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out strings.Builder
+			err = p.Preflight(context.Background(), &out)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Preflight() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Preflight() = %v, want an error containing %q", err, tt.wantErr)
+			}
+			for _, want := range tt.wantLines {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("got\n%s\nwant it to contain %q", out.String(), want)
+				}
+			}
+		})
+	}
+}
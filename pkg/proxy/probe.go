@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// memberProber checks the /health endpoint of every upstream member in the
+// background and exports the results, so a single unhealthy member is seen
+// even though scrapes are only sent to one of them.
+type memberProber struct {
+	targets   *upstreamTargets
+	transport http.RoundTripper
+	scheme    string
+	interval  time.Duration
+
+	// healthy holds the last result of each probed member, to log changes
+	// and drop the series of members that went away.
+	healthy map[string]bool
+}
+
+type memberHealth struct {
+	Health string `json:"health"`
+	Reason string `json:"reason"`
+}
+
+// probe returns an error unless the member at addr reports itself healthy.
+func (m *memberProber) probe(ctx context.Context, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.scheme+"://"+addr+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var health memberHealth
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&health); err != nil {
+		return fmt.Errorf("health: %s", resp.Status)
+	}
+	if health.Health != "true" {
+		if health.Reason != "" {
+			return errors.New(health.Reason)
+		}
+		return fmt.Errorf("health: %s", resp.Status)
+	}
+	return nil
+}
+
+// probeAll probes every member concurrently, each bounded by the interval.
+func (m *memberProber) probeAll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+
+	addrs := m.targets.all()
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = m.probe(ctx, addr)
+			memberProbeDuration.WithLabelValues(addr).Set(time.Since(start).Seconds())
+		}()
+	}
+	wg.Wait()
+
+	healthy := make(map[string]bool, len(addrs))
+	for i, addr := range addrs {
+		healthy[addr] = errs[i] == nil
+		was, known := m.healthy[addr]
+		switch {
+		case errs[i] != nil && (was || !known):
+			slog.Warn("etcd member is unhealthy", "endpoint", addr, "err", errs[i])
+		case errs[i] == nil && known && !was:
+			slog.Info("etcd member is healthy again", "endpoint", addr)
+		}
+		if errs[i] == nil {
+			memberHealthy.WithLabelValues(addr).Set(1)
+		} else {
+			memberHealthy.WithLabelValues(addr).Set(0)
+		}
+	}
+	for addr := range m.healthy {
+		if _, ok := healthy[addr]; !ok {
+			memberHealthy.DeleteLabelValues(addr)
+			memberProbeDuration.DeleteLabelValues(addr)
+		}
+	}
+	m.healthy = healthy
+}
+
+// run probes the members every interval until ctx is done.
+func (m *memberProber) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
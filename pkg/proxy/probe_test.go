@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMemberProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "healthy", status: http.StatusOK, body: `{"health":"true","reason":""}`},
+		{name: "unhealthy with a reason", status: http.StatusServiceUnavailable, body: `{"health":"false","reason":"RAFT NO LEADER"}`, wantErr: "RAFT NO LEADER"},
+		{name: "unhealthy", status: http.StatusServiceUnavailable, body: `{"health":"false"}`, wantErr: "health: 503 Service Unavailable"},
+		{name: "not json", status: http.StatusNotFound, body: "404 page not found", wantErr: "health: 404 Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/health" {
+					t.Errorf("got %s, want /health", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			m := &memberProber{transport: http.DefaultTransport, scheme: "http"}
+			err := m.probe(context.Background(), srv.Listener.Addr().String())
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("probe() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("probe() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProbeAll(t *testing.T) {
+	member := func(body string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(srv.Close)
+		addr := srv.Listener.Addr().String()
+		t.Cleanup(func() {
+			memberHealthy.DeleteLabelValues(addr)
+			memberProbeDuration.DeleteLabelValues(addr)
+		})
+		return addr
+	}
+	healthy, unhealthy := member(`{"health":"true"}`), member(`{"health":"false","reason":"NOSPACE"}`)
+	// nothing listens on a closed server's address.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	down := closed.Listener.Addr().String()
+	closed.Close()
+
+	m := &memberProber{targets: newUpstreamTargets(healthy, unhealthy, down), transport: http.DefaultTransport, scheme: "http", interval: 5 * time.Second}
+	m.probeAll(context.Background())
+	for addr, want := range map[string]float64{healthy: 1, unhealthy: 0, down: 0} {
+		if got := testutil.ToFloat64(memberHealthy.WithLabelValues(addr)); got != want {
+			t.Errorf("%s: healthy %v, want %v", addr, got, want)
+		}
+	}
+
+	// the series of members that went away are dropped.
+	m.targets.set([]string{healthy})
+	m.probeAll(context.Background())
+	metrics := gatherSelfMetrics(t)
+	for _, addr := range []string{unhealthy, down} {
+		if strings.Contains(metrics, `"`+addr+`"`) {
+			t.Errorf("the series of %s are still exported", addr)
+		}
+	}
+	if !strings.Contains(metrics, `etcd_member_health_probe_duration_seconds{endpoint="`+healthy+`"}`) {
+		t.Errorf("the probe duration of %s isn't exported", healthy)
+	}
+}
@@ -0,0 +1,1468 @@
+// Package proxy implements the etcd metrics proxy: an http server exposing
+// the metrics of an mTLS protected etcd to unauthenticated scrapers.
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openinsight-proj/etcd-metrics-proxy/pkg/version"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/time/rate"
+)
+
+// Config configures a Proxy. Each field corresponds to the command line
+// flag of the same name registered by RegisterFlags; start from
+// DefaultConfig when building one in code.
+type Config struct {
+	Port                    int
+	ListenAddresses         []string
+	SocketMode              fs.FileMode
+	ListenReusePort         bool
+	ListenKeepAlive         time.Duration
+	H2C                     bool
+	ListenTLSCert           string
+	ListenTLSKey            string
+	ListenTLSClientCA       []string
+	ServeProxyMetrics       bool
+	AdminPort               int
+	AdminListenAddress      string
+	AdminTLSCert            string
+	AdminTLSKey             string
+	AdminTLSClientCA        []string
+	EnableLifecycle         bool
+	UpstreamURL             string
+	UpstreamProxyURL        string
+	UpstreamHost            string
+	UpstreamPort            int
+	UpstreamMetricsPort     int
+	UpstreamMetricsScheme   string
+	UpstreamMetricsDiscover bool
+	UpstreamServerName      string
+	UpstreamUsername        string
+	UpstreamPasswordFile    string
+	UpstreamBearerTokenFile string
+	UpstreamScheme          string
+	EtcdCA                  []string
+	UseSystemCA             bool
+	InsecureSkipVerify      bool
+	EtcdCert                string
+	EtcdKey                 string
+	// EtcdKeyPasswordFile holds the passphrase of an encrypted EtcdKey or
+	// EtcdPKCS12 bundle.
+	EtcdKeyPasswordFile string
+	EtcdPKCS12          string
+	EtcdTLSSecret       string
+	// EtcdCRL, EtcdOCSP and EtcdRevocationPolicy configure the revocation
+	// check of the upstream certificate.
+	EtcdCRL              string
+	EtcdOCSP             bool
+	EtcdRevocationPolicy string
+	SPIFFESocket         string
+	SPIFFEServerID       string
+	VaultAddr            string
+	VaultNamespace       string
+	VaultCA              string
+	VaultPKIPath         string
+	VaultRole            string
+	VaultCommonName      string
+	VaultTTL             time.Duration
+	VaultTokenFile       string
+	VaultAppRolePath     string
+	VaultRoleIDFile      string
+	VaultSecretIDFile    string
+	MetricAllow          []string
+	MetricDeny           []string
+	ConfigFile           string
+	ConfigWatch          bool
+	CacheTTL             time.Duration
+	CoalesceRequests     bool
+	CompressResponses    bool
+	MaxResponseBytes     int64
+	ValidateExposition   string
+	ServeStale           bool
+	AccessLogFormat      string
+	AuditLog             string
+	AccessLogFields      []string
+	RequestLogMode       string
+	RequestLogRate       float64
+	RequestIDHeader      string
+	OTLPEndpoint         string
+	ShutdownTimeout      time.Duration
+
+	// BackgroundScrapeInterval, if set, is how often the snapshots served
+	// to scrapers are refreshed.
+	BackgroundScrapeInterval time.Duration
+
+	OTLPMetricsEndpoint string
+	OTLPMetricsProtocol string
+	OTLPMetricsInterval time.Duration
+
+	RemoteWriteURL             string
+	RemoteWriteInterval        time.Duration
+	RemoteWriteBatchSize       int
+	RemoteWriteMaxRetries      int
+	RemoteWriteUsername        string
+	RemoteWritePasswordFile    string
+	RemoteWriteBearerTokenFile string
+
+	MaxRequestsPerSecond float64
+	Burst                int
+	// ScraperMetrics, ScraperRequestsPerSecond and ScraperBurst account
+	// for and limit the requests of each scraper.
+	ScraperMetrics           bool
+	ScraperRequestsPerSecond float64
+	ScraperBurst             int
+	AllowedCIDRs             []string
+	JWTJWKSURL               string
+	JWTJWKSRefreshInterval   time.Duration
+	JWTIssuer                string
+	JWTAudience              string
+	JWTSubjects              []string
+	TrustedProxies           []string
+	ForwardHeaders           []string
+	CatchAllHealth           bool
+	HTTPSD                   bool
+	HTTPSDTarget             string
+
+	UpstreamTimeout        time.Duration
+	HonorScrapeTimeout     bool
+	ScrapeTimeoutOffset    time.Duration
+	UpstreamRetries        int
+	UpstreamRetryBackoff   time.Duration
+	UpstreamRetryOn        string
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+	DialTimeout            time.Duration
+	ResponseHeaderTimeout  time.Duration
+	MaxIdleConns           int
+	MaxIdleConnsPerHost    int
+	MaxConnsPerHost        int
+	IdleConnTimeout        time.Duration
+	UpstreamKeepAlive      time.Duration
+	DisableKeepAlives      bool
+
+	ProxyHealth  bool
+	ProxyVersion bool
+	ProxyPprof   bool
+
+	KubeDiscovery       bool
+	KubeNamespace       string
+	KubeService         string
+	KubeSelector        string
+	KubePortName        string
+	KubeRefreshInterval time.Duration
+
+	UpstreamSRV        string
+	DNSRefreshInterval time.Duration
+	UpstreamEndpoints  []string
+
+	LeaderLabel                bool
+	MemberRoleLabels           bool
+	LeaderOnly                 bool
+	LeaderCheckInterval        time.Duration
+	MaintenanceMetrics         bool
+	MaintenanceMetricsInterval time.Duration
+	MemberHealthInterval       time.Duration
+
+	ClusterLabel string
+	ClusterName  string
+
+	TLSReloadInterval time.Duration
+	TLSWatch          bool
+	TLSReloadDebounce time.Duration
+	CertExpiryWarning time.Duration
+	TLSWaitTimeout    time.Duration
+	TLSMinVersion     string
+	TLSMaxVersion     string
+	TLSCipherSuites   []string
+	// TLSSessionCacheSize is the number of tls sessions kept for
+	// resumption, unless DisableTLSResumption is set.
+	TLSSessionCacheSize  int
+	DisableTLSResumption bool
+
+	// upstreamSocket is the socket path taken from UpstreamURL.
+	upstreamSocket string
+	// upstreamPath is the metrics path taken from UpstreamURL, "" for
+	// /metrics.
+	upstreamPath string
+	// upstreamProxy is the parsed UpstreamProxyURL.
+	upstreamProxy *url.URL
+	// revocation checks the upstream certificate with EtcdCRL or EtcdOCSP.
+	revocation *revocationChecker
+	// tlsMinVersion, tlsMaxVersion and cipherSuites are parsed from the
+	// TLS version and cipher suite fields.
+	tlsMinVersion, tlsMaxVersion uint16
+	cipherSuites                 []uint16
+	// retryOn holds the error classes of UpstreamRetryOn.
+	retryOn map[string]bool
+	// cluster names the additional cluster this config was derived for.
+	cluster string
+	// flags is the flag set the config was registered on, if any.
+	flags *flag.FlagSet
+}
+
+// DefaultConfig returns a Config holding the flag defaults.
+func DefaultConfig() Config {
+	var c Config
+	RegisterFlags(flag.NewFlagSet("", flag.ContinueOnError), &c)
+	c.flags = nil
+	return c
+}
+
+// stringSlice is a flag.Value collecting every occurrence of a repeated flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// RegisterFlags defines a command line flag for every Config field on set,
+// resetting c to the defaults, and remembers set so the lifecycle /-/config
+// endpoint can show the effective flags.
+func RegisterFlags(set *flag.FlagSet, c *Config) {
+	*c = Config{
+		SocketMode:      0o660,
+		AccessLogFields: strings.Split(defaultAccessLogFields, ","),
+		flags:           set,
+	}
+	set.IntVar(&c.Port, "port", 2381, "Port to bind to.")
+	set.Var((*stringSlice)(&c.ListenAddresses), "listen-address", "Address to listen on, e.g. 127.0.0.1:2381, [::1]:2381 or unix:///var/run/etcd-metrics.sock; may be repeated. Overrides --port.")
+	set.Func("listen-socket-mode", "File mode of unix sockets created by --listen-address, in octal. (default 0660)", func(s string) error {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return err
+		}
+		c.SocketMode = fs.FileMode(m)
+		return nil
+	})
+	set.BoolVar(&c.ListenReusePort, "listen-reuse-port", false, "Set SO_REUSEPORT on the tcp listeners, so a new proxy process can bind the same address before the old one stops, e.g. for zero-downtime restarts.")
+	set.DurationVar(&c.ListenKeepAlive, "listen-keepalive", 0, "Tcp keepalive period of accepted connections. 0 uses Go's default of 15s; a negative value disables keepalives.")
+	set.BoolVar(&c.H2C, "h2c", false, "Also accept HTTP/2 without tls (h2c) on the listeners, by prior knowledge or an HTTP/1.1 Upgrade.")
+	set.StringVar(&c.ListenTLSCert, "listen-tls-cert", "", "Certificate file to serve the listeners over tls (and HTTP/2). Re-read when it changes.")
+	set.StringVar(&c.ListenTLSKey, "listen-tls-key", "", "Key file of --listen-tls-cert.")
+	set.Var((*stringSlice)(&c.ListenTLSClientCA), "listen-tls-client-ca", "Require scrapers to present a client certificate issued by this CA file or directory. May be repeated.")
+	set.BoolVar(&c.ServeProxyMetrics, "serve-proxy-metrics", true, "Serve the proxy's own metrics on /proxy-metrics of the scrape listener. Set to false to keep them on the admin listener only.")
+	set.IntVar(&c.AdminPort, "admin-port", 0, "Port serving pprof, expvar and the proxy's own metrics. 0 disables the admin listener.")
+	set.StringVar(&c.AdminListenAddress, "admin-listen-address", "", "Address of the admin listener, e.g. 127.0.0.1:9091 or unix:///var/run/etcd-metrics-admin.sock. Overrides --admin-port.")
+	set.StringVar(&c.AdminTLSCert, "admin-tls-cert", "", "Certificate file to serve the admin listener over tls. Re-read when it changes.")
+	set.StringVar(&c.AdminTLSKey, "admin-tls-key", "", "Key file of --admin-tls-cert.")
+	set.Var((*stringSlice)(&c.AdminTLSClientCA), "admin-tls-client-ca", "Require admin clients to present a client certificate issued by this CA file or directory. May be repeated.")
+	set.BoolVar(&c.EnableLifecycle, "enable-lifecycle", false, "Serve POST /-/reload, GET /-/config and POST /-/quit on the admin listener. Requires --admin-port.")
+	set.StringVar(&c.UpstreamProxyURL, "upstream-proxy-url", "", "Reach the upstream through this jump proxy: http:// or https:// for HTTP CONNECT, or socks5:// for SOCKS5, with optional user:password@. The HTTP_PROXY environment variables are never used for the upstream.")
+	set.StringVar(&c.UpstreamURL, "upstream-url", "", "The upstream etcd metrics url, e.g. https://etcd-0.etcd:2379/metrics, overriding --upstream-scheme, --upstream-host and --upstream-port; or a unix socket: unix:///path for http or unixs:///path for https.")
+	set.StringVar(&c.UpstreamHost, "upstream-host", "localhost", "The upstream etcd host.")
+	set.IntVar(&c.UpstreamPort, "upstream-port", 2379, "The upstream etcd port.")
+	set.StringVar(&c.UpstreamScheme, "upstream-scheme", "https", "The upstream etcd scheme, http or https. https requires --etcd-cert, --etcd-key and --etcd-ca or --use-system-ca.")
+	set.IntVar(&c.UpstreamMetricsPort, "upstream-metrics-port", 0, "Port of etcd's --listen-metrics-urls listener. Its metrics are merged with those of the client port, fetched from the same member. 0 only scrapes the client port.")
+	set.StringVar(&c.UpstreamMetricsScheme, "upstream-metrics-scheme", "", "Scheme of the --upstream-metrics-port listener: http, https or auto to probe each member's listener for tls. Defaults to --upstream-scheme.")
+	set.BoolVar(&c.UpstreamMetricsDiscover, "upstream-metrics-discover", false, "Find etcd's --listen-metrics-urls listener from the command line each member publishes on /debug/vars, and merge its metrics like --upstream-metrics-port.")
+	set.StringVar(&c.UpstreamServerName, "upstream-server-name", "localhost", "The upstream tls server name.")
+	set.StringVar(&c.UpstreamUsername, "upstream-username", "", "Username for basic auth to the upstream, for endpoints behind token auth rather than mtls.")
+	set.StringVar(&c.UpstreamPasswordFile, "upstream-password-file", "", "File containing the password for --upstream-username. Re-read for every request.")
+	set.StringVar(&c.UpstreamBearerTokenFile, "upstream-bearer-token-file", "", "File containing a bearer token sent to the upstream. Re-read for every request.")
+	set.Var((*stringSlice)(&c.EtcdCA), "etcd-ca", "The CA file for etcd tls, or a directory of CA files. May be repeated; every CA found is trusted.")
+	set.BoolVar(&c.UseSystemCA, "use-system-ca", false, "Trust the system certificate pool for etcd tls, in addition to any --etcd-ca.")
+	set.BoolVar(&c.InsecureSkipVerify, "insecure-skip-verify", false, "Don't verify the etcd server certificate. The client certificate is still presented. Only for testing.")
+	set.StringVar(&c.EtcdCert, "etcd-cert", "", "The cert file for etcd tls.")
+	set.StringVar(&c.EtcdKey, "etcd-key", "", "The key file for etcd tls.")
+	set.StringVar(&c.EtcdKeyPasswordFile, "etcd-key-password-file", "", "File holding the passphrase of an encrypted --etcd-key or of the --etcd-pkcs12 bundle.")
+	set.StringVar(&c.EtcdCRL, "etcd-crl", "", "File of PEM or DER encoded CRLs the upstream certificate is checked against. Re-read whenever it changes.")
+	set.BoolVar(&c.EtcdOCSP, "etcd-ocsp", false, "Check the upstream certificate with OCSP: the response stapled by the server, or else one from the responder named in the certificate.")
+	set.StringVar(&c.EtcdRevocationPolicy, "etcd-revocation-policy", "fail-open", "Whether a handshake succeeds when --etcd-crl and --etcd-ocsp can't establish the revocation status of the upstream certificate: fail-open or fail-closed. A revoked certificate always fails.")
+	set.StringVar(&c.EtcdTLSSecret, "etcd-tls-secret", "", "Read the etcd client certificate, key and CA from the tls.crt, tls.key and ca.crt keys of this Kubernetes Secret, as [<namespace>/]<name>, and reload them when it changes, instead of files.")
+	set.StringVar(&c.SPIFFESocket, "spiffe-socket", "", "Fetch the etcd client certificate and trust bundle from the SPIFFE Workload API at this address, e.g. unix:///run/spire/sockets/agent.sock, instead of files.")
+	set.StringVar(&c.SPIFFEServerID, "spiffe-server-id", "", "With --spiffe-socket, the SPIFFE ID the etcd server must present. Defaults to any ID trusted by the bundle.")
+	set.StringVar(&c.VaultAddr, "vault-addr", "", "Request the etcd client certificate from the Vault PKI secrets engine at this address, e.g. https://vault:8200, instead of files.")
+	set.StringVar(&c.VaultNamespace, "vault-namespace", "", "The Vault namespace, for Vault Enterprise.")
+	set.StringVar(&c.VaultCA, "vault-ca", "", "The CA file for the Vault server. Defaults to the system pool.")
+	set.StringVar(&c.VaultPKIPath, "vault-pki-path", "pki", "The mount path of the Vault PKI secrets engine.")
+	set.StringVar(&c.VaultRole, "vault-role", "", "The Vault PKI role to issue the client certificate with.")
+	set.StringVar(&c.VaultCommonName, "vault-common-name", "", "The common name of the client certificate requested from Vault.")
+	set.DurationVar(&c.VaultTTL, "vault-ttl", 0, "The lifetime of the client certificate requested from Vault. Defaults to the role's ttl.")
+	set.StringVar(&c.VaultTokenFile, "vault-token-file", "", "File holding the Vault token, re-read for every request.")
+	set.StringVar(&c.VaultAppRolePath, "vault-approle-path", "approle", "The mount path of the Vault AppRole auth method.")
+	set.StringVar(&c.VaultRoleIDFile, "vault-role-id-file", "", "File holding the AppRole role_id, used instead of --vault-token-file.")
+	set.StringVar(&c.VaultSecretIDFile, "vault-secret-id-file", "", "File holding the AppRole secret_id.")
+	set.StringVar(&c.EtcdPKCS12, "etcd-pkcs12", "", "A PKCS#12 (.p12) bundle holding the etcd client certificate and key, instead of --etcd-cert and --etcd-key.")
+	set.DurationVar(&c.UpstreamTimeout, "upstream-timeout", 30*time.Second, "Hard deadline of a single scrape, including retries; the upstream request is cancelled and a 504 returned when it passes. 0 disables the limit.")
+	set.BoolVar(&c.HonorScrapeTimeout, "honor-scrape-timeout", true, "Also bound a scrape to the X-Prometheus-Scrape-Timeout-Seconds header Prometheus sends, less --scrape-timeout-offset, when that is shorter than --upstream-timeout.")
+	set.DurationVar(&c.ScrapeTimeoutOffset, "scrape-timeout-offset", 500*time.Millisecond, "Safety margin subtracted from the Prometheus scrape timeout, leaving time to deliver the error or stale metrics before Prometheus gives up.")
+	set.IntVar(&c.UpstreamRetries, "upstream-retries", 0, "Retry GET and HEAD requests that failed on every upstream endpoint up to this many times, within --upstream-timeout.")
+	set.DurationVar(&c.UpstreamRetryBackoff, "upstream-retry-backoff", 100*time.Millisecond, "Delay before the first retry, doubled for every further retry up to 5s.")
+	set.StringVar(&c.UpstreamRetryOn, "upstream-retry-on", "connect,reset", "Comma separated classes of upstream errors to retry: connect (the connection could not be established), reset (it was closed or reset), timeout and 5xx.")
+	set.IntVar(&c.CircuitBreakerFailures, "circuit-breaker-failures", 0, "Stop sending requests to an upstream endpoint after this many consecutive failures, failing fast until --circuit-breaker-cooldown has passed. 0 disables the circuit breaker.")
+	set.DurationVar(&c.CircuitBreakerCooldown, "circuit-breaker-cooldown", 30*time.Second, "How long an open circuit breaker fails fast before a request probes the endpoint again.")
+	set.DurationVar(&c.DialTimeout, "dial-timeout", 5*time.Second, "Timeout for establishing an upstream connection, including the tls handshake.")
+	set.DurationVar(&c.ResponseHeaderTimeout, "response-header-timeout", 0, "Time to wait for the upstream response headers after sending the request. 0 disables the limit.")
+	set.IntVar(&c.MaxIdleConns, "max-idle-conns", 100, "Maximum number of idle upstream connections kept open.")
+	set.IntVar(&c.MaxIdleConnsPerHost, "max-idle-conns-per-host", 0, "Maximum number of idle connections kept open to each upstream endpoint. 0 uses Go's default of 2; raise it for many concurrent scrapers.")
+	set.IntVar(&c.MaxConnsPerHost, "max-conns-per-host", 0, "Maximum number of connections to each upstream endpoint, idle or not. Further requests wait for a connection. 0 means no limit.")
+	set.DurationVar(&c.IdleConnTimeout, "idle-conn-timeout", 90*time.Second, "How long an idle upstream connection is kept before closing.")
+	set.DurationVar(&c.UpstreamKeepAlive, "upstream-keepalive", 30*time.Second, "Tcp keepalive period of upstream connections. A negative value disables keepalive probes.")
+	set.BoolVar(&c.DisableKeepAlives, "disable-keepalives", false, "Open a new upstream connection for every request instead of reusing idle ones.")
+	set.BoolVar(&c.ProxyHealth, "proxy-health", false, "Also proxy the etcd /health endpoint.")
+	set.BoolVar(&c.ProxyVersion, "proxy-version", false, "Also proxy the etcd /version endpoint.")
+	set.BoolVar(&c.ProxyPprof, "proxy-pprof", false, "Also proxy the etcd /debug/pprof/ endpoints (requires etcd --enable-pprof).")
+	set.BoolVar(&c.KubeDiscovery, "kube-discovery", false, "Discover the upstream etcd members from the Kubernetes API instead of using --upstream-host.")
+	set.StringVar(&c.KubeNamespace, "kube-namespace", "", "Namespace of the etcd members. Defaults to the namespace of the proxy pod.")
+	set.StringVar(&c.KubeService, "kube-service", "", "Discover members from the EndpointSlices of this service.")
+	set.StringVar(&c.KubeSelector, "kube-selector", "", "Discover members from the pods matching this label selector.")
+	set.StringVar(&c.KubePortName, "kube-port-name", "", "With --kube-service, send requests to the port of this name in the EndpointSlices, e.g. client, instead of --upstream-port.")
+	set.DurationVar(&c.KubeRefreshInterval, "kube-refresh-interval", 30*time.Second, "How often to refresh the discovered members.")
+	set.Var((*stringSlice)(&c.UpstreamEndpoints), "upstream-endpoint", "An upstream etcd host:port; may be repeated. Endpoints are tried in order, failing over to the next on connection errors or 5xx responses. Replaces --upstream-host/--upstream-port.")
+	set.StringVar(&c.UpstreamSRV, "upstream-srv", "", "Discover the upstream members from this DNS SRV record (e.g. _etcd-client-ssl._tcp.example.com) instead of --upstream-host.")
+	set.DurationVar(&c.DNSRefreshInterval, "dns-refresh-interval", 0, "Re-resolve --upstream-host (or --upstream-srv) at this interval, recycling connections when the addresses change. 0 resolves SRV records once and leaves host resolution to the dialer.")
+	set.BoolVar(&c.LeaderLabel, "leader-label", false, "Add an is_leader label to every proxied series, telling whether the member that served the scrape is the raft leader.")
+	set.StringVar(&c.ClusterLabel, "cluster-label", "", "Add this label to every proxied series, set to --cluster-name for the default cluster and to the name of each cluster from the --config file. Empty adds none.")
+	set.StringVar(&c.ClusterName, "cluster-name", "default", "Value of --cluster-label for the default cluster.")
+	set.BoolVar(&c.MemberRoleLabels, "member-role-labels", false, "Add role (leader, follower or learner), member_id and member_name labels to every proxied series, from the status and cluster member list of the member that served the scrape.")
+	set.BoolVar(&c.LeaderOnly, "leader-only", false, "Only scrape the current raft leader among the upstream members, failing over as usual while no leader is known.")
+	set.DurationVar(&c.LeaderCheckInterval, "leader-check-interval", 10*time.Second, "How often to check which upstream member is the leader, with --leader-label, --leader-only or --member-role-labels.")
+	set.DurationVar(&c.MemberHealthInterval, "member-health-interval", 0, "Probe the /health endpoint of every upstream member at this interval and export etcd_member_healthy on /proxy-metrics. 0 disables probing.")
+	set.BoolVar(&c.MaintenanceMetrics, "maintenance-metrics", false, "Append series for the active alarms, database size in use and fragmentation and member list, queried from the etcd gRPC gateway of the member serving the scrape.")
+	set.DurationVar(&c.MaintenanceMetricsInterval, "maintenance-metrics-interval", 30*time.Second, "How often to query the --maintenance-metrics series of every upstream member.")
+	set.BoolVar(&c.TLSWatch, "tls-watch", true, "Watch the etcd tls files and reload them when they change, following symlinks such as kubernetes secret mounts.")
+	set.DurationVar(&c.TLSReloadDebounce, "tls-reload-debounce", 250*time.Millisecond, "With --tls-watch, wait until the tls files have been quiet for this long before reloading, so a rotation touching several files triggers one reload. 0 reloads on the first event.")
+	set.DurationVar(&c.TLSWaitTimeout, "tls-wait-timeout", 0, "At startup, keep retrying to load the etcd tls files for up to this long, e.g. while a Kubernetes Secret is being mounted, instead of exiting. 0 fails immediately.")
+	set.DurationVar(&c.CertExpiryWarning, "cert-expiry-warning", 14*24*time.Hour, "Log a warning when a loaded certificate expires within this window.")
+	set.StringVar(&c.TLSMinVersion, "tls-min-version", "", "Minimum tls version for the upstream connection: 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2.")
+	set.StringVar(&c.TLSMaxVersion, "tls-max-version", "", "Maximum tls version for the upstream connection: 1.0, 1.1, 1.2 or 1.3. Defaults to 1.3.")
+	set.Func("tls-cipher-suites", "Comma-separated list of cipher suites offered to the upstream for tls 1.2 and below, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Defaults to Go's secure suites. TLS 1.3 suites are not configurable.", func(s string) error {
+		c.TLSCipherSuites = append(c.TLSCipherSuites, strings.Split(s, ",")...)
+		return nil
+	})
+	set.IntVar(&c.TLSSessionCacheSize, "tls-session-cache-size", 64, "Number of upstream tls sessions kept to resume connections with an abbreviated handshake.")
+	set.BoolVar(&c.DisableTLSResumption, "disable-tls-resumption", false, "Make a full tls handshake for every new upstream connection instead of resuming a previous session.")
+	set.DurationVar(&c.TLSReloadInterval, "tls-reload-interval", 0, "Check the etcd tls files for changes at this interval and reload them when their contents change. 0 disables polling.")
+	set.Float64Var(&c.MaxRequestsPerSecond, "max-requests-per-second", 0, "Maximum rate of /metrics requests; requests beyond it get 429. 0 disables rate limiting.")
+	set.IntVar(&c.Burst, "burst", 5, "Number of /metrics requests allowed in a burst above --max-requests-per-second.")
+	set.BoolVar(&c.ScraperMetrics, "scraper-metrics", false, "Export the /metrics requests and bytes served to each scraper, identified by its JWT subject, client certificate or address, on /proxy-metrics.")
+	set.Float64Var(&c.ScraperRequestsPerSecond, "scraper-requests-per-second", 0, "Maximum rate of /metrics requests of each scraper; its requests beyond it get 429. 0 disables the quota.")
+	set.IntVar(&c.ScraperBurst, "scraper-burst", 5, "Number of /metrics requests a scraper may send in a burst above --scraper-requests-per-second.")
+	set.Var((*stringSlice)(&c.AllowedCIDRs), "allowed-cidrs", "Comma separated CIDRs allowed to request /metrics; may be repeated. Others get 403. Defaults to allowing everyone.")
+	set.StringVar(&c.JWTJWKSURL, "jwt-jwks-url", "", "Require a bearer JWT on /metrics, signed by a key from this JWKS url, e.g. https://issuer.example.com/.well-known/jwks.json. Requires --jwt-issuer and --jwt-audience.")
+	set.DurationVar(&c.JWTJWKSRefreshInterval, "jwt-jwks-refresh-interval", time.Hour, "How long the keys from --jwt-jwks-url are cached. Tokens signed with an unknown key refetch them sooner.")
+	set.StringVar(&c.JWTIssuer, "jwt-issuer", "", "Required iss claim of the JWT.")
+	set.StringVar(&c.JWTAudience, "jwt-audience", "", "Audience the JWT must be issued for.")
+	set.Var((*stringSlice)(&c.JWTSubjects), "jwt-subject", "Only accept JWTs with this sub claim, e.g. system:serviceaccount:monitoring:prometheus; may be repeated. By default any subject is accepted.")
+	set.Var((*stringSlice)(&c.TrustedProxies), "trusted-proxies", "Comma separated CIDRs of proxies whose X-Forwarded-For header is trusted when applying --allowed-cidrs, and whose X-Forwarded-* headers are passed on to etcd.")
+	set.BoolVar(&c.HTTPSD, "http-sd", false, "Serve /sd, listing a Prometheus http_sd target for every upstream member, scraped through the proxy with a member parameter.")
+	set.StringVar(&c.HTTPSDTarget, "http-sd-target", "", "The host:port of the proxy in the targets of /sd. Defaults to the address /sd was requested at.")
+	set.BoolVar(&c.CatchAllHealth, "catch-all-health", false, "Answer 200 ok on / and every unknown path, as earlier versions did, instead of 404.")
+	set.Var((*stringSlice)(&c.ForwardHeaders), "forward-header", "Inbound request header to forward to etcd, in addition to Accept, Accept-Encoding, User-Agent, X-Prometheus-Scrape-Timeout-Seconds and the trace context; may be repeated. Other headers are removed.")
+	set.StringVar(&c.ConfigFile, "config", "", "Optional YAML file with relabel rules.")
+	set.BoolVar(&c.ConfigWatch, "config-watch", true, "Watch the --config file and reload it when it changes, following symlinks such as kubernetes ConfigMap mounts.")
+	set.DurationVar(&c.BackgroundScrapeInterval, "background-scrape-interval", 0, "Scrape the upstream on this interval, independent of incoming requests, and answer every /metrics request with the latest snapshot, exporting its age as etcd_metrics_proxy_snapshot_age_seconds. 0 fetches for every request.")
+	set.DurationVar(&c.CacheTTL, "cache-ttl", 0, "Serve the last upstream response for this long before fetching again. 0 disables caching.")
+	set.Int64Var(&c.MaxResponseBytes, "max-response-bytes", 0, "Reject upstream responses larger than this many bytes with 502. 0 means no limit.")
+	set.StringVar(&c.ValidateExposition, "validate-exposition", "off", "Parse every upstream exposition: off, reject (answer malformed or truncated ones with 502) or repair (drop their malformed lines and incomplete tail).")
+	set.BoolVar(&c.CompressResponses, "compress-responses", true, "Gzip /metrics responses for clients that accept it when the upstream did not compress them.")
+	set.BoolVar(&c.CoalesceRequests, "coalesce-requests", true, "Share one upstream fetch between concurrent identical /metrics requests.")
+	set.BoolVar(&c.ServeStale, "serve-stale", false, "On upstream failure serve the last successful response, annotated with etcd_metrics_proxy_upstream_up.")
+	set.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "How long to wait for in-flight requests to finish on SIGTERM/SIGINT.")
+	set.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "OTLP http endpoint to export traces of /metrics requests to, e.g. http://otel-collector:4318. Tracing is disabled when empty.")
+	set.StringVar(&c.OTLPMetricsEndpoint, "otlp-metrics-endpoint", "", "Periodically scrape etcd and export the metrics over OTLP to this collector url, e.g. http://otel-collector:4318.")
+	set.StringVar(&c.OTLPMetricsProtocol, "otlp-metrics-protocol", "http", "Protocol for --otlp-metrics-endpoint: http or grpc.")
+	set.DurationVar(&c.OTLPMetricsInterval, "otlp-metrics-interval", 30*time.Second, "How often to scrape and export with --otlp-metrics-endpoint.")
+	set.StringVar(&c.RemoteWriteURL, "remote-write-url", "", "Periodically scrape etcd and push the samples to this Prometheus remote_write endpoint.")
+	set.DurationVar(&c.RemoteWriteInterval, "remote-write-interval", 30*time.Second, "How often to scrape and push with --remote-write-url.")
+	set.IntVar(&c.RemoteWriteBatchSize, "remote-write-batch-size", 2000, "Maximum number of samples per remote_write request.")
+	set.IntVar(&c.RemoteWriteMaxRetries, "remote-write-max-retries", 5, "How many times a failed remote_write request is retried, with exponential backoff.")
+	set.StringVar(&c.RemoteWriteUsername, "remote-write-username", "", "Username for basic auth to --remote-write-url.")
+	set.StringVar(&c.RemoteWritePasswordFile, "remote-write-password-file", "", "File containing the password for basic auth to --remote-write-url.")
+	set.StringVar(&c.RemoteWriteBearerTokenFile, "remote-write-bearer-token-file", "", "File containing a bearer token for --remote-write-url.")
+	set.StringVar(&c.AccessLogFormat, "access-log-format", "default", "Access log format: default (a structured line through the logger), common (Common Log Format on stdout) or none.")
+	set.StringVar(&c.AuditLog, "audit-log", "", "Append a JSON line per request on the scrape listener, with the identity of the scraper from its client certificate or JWT, to this file, or to stdout for -.")
+	set.StringVar(&c.RequestLogMode, "request-log-mode", "all", "Which requests the access log records: all, sampled (a share of --request-log-sample-rate) or off. Failed requests are always logged.")
+	set.Float64Var(&c.RequestLogRate, "request-log-sample-rate", 0.01, "Share of the successful requests logged with --request-log-mode=sampled, from 0 to 1.")
+	set.StringVar(&c.RequestIDHeader, "request-id-header", "X-Request-ID", "Header carrying the id of a request, kept from the scraper or generated, forwarded to etcd, returned in the response and logged. Empty disables request ids.")
+	set.Func("access-log-fields", "Comma separated fields of the default access log, from: "+strings.Join(accessLogFields, ", ")+". (default \""+defaultAccessLogFields+"\")", func(s string) error {
+		fields, err := parseAccessLogFields(s)
+		c.AccessLogFields = fields
+		return err
+	})
+	set.Var((*stringSlice)(&c.MetricAllow), "metric-allow", "Regex of metric family names to return; may be repeated. Defaults to all families.")
+	set.Var((*stringSlice)(&c.MetricDeny), "metric-deny", "Regex of metric family names to drop; may be repeated.")
+}
+
+// validate checks c for invalid or conflicting settings and fills in the
+// fields derived from others.
+func (c *Config) validate() error {
+	if c.UpstreamURL != "" {
+		u, err := url.Parse(c.UpstreamURL)
+		if err != nil {
+			return fmt.Errorf("invalid --upstream-url: %w", err)
+		}
+		switch u.Scheme {
+		case "unix", "unixs":
+			c.UpstreamScheme = "http"
+			if u.Scheme == "unixs" {
+				c.UpstreamScheme = "https"
+			}
+			if u.Path == "" {
+				return fmt.Errorf("--upstream-url %q is missing the socket path", c.UpstreamURL)
+			}
+			c.upstreamSocket = u.Path
+		case "http", "https":
+			if u.Hostname() == "" {
+				return fmt.Errorf("--upstream-url %q is missing the host", c.UpstreamURL)
+			}
+			if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+				return fmt.Errorf("--upstream-url %q may only have a scheme, host, port and path", c.UpstreamURL)
+			}
+			c.UpstreamScheme = u.Scheme
+			c.UpstreamHost = u.Hostname()
+			if u.Port() != "" {
+				port, err := strconv.Atoi(u.Port())
+				if err != nil || port < 1 || port > 65535 {
+					return fmt.Errorf("--upstream-url %q has an invalid port", c.UpstreamURL)
+				}
+				c.UpstreamPort = port
+			}
+			if u.Path != "" && u.Path != "/" {
+				c.upstreamPath = u.Path
+			}
+		default:
+			return fmt.Errorf("--upstream-url must be an http://, https://, unix:// or unixs:// url, got %q", c.UpstreamURL)
+		}
+	}
+	c.upstreamProxy = nil
+	if c.UpstreamProxyURL != "" {
+		u, err := url.Parse(c.UpstreamProxyURL)
+		if err != nil {
+			return errors.New("invalid --upstream-proxy-url")
+		}
+		if _, ok := upstreamProxyPorts[u.Scheme]; !ok {
+			return fmt.Errorf("--upstream-proxy-url must be an http://, https:// or socks5:// url, got %q", u.Redacted())
+		}
+		if u.Hostname() == "" {
+			return fmt.Errorf("--upstream-proxy-url %q is missing the host", u.Redacted())
+		}
+		if c.upstreamSocket != "" {
+			return errors.New("--upstream-proxy-url can't be used with a unix socket --upstream-url")
+		}
+		c.upstreamProxy = u
+	}
+	if err := c.parseTLSParameters(); err != nil {
+		return err
+	}
+	if err := c.parseRetryOn(); err != nil {
+		return err
+	}
+	switch c.UpstreamScheme {
+	case "https":
+		if c.SPIFFESocket != "" {
+			if len(c.EtcdCA) > 0 || c.UseSystemCA || c.InsecureSkipVerify || c.EtcdCert != "" || c.EtcdKey != "" || c.EtcdPKCS12 != "" {
+				return errors.New("--spiffe-socket can't be used with the file based etcd tls flags")
+			}
+			break
+		}
+		if c.SPIFFEServerID != "" {
+			return errors.New("--spiffe-server-id requires --spiffe-socket")
+		}
+		if c.VaultAddr != "" {
+			if err := c.validateVault(); err != nil {
+				return err
+			}
+			break
+		}
+		if c.EtcdTLSSecret != "" {
+			if c.EtcdCert != "" || c.EtcdKey != "" || c.EtcdPKCS12 != "" {
+				return errors.New("--etcd-tls-secret can't be used with --etcd-cert, --etcd-key or --etcd-pkcs12")
+			}
+			break
+		}
+		if len(c.EtcdCA) == 0 && !c.UseSystemCA && !c.InsecureSkipVerify {
+			return errors.New("--etcd-ca=<ca-file> or --use-system-ca is required")
+		}
+		if c.EtcdPKCS12 != "" {
+			if c.EtcdCert != "" || c.EtcdKey != "" {
+				return errors.New("--etcd-pkcs12 can't be used with --etcd-cert and --etcd-key")
+			}
+			break
+		}
+		if len(c.EtcdCert) == 0 {
+			return errors.New("--etcd-cert=<cert-file> or --etcd-pkcs12 is required")
+		}
+		if len(c.EtcdKey) == 0 {
+			return errors.New("--etcd-key=<key-file> is required")
+		}
+	case "http":
+		if len(c.EtcdCA) > 0 || c.UseSystemCA || c.InsecureSkipVerify || c.EtcdCert != "" || c.EtcdKey != "" || c.EtcdPKCS12 != "" || c.EtcdKeyPasswordFile != "" || c.SPIFFESocket != "" || c.VaultAddr != "" || c.EtcdTLSSecret != "" || c.EtcdCRL != "" || c.EtcdOCSP {
+			return errors.New("the etcd tls flags can't be used with --upstream-scheme=http")
+		}
+	default:
+		return fmt.Errorf("--upstream-scheme must be http or https, got %q", c.UpstreamScheme)
+	}
+	switch c.EtcdRevocationPolicy {
+	case "fail-open", "fail-closed":
+	default:
+		return fmt.Errorf("invalid --etcd-revocation-policy %q, must be fail-open or fail-closed", c.EtcdRevocationPolicy)
+	}
+	if c.EtcdCRL != "" || c.EtcdOCSP {
+		if c.SPIFFESocket != "" {
+			return errors.New("--etcd-crl and --etcd-ocsp can't be used with --spiffe-socket")
+		}
+		if c.InsecureSkipVerify {
+			return errors.New("--etcd-crl and --etcd-ocsp can't be used with --insecure-skip-verify")
+		}
+	}
+	discovery := 0
+	for _, set := range []bool{c.KubeDiscovery, c.UpstreamSRV != "", len(c.UpstreamEndpoints) > 0, c.UpstreamURL != ""} {
+		if set {
+			discovery++
+		}
+	}
+	if discovery > 1 {
+		return errors.New("--kube-discovery, --upstream-srv, --upstream-endpoint and --upstream-url are mutually exclusive")
+	}
+	for _, ep := range c.UpstreamEndpoints {
+		if _, _, err := net.SplitHostPort(ep); err != nil {
+			return fmt.Errorf("invalid --upstream-endpoint %q: %w", ep, err)
+		}
+	}
+	if c.UpstreamMetricsPort != 0 {
+		if c.UpstreamMetricsPort < 0 || c.UpstreamMetricsPort > 65535 {
+			return fmt.Errorf("invalid --upstream-metrics-port %d", c.UpstreamMetricsPort)
+		}
+		if c.upstreamSocket != "" {
+			return errors.New("--upstream-metrics-port can't be used with a unix socket --upstream-url")
+		}
+		switch c.UpstreamMetricsScheme {
+		case "", "http", "https", "auto":
+		default:
+			return fmt.Errorf("--upstream-metrics-scheme must be http, https or auto, got %q", c.UpstreamMetricsScheme)
+		}
+	}
+	if c.UpstreamMetricsDiscover {
+		if c.UpstreamMetricsPort != 0 {
+			return errors.New("--upstream-metrics-discover and --upstream-metrics-port are mutually exclusive")
+		}
+		if c.upstreamSocket != "" {
+			return errors.New("--upstream-metrics-discover can't be used with a unix socket --upstream-url")
+		}
+	}
+	if c.ClusterLabel != "" {
+		if !labelNameRE.MatchString(c.ClusterLabel) {
+			return fmt.Errorf("invalid --cluster-label %q", c.ClusterLabel)
+		}
+		if c.ClusterName == "" {
+			return errors.New("--cluster-label requires --cluster-name")
+		}
+	}
+	if c.JWTJWKSURL != "" {
+		if u, err := url.Parse(c.JWTJWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --jwt-jwks-url %q, must be an http or https url", c.JWTJWKSURL)
+		}
+		if c.JWTIssuer == "" || c.JWTAudience == "" {
+			return errors.New("--jwt-jwks-url requires --jwt-issuer and --jwt-audience")
+		}
+	} else if c.JWTIssuer != "" || c.JWTAudience != "" || len(c.JWTSubjects) > 0 {
+		return errors.New("--jwt-issuer, --jwt-audience and --jwt-subject require --jwt-jwks-url")
+	}
+	if c.UpstreamBearerTokenFile != "" && c.UpstreamUsername != "" {
+		return errors.New("--upstream-bearer-token-file and --upstream-username are mutually exclusive")
+	}
+	if c.UpstreamPasswordFile != "" && c.UpstreamUsername == "" {
+		return errors.New("--upstream-password-file requires --upstream-username")
+	}
+	if c.ScrapeTimeoutOffset < 0 {
+		return errors.New("--scrape-timeout-offset must not be negative")
+	}
+	if c.BackgroundScrapeInterval < 0 {
+		return errors.New("--background-scrape-interval must not be negative")
+	}
+	if c.TLSReloadDebounce < 0 {
+		return errors.New("--tls-reload-debounce must not be negative")
+	}
+	if c.EnableLifecycle && c.adminAddress() == "" {
+		return errors.New("--enable-lifecycle requires --admin-port or --admin-listen-address")
+	}
+	if err := c.scrapeTLS().validate(); err != nil {
+		return err
+	}
+	if err := c.adminTLS().validate(); err != nil {
+		return err
+	}
+	if c.adminTLS().enabled() && c.adminAddress() == "" {
+		return errors.New("--admin-tls-cert requires --admin-port or --admin-listen-address")
+	}
+	if c.RemoteWriteURL != "" {
+		u, err := url.Parse(c.RemoteWriteURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid --remote-write-url %q, must be an http or https url", c.RemoteWriteURL)
+		}
+		if c.RemoteWriteInterval <= 0 || c.RemoteWriteBatchSize <= 0 {
+			return errors.New("--remote-write-interval and --remote-write-batch-size must be positive")
+		}
+		if c.RemoteWriteBearerTokenFile != "" && c.RemoteWriteUsername != "" {
+			return errors.New("--remote-write-bearer-token-file and --remote-write-username are mutually exclusive")
+		}
+	}
+	if c.MaintenanceMetrics && c.MaintenanceMetricsInterval <= 0 {
+		return errors.New("--maintenance-metrics-interval must be positive")
+	}
+	if c.OTLPMetricsEndpoint != "" && c.OTLPMetricsInterval <= 0 {
+		return errors.New("--otlp-metrics-interval must be positive")
+	}
+	if c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		return errors.New("--max-idle-conns-per-host and --max-conns-per-host must not be negative")
+	}
+	if c.ScraperRequestsPerSecond < 0 {
+		return errors.New("--scraper-requests-per-second must not be negative")
+	}
+	if c.ScraperRequestsPerSecond > 0 && c.ScraperBurst < 1 {
+		return errors.New("--scraper-burst must be at least 1")
+	}
+	if c.TLSSessionCacheSize <= 0 {
+		return errors.New("--tls-session-cache-size must be positive, use --disable-tls-resumption to turn resumption off")
+	}
+	switch c.ValidateExposition {
+	case "off", "reject", "repair":
+	default:
+		return fmt.Errorf("invalid --validate-exposition %q, must be off, reject or repair", c.ValidateExposition)
+	}
+	switch c.RequestLogMode {
+	case "all", "sampled", "off":
+	default:
+		return fmt.Errorf("invalid --request-log-mode %q, must be all, sampled or off", c.RequestLogMode)
+	}
+	if c.RequestLogRate < 0 || c.RequestLogRate > 1 {
+		return fmt.Errorf("--request-log-sample-rate must be between 0 and 1, got %g", c.RequestLogRate)
+	}
+	if strings.ContainsAny(c.RequestIDHeader, " \t\r\n:") {
+		return fmt.Errorf("invalid --request-id-header %q", c.RequestIDHeader)
+	}
+	switch c.AccessLogFormat {
+	case "default", "common", "none":
+	default:
+		return fmt.Errorf("invalid --access-log-format %q, must be default, common or none", c.AccessLogFormat)
+	}
+	if c.KubeDiscovery && (c.KubeService == "") == (c.KubeSelector == "") {
+		return errors.New("--kube-discovery requires exactly one of --kube-service or --kube-selector")
+	}
+	if c.KubePortName != "" && c.KubeService == "" {
+		return errors.New("--kube-port-name requires --kube-service")
+	}
+	return nil
+}
+
+// CheckConfig validates cfg and the --config file it refers to without
+// connecting to etcd or opening any listener.
+func CheckConfig(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	fc, err := loadFileConfig(cfg.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if _, err := buildRewrite(&cfg, fc); err != nil {
+		return fmt.Errorf("invalid metric filter: %w", err)
+	}
+	if _, err := parsePrefixes(cfg.AllowedCIDRs); err != nil {
+		return fmt.Errorf("invalid --allowed-cidrs: %w", err)
+	}
+	if _, err := parsePrefixes(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid --trusted-proxies: %w", err)
+	}
+	return nil
+}
+
+// Proxy serves the metrics of an upstream etcd.
+type Proxy struct {
+	cfg Config
+
+	switcher *transportSwitcher
+	targets  *upstreamTargets
+	reload   *reloader
+
+	metrics http.Handler
+	handler http.Handler
+	admin   *http.ServeMux
+
+	remoteWriter    *remoteWriter
+	exporter        *otlpExporter
+	shutdownTracing func(context.Context) error
+	// spiffe provides the client certificate with --spiffe-socket.
+	spiffe *workloadapi.X509Source
+	// vault issues the client certificate with --vault-addr.
+	vault *vaultIssuer
+	// leader tracks the leadership of the upstream members.
+	leader *leaderTracker
+	// snapshots serves the snapshots of --background-scrape-interval.
+	snapshots *snapshotter
+	// prober checks the health of every upstream member.
+	prober *memberProber
+	// maintenance synthesizes the --maintenance-metrics series.
+	maintenance *maintenanceMetrics
+	// metricsListener, if set, merges in etcd's metrics listener.
+	metricsListener *metricsListenerMerger
+	// secret holds the tls material with --etcd-tls-secret.
+	secret        *tlsSecret
+	secretVersion string
+	// clusters are the additional clusters from the config file.
+	clusters map[string]*Proxy
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// NewProxy validates cfg and sets up the upstream transport, rewriting
+// pipeline and handlers. Nothing is started until Run.
+func NewProxy(cfg Config) (*Proxy, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	p := &Proxy{cfg: cfg, quit: make(chan struct{})}
+	c := &p.cfg
+
+	fc, err := loadFileConfig(c.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	rewrite, err := buildRewrite(c, fc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric filter: %w", err)
+	}
+	pipeline := &rewritePipeline{}
+	pipeline.store(rewrite)
+
+	useTLS := c.UpstreamScheme == "https"
+	scheme := c.UpstreamScheme
+	host := net.JoinHostPort(c.UpstreamHost, strconv.Itoa(c.UpstreamPort))
+	if c.upstreamSocket != "" {
+		host = "localhost"
+	}
+
+	if useTLS && (c.EtcdCRL != "" || c.EtcdOCSP) {
+		if c.revocation, err = newRevocationChecker(c); err != nil {
+			return nil, err
+		}
+	}
+	transport := buildHTTPTransport(c)
+	if useTLS && c.SPIFFESocket != "" {
+		if p.spiffe, err = newSPIFFESource(c); err != nil {
+			return nil, err
+		}
+		tlsConfig, err := spiffeTLSConfig(c, p.spiffe)
+		if err != nil {
+			p.spiffe.Close()
+			return nil, err
+		}
+		transport = buildHTTPSTransport(c, tlsConfig)
+	} else if useTLS && c.VaultAddr != "" {
+		if p.vault, err = newVaultIssuer(c); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		tlsConfig, err := p.vault.issue(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to issue etcd client certificate from vault: %w", err)
+		}
+		transport = buildHTTPSTransport(c, tlsConfig)
+		tlsLastSuccessfulReload.WithLabelValues(c.cluster).SetToCurrentTime()
+		recordVaultExpiry(c, tlsConfig)
+	} else if useTLS && c.EtcdTLSSecret != "" {
+		if p.secret, err = newTLSSecret(c); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		secret, err := p.secret.get(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tls secret %s: %w", p.secret, err)
+		}
+		tlsConfig, err := p.secret.tlsConfig(c, secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls configuration: %w", err)
+		}
+		p.secretVersion = secret.Metadata.ResourceVersion
+		transport = buildHTTPSTransport(c, tlsConfig)
+		tlsLastSuccessfulReload.WithLabelValues(c.cluster).SetToCurrentTime()
+		recordLeafExpiry(c, "secret:"+p.secret.String(), tlsConfig.Certificates[0].Leaf)
+	} else if useTLS {
+		if c.InsecureSkipVerify {
+			slog.Warn("--insecure-skip-verify is set: the etcd server certificate is NOT verified and the connection can be intercepted, don't use this in production")
+		}
+		tlsConfig, err := waitForTLSConfig(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls configuration: %w", err)
+		}
+		transport = buildHTTPSTransport(c, tlsConfig)
+		tlsLastSuccessfulReload.WithLabelValues(c.cluster).SetToCurrentTime()
+		recordCertExpiry(c)
+	}
+	if useTLS {
+		initTLSReloadMetrics(c.cluster)
+	}
+	p.switcher = newTransportSwitcher(transport)
+	auth := newUpstreamAuth(c)
+	checker := &upstreamChecker{transport: p.switcher, auth: auth, path: c.metricsPath(), timeout: c.DialTimeout}
+
+	p.targets = newUpstreamTargets(host)
+	if len(c.UpstreamEndpoints) > 0 {
+		p.targets = newUpstreamTargets(c.UpstreamEndpoints...)
+	}
+	if c.KubeDiscovery {
+		p.targets = newUpstreamTargets()
+	}
+	flagTargets := p.targets.all()
+	if endpoints := fileEndpoints(c, fc); len(endpoints) > 0 {
+		if c.discovers() {
+			return nil, errors.New("upstream_endpoints of the config file can't be used with discovery or a unix socket --upstream-url")
+		}
+		p.targets = newUpstreamTargets(endpoints...)
+	}
+	settings := &runtimeSettings{}
+	settings.apply(c, fc)
+	// connections to members that went away are not reused.
+	p.targets.onChange = p.switcher.CloseIdleConnections
+	checker.targets = p.targets
+
+	// the Workload API, vault and the secret watch rotate the certificate,
+	// there are no files to reload.
+	fileTLS := useTLS && p.spiffe == nil && p.vault == nil && p.secret == nil
+	p.reload = &reloader{c: c, tls: fileTLS, switcher: p.switcher, pipeline: pipeline, settings: settings, targets: p.targets, flagTargets: flagTargets, checker: checker, fc: fc}
+
+	authed := withAuth(p.switcher, auth)
+	upstream := authed
+	if c.OTLPEndpoint != "" {
+		// clusters use the tracer provider of their parent.
+		if c.cluster == "" {
+			if p.shutdownTracing, err = setupTracing(context.Background(), c.OTLPEndpoint); err != nil {
+				return nil, fmt.Errorf("failed to set up tracing: %w", err)
+			}
+		}
+		upstream = tracedTransport(authed)
+	}
+	if c.LeaderLabel || c.LeaderOnly || c.MemberRoleLabels {
+		p.leader = &leaderTracker{
+			targets:   p.targets,
+			transport: authed,
+			scheme:    scheme,
+			timeout:   c.UpstreamTimeout,
+			interval:  c.LeaderCheckInterval,
+			roles:     c.MemberRoleLabels,
+		}
+	}
+	if c.MemberHealthInterval > 0 {
+		p.prober = &memberProber{
+			targets:   p.targets,
+			transport: authed,
+			scheme:    scheme,
+			interval:  c.MemberHealthInterval,
+		}
+	}
+	if c.MaintenanceMetrics {
+		p.maintenance = &maintenanceMetrics{
+			targets:   p.targets,
+			transport: authed,
+			scheme:    scheme,
+			timeout:   c.UpstreamTimeout,
+			interval:  c.MaintenanceMetricsInterval,
+		}
+	}
+	if c.UpstreamMetricsPort > 0 {
+		metricsScheme := c.UpstreamMetricsScheme
+		if metricsScheme == "" {
+			metricsScheme = scheme
+		}
+		p.metricsListener = &metricsListenerMerger{transport: upstream, scheme: metricsScheme, port: c.UpstreamMetricsPort}
+		if metricsScheme == "auto" {
+			p.metricsListener.probe = &schemeProber{timeout: c.DialTimeout, dial: upstreamDialer(c).DialContext}
+		}
+	}
+	if c.UpstreamMetricsDiscover {
+		p.metricsListener = &metricsListenerMerger{transport: upstream, discovery: &metricsListenerDiscovery{transport: upstream, scheme: scheme}}
+	}
+	var leaderOnly *leaderTracker
+	if c.LeaderOnly {
+		leaderOnly = p.leader
+	}
+	trusted, err := parsePrefixes(c.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --trusted-proxies: %w", err)
+	}
+	forward := c.ForwardHeaders
+	if c.RequestIDHeader != "" {
+		forward = append(slices.Clone(forward), c.RequestIDHeader)
+	}
+	headers := newHeaderScrubber(forward, trusted)
+	retry, breaker := newRetryPolicy(c), newCircuitBreaker(c)
+	p.targets.onRemove = func(removed []string) {
+		breaker.forget(removed)
+		p.metricsListener.forget(removed)
+	}
+	proxy := newUpstreamProxy(scheme, &failoverTransport{
+		targets:    p.targets,
+		next:       upstream,
+		leaderOnly: leaderOnly,
+		retry:      retry,
+		breaker:    breaker,
+	}, headers)
+
+	var clusterLabel rewriteFunc
+	if c.ClusterLabel != "" {
+		name := c.ClusterName
+		if c.cluster != "" {
+			name = c.cluster
+		}
+		clusterLabel = labelRewrite(c.ClusterLabel, name)
+	}
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		if c.upstreamPath != "" {
+			req.URL.Path, req.URL.RawPath = c.upstreamPath, ""
+		}
+		if q := req.URL.Query(); c.HTTPSD && q.Has("member") {
+			q.Del("member")
+			req.URL.RawQuery = q.Encode()
+		}
+		// the body is modified by the proxy, so ask for a text format and
+		// let the transport handle compression transparently.
+		if c.ServeStale || c.LeaderLabel || c.MemberRoleLabels || c.ClusterLabel != "" || c.ValidateExposition != "off" || c.MaintenanceMetrics || p.metricsListener != nil || pipeline.load() != nil {
+			req.Header.Set("Accept", textAccept(req.Header.Get("Accept")))
+			req.Header.Del("Accept-Encoding")
+		}
+	}
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if err := modifyResponse(resp); err != nil {
+			return err
+		}
+		if c.MaxResponseBytes > 0 {
+			if err := limitResponseBody(resp, c.MaxResponseBytes); err != nil {
+				return err
+			}
+		}
+		if c.ValidateExposition != "off" {
+			if err := validateResponse(resp, c.ValidateExposition); err != nil {
+				return err
+			}
+		}
+		rewrite := pipeline.load()
+		if c.LeaderLabel {
+			if label := p.leader.leaderRewrite(resp.Header.Get(upstreamHeader)); label != nil && rewrite != nil {
+				rewrite = chainRewrites(rewrite, label)
+			} else if label != nil {
+				rewrite = label
+			}
+		}
+		if c.MemberRoleLabels {
+			if label := p.leader.roleRewrite(resp.Header.Get(upstreamHeader)); label != nil && rewrite != nil {
+				rewrite = chainRewrites(rewrite, label)
+			} else if label != nil {
+				rewrite = label
+			}
+		}
+		if clusterLabel != nil {
+			if rewrite != nil {
+				rewrite = chainRewrites(rewrite, clusterLabel)
+			} else {
+				rewrite = clusterLabel
+			}
+		}
+		if (rewrite == nil && p.maintenance == nil && p.metricsListener == nil) || resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		_, span := otel.Tracer(tracerName).Start(resp.Request.Context(), "rewrite")
+		upstreamBody := resp.Body
+		body := io.Reader(upstreamBody)
+		// an upstream may compress even though it was not asked to.
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(upstreamBody)
+			if err != nil {
+				upstreamBody.Close()
+				span.End()
+				return err
+			}
+			body = gz
+			resp.Header.Del("Content-Encoding")
+		}
+		addr := resp.Header.Get(upstreamHeader)
+		var upstream *bytes.Buffer
+		if p.metricsListener != nil {
+			// merging needs the whole exposition of the client port.
+			upstream = getBuffer()
+			_, err := upstream.ReadFrom(body)
+			if err != nil {
+				putBuffer(upstream)
+				upstreamBody.Close()
+				span.End()
+				return err
+			}
+			p.metricsListener.mergeInto(resp.Request.Context(), upstream, addr, resp.Request.Header.Get("Accept"))
+			body = upstream
+		}
+		// the synthesized series are filtered and renamed like the rest.
+		tail := getBuffer()
+		if p.maintenance != nil {
+			p.maintenance.appendTo(tail, addr)
+		}
+		if rewrite == nil {
+			rewrite = func(*line) bool { return true }
+		}
+		// the exposition is rewritten line by line as the scraper reads it,
+		// so memory doesn't grow with its size.
+		pr, pw := io.Pipe()
+		go func() {
+			defer span.End()
+			defer upstreamBody.Close()
+			defer putBuffer(tail)
+			if upstream != nil {
+				defer putBuffer(upstream)
+			}
+			pw.CloseWithError(streamExposition(pw, body, tail.Bytes(), rewrite))
+		}()
+		resp.Body = pr
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+
+	var metrics http.Handler = withTimeout(proxy, settings.timeout)
+	if c.HonorScrapeTimeout {
+		metrics = withScrapeTimeout(proxy, settings.timeout, c.ScrapeTimeoutOffset)
+	}
+	if c.ServeStale {
+		metrics = &staleHandler{next: metrics}
+	}
+	if c.BackgroundScrapeInterval > 0 {
+		p.snapshots = newSnapshotter(metrics, c)
+		metrics = p.snapshots
+	}
+	if c.CompressResponses {
+		metrics = &gzipHandler{next: metrics}
+	}
+	if c.CoalesceRequests {
+		metrics = &coalescingHandler{next: metrics}
+	}
+	// with a config file, cache_ttl may enable the cache on reload.
+	if c.CacheTTL > 0 || c.ConfigFile != "" {
+		metrics = newResponseCache(metrics, settings.ttl)
+	}
+	if c.HTTPSD {
+		metrics = withMemberPinning(metrics, p.targets)
+	}
+	if c.MaxRequestsPerSecond > 0 {
+		metrics = rateLimited(metrics, rate.NewLimiter(rate.Limit(c.MaxRequestsPerSecond), c.Burst))
+	}
+	if c.ScraperMetrics || c.ScraperRequestsPerSecond > 0 {
+		metrics = newScraperAccounting(metrics, c, trusted)
+	}
+	var allowlist *ipAllowlist
+	var jwtAuth *jwtAuthenticator
+	if c.JWTJWKSURL != "" {
+		jwtAuth = newJWTAuthenticator(metrics, c)
+		metrics = jwtAuth
+	}
+	// the source address is checked first, so clients outside the allowed
+	// networks can't make the proxy verify tokens and fetch the jwks.
+	if len(c.AllowedCIDRs) > 0 {
+		allowed, err := parsePrefixes(c.AllowedCIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --allowed-cidrs: %w", err)
+		}
+		allowlist = &ipAllowlist{next: metrics, allowed: allowed, trusted: trusted}
+		metrics = allowlist
+	}
+	if c.OTLPEndpoint != "" {
+		metrics = tracedHandler(metrics, "scrape")
+	}
+	p.metrics = metrics
+
+	if c.RemoteWriteURL != "" {
+		p.remoteWriter = &remoteWriter{
+			url:        c.RemoteWriteURL,
+			interval:   c.RemoteWriteInterval,
+			batchSize:  c.RemoteWriteBatchSize,
+			maxRetries: c.RemoteWriteMaxRetries,
+			auth: &httpAuth{
+				username:        c.RemoteWriteUsername,
+				passwordFile:    c.RemoteWritePasswordFile,
+				bearerTokenFile: c.RemoteWriteBearerTokenFile,
+			},
+			source: withTimeout(proxy, settings.timeout),
+			client: &http.Client{},
+		}
+	}
+	if c.OTLPMetricsEndpoint != "" {
+		p.exporter, err = newOTLPExporter(c.OTLPMetricsEndpoint, c.OTLPMetricsProtocol, c.OTLPMetricsInterval, withTimeout(proxy, settings.timeout))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --otlp-metrics-endpoint: %w", err)
+		}
+	}
+
+	server := http.NewServeMux()
+	server.Handle("/metrics", readOnly(metrics))
+	if c.HTTPSD {
+		// the member addresses are only listed to scrapers let in to /metrics.
+		sd := p.sdHandler()
+		if jwtAuth != nil {
+			a := *jwtAuth
+			a.next, sd = sd, &a
+		}
+		if allowlist != nil {
+			a := *allowlist
+			a.next, sd = sd, &a
+		}
+		server.Handle("/sd", readOnly(sd))
+	}
+	if c.ProxyHealth || c.ProxyVersion || c.ProxyPprof {
+		passthrough := newUpstreamProxy(scheme, &failoverTransport{
+			targets: p.targets,
+			next:    upstream,
+			retry:   retry,
+			breaker: breaker,
+		}, headers)
+		if c.ProxyHealth {
+			server.Handle("/health", readOnly(withTimeout(passthrough, settings.timeout)))
+		}
+		if c.ProxyVersion {
+			server.Handle("/version", readOnly(withTimeout(passthrough, settings.timeout)))
+		}
+		if c.ProxyPprof {
+			// profiles run for a caller supplied duration, so the upstream
+			// timeout is not applied. /debug/pprof/symbol takes POST.
+			server.Handle("/debug/pprof/", passthrough)
+		}
+	}
+	if c.ServeProxyMetrics {
+		server.Handle("/proxy-metrics", readOnly(selfMetricsHandler()))
+	}
+	server.Handle("/buildinfo", readOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(version.Get())
+	})))
+	server.Handle("/healthz", readOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})))
+	server.Handle("/readyz", readOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checker.check(r.Context()); err != nil {
+			slog.Warn("readiness check failed", "err", err)
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})))
+	if c.CatchAllHealth {
+		server.Handle("/", readOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		})))
+	}
+	if c.cluster == "" && len(fc.Clusters) > 0 {
+		p.clusters = make(map[string]*Proxy, len(fc.Clusters))
+		for _, cc := range fc.Clusters {
+			cfg, err := c.clusterConfig(cc)
+			if err != nil {
+				return nil, err
+			}
+			cluster, err := NewProxy(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("cluster %q: %w", cc.Name, err)
+			}
+			p.clusters[cc.Name] = cluster
+			p.reload.clusters = append(p.reload.clusters, cluster.reload)
+			prefix := "/clusters/" + cc.Name
+			server.Handle(prefix+"/", http.StripPrefix(prefix, cluster.handler))
+		}
+	}
+	p.handler = server
+	if c.AuditLog != "" {
+		audit, err := openAuditLog(c.AuditLog, trusted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open --audit-log: %w", err)
+		}
+		p.handler = audit.wrap(p.handler)
+	}
+	if c.AccessLogFormat != "none" {
+		sampler := requestSampler{mode: c.RequestLogMode, rate: c.RequestLogRate}
+		p.handler = accessLogged(p.handler, c.AccessLogFormat, c.AccessLogFields, sampler, os.Stdout)
+	}
+	if c.RequestIDHeader != "" {
+		p.handler = withRequestIDs(p.handler, c.RequestIDHeader)
+	}
+
+	p.admin = newAdminMux()
+	if c.EnableLifecycle {
+		registerLifecycle(p.admin, p.reload, p.Quit)
+	}
+	return p, nil
+}
+
+// MetricsHandler returns the handler serving the proxied /metrics.
+func (p *Proxy) MetricsHandler() http.Handler {
+	return p.metrics
+}
+
+// Handler returns the handler of the scrape listener: /metrics along with
+// the health, readiness and passthrough endpoints.
+func (p *Proxy) Handler() http.Handler {
+	return p.handler
+}
+
+// AdminHandler returns the handler of the admin listener: pprof, expvar,
+// the proxy's own metrics and, when enabled, the lifecycle endpoints.
+func (p *Proxy) AdminHandler() http.Handler {
+	return p.admin
+}
+
+// Reload reloads the tls material and config file, keeping the current
+// configuration if either fails.
+func (p *Proxy) Reload() error {
+	return p.reload.reloadAll()
+}
+
+// Quit makes Run shut down gracefully.
+func (p *Proxy) Quit() {
+	p.quitOnce.Do(func() { close(p.quit) })
+}
+
+// startDiscovery starts following the upstream members if discovery is
+// configured, until ctx is done.
+func (p *Proxy) startDiscovery(ctx context.Context) error {
+	c := &p.cfg
+	scheme := c.UpstreamScheme
+	switch {
+	case c.KubeDiscovery:
+		if err := startKubeDiscovery(ctx, c, p.targets); err != nil {
+			return err
+		}
+		slog.Info("will proxy discovered kubernetes members", "scheme", scheme)
+	case len(c.UpstreamEndpoints) > 0:
+		slog.Info("will proxy", "scheme", scheme, "endpoints", c.UpstreamEndpoints)
+	case c.UpstreamSRV != "" || c.DNSRefreshInterval > 0:
+		startDNSDiscovery(ctx, c, p.targets)
+		slog.Info("will proxy dns discovered members", "scheme", scheme)
+	case c.UpstreamURL != "":
+		slog.Info("will proxy", "upstream", c.UpstreamURL)
+	default:
+		slog.Info("will proxy", "upstream", scheme+"://"+p.targets.current())
+	}
+	return nil
+}
+
+// start begins discovery and the tls and config reload loops of the proxy
+// and its clusters, until ctx is done.
+func (p *Proxy) start(ctx context.Context) error {
+	c := &p.cfg
+	if err := p.startDiscovery(ctx); err != nil {
+		return err
+	}
+	go p.reload.watchSIGHUP(ctx)
+	go p.reload.checker.waitReady(ctx)
+	if p.reload.tls && c.TLSWatch {
+		go p.reload.watchAndReloadTLS(ctx)
+	}
+	if c.ConfigFile != "" && c.ConfigWatch {
+		go p.reload.watchAndReloadConfig(ctx)
+	}
+	if p.reload.tls && c.TLSReloadInterval > 0 {
+		go p.reload.pollTLS(ctx, c.TLSReloadInterval)
+	}
+	if p.spiffe != nil {
+		go watchSVID(ctx, p.spiffe)
+	}
+	if p.vault != nil {
+		go p.vault.run(ctx, p.switcher)
+	}
+	if p.leader != nil {
+		p.leader.refresh(ctx)
+		go p.leader.run(ctx)
+	}
+	if p.maintenance != nil {
+		p.maintenance.refresh(ctx)
+		go p.maintenance.run(ctx)
+	}
+	if p.prober != nil {
+		go p.prober.run(ctx)
+	}
+	if p.snapshots != nil {
+		go p.snapshots.run(ctx)
+	}
+	if p.metricsListener != nil && p.metricsListener.probe != nil {
+		go p.metricsListener.probeAll(ctx, p.targets.all())
+	}
+	if p.secret != nil {
+		go p.secret.watch(ctx, p.secretVersion, func(secret *kubeSecret) {
+			p.reload.applySecret(p.secret, secret)
+		})
+	}
+	for _, cluster := range p.clusters {
+		if err := cluster.start(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeSPIFFE closes the Workload API sources of the proxy and its clusters.
+func (p *Proxy) closeSPIFFE() {
+	if p.spiffe != nil {
+		p.spiffe.Close()
+	}
+	for _, cluster := range p.clusters {
+		cluster.closeSPIFFE()
+	}
+}
+
+// Run starts discovery, reloading and any push exporters, serves the
+// configured listeners and blocks until ctx is done or Quit is called, then
+// drains in-flight requests for up to the shutdown timeout.
+func (p *Proxy) Run(ctx context.Context) error {
+	c := &p.cfg
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if p.shutdownTracing != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := p.shutdownTracing(ctx); err != nil {
+				slog.Warn("failed to flush traces", "err", err)
+			}
+		}()
+	}
+	defer p.closeSPIFFE()
+
+	if err := p.start(ctx); err != nil {
+		return err
+	}
+	if p.remoteWriter != nil {
+		slog.Info("pushing metrics with remote write", "url", c.RemoteWriteURL, "interval", c.RemoteWriteInterval)
+		go p.remoteWriter.run(ctx)
+	}
+	if p.exporter != nil {
+		slog.Info("exporting metrics over otlp", "endpoint", c.OTLPMetricsEndpoint, "protocol", c.OTLPMetricsProtocol, "interval", c.OTLPMetricsInterval)
+		go p.exporter.run(ctx)
+	}
+
+	// sockets handed over by the process this one upgrades, or else passed
+	// by systemd socket activation, replace --listen-address.
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	listeners := inherited.scrape
+	if len(listeners) > 0 {
+		slog.Info("using the sockets of the upgraded process", "count", len(listeners))
+	} else if listeners, err = systemdListeners(); err != nil {
+		return err
+	} else if len(listeners) > 0 {
+		slog.Info("using the sockets passed by systemd", "count", len(listeners))
+	}
+	if len(listeners) == 0 {
+		addrs := c.ListenAddresses
+		if len(addrs) == 0 {
+			addrs = []string{fmt.Sprintf(":%d", c.Port)}
+		}
+		for _, addr := range addrs {
+			l, err := listen(addr, c)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	// the sockets handed over on the next upgrade, before tls is added.
+	next := &handoff{scrape: slices.Clone(listeners)}
+	if listeners, err = withListenerTLS(listeners, c.scrapeTLS()); err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: p.handler}
+	if c.H2C {
+		if err := enableH2C(srv); err != nil {
+			return fmt.Errorf("failed to enable h2c: %w", err)
+		}
+	}
+	servers := []*http.Server{srv}
+	errc := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		slog.Info("listening", "addr", l.Addr().String(), "tls", c.scrapeTLS().enabled())
+		go func() {
+			errc <- srv.Serve(l)
+		}()
+	}
+	if addr := c.adminAddress(); addr != "" {
+		l := inherited.admin
+		if l == nil {
+			if l, err = listen(addr, c); err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+		}
+		next.admin = l
+		adminListeners, err := withListenerTLS([]net.Listener{l}, c.adminTLS())
+		if err != nil {
+			return err
+		}
+		admin := &http.Server{Handler: p.admin}
+		servers = append(servers, admin)
+		slog.Info("admin listening", "addr", l.Addr().String(), "tls", c.adminTLS().enabled())
+		go func() {
+			errc <- admin.Serve(adminListeners[0])
+		}()
+	}
+	if inherited.admin != nil && next.admin == nil {
+		inherited.admin.Close()
+	}
+	notifySystemd("READY=1")
+	inherited.signalReady()
+	if interval := systemdWatchdogInterval(); interval > 0 {
+		go runSystemdWatchdog(ctx, interval)
+	}
+	upgraded := make(chan struct{})
+	go watchUpgrade(ctx, next, upgraded)
+
+	select {
+	case err = <-errc:
+		err = fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
+	case <-p.quit:
+	case <-upgraded:
+	}
+
+	select {
+	case <-upgraded:
+		// the new process is the one systemd tracks now.
+	default:
+		notifySystemd("STOPPING=1")
+	}
+	slog.Info("shutting down, draining connections", "timeout", c.ShutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancelShutdown()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutdown did not complete", "err", err)
+		}
+	}
+	p.switcher.CloseIdleConnections()
+	slog.Info("stopped")
+	return err
+}
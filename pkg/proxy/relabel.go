@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	relabelAdd    = "add"
+	relabelRename = "rename"
+	relabelDrop   = "drop"
+)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// relabelRule modifies the labels of every proxied sample.
+//
+//	add:    set label to value, replacing any existing value.
+//	rename: move the value of label to target.
+//	drop:   remove label.
+type relabelRule struct {
+	Action string `yaml:"action"`
+	Label  string `yaml:"label"`
+	Value  string `yaml:"value,omitempty"`
+	Target string `yaml:"target,omitempty"`
+}
+
+func (r *relabelRule) validate() error {
+	if !labelNameRE.MatchString(r.Label) {
+		return fmt.Errorf("invalid label name %q", r.Label)
+	}
+	switch r.Action {
+	case relabelAdd, relabelDrop:
+	case relabelRename:
+		if !labelNameRE.MatchString(r.Target) {
+			return fmt.Errorf("invalid target label name %q", r.Target)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	return nil
+}
+
+// relabeler applies relabel rules, in order, to sample lines.
+type relabeler struct {
+	rules []relabelRule
+}
+
+func (r *relabeler) rewrite(l *line) bool {
+	if l.kind != lineSample {
+		return true
+	}
+	for _, rule := range r.rules {
+		switch rule.Action {
+		case relabelAdd:
+			l.labels = setLabel(l.labels, rule.Label, rule.Value)
+		case relabelRename:
+			if v, ok := getLabel(l.labels, rule.Label); ok {
+				l.labels = setLabel(deleteLabel(l.labels, rule.Label), rule.Target, v)
+			}
+		case relabelDrop:
+			l.labels = deleteLabel(l.labels, rule.Label)
+		}
+	}
+	return true
+}
+
+func getLabel(labels []label, name string) (string, bool) {
+	for _, lb := range labels {
+		if lb.name == name {
+			return lb.value, true
+		}
+	}
+	return "", false
+}
+
+func setLabel(labels []label, name, value string) []label {
+	for i := range labels {
+		if labels[i].name == name {
+			labels[i].value = value
+			return labels
+		}
+	}
+	return append(labels, label{name: name, value: value})
+}
+
+func deleteLabel(labels []label, name string) []label {
+	for i := range labels {
+		if labels[i].name == name {
+			return append(labels[:i], labels[i+1:]...)
+		}
+	}
+	return labels
+}
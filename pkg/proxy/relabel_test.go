@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRelabelRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    relabelRule
+		wantErr bool
+	}{
+		{"add", relabelRule{Action: "add", Label: "cluster", Value: "prod"}, false},
+		{"add an empty value", relabelRule{Action: "add", Label: "cluster"}, false},
+		{"rename", relabelRule{Action: "rename", Label: "instance", Target: "member"}, false},
+		{"drop", relabelRule{Action: "drop", Label: "instance"}, false},
+		{"invalid label", relabelRule{Action: "add", Label: "cluster-name", Value: "prod"}, true},
+		{"label starting with a digit", relabelRule{Action: "drop", Label: "1st"}, true},
+		{"rename without target", relabelRule{Action: "rename", Label: "instance"}, true},
+		{"invalid target", relabelRule{Action: "rename", Label: "instance", Target: "etcd.member"}, true},
+		{"unknown action", relabelRule{Action: "replace", Label: "instance"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRelabeler(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []relabelRule
+		in    string
+		want  string
+	}{
+		{
+			name:  "add a static label",
+			rules: []relabelRule{{Action: "add", Label: "cluster", Value: "prod"}},
+			in: `# HELP etcd_server_has_leader Whether or not a leader exists.
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+grpc_server_handled_total{grpc_code="OK"} 42
+`,
+			want: `# HELP etcd_server_has_leader Whether or not a leader exists.
+# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader{cluster="prod"} 1
+grpc_server_handled_total{grpc_code="OK",cluster="prod"} 42
+`,
+		},
+		{
+			name:  "add replaces the value",
+			rules: []relabelRule{{Action: "add", Label: "cluster", Value: "prod"}},
+			in:    `etcd_server_has_leader{cluster="dev",member="etcd-0"} 1` + "\n",
+			want:  `etcd_server_has_leader{cluster="prod",member="etcd-0"} 1` + "\n",
+		},
+		{
+			name:  "add escapes the value",
+			rules: []relabelRule{{Action: "add", Label: "note", Value: "a \"b\"\\c\nd"}},
+			in:    "etcd_server_has_leader 1\n",
+			want:  `etcd_server_has_leader{note="a \"b\"\\c\nd"} 1` + "\n",
+		},
+		{
+			name:  "rename",
+			rules: []relabelRule{{Action: "rename", Label: "instance", Target: "member"}},
+			in: `etcd_server_has_leader{instance="etcd-0",job="etcd"} 1
+etcd_server_is_leader{job="etcd"} 0
+`,
+			want: `etcd_server_has_leader{job="etcd",member="etcd-0"} 1
+etcd_server_is_leader{job="etcd"} 0
+`,
+		},
+		{
+			name:  "rename onto an existing label",
+			rules: []relabelRule{{Action: "rename", Label: "instance", Target: "member"}},
+			in:    `etcd_server_has_leader{member="old",instance="etcd-0"} 1` + "\n",
+			want:  `etcd_server_has_leader{member="etcd-0"} 1` + "\n",
+		},
+		{
+			name:  "drop",
+			rules: []relabelRule{{Action: "drop", Label: "instance"}},
+			in:    `etcd_server_has_leader{instance="etcd-0"} 1 1700000000000` + "\n",
+			want:  "etcd_server_has_leader 1 1700000000000\n",
+		},
+		{
+			name: "rules apply in order",
+			rules: []relabelRule{
+				{Action: "add", Label: "cluster", Value: "prod"},
+				{Action: "rename", Label: "cluster", Target: "env"},
+				{Action: "drop", Label: "job"},
+			},
+			in:   `etcd_server_has_leader{job="etcd"} 1` + "\n",
+			want: `etcd_server_has_leader{env="prod"} 1` + "\n",
+		},
+		{
+			name:  "comments are left alone",
+			rules: []relabelRule{{Action: "add", Label: "cluster", Value: "prod"}},
+			in:    "# instance is a label\n# EOF\n",
+			want:  "# instance is a label\n# EOF\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &relabeler{rules: tt.rules}
+			var b strings.Builder
+			if err := rewriteExposition(strings.NewReader(tt.in), &b, r.rewrite); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFileConfigRelabel(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    []relabelRule
+		wantErr string
+	}{
+		{
+			name: "rules",
+			file: `relabel:
+  - action: add
+    label: cluster
+    value: prod
+  - action: rename
+    label: instance
+    target: member
+  - action: drop
+    label: job
+`,
+			want: []relabelRule{
+				{Action: "add", Label: "cluster", Value: "prod"},
+				{Action: "rename", Label: "instance", Target: "member"},
+				{Action: "drop", Label: "job"},
+			},
+		},
+		{
+			name:    "invalid rule",
+			file:    "relabel:\n  - action: add\n    label: cluster\n  - action: rename\n    label: instance\n",
+			wantErr: "relabel rule 1: invalid target label name",
+		},
+		{
+			name:    "unknown field",
+			file:    "relabel:\n  - action: add\n    label: cluster\n    replacement: prod\n",
+			wantErr: "field replacement not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			fc, err := loadFileConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadFileConfig() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fc.Relabel, tt.want) {
+				t.Errorf("got %+v, want %+v", fc.Relabel, tt.want)
+			}
+		})
+	}
+}
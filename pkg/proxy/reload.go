@@ -0,0 +1,516 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// loadTLSConfig reads the etcd CAs, client certificate and key from disk.
+func loadTLSConfig(c *Config) (*tls.Config, error) {
+	pool, err := loadCAPool(c.EtcdCA, c.UseSystemCA)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadClientCertificate(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load etcd client certificate: %w", err)
+	}
+	return &tls.Config{
+		RootCAs:            pool,
+		Certificates:       []tls.Certificate{cert},
+		ServerName:         c.UpstreamServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}, nil
+}
+
+// waitForTLSConfig loads the tls configuration like loadTLSConfig, retrying
+// with backoff for up to --tls-wait-timeout while it fails, e.g. because a
+// kubernetes secret is only mounted after the container started.
+func waitForTLSConfig(c *Config) (*tls.Config, error) {
+	deadline := time.Now().Add(c.TLSWaitTimeout)
+	backoff := 250 * time.Millisecond
+	for {
+		tlsConfig, err := loadTLSConfig(c)
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return tlsConfig, err
+		}
+		slog.Warn("failed to load the etcd tls files, waiting for them", "err", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
+
+// transportSwitcher is a RoundTripper whose transport can be replaced at
+// runtime, e.g. after the tls material was rotated.
+type transportSwitcher struct {
+	current atomic.Pointer[http.Transport]
+}
+
+func newTransportSwitcher(t *http.Transport) *transportSwitcher {
+	s := &transportSwitcher{}
+	s.current.Store(t)
+	return s
+}
+
+func (s *transportSwitcher) RoundTrip(req *http.Request) (*http.Response, error) {
+	return s.current.Load().RoundTrip(withConnTracking(req))
+}
+
+func (s *transportSwitcher) Load() *http.Transport {
+	return s.current.Load()
+}
+
+// Store replaces the transport. Idle connections of the previous transport
+// are closed; in-flight requests finish on their existing connection.
+func (s *transportSwitcher) Store(t *http.Transport) {
+	if old := s.current.Swap(t); old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+func (s *transportSwitcher) CloseIdleConnections() {
+	s.current.Load().CloseIdleConnections()
+}
+
+// rewritePipeline holds the current response rewrite, replaced when the
+// config file is reloaded. A nil rewrite passes responses through.
+type rewritePipeline struct {
+	fn atomic.Pointer[rewriteFunc]
+}
+
+func (p *rewritePipeline) load() rewriteFunc {
+	if fn := p.fn.Load(); fn != nil {
+		return *fn
+	}
+	return nil
+}
+
+func (p *rewritePipeline) store(fn rewriteFunc) {
+	p.fn.Store(&fn)
+}
+
+// buildRewrite assembles the response rewrite from the flags and file
+// config, returning nil when no rewriting is configured.
+func buildRewrite(c *Config, fc *fileConfig) (rewriteFunc, error) {
+	allow, deny := c.MetricAllow, c.MetricDeny
+	if len(fc.MetricAllow) > 0 || len(fc.MetricDeny) > 0 {
+		allow, deny = fc.MetricAllow, fc.MetricDeny
+	}
+	filter, err := newMetricFilter(allow, deny)
+	if err != nil {
+		return nil, err
+	}
+	var rewrites []rewriteFunc
+	if filter.enabled() {
+		rewrites = append(rewrites, filter.rewrite)
+	}
+	if len(fc.Histograms) > 0 {
+		rewrites = append(rewrites, (&histogramReducer{rules: fc.Histograms}).rewrite)
+	}
+	if len(fc.DropLabels) > 0 {
+		rewrites = append(rewrites, (&labelDropper{rules: fc.DropLabels}).rewrite)
+	}
+	if len(fc.Relabel) > 0 {
+		rewrites = append(rewrites, (&relabeler{rules: fc.Relabel}).rewrite)
+	}
+	// renaming comes last, so the other rules match the names etcd uses.
+	if len(fc.Rename) > 0 || fc.MetricPrefix != "" {
+		rewrites = append(rewrites, (&renamer{rules: fc.Rename, prefix: fc.MetricPrefix}).rewrite)
+	}
+	if len(rewrites) == 0 {
+		return nil, nil
+	}
+	return chainRewrites(rewrites...), nil
+}
+
+// runtimeSettings holds the settings requests read as they are served,
+// from the flags or the config file overriding them, and replaced when the
+// config file is reloaded.
+type runtimeSettings struct {
+	upstreamTimeout atomic.Int64
+	cacheTTL        atomic.Int64
+}
+
+func (s *runtimeSettings) apply(c *Config, fc *fileConfig) {
+	timeout, ttl := c.UpstreamTimeout, c.CacheTTL
+	if fc.UpstreamTimeout != nil {
+		timeout = *fc.UpstreamTimeout
+	}
+	if fc.CacheTTL != nil {
+		ttl = *fc.CacheTTL
+	}
+	s.upstreamTimeout.Store(int64(timeout))
+	s.cacheTTL.Store(int64(ttl))
+}
+
+func (s *runtimeSettings) timeout() time.Duration {
+	return time.Duration(s.upstreamTimeout.Load())
+}
+
+func (s *runtimeSettings) ttl() time.Duration {
+	return time.Duration(s.cacheTTL.Load())
+}
+
+// fileEndpoints returns the upstream endpoints the config file sets for the
+// cluster of c, or nil if it sets none.
+func fileEndpoints(c *Config, fc *fileConfig) []string {
+	if c.cluster == "" {
+		return fc.UpstreamEndpoints
+	}
+	for _, cc := range fc.Clusters {
+		if cc.Name == c.cluster {
+			return cc.UpstreamEndpoints
+		}
+	}
+	return nil
+}
+
+// reloader re-reads the tls material and config file at runtime.
+type reloader struct {
+	c        *Config
+	tls      bool
+	switcher *transportSwitcher
+	pipeline *rewritePipeline
+	settings *runtimeSettings
+	targets  *upstreamTargets
+	// flagTargets are the upstream endpoints given by the flags, restored
+	// when the config file no longer sets any.
+	flagTargets []string
+	checker     *upstreamChecker
+	// clusters are the reloaders of the additional clusters, reloaded
+	// along with this one through /-/reload.
+	clusters []*reloader
+
+	mu sync.Mutex
+	fc *fileConfig
+	// tlsSum is the hash of the tls files last loaded successfully.
+	tlsSum []byte
+	// failedTLSSum is the hash of the tls files the last reload failed on,
+	// so polling doesn't read them again until they change.
+	failedTLSSum []byte
+}
+
+// performReload rebuilds the upstream transport from the tls files on disk.
+// On failure the current transport is kept.
+func (r *reloader) performReload() error {
+	if !r.tls {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tlsReloadAttempts.WithLabelValues(r.c.cluster).Inc()
+	// hashed before the files are read, so a change racing the reload
+	// is picked up again.
+	sum, _ := r.hashTLSFiles()
+	if err := r.reloadTLS(); err != nil {
+		r.failedTLSSum = sum
+		tlsReloadFailures.WithLabelValues(r.c.cluster).Inc()
+		return err
+	}
+	r.tlsSum, r.failedTLSSum = sum, nil
+	tlsReloadSuccesses.WithLabelValues(r.c.cluster).Inc()
+	tlsLastSuccessfulReload.WithLabelValues(r.c.cluster).SetToCurrentTime()
+	recordCertExpiry(r.c)
+	slog.Info("reloaded tls configuration")
+	return nil
+}
+
+func (r *reloader) reloadTLS() error {
+	tlsConfig, err := loadTLSConfig(r.c)
+	if err != nil {
+		return err
+	}
+	t := buildHTTPSTransport(r.c, tlsConfig)
+	if err := r.validate(t.TLSClientConfig); err != nil {
+		return fmt.Errorf("new tls material rejected: %w", err)
+	}
+	r.switcher.Store(t)
+	return nil
+}
+
+// validate checks that the client certificate and CA in tlsConfig are
+// currently valid and that a handshake with the upstream succeeds. A failed
+// handshake only rejects the material when the current one still works, so
+// an upstream outage doesn't block a rotation.
+func (r *reloader) validate(tlsConfig *tls.Config) error {
+	now := time.Now()
+	for _, cert := range tlsConfig.Certificates {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parse client certificate: %w", err)
+		}
+		if err := checkValidity(leaf, now); err != nil {
+			return fmt.Errorf("client certificate: %w", err)
+		}
+	}
+	files, err := caFiles(r.c.EtcdCA)
+	if err != nil {
+		return err
+	}
+	var cas []*x509.Certificate
+	for _, f := range files {
+		capem, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		certs, err := parsePEMCertificates(capem)
+		if err != nil {
+			return fmt.Errorf("parse ca %s: %w", f, err)
+		}
+		cas = append(cas, certs...)
+	}
+	var caErr error
+	for _, ca := range cas {
+		if caErr = checkValidity(ca, now); caErr == nil {
+			break
+		}
+	}
+	if caErr != nil {
+		return fmt.Errorf("ca: %w", caErr)
+	}
+
+	if r.checker == nil {
+		return nil
+	}
+	ctx := context.Background()
+	if err := r.checker.checkWith(ctx, tlsConfig); err != nil {
+		if r.checker.check(ctx) == nil {
+			return fmt.Errorf("upstream handshake: %w", err)
+		}
+		slog.Warn("upstream unreachable, accepting new tls material without a handshake", "err", err)
+	}
+	return nil
+}
+
+// recordCertExpiry exports the expiry of the CA and client certificate files
+// and warns about those expiring within --cert-expiry-warning.
+func recordCertExpiry(c *Config) {
+	files, err := caFiles(c.EtcdCA)
+	if err != nil {
+		slog.Warn("failed to list ca files for expiry check", "err", err)
+	}
+	for _, f := range append(files, c.clientCertFile()) {
+		certs, err := readCertificates(c, f)
+		if err != nil {
+			slog.Warn("failed to read certificate for expiry check", "file", f, "err", err)
+			continue
+		}
+		expiry := certs[0].NotAfter
+		for _, cert := range certs[1:] {
+			if cert.NotAfter.Before(expiry) {
+				expiry = cert.NotAfter
+			}
+		}
+		certExpiry.WithLabelValues(f).Set(float64(expiry.Unix()))
+		if remaining := time.Until(expiry); remaining < c.CertExpiryWarning {
+			slog.Warn("certificate expires soon", "file", f, "expiry", expiry, "remaining", remaining.Round(time.Minute).String())
+		}
+	}
+}
+
+// recordLeafExpiry exports the expiry of a client certificate that wasn't
+// read from a file, labelled with its source, and warns if it expires within
+// --cert-expiry-warning.
+func recordLeafExpiry(c *Config, source string, leaf *x509.Certificate) {
+	certExpiry.WithLabelValues(source).Set(float64(leaf.NotAfter.Unix()))
+	if remaining := time.Until(leaf.NotAfter); remaining < c.CertExpiryWarning {
+		slog.Warn("certificate expires soon", "file", source, "expiry", leaf.NotAfter, "remaining", remaining.Round(time.Minute).String())
+	}
+}
+
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("%q is not valid before %s", cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("%q expired at %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// parsePEMCertificates returns every certificate in the PEM data.
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// reloadConfig re-reads the config file and swaps in the new rewrite,
+// settings and upstream endpoints. On failure the current ones are kept.
+func (r *reloader) reloadConfig() error {
+	if r.c.ConfigFile == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fc, err := loadFileConfig(r.c.ConfigFile)
+	if err != nil {
+		return err
+	}
+	rewrite, err := buildRewrite(r.c, fc)
+	if err != nil {
+		return err
+	}
+	endpoints := fileEndpoints(r.c, fc)
+	if len(endpoints) > 0 && r.c.discovers() {
+		return errors.New("upstream_endpoints can't be used with discovery or a unix socket --upstream-url")
+	}
+	r.pipeline.store(rewrite)
+	r.settings.apply(r.c, fc)
+	if !r.c.discovers() {
+		if len(endpoints) == 0 {
+			endpoints = r.flagTargets
+		}
+		if r.targets.set(endpoints) {
+			slog.Info("upstream endpoints changed", "endpoints", endpoints)
+		}
+	}
+	r.fc = fc
+	slog.Info("reloaded config", "file", r.c.ConfigFile)
+	return nil
+}
+
+// reloadAll reloads both the tls material and the config file, along with
+// those of every additional cluster.
+func (r *reloader) reloadAll() error {
+	errs := []error{r.performReload(), r.reloadConfig()}
+	for _, cluster := range r.clusters {
+		errs = append(errs, cluster.reloadAll())
+	}
+	return errors.Join(errs...)
+}
+
+// fileConfig returns the config file contents currently in use.
+func (r *reloader) fileConfig() *fileConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fc
+}
+
+// watchSIGHUP reloads the tls material and config file whenever the process
+// receives SIGHUP, until ctx is done.
+func (r *reloader) watchSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("received SIGHUP, reloading")
+			if err := r.performReload(); err != nil {
+				slog.Error("tls reload failed, keeping the current configuration", "err", err)
+			}
+			if err := r.reloadConfig(); err != nil {
+				slog.Error("config reload failed, keeping the current configuration", "err", err)
+			}
+		}
+	}
+}
+
+// hashTLSFiles returns a digest of the names and contents of the tls files,
+// so CA files added to or removed from a directory are noticed too.
+func (r *reloader) hashTLSFiles() ([]byte, error) {
+	files, err := caFiles(r.c.EtcdCA)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	for _, f := range append(files, r.c.clientFiles()...) {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f, len(data))
+		h.Write(data)
+	}
+	return h.Sum(nil), nil
+}
+
+// loadedTLSSum returns the hash of the tls files last loaded successfully,
+// hashing the files on disk if none were reloaded yet.
+func (r *reloader) loadedTLSSum() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tlsSum == nil {
+		r.tlsSum, _ = r.hashTLSFiles()
+	}
+	return r.tlsSum
+}
+
+// tlsFilesChanged reports whether the tls files hashing to sum are neither
+// those in use nor those the last reload failed on.
+func (r *reloader) tlsFilesChanged(sum []byte) bool {
+	loaded := r.loadedTLSSum()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !bytes.Equal(sum, loaded) && !bytes.Equal(sum, r.failedTLSSum)
+}
+
+// pollTLS reloads the tls material whenever the file contents change,
+// checking every interval until ctx is done. It works on filesystems where
+// change notifications are never delivered. Files a reload failed on are only
+// tried again once they change.
+func (r *reloader) pollTLS(ctx context.Context, interval time.Duration) {
+	if _, err := r.hashTLSFiles(); err != nil {
+		slog.Warn("failed to read tls files", "err", err)
+	}
+	// the files loaded at startup, unless they were reloaded since.
+	r.loadedTLSSum()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sum, err := r.hashTLSFiles()
+		if err != nil {
+			// files may briefly be missing during a rotation.
+			slog.Debug("failed to read tls files", "err", err)
+			continue
+		}
+		if !r.tlsFilesChanged(sum) {
+			continue
+		}
+		slog.Info("tls files changed, reloading")
+		if err := r.performReload(); err != nil {
+			slog.Error("tls reload failed, keeping the current configuration", "err", err)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key for cn
+// to cert and key.
+func writeTestCertificate(t *testing.T, cert, key, cn string) {
+	t.Helper()
+	writeTestCertificateValidity(t, cert, key, cn, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// writeTestCertificateValidity is writeTestCertificate for a certificate
+// valid from notBefore to notAfter.
+func writeTestCertificateValidity(t *testing.T, cert, key, cn string, notBefore, notAfter time.Time) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPerformReloadRecordsLoadedFiles(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, cert, key, "before")
+	c := &Config{EtcdCA: []string{cert}, EtcdCert: cert, EtcdKey: key}
+	r := &reloader{c: c, tls: true, switcher: newTransportSwitcher(&http.Transport{})}
+
+	before := r.loadedTLSSum()
+	if before == nil {
+		t.Fatal("no hash of the tls files at startup")
+	}
+	writeTestCertificate(t, cert, key, "after")
+	if err := r.performReload(); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := r.hashTLSFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.loadedTLSSum(); !bytes.Equal(got, sum) || bytes.Equal(got, before) {
+		t.Error("the hash of the reloaded files wasn't recorded, a watcher restart would reload them again")
+	}
+
+	// a failed reload keeps the hash of the files in use.
+	if err := os.WriteFile(key, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.performReload(); err == nil {
+		t.Fatal("reloading an invalid key succeeded")
+	}
+	if got := r.loadedTLSSum(); !bytes.Equal(got, sum) {
+		t.Error("a failed reload replaced the hash of the files in use")
+	}
+}
+
+func TestPollTLSSkipsFilesThatFailedToLoad(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, cert, key, "before")
+	c := &Config{EtcdCA: []string{cert}, EtcdCert: cert, EtcdKey: key, cluster: "poll-test"}
+	r := &reloader{c: c, tls: true, switcher: newTransportSwitcher(&http.Transport{})}
+	attempts := tlsReloadAttempts.WithLabelValues(c.cluster)
+	defer tlsReloadAttempts.DeleteLabelValues(c.cluster)
+	defer tlsReloadSuccesses.DeleteLabelValues(c.cluster)
+	// the files loaded at startup.
+	r.loadedTLSSum()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.pollTLS(ctx, time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// waitFor waits for cond, which the poll makes true.
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	if err := os.WriteFile(key, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the reload of the invalid key", func() bool { return testutil.ToFloat64(attempts) == 1 })
+	// many polls later, the same files weren't read again.
+	time.Sleep(50 * time.Millisecond)
+	if got := testutil.ToFloat64(attempts); got != 1 {
+		t.Errorf("%v reloads of files that didn't change, want 1", got)
+	}
+
+	writeTestCertificate(t, cert, key, "after")
+	sum, err := r.hashTLSFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the reload of the fixed files", func() bool { return bytes.Equal(r.loadedTLSSum(), sum) })
+	// a poll between the writes of the certificate and key may have tried
+	// the mismatched pair as well.
+	if got := testutil.ToFloat64(tlsReloadSuccesses.WithLabelValues(c.cluster)); got != 1 {
+		t.Errorf("%v successful reloads, want 1", got)
+	}
+}
+
+func TestWatchSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	config := filepath.Join(dir, "config.yaml")
+	writeTestCertificate(t, cert, key, "before")
+	if err := os.WriteFile(config, []byte("upstream_timeout: 5s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{EtcdCA: []string{cert}, EtcdCert: cert, EtcdKey: key, ConfigFile: config, UpstreamTimeout: time.Second}
+	r := &reloader{
+		c:        c,
+		tls:      true,
+		switcher: newTransportSwitcher(&http.Transport{}),
+		pipeline: &rewritePipeline{},
+		settings: &runtimeSettings{},
+		targets:  newUpstreamTargets(),
+	}
+	before := r.loadedTLSSum()
+
+	// keeps SIGHUP from terminating the test binary before the reloader
+	// is notified.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.watchSIGHUP(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the files changed without a notification, e.g. on overlayfs.
+	writeTestCertificate(t, cert, key, "after")
+	if err := os.WriteFile(config, []byte("upstream_timeout: 3s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := r.hashTLSFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := func() bool {
+		return bytes.Equal(r.loadedTLSSum(), sum) && r.settings.timeout() == 3*time.Second
+	}
+	for deadline := time.Now().Add(5 * time.Second); !reloaded(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGHUP didn't reload the tls files and config file")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	}
+	if bytes.Equal(sum, before) {
+		t.Fatal("the rewritten tls files hash like the old ones")
+	}
+	if fc := r.fileConfig(); fc == nil || *fc.UpstreamTimeout != 3*time.Second {
+		t.Errorf("got config %+v, want the rewritten file", fc)
+	}
+}
+
+func TestReloadValidatesNewTLSMaterial(t *testing.T) {
+	// the upstream accepts the client certificates of these common names.
+	trusted := map[string]bool{"before": true, "after": true}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if !trusted[cert.Subject.CommonName] {
+				return errors.New("untrusted client certificate")
+			}
+			return nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	now := time.Now()
+	tests := []struct {
+		name                string
+		cn                  string
+		notBefore, notAfter time.Time
+		upstreamDown        bool
+		wantErr             string
+	}{
+		{name: "valid rotation", cn: "after", notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Hour)},
+		{name: "expired client certificate", cn: "after", notBefore: now.Add(-2 * time.Hour), notAfter: now.Add(-time.Hour), wantErr: "expired"},
+		{name: "client certificate not yet valid", cn: "after", notBefore: now.Add(time.Hour), notAfter: now.Add(2 * time.Hour), wantErr: "not valid before"},
+		{name: "rejected by the upstream", cn: "untrusted", notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Hour), wantErr: "upstream handshake"},
+		{name: "upstream unreachable", cn: "untrusted", notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Hour), upstreamDown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca, cert, key := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+			if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			writeTestCertificate(t, cert, key, "before")
+			c := DefaultConfig()
+			c.EtcdCA, c.EtcdCert, c.EtcdKey = []string{ca}, cert, key
+			// the name in the certificate of the httptest server.
+			c.UpstreamServerName = "example.com"
+			tlsConfig, err := loadTLSConfig(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current := buildHTTPSTransport(&c, tlsConfig)
+			switcher := newTransportSwitcher(current)
+			addr := srv.Listener.Addr().String()
+			if tt.upstreamDown {
+				addr = down.Listener.Addr().String()
+			}
+			checker := &upstreamChecker{targets: newUpstreamTargets(addr), transport: switcher, path: "/metrics", timeout: 5 * time.Second}
+			r := &reloader{c: &c, tls: true, switcher: switcher, checker: checker}
+			if !tt.upstreamDown {
+				if err := checker.check(context.Background()); err != nil {
+					t.Fatalf("the current tls material doesn't work: %v", err)
+				}
+			}
+
+			writeTestCertificateValidity(t, cert, key, tt.cn, tt.notBefore, tt.notAfter)
+			err = r.performReload()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("performReload() = %v", err)
+				}
+				if switcher.Load() == current {
+					t.Error("the transport wasn't replaced")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("performReload() = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if switcher.Load() != current {
+				t.Error("the rejected tls material replaced the transport")
+			}
+		})
+	}
+}
+
+func TestTLSReloadMetrics(t *testing.T) {
+	tests := []struct {
+		name string
+		// reloads are the outcomes of successive reloads, true for a valid key.
+		reloads                     []bool
+		wantSuccesses, wantFailures float64
+		wantLastSuccess             bool
+	}{
+		{name: "no reloads"},
+		{name: "success", reloads: []bool{true}, wantSuccesses: 1, wantLastSuccess: true},
+		{name: "failure", reloads: []bool{false}, wantFailures: 1},
+		{name: "failure after success", reloads: []bool{true, false}, wantSuccesses: 1, wantFailures: 1, wantLastSuccess: true},
+		{name: "failures", reloads: []bool{false, false, false}, wantFailures: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+			c := &Config{EtcdCA: []string{cert}, EtcdCert: cert, EtcdKey: key, cluster: "metrics-" + tt.name}
+			r := &reloader{c: c, tls: true, switcher: newTransportSwitcher(&http.Transport{})}
+			initTLSReloadMetrics(c.cluster)
+			defer func() {
+				for _, m := range []*prometheus.CounterVec{tlsReloadAttempts, tlsReloadSuccesses, tlsReloadFailures, tlsWatcherRestarts} {
+					m.DeleteLabelValues(c.cluster)
+				}
+				tlsLastSuccessfulReload.DeleteLabelValues(c.cluster)
+				certExpiry.DeleteLabelValues(cert)
+			}()
+
+			start := time.Now().Truncate(time.Second)
+			for _, valid := range tt.reloads {
+				writeTestCertificate(t, cert, key, "client")
+				if !valid {
+					if err := os.WriteFile(key, []byte("not a key"), 0o600); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := r.performReload(); (err == nil) != valid {
+					t.Fatalf("performReload() = %v", err)
+				}
+			}
+			// the counters are exported before the first reload.
+			for _, name := range []string{
+				"etcd_metrics_proxy_tls_reload_attempts_total",
+				"etcd_metrics_proxy_tls_reload_successes_total",
+				"etcd_metrics_proxy_tls_reload_failures_total",
+				"etcd_metrics_proxy_tls_watcher_restarts_total",
+			} {
+				if !strings.Contains(gatherSelfMetrics(t), name+`{cluster="`+c.cluster+`"}`) {
+					t.Errorf("%s isn't exported for the cluster", name)
+				}
+			}
+			if got := testutil.ToFloat64(tlsReloadAttempts.WithLabelValues(c.cluster)); got != float64(len(tt.reloads)) {
+				t.Errorf("%v attempts, want %d", got, len(tt.reloads))
+			}
+			if got := testutil.ToFloat64(tlsReloadSuccesses.WithLabelValues(c.cluster)); got != tt.wantSuccesses {
+				t.Errorf("%v successes, want %v", got, tt.wantSuccesses)
+			}
+			if got := testutil.ToFloat64(tlsReloadFailures.WithLabelValues(c.cluster)); got != tt.wantFailures {
+				t.Errorf("%v failures, want %v", got, tt.wantFailures)
+			}
+			last := testutil.ToFloat64(tlsLastSuccessfulReload.WithLabelValues(c.cluster))
+			if got := last >= float64(start.Unix()); got != tt.wantLastSuccess {
+				t.Errorf("last successful reload at %v, want it set by a reload: %v", last, tt.wantLastSuccess)
+			}
+		})
+	}
+}
+
+// gatherSelfMetrics returns the proxy's own metrics in the text format.
+func gatherSelfMetrics(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	selfMetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestRecordCertExpiry(t *testing.T) {
+	dir := t.TempDir()
+	// the ca file holds a bundle, of which the earliest expiry counts.
+	ca, caKey := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	first, second := filepath.Join(dir, "first.crt"), filepath.Join(dir, "second.crt")
+	caExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	writeTestCertificateValidity(t, first, caKey, "ca-1", time.Now().Add(-time.Hour), caExpiry.Add(24*time.Hour))
+	writeTestCertificateValidity(t, second, caKey, "ca-2", time.Now().Add(-time.Hour), caExpiry)
+	var bundle []byte
+	for _, f := range []string{first, second} {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle = append(bundle, data...)
+	}
+	if err := os.WriteFile(ca, bundle, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	clientExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	writeTestCertificateValidity(t, cert, key, "client", time.Now().Add(-time.Hour), clientExpiry)
+	defer certExpiry.DeleteLabelValues(ca)
+	defer certExpiry.DeleteLabelValues(cert)
+
+	tests := []struct {
+		name        string
+		warning     time.Duration
+		wantWarning []string
+	}{
+		{name: "no warning", warning: time.Minute},
+		{name: "client certificate within the window", warning: 24 * time.Hour, wantWarning: []string{cert}},
+		{name: "both within the window", warning: 72 * time.Hour, wantWarning: []string{ca, cert}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+			recordCertExpiry(&Config{EtcdCA: []string{ca}, EtcdCert: cert, EtcdKey: key, CertExpiryWarning: tt.warning})
+			if got := testutil.ToFloat64(certExpiry.WithLabelValues(ca)); got != float64(caExpiry.Unix()) {
+				t.Errorf("ca expires at %v, want %d", got, caExpiry.Unix())
+			}
+			if got := testutil.ToFloat64(certExpiry.WithLabelValues(cert)); got != float64(clientExpiry.Unix()) {
+				t.Errorf("client certificate expires at %v, want %d", got, clientExpiry.Unix())
+			}
+			var warned []string
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if strings.Contains(line, "certificate expires soon") {
+					for _, f := range []string{ca, cert} {
+						if strings.Contains(line, "file="+f+" ") {
+							warned = append(warned, f)
+						}
+					}
+				}
+			}
+			if strings.Join(warned, " ") != strings.Join(tt.wantWarning, " ") {
+				t.Errorf("warned about %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestWaitForTLSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// writeAfter is when the tls files appear, or never if negative.
+		writeAfter time.Duration
+		wantErr    bool
+		maxWait    time.Duration
+	}{
+		{name: "files present", writeAfter: 0, maxWait: time.Second},
+		{name: "files missing without waiting", writeAfter: -1, wantErr: true, maxWait: 100 * time.Millisecond},
+		{name: "files mounted late", timeout: 5 * time.Second, writeAfter: 300 * time.Millisecond, maxWait: 3 * time.Second},
+		{name: "files never mounted", timeout: time.Second, writeAfter: -1, wantErr: true, maxWait: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+			c := &Config{EtcdCA: []string{cert}, EtcdCert: cert, EtcdKey: key, TLSWaitTimeout: tt.timeout}
+			if tt.writeAfter == 0 {
+				writeTestCertificate(t, cert, key, "client")
+			} else if tt.writeAfter > 0 {
+				// written to a temporary directory and renamed in place, so
+				// the files never appear half-written.
+				tmp := t.TempDir()
+				writeTestCertificate(t, filepath.Join(tmp, "client.crt"), filepath.Join(tmp, "client.key"), "client")
+				timer := time.AfterFunc(tt.writeAfter, func() {
+					os.Rename(filepath.Join(tmp, "client.key"), key)
+					os.Rename(filepath.Join(tmp, "client.crt"), cert)
+				})
+				defer timer.Stop()
+			}
+			start := time.Now()
+			tlsConfig, err := waitForTLSConfig(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("waitForTLSConfig() = %v, want an error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(tlsConfig.Certificates) != 1 {
+				t.Errorf("got %d client certificates, want 1", len(tlsConfig.Certificates))
+			}
+			if d := time.Since(start); d > tt.maxWait {
+				t.Errorf("waited %v, want at most %v", d, tt.maxWait)
+			}
+		})
+	}
+}
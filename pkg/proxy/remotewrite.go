@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriter periodically scrapes the proxied metrics and pushes them to a
+// Prometheus remote_write endpoint, for environments where nothing can
+// scrape the proxy.
+type remoteWriter struct {
+	url        string
+	interval   time.Duration
+	batchSize  int
+	maxRetries int
+	auth       *httpAuth
+
+	source http.Handler
+	client *http.Client
+}
+
+func (w *remoteWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.push(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("remote write failed", "url", w.url, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// push scrapes once and sends the samples in batches of batchSize.
+func (w *remoteWriter) push(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, w.interval)
+	defer cancel()
+	samples, err := scrapeSamples(ctx, w.source)
+	if err != nil {
+		return fmt.Errorf("scrape: %w", err)
+	}
+	for len(samples) > 0 {
+		n := min(w.batchSize, len(samples))
+		if err := w.send(ctx, encodeWriteRequest(samples[:n])); err != nil {
+			remoteWriteFailedSamples.Add(float64(len(samples)))
+			return err
+		}
+		remoteWriteSamples.Add(float64(n))
+		samples = samples[n:]
+	}
+	return nil
+}
+
+// errNonRetryable marks remote write responses that must not be retried.
+var errNonRetryable = errors.New("non-retryable")
+
+// send posts a snappy compressed write request, retrying connection errors,
+// 429 and 5xx responses with exponential backoff.
+func (w *remoteWriter) send(ctx context.Context, req []byte) error {
+	body := snappy.Encode(nil, req)
+	backoff := 500 * time.Millisecond
+	var err error
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			slog.Warn("remote write failed, retrying", "url", w.url, "err", err, "backoff", backoff)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, 30*time.Second)
+		}
+		err = w.sendOnce(ctx, body)
+		if err == nil || errors.Is(err, errNonRetryable) {
+			return err
+		}
+	}
+	return err
+}
+
+func (w *remoteWriter) sendOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNonRetryable, err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "etcd-metrics-proxy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if err := w.auth.authorize(req); err != nil {
+		return fmt.Errorf("%w: %v", errNonRetryable, err)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		err = fmt.Errorf("%w: %v", errNonRetryable, err)
+	}
+	return err
+}
+
+// encodeWriteRequest encodes samples as a prometheus.WriteRequest, one time
+// series per sample.
+func encodeWriteRequest(samples []sample) []byte {
+	var b []byte
+	for _, s := range samples {
+		labels := append([]label{{name: "__name__", value: s.name}}, s.labels...)
+		slices.SortFunc(labels, func(a, b label) int { return strings.Compare(a.name, b.name) })
+
+		var ts []byte
+		for _, l := range labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.timestamp.UnixMilli()))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sb)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
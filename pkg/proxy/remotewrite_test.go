@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// writtenSeries is a time series decoded from a prometheus.WriteRequest.
+type writtenSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the time series of a prometheus.WriteRequest,
+// failing on fields it doesn't expect.
+func decodeWriteRequest(t *testing.T, b []byte) []writtenSeries {
+	t.Helper()
+	var series []writtenSeries
+	forEachField(t, b, func(num protowire.Number, typ protowire.Type, v []byte) {
+		if num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected WriteRequest field %d of type %d", num, typ)
+		}
+		var s writtenSeries
+		samples := 0
+		forEachField(t, v, func(num protowire.Number, typ protowire.Type, v []byte) {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				var l label
+				forEachField(t, v, func(num protowire.Number, typ protowire.Type, v []byte) {
+					switch {
+					case num == 1 && typ == protowire.BytesType:
+						l.name = string(v)
+					case num == 2 && typ == protowire.BytesType:
+						l.value = string(v)
+					default:
+						t.Fatalf("unexpected Label field %d of type %d", num, typ)
+					}
+				})
+				s.labels = append(s.labels, l)
+			case num == 2 && typ == protowire.BytesType:
+				samples++
+				forEachField(t, v, func(num protowire.Number, typ protowire.Type, v []byte) {
+					switch {
+					case num == 1 && typ == protowire.Fixed64Type:
+						bits, _ := protowire.ConsumeFixed64(v)
+						s.value = math.Float64frombits(bits)
+					case num == 2 && typ == protowire.VarintType:
+						ts, _ := protowire.ConsumeVarint(v)
+						s.timestamp = int64(ts)
+					default:
+						t.Fatalf("unexpected Sample field %d of type %d", num, typ)
+					}
+				})
+			default:
+				t.Fatalf("unexpected TimeSeries field %d of type %d", num, typ)
+			}
+		})
+		if samples != 1 {
+			t.Fatalf("time series with %d samples, want 1", samples)
+		}
+		series = append(series, s)
+	})
+	return series
+}
+
+// forEachField calls fn with each field of the message b. The value of
+// length delimited fields is their content, that of the others their
+// encoding.
+func forEachField(t *testing.T, b []byte, fn func(protowire.Number, protowire.Type, []byte)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			t.Fatal(protowire.ParseError(m))
+		}
+		v := b[:m]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		fn(num, typ, v)
+		b = b[m:]
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	samples := []sample{
+		{name: "etcd_server_has_leader", value: 1, timestamp: ts},
+		{
+			name:      "grpc_server_handled_total",
+			labels:    []label{{"grpc_method", "Range"}, {"grpc_code", "OK"}, {"a\"b", "line\nbreak"}},
+			value:     1234.5,
+			timestamp: ts.Add(time.Second),
+		},
+		{name: "etcd_disk_wal_fsync_duration_seconds_bucket", labels: []label{{"le", "+Inf"}}, value: math.Inf(1), timestamp: ts},
+		{name: "etcd_mvcc_db_compaction_keys_total", value: -0.25, timestamp: time.UnixMilli(0)},
+	}
+	want := []writtenSeries{
+		{labels: []label{{"__name__", "etcd_server_has_leader"}}, value: 1, timestamp: 1700000000123},
+		{
+			labels:    []label{{"__name__", "grpc_server_handled_total"}, {"a\"b", "line\nbreak"}, {"grpc_code", "OK"}, {"grpc_method", "Range"}},
+			value:     1234.5,
+			timestamp: 1700000001123,
+		},
+		{labels: []label{{"__name__", "etcd_disk_wal_fsync_duration_seconds_bucket"}, {"le", "+Inf"}}, value: math.Inf(1), timestamp: 1700000000123},
+		{labels: []label{{"__name__", "etcd_mvcc_db_compaction_keys_total"}}, value: -0.25, timestamp: 0},
+	}
+	got := decodeWriteRequest(t, encodeWriteRequest(samples))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	// the labels of the samples are left as they were.
+	if samples[1].labels[0].name != "grpc_method" {
+		t.Errorf("encoding sorted the labels of the sample: %v", samples[1].labels)
+	}
+
+	if got := decodeWriteRequest(t, encodeWriteRequest([]sample{{name: "nan", value: math.NaN(), timestamp: ts}})); len(got) != 1 || !math.IsNaN(got[0].value) {
+		t.Errorf("got %+v, want a NaN sample", got)
+	}
+}
+
+func TestRemoteWriterPush(t *testing.T) {
+	source := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1 1700000000000
+etcd_server_is_leader 0 1700000000000
+etcd_mvcc_keys_total{instance="a"} 42 1700000000000
+`))
+	})
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("remote-write-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var requests [][]writtenSeries
+	statuses := []int{http.StatusServiceUnavailable}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+			return
+		}
+		for name, want := range map[string]string{
+			"Content-Encoding":                  "snappy",
+			"Content-Type":                      "application/x-protobuf",
+			"X-Prometheus-Remote-Write-Version": "0.1.0",
+			"Authorization":                     "Bearer remote-write-token",
+		} {
+			if got := r.Header.Get(name); got != want {
+				t.Errorf("%s %q, want %q", name, got, want)
+			}
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Fatalf("body isn't snappy encoded: %v", err)
+		}
+		requests = append(requests, decodeWriteRequest(t, req))
+	}))
+	defer srv.Close()
+
+	w := &remoteWriter{
+		url:        srv.URL,
+		interval:   time.Minute,
+		batchSize:  2,
+		maxRetries: 1,
+		auth:       &httpAuth{bearerTokenFile: token},
+		source:     source,
+		client:     srv.Client(),
+	}
+	if err := w.push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]writtenSeries{
+		{
+			{labels: []label{{"__name__", "etcd_server_has_leader"}}, value: 1, timestamp: 1700000000000},
+			{labels: []label{{"__name__", "etcd_server_is_leader"}}, value: 0, timestamp: 1700000000000},
+		},
+		{
+			{labels: []label{{"__name__", "etcd_mvcc_keys_total"}, {"instance", "a"}}, value: 42, timestamp: 1700000000000},
+		},
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("got %+v\nwant %+v", requests, want)
+	}
+
+	// a 4xx response isn't retried.
+	statuses = []int{http.StatusBadRequest, http.StatusBadRequest}
+	requests = nil
+	if err := w.push(context.Background()); err == nil {
+		t.Error("push succeeded on a 400")
+	}
+	if len(statuses) != 1 {
+		t.Errorf("a 400 was retried")
+	}
+}
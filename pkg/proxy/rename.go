@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// renameRule renames the families matching Metric, an anchored regular
+// expression, to Target, which may refer to capture groups as $1 or ${name}.
+type renameRule struct {
+	Metric string `yaml:"metric"`
+	Target string `yaml:"target"`
+
+	re *regexp.Regexp
+}
+
+func (r *renameRule) validate() error {
+	res, err := compileAnchored([]string{r.Metric})
+	if err != nil {
+		return fmt.Errorf("invalid metric %q: %w", r.Metric, err)
+	}
+	r.re = res[0]
+	if !strings.Contains(r.Target, "$") && !metricNameRE.MatchString(r.Target) {
+		return fmt.Errorf("invalid target metric name %q", r.Target)
+	}
+	return nil
+}
+
+// renamer renames metric families by the first matching rule, then adds
+// prefix. HELP, TYPE and UNIT lines are renamed along with the samples,
+// which keep their _bucket, _total etc. suffix.
+type renamer struct {
+	rules  []renameRule
+	prefix string
+}
+
+func (r *renamer) rename(family string) string {
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if m := rule.re.FindStringSubmatchIndex(family); m != nil {
+			target := string(rule.re.ExpandString(nil, rule.Target, family, m))
+			// an expansion that isn't a valid name would break the
+			// exposition.
+			if metricNameRE.MatchString(target) {
+				family = target
+			}
+			break
+		}
+	}
+	return r.prefix + family
+}
+
+func (r *renamer) rewrite(l *line) bool {
+	switch l.kind {
+	case lineHelp, lineType, lineUnit, lineSample:
+	default:
+		return true
+	}
+	name := r.rename(l.family)
+	if name == l.family {
+		return true
+	}
+	if l.kind == lineSample {
+		l.name = name + strings.TrimPrefix(l.name, l.family)
+	} else {
+		l.name = name
+	}
+	l.family = name
+	return true
+}
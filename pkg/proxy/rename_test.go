@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenameRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    renameRule
+		wantErr bool
+	}{
+		{"literal", renameRule{Metric: "etcd_server_has_leader", Target: "etcd_has_leader"}, false},
+		{"capture group", renameRule{Metric: "etcd_debugging_(.*)", Target: "etcd_$1"}, false},
+		{"invalid metric", renameRule{Metric: "etcd_(", Target: "etcd"}, true},
+		{"invalid target", renameRule{Metric: "etcd_.*", Target: "etcd-server"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenamer(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []renameRule
+		prefix string
+		in     string
+		want   string
+	}{
+		{
+			name:  "family with suffixes",
+			rules: []renameRule{{Metric: "etcd_disk_wal_fsync_duration_seconds", Target: "etcd_wal_fsync_seconds"}},
+			in: `# HELP etcd_disk_wal_fsync_duration_seconds The latency distributions of fsync called by WAL.
+# TYPE etcd_disk_wal_fsync_duration_seconds histogram
+# UNIT etcd_disk_wal_fsync_duration_seconds seconds
+etcd_disk_wal_fsync_duration_seconds_bucket{le="+Inf"} 9
+etcd_disk_wal_fsync_duration_seconds_sum 0.123
+etcd_disk_wal_fsync_duration_seconds_count 9
+`,
+			want: `# HELP etcd_wal_fsync_seconds The latency distributions of fsync called by WAL.
+# TYPE etcd_wal_fsync_seconds histogram
+# UNIT etcd_wal_fsync_seconds seconds
+etcd_wal_fsync_seconds_bucket{le="+Inf"} 9
+etcd_wal_fsync_seconds_sum 0.123
+etcd_wal_fsync_seconds_count 9
+`,
+		},
+		{
+			name:  "capture groups",
+			rules: []renameRule{{Metric: "etcd_debugging_(?P<rest>.*)", Target: "etcd_${rest}"}},
+			in: `# TYPE etcd_debugging_mvcc_keys_total gauge
+etcd_debugging_mvcc_keys_total 42
+`,
+			want: `# TYPE etcd_mvcc_keys_total gauge
+etcd_mvcc_keys_total 42
+`,
+		},
+		{
+			name:  "first matching rule",
+			rules: []renameRule{{Metric: "etcd_server_(.*)", Target: "server_$1"}, {Metric: "etcd_(.*)", Target: "other_$1"}},
+			in: `etcd_server_has_leader 1
+etcd_network_peer_sent_bytes_total 2
+`,
+			want: `server_has_leader 1
+other_network_peer_sent_bytes_total 2
+`,
+		},
+		{
+			name:   "prefix",
+			rules:  []renameRule{{Metric: "etcd_server_has_leader", Target: "has_leader"}},
+			prefix: "prod_",
+			in: `# TYPE etcd_server_has_leader gauge
+etcd_server_has_leader 1
+process_open_fds 12
+`,
+			want: `# TYPE prod_has_leader gauge
+prod_has_leader 1
+prod_process_open_fds 12
+`,
+		},
+		{
+			name:  "invalid expansion is not applied",
+			rules: []renameRule{{Metric: "etcd_(.*)", Target: "$1"}},
+			in: `etcd_1st 1
+etcd_ok 2
+`,
+			want: `etcd_1st 1
+ok 2
+`,
+		},
+		{
+			name:  "comments and labels are left alone",
+			rules: []renameRule{{Metric: "foo", Target: "bar"}},
+			in: `# foo is a comment
+foo{foo="foo"} 1
+# EOF
+`,
+			want: `# foo is a comment
+bar{foo="foo"} 1
+# EOF
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.rules {
+				if err := tt.rules[i].validate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := &renamer{rules: tt.rules, prefix: tt.prefix}
+			var b strings.Builder
+			if err := rewriteExposition(strings.NewReader(tt.in), &b, r.rewrite); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
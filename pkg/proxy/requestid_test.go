@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var generatedRequestID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func TestWithRequestIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// want is the id kept, or "" for a generated one.
+		want string
+	}{
+		{name: "kept", in: "prometheus-1234", want: "prometheus-1234"},
+		{name: "missing"},
+		{name: "too long", in: strings.Repeat("a", maxRequestIDLength+1)},
+		{name: "longest kept", in: strings.Repeat("a", maxRequestIDLength), want: strings.Repeat("a", maxRequestIDLength)},
+		{name: "space", in: "a b"},
+		{name: "not ascii", in: "id-é"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+			var forwarded, inContext string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded, inContext = r.Header.Get("X-Request-ID"), requestID(r.Context())
+			})
+			h := withRequestIDs(accessLogged(next, "default", []string{"request_id"}, requestSampler{mode: "all"}, nil), "X-Request-ID")
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.in != "" {
+				req.Header.Set("X-Request-ID", tt.in)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get("X-Request-ID")
+			if tt.want != "" && id != tt.want {
+				t.Errorf("got id %q, want %q", id, tt.want)
+			} else if tt.want == "" && !generatedRequestID.MatchString(id) {
+				t.Errorf("got id %q, want a generated one", id)
+			}
+			if forwarded != id || inContext != id {
+				t.Errorf("got %q in the request and %q in the context, want %q", forwarded, inContext, id)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(logs.Bytes(), &got); err != nil {
+				t.Fatalf("log %q: %v", logs.String(), err)
+			}
+			if got["request_id"] != id {
+				t.Errorf("logged request_id %v, want %q", got["request_id"], id)
+			}
+		})
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	// the upstream answers with the ids it got, and fails the request with
+	// the id "fail".
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Request-ID") == "fail" {
+			panic(http.ErrAbortHandler)
+		}
+		fmt.Fprintf(w, "# %q %q\n", r.Header.Get("X-Request-ID"), r.Header.Get("X-Trace"))
+	})
+	tests := []struct {
+		name   string
+		header string
+		// sent is the header the request id is sent in.
+		sent     string
+		id       string
+		wantID   string
+		wantBody string
+	}{
+		{name: "forwarded", header: "X-Request-ID", sent: "X-Request-ID", id: "scrape-1", wantID: "scrape-1", wantBody: "# \"scrape-1\" \"\"\n"},
+		{name: "custom header", header: "X-Trace", sent: "X-Trace", id: "scrape-2", wantID: "scrape-2", wantBody: "# \"\" \"scrape-2\"\n"},
+		{name: "disabled", sent: "X-Request-ID", id: "scrape-3", wantBody: "# \"\" \"\"\n"},
+		{name: "upstream error", header: "X-Request-ID", sent: "X-Request-ID", id: "fail", wantID: "fail", wantBody: "Bad Gateway (request id fail)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, upstream, func(c *Config) { c.RequestIDHeader = tt.header })
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set(tt.sent, tt.id)
+			rec := httptest.NewRecorder()
+			p.Handler().ServeHTTP(rec, req)
+			if got := rec.Header().Get(tt.sent); got != tt.wantID {
+				t.Errorf("got id %q in the response, want %q", got, tt.wantID)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRequestIDHeaderFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		wantErr string
+	}{
+		{name: "default", header: "X-Request-ID"},
+		{name: "disabled"},
+		{name: "space", header: "X Request", wantErr: `invalid --request-id-header "X Request"`},
+		{name: "colon", header: "X-Request-ID:", wantErr: `invalid --request-id-header "X-Request-ID:"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			c.RequestIDHeader = tt.header
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// retryMaxBackoff caps the doubling backoff between retries.
+const retryMaxBackoff = 5 * time.Second
+
+// The classes of upstream errors --upstream-retry-on can select.
+const (
+	retryConnect = "connect"
+	retryReset   = "reset"
+	retryTimeout = "timeout"
+	retry5xx     = "5xx"
+)
+
+var retryClasses = []string{retryConnect, retryReset, retryTimeout, retry5xx}
+
+// retryPolicy retries idempotent requests that failed on every upstream
+// target with a retryable error, after a doubling backoff.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	on      map[string]bool
+}
+
+// parseRetryOn checks --upstream-retry-on.
+func (c *Config) parseRetryOn() error {
+	c.retryOn = map[string]bool{}
+	for _, class := range strings.Split(c.UpstreamRetryOn, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		if !slices.Contains(retryClasses, class) {
+			return fmt.Errorf("--upstream-retry-on: unknown error class %q, must be one of %s", class, strings.Join(retryClasses, ", "))
+		}
+		c.retryOn[class] = true
+	}
+	return nil
+}
+
+func newRetryPolicy(c *Config) *retryPolicy {
+	if c.UpstreamRetries <= 0 {
+		return nil
+	}
+	return &retryPolicy{retries: c.UpstreamRetries, backoff: c.UpstreamRetryBackoff, on: c.retryOn}
+}
+
+// errorClass returns the retry class of a failed round trip, or "" if it
+// isn't one.
+func errorClass(resp *http.Response, err error) string {
+	if err == nil {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return retry5xx
+		}
+		return ""
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return retryConnect
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return retryReset
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return retryTimeout
+	}
+	return ""
+}
+
+// do calls roundTrip until it succeeds, fails with an error not selected by
+// the policy or the retries are used up. Only GET and HEAD requests are
+// retried.
+func (p *retryPolicy) do(req *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if p == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return roundTrip(req)
+	}
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := roundTrip(req)
+		class := errorClass(resp, err)
+		if class == "" || !p.on[class] || attempt == p.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		reason := any(err)
+		if err == nil {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		upstreamRetries.WithLabelValues(class).Inc()
+		slog.Warn("upstream request failed on every endpoint, retrying", "class", class, "attempt", attempt+1, "backoff", backoff, "err", reason)
+		if err := sleepContext(req.Context(), backoff); err != nil {
+			return nil, err
+		}
+		backoff = min(backoff*2, retryMaxBackoff)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   string
+	}{
+		{"ok", http.StatusOK, nil, ""},
+		{"4xx", http.StatusNotFound, nil, ""},
+		{"5xx", http.StatusServiceUnavailable, nil, retry5xx},
+		{"connection refused", 0, errConnRefused, retryConnect},
+		{"dial timeout", 0, &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, retryConnect},
+		{"connection reset", 0, &net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, retryReset},
+		{"broken pipe", 0, fmt.Errorf("write: %w", syscall.EPIPE), retryReset},
+		{"closed connection", 0, io.EOF, retryReset},
+		{"truncated response", 0, fmt.Errorf("reading headers: %w", io.ErrUnexpectedEOF), retryReset},
+		{"read timeout", 0, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, retryTimeout},
+		{"cancelled", 0, context.Canceled, ""},
+		{"other", 0, errors.New("malformed HTTP response"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := errorClass(resp, tt.err); got != tt.want {
+				t.Errorf("errorClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// roundTripFunc adapts a function to an http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestRetryPolicy(t *testing.T) {
+	refused := func(*http.Request) (*http.Response, error) { return nil, errConnRefused }
+	status := func(code int) func(*http.Request) (*http.Response, error) {
+		return func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+		}
+	}
+	tests := []struct {
+		name         string
+		method       string
+		on           string
+		attempts     []func(*http.Request) (*http.Response, error)
+		wantAttempts int
+		wantStatus   int
+	}{
+		{"connection error is retried", http.MethodGet, "connect", []func(*http.Request) (*http.Response, error){refused, refused, status(200)}, 3, http.StatusOK},
+		{"5xx is retried", http.MethodGet, "5xx", []func(*http.Request) (*http.Response, error){status(503), status(200)}, 2, http.StatusOK},
+		{"head is retried", http.MethodHead, "connect", []func(*http.Request) (*http.Response, error){refused, status(200)}, 2, http.StatusOK},
+		{"retries are used up", http.MethodGet, "connect", []func(*http.Request) (*http.Response, error){refused, refused, refused, status(200)}, 3, 0},
+		{"last 5xx is returned", http.MethodGet, "5xx", []func(*http.Request) (*http.Response, error){status(503), status(503), status(502)}, 3, http.StatusBadGateway},
+		{"4xx isn't retried", http.MethodGet, "connect,reset,timeout,5xx", []func(*http.Request) (*http.Response, error){status(404), status(200)}, 1, http.StatusNotFound},
+		{"unselected class isn't retried", http.MethodGet, "5xx", []func(*http.Request) (*http.Response, error){refused, status(200)}, 1, 0},
+		{"post isn't retried", http.MethodPost, "connect,5xx", []func(*http.Request) (*http.Response, error){status(503), status(200)}, 1, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamRetries = 2
+			c.UpstreamRetryBackoff = time.Millisecond
+			c.UpstreamRetryOn = tt.on
+			if err := c.parseRetryOn(); err != nil {
+				t.Fatal(err)
+			}
+			attempts := 0
+			f := &failoverTransport{
+				targets: newUpstreamTargets("etcd-0:2379"),
+				next: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					attempts++
+					return tt.attempts[attempts-1](r)
+				}),
+				retry: newRetryPolicy(&c),
+			}
+			defer forgetEndpoints([]string{"etcd-0:2379"})
+
+			req, err := http.NewRequest(tt.method, "http://upstream/metrics", strings.NewReader(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := f.RoundTrip(req)
+			if attempts != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantStatus == 0 {
+				if err == nil {
+					t.Fatalf("got %d, want an error", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyCancelledBackoff(t *testing.T) {
+	p := &retryPolicy{retries: 3, backoff: time.Hour, on: map[string]bool{retryConnect: true}}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://upstream/metrics", nil)
+	attempts := 0
+	_, err := p.do(req, func(*http.Request) (*http.Response, error) {
+		attempts++
+		cancel()
+		return nil, errConnRefused
+	})
+	if attempts != 1 || err == nil {
+		t.Errorf("%d attempts and error %v after the scrape was cancelled, want 1 and an error", attempts, err)
+	}
+}
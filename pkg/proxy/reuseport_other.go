@@ -0,0 +1,9 @@
+//go:build !unix
+
+package proxy
+
+import "errors"
+
+func setReusePort(uintptr) error {
+	return errors.New("--listen-reuse-port is not supported on this platform")
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package proxy
+
+import "golang.org/x/sys/unix"
+
+// setReusePort sets SO_REUSEPORT on the socket fd, so that a new process can
+// bind the same address while the old one is still serving.
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,100 @@
+//go:build unix
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockoptInt returns the socket option of conn.
+func sockoptInt(t *testing.T, conn syscall.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) { value, sockErr = unix.GetsockoptInt(int(fd), level, opt) }); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value
+}
+
+func TestListenReusePort(t *testing.T) {
+	tests := []struct {
+		name      string
+		reusePort bool
+	}{
+		{"without reuse port", false},
+		{"reuse port", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.ListenReusePort = tt.reusePort
+			first, err := listen("127.0.0.1:0", &c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			if got := sockoptInt(t, first.(*net.TCPListener), unix.SOL_SOCKET, unix.SO_REUSEPORT) != 0; got != tt.reusePort {
+				t.Errorf("SO_REUSEPORT set: %v, want %v", got, tt.reusePort)
+			}
+			// a second process binds the same address while the first serves.
+			second, err := listen(first.Addr().String(), &c)
+			if tt.reusePort && err != nil {
+				t.Errorf("second listen: %v", err)
+			} else if !tt.reusePort && err == nil {
+				t.Error("the address was bound twice without SO_REUSEPORT")
+			}
+			if second != nil {
+				second.Close()
+			}
+		})
+	}
+}
+
+func TestListenKeepAlive(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAlive time.Duration
+		want      bool
+	}{
+		{"default", 0, true},
+		{"period", 30 * time.Second, true},
+		{"disabled", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.ListenKeepAlive = tt.keepAlive
+			l, err := listen("127.0.0.1:0", &c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := sockoptInt(t, conn.(*net.TCPConn), unix.SOL_SOCKET, unix.SO_KEEPALIVE) != 0; got != tt.want {
+				t.Errorf("SO_KEEPALIVE set: %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
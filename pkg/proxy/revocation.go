@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspTimeout bounds a request to an OCSP responder, which is made during
+// the handshake.
+const ocspTimeout = 5 * time.Second
+
+// ocspDefaultValidity is how long an OCSP response without a next update
+// is used before the responder is asked again.
+const ocspDefaultValidity = time.Hour
+
+var errRevoked = errors.New("upstream certificate is revoked")
+
+// revocationChecker checks that the certificate of the upstream hasn't been
+// revoked, against the CRLs of --etcd-crl and, with --etcd-ocsp, the OCSP
+// response stapled by the server or else one from the responder named in
+// the certificate. A revoked certificate always fails the handshake. When
+// no method could establish the status, e.g. because the CRL expired or the
+// responder is unreachable, it only fails with
+// --etcd-revocation-policy=fail-closed.
+type revocationChecker struct {
+	crlFile    string
+	ocsp       bool
+	failClosed bool
+	client     *http.Client
+
+	mu sync.Mutex
+	// crls were read from crlFile when it had the modification time and
+	// size of crlStat.
+	crls    []*x509.RevocationList
+	crlStat os.FileInfo
+	// responses caches the OCSP responses fetched from responders, by
+	// issuer and serial number.
+	responses map[string]*ocsp.Response
+}
+
+func newRevocationChecker(c *Config) (*revocationChecker, error) {
+	r := &revocationChecker{
+		crlFile:    c.EtcdCRL,
+		ocsp:       c.EtcdOCSP,
+		failClosed: c.EtcdRevocationPolicy == "fail-closed",
+		client:     &http.Client{Timeout: ocspTimeout},
+		responses:  map[string]*ocsp.Response{},
+	}
+	if r.crlFile != "" {
+		if _, err := r.currentCRLs(); err != nil {
+			return nil, fmt.Errorf("failed to load --etcd-crl: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// verifyConnection is the tls.Config.VerifyConnection of the upstream
+// transport, run after the server certificate was verified.
+func (r *revocationChecker) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) < 2 {
+		// a self-signed certificate trusted as is has no issuer to
+		// revoke it.
+		return nil
+	}
+	chain := cs.VerifiedChains[0]
+	var unknown []error
+	good := false
+	check := func(method string, err error) error {
+		switch {
+		case errors.Is(err, errRevoked):
+			revocationChecks.WithLabelValues(method, "revoked").Inc()
+			slog.Error("upstream certificate is revoked", "method", method, "subject", chain[0].Subject.String(), "err", err)
+			return err
+		case err != nil:
+			revocationChecks.WithLabelValues(method, "unknown").Inc()
+			unknown = append(unknown, fmt.Errorf("%s: %w", method, err))
+		default:
+			revocationChecks.WithLabelValues(method, "good").Inc()
+			good = true
+		}
+		return nil
+	}
+	if r.crlFile != "" {
+		if err := check("crl", r.checkCRL(chain)); err != nil {
+			return err
+		}
+	}
+	if r.ocsp {
+		if err := check("ocsp", r.checkOCSP(cs.OCSPResponse, chain[0], chain[1])); err != nil {
+			return err
+		}
+	}
+	if good {
+		return nil
+	}
+	err := fmt.Errorf("revocation status of the upstream certificate unknown: %w", errors.Join(unknown...))
+	if r.failClosed {
+		return err
+	}
+	slog.Warn("accepting the upstream certificate with --etcd-revocation-policy=fail-open", "subject", chain[0].Subject.String(), "err", err)
+	return nil
+}
+
+// checkCRL looks up the certificates of chain, but its root, in the CRLs.
+// The server certificate needs a current CRL from its issuer, the
+// intermediates are only checked if there is one for them.
+func (r *revocationChecker) checkCRL(chain []*x509.Certificate) error {
+	crls, err := r.currentCRLs()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, cert := range chain[:len(chain)-1] {
+		issuer := chain[i+1]
+		covered := false
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				continue
+			}
+			covered = true
+			for _, revoked := range crl.RevokedCertificateEntries {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("%w: %q listed in the crl since %s", errRevoked, cert.Subject.String(), revoked.RevocationTime.Format(time.RFC3339))
+				}
+			}
+		}
+		if !covered && i == 0 {
+			return fmt.Errorf("%s has no current crl from %q", r.crlFile, cert.Issuer.String())
+		}
+	}
+	return nil
+}
+
+// currentCRLs returns the CRLs of crlFile, reading it again whenever its
+// modification time or size changed, so a CRL that is republished is
+// picked up without a reload. If it fails to parse, the CRLs read before
+// stay in use.
+func (r *revocationChecker) currentCRLs() ([]*x509.RevocationList, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fi, err := os.Stat(r.crlFile)
+	if err == nil && r.crlStat != nil && fi.ModTime().Equal(r.crlStat.ModTime()) && fi.Size() == r.crlStat.Size() {
+		return r.crls, nil
+	}
+	var crls []*x509.RevocationList
+	if err == nil {
+		crls, err = readCRLs(r.crlFile)
+	}
+	if err != nil {
+		if r.crls == nil {
+			return nil, err
+		}
+		slog.Warn("failed to read the crl, keeping the current one", "file", r.crlFile, "err", err)
+		return r.crls, nil
+	}
+	if r.crlStat != nil {
+		slog.Info("reloaded the crl", "file", r.crlFile, "crls", len(crls))
+	}
+	r.crls, r.crlStat = crls, fi
+	return crls, nil
+}
+
+// readCRLs parses the CRLs in path, PEM encoded or a single DER one.
+func readCRLs(path string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var crls []*x509.RevocationList
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("no crl in %s: %w", path, err)
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// checkOCSP checks the OCSP status of cert, issued by issuer, from the
+// stapled response if the server sent a current one, or else from its
+// responder.
+func (r *revocationChecker) checkOCSP(stapled []byte, cert, issuer *x509.Certificate) error {
+	now := time.Now()
+	if len(stapled) > 0 {
+		resp, err := ocsp.ParseResponseForCert(stapled, cert, issuer)
+		if err == nil && (resp.NextUpdate.IsZero() || now.Before(resp.NextUpdate)) {
+			return ocspStatus(resp)
+		}
+		slog.Debug("ignoring the stapled ocsp response of the upstream", "err", err)
+	}
+	key := string(cert.RawIssuer) + "\x00" + cert.SerialNumber.String()
+	r.mu.Lock()
+	cached, ok := r.responses[key]
+	r.mu.Unlock()
+	if ok && now.Before(ocspExpiry(cached)) {
+		return ocspStatus(cached)
+	}
+	resp, err := r.queryResponder(cert, issuer)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.responses[key] = resp
+	r.mu.Unlock()
+	return ocspStatus(resp)
+}
+
+// queryResponder asks the OCSP responders named in cert for its status.
+func (r *revocationChecker) queryResponder(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, errors.New("no stapled ocsp response and the certificate names no responder")
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	var failed []error
+	for _, server := range cert.OCSPServer {
+		resp, err := r.post(server, req, cert, issuer)
+		if err == nil {
+			return resp, nil
+		}
+		failed = append(failed, fmt.Errorf("%s: %w", server, err))
+	}
+	return nil, errors.Join(failed...)
+}
+
+func (r *revocationChecker) post(server string, req []byte, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	resp, err := r.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
+
+// ocspExpiry is when resp should be replaced by a newer one.
+func ocspExpiry(resp *ocsp.Response) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return resp.ThisUpdate.Add(ocspDefaultValidity)
+	}
+	return resp.NextUpdate
+}
+
+func ocspStatus(resp *ocsp.Response) error {
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w: revoked at %s according to ocsp", errRevoked, resp.RevokedAt.Format(time.RFC3339))
+	}
+	return errors.New("ocsp status is unknown")
+}
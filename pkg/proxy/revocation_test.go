@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+// writeTestCRL writes a crl of ca to path, valid until nextUpdate and
+// listing the revoked certificates.
+func writeTestCRL(t *testing.T, ca *testCA, path string, nextUpdate time.Time, revoked ...*x509.Certificate) {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, cert := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Hour),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})))
+}
+
+// testOCSPResponse returns an ocsp response of ca for cert, valid until
+// nextUpdate.
+func testOCSPResponse(t *testing.T, ca *testCA, cert *x509.Certificate, status int, nextUpdate time.Time) []byte {
+	t.Helper()
+	resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   time.Now().Add(-2 * time.Hour),
+		NextUpdate:   nextUpdate,
+		RevokedAt:    time.Now().Add(-time.Hour),
+	}, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// revocationResult is the checks of method with result counted since the
+// test started.
+func revocationResult(method, result string) func() float64 {
+	start := testutil.ToFloat64(revocationChecks.WithLabelValues(method, result))
+	return func() float64 {
+		return testutil.ToFloat64(revocationChecks.WithLabelValues(method, result)) - start
+	}
+}
+
+func TestRevocationCRL(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	leaf := ca.issue(t, &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}).Leaf
+	tests := []struct {
+		name       string
+		crl        func(path string)
+		failClosed bool
+		wantErr    string
+		wantResult string
+	}{
+		{name: "good", crl: func(path string) { writeTestCRL(t, ca, path, time.Now().Add(time.Hour)) }, wantResult: "good"},
+		{
+			name:       "revoked",
+			crl:        func(path string) { writeTestCRL(t, ca, path, time.Now().Add(time.Hour), leaf) },
+			wantErr:    "upstream certificate is revoked",
+			wantResult: "revoked",
+		},
+		{
+			name:       "expired crl",
+			crl:        func(path string) { writeTestCRL(t, ca, path, time.Now().Add(-time.Minute), leaf) },
+			wantResult: "unknown",
+		},
+		{
+			name:       "expired crl failing closed",
+			crl:        func(path string) { writeTestCRL(t, ca, path, time.Now().Add(-time.Minute)) },
+			failClosed: true,
+			wantErr:    "has no current crl from",
+			wantResult: "unknown",
+		},
+		{
+			name:       "crl of another ca failing closed",
+			crl:        func(path string) { writeTestCRL(t, other, path, time.Now().Add(time.Hour), leaf) },
+			failClosed: true,
+			wantErr:    "revocation status of the upstream certificate unknown",
+			wantResult: "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ca.crl")
+			tt.crl(path)
+			c := DefaultConfig()
+			c.EtcdCRL = path
+			if tt.failClosed {
+				c.EtcdRevocationPolicy = "fail-closed"
+			}
+			r, err := newRevocationChecker(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checks := revocationResult("crl", tt.wantResult)
+			err = r.verifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca.cert}}})
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("verifyConnection() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("verifyConnection() = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := checks(); got != 1 {
+				t.Errorf("got %v %s crl checks, want 1", got, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestCRLReload(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := ca.issue(t, &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}).Leaf
+	chain := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca.cert}}}
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	c := DefaultConfig()
+	c.EtcdCRL = path
+	if _, err := newRevocationChecker(&c); err == nil || !strings.Contains(err.Error(), "failed to load --etcd-crl") {
+		t.Errorf("newRevocationChecker() = %v, want an error for the missing crl", err)
+	}
+
+	writeTestCRL(t, ca, path, time.Now().Add(time.Hour))
+	r, err := newRevocationChecker(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.verifyConnection(chain); err != nil {
+		t.Fatalf("verifyConnection() = %v", err)
+	}
+	// a republished crl is read again without a reload.
+	writeTestCRL(t, ca, path, time.Now().Add(time.Hour), leaf)
+	if err := r.verifyConnection(chain); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("verifyConnection() = %v, want the certificate revoked by the new crl", err)
+	}
+	// a crl that fails to parse keeps the current one.
+	writeFile(t, path, "not a crl")
+	if err := r.verifyConnection(chain); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("verifyConnection() = %v, want the previous crl kept", err)
+	}
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	var queries atomic.Int32
+	var responses atomic.Pointer[[]byte]
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		if _, err := io.ReadAll(r.Body); err != nil {
+			t.Error(err)
+		}
+		resp := responses.Load()
+		if resp == nil {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(*resp)
+	}))
+	defer responder.Close()
+	withResponder := ca.issue(t, &x509.Certificate{NotAfter: time.Now().Add(time.Hour), OCSPServer: []string{responder.URL}}).Leaf
+	withoutResponder := ca.issue(t, &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}).Leaf
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		cert        *x509.Certificate
+		stapled     func(cert *x509.Certificate) []byte
+		responder   func(cert *x509.Certificate) []byte
+		failClosed  bool
+		wantErr     string
+		wantResult  string
+		wantQueries int32
+	}{
+		{
+			name:       "stapled good",
+			cert:       withoutResponder,
+			stapled:    func(cert *x509.Certificate) []byte { return testOCSPResponse(t, ca, cert, ocsp.Good, later) },
+			wantResult: "good",
+		},
+		{
+			name:       "stapled revoked",
+			cert:       withoutResponder,
+			stapled:    func(cert *x509.Certificate) []byte { return testOCSPResponse(t, ca, cert, ocsp.Revoked, later) },
+			wantErr:    "revoked at",
+			wantResult: "revoked",
+		},
+		{
+			name: "expired stapled response asks the responder",
+			cert: withResponder,
+			stapled: func(cert *x509.Certificate) []byte {
+				return testOCSPResponse(t, ca, cert, ocsp.Good, time.Now().Add(-time.Minute))
+			},
+			responder:   func(cert *x509.Certificate) []byte { return testOCSPResponse(t, ca, cert, ocsp.Revoked, later) },
+			wantErr:     "revoked at",
+			wantResult:  "revoked",
+			wantQueries: 1,
+		},
+		{
+			name:        "responder",
+			cert:        withResponder,
+			responder:   func(cert *x509.Certificate) []byte { return testOCSPResponse(t, ca, cert, ocsp.Good, later) },
+			wantResult:  "good",
+			wantQueries: 1,
+		},
+		{
+			name:        "responder down",
+			cert:        withResponder,
+			wantResult:  "unknown",
+			wantQueries: 2,
+		},
+		{
+			name:        "responder down failing closed",
+			cert:        withResponder,
+			failClosed:  true,
+			wantErr:     "responder returned 503 Service Unavailable",
+			wantResult:  "unknown",
+			wantQueries: 2,
+		},
+		{
+			name:       "no responder failing closed",
+			cert:       withoutResponder,
+			failClosed: true,
+			wantErr:    "the certificate names no responder",
+			wantResult: "unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses.Store(nil)
+			if tt.responder != nil {
+				resp := tt.responder(tt.cert)
+				responses.Store(&resp)
+			}
+			cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert, ca.cert}}}
+			if tt.stapled != nil {
+				cs.OCSPResponse = tt.stapled(tt.cert)
+			}
+			c := DefaultConfig()
+			c.EtcdOCSP = true
+			if tt.failClosed {
+				c.EtcdRevocationPolicy = "fail-closed"
+			}
+			r, err := newRevocationChecker(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checks := revocationResult("ocsp", tt.wantResult)
+			queries.Store(0)
+			// a response of the responder is cached, a failure isn't.
+			for range 2 {
+				err = r.verifyConnection(cs)
+				if tt.wantErr == "" && err != nil {
+					t.Errorf("verifyConnection() = %v", err)
+				} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+					t.Errorf("verifyConnection() = %v, want an error containing %q", err, tt.wantErr)
+				}
+			}
+			if got := checks(); got != 2 {
+				t.Errorf("got %v %s ocsp checks, want 2", got, tt.wantResult)
+			}
+			if got := queries.Load(); got != tt.wantQueries {
+				t.Errorf("queried the responder %d times, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestRevokedUpstream(t *testing.T) {
+	ca := newTestCA(t)
+	server := ca.issue(t, &x509.Certificate{DNSNames: []string{"localhost"}, NotAfter: time.Now().Add(time.Hour)})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{server}}
+	srv.StartTLS()
+	defer srv.Close()
+	defer forgetEndpoints([]string{srv.Listener.Addr().String()})
+
+	dir := t.TempDir()
+	caFile, cert, key, crl := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), filepath.Join(dir, "ca.crl")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, cert, key, "client")
+	tests := []struct {
+		name    string
+		revoked []*x509.Certificate
+		want    int
+	}{
+		{name: "good", want: http.StatusOK},
+		{name: "revoked", revoked: []*x509.Certificate{server.Leaf}, want: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeTestCRL(t, ca, crl, time.Now().Add(time.Hour), tt.revoked...)
+			c := DefaultConfig()
+			c.UpstreamURL = srv.URL + "/metrics"
+			c.EtcdCA, c.EtcdCert, c.EtcdKey = []string{caFile}, cert, key
+			c.EtcdCRL = crl
+			c.AccessLogFormat = "none"
+			defer certExpiry.DeleteLabelValues(caFile)
+			defer certExpiry.DeleteLabelValues(cert)
+			p, err := NewProxy(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != tt.want {
+				t.Errorf("got %d %q, want %d", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRevocationFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "crl", configure: func(c *Config) { c.EtcdCRL = "ca.crl" }},
+		{name: "ocsp failing closed", configure: func(c *Config) { c.EtcdOCSP, c.EtcdRevocationPolicy = true, "fail-closed" }},
+		{
+			name:      "invalid policy",
+			configure: func(c *Config) { c.EtcdRevocationPolicy = "strict" },
+			wantErr:   `invalid --etcd-revocation-policy "strict", must be fail-open or fail-closed`,
+		},
+		{
+			name: "http upstream",
+			configure: func(c *Config) {
+				c.UpstreamScheme, c.UseSystemCA, c.EtcdCert, c.EtcdKey, c.EtcdCRL = "http", false, "", "", "ca.crl"
+			},
+			wantErr: "the etcd tls flags can't be used with --upstream-scheme=http",
+		},
+		{
+			name: "spiffe",
+			configure: func(c *Config) {
+				c.UseSystemCA, c.EtcdCert, c.EtcdKey = false, "", ""
+				c.EtcdOCSP, c.SPIFFESocket = true, "unix:///run/spire/agent.sock"
+			},
+			wantErr: "--etcd-crl and --etcd-ocsp can't be used with --spiffe-socket",
+		},
+		{
+			name:      "insecure skip verify",
+			configure: func(c *Config) { c.EtcdCRL, c.InsecureSkipVerify = "ca.crl", true },
+			wantErr:   "--etcd-crl and --etcd-ocsp can't be used with --insecure-skip-verify",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			// the files are only loaded by NewProxy.
+			c.UseSystemCA, c.EtcdCert, c.EtcdKey = true, "client.crt", "client.key"
+			tt.configure(&c)
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sample is a single parsed series value from a scrape.
+type sample struct {
+	name   string
+	family string
+	// typ is the declared type of the family, "untyped" if none was given.
+	typ       string
+	help      string
+	labels    []label
+	value     float64
+	timestamp time.Time
+}
+
+// scrapeSamples requests /metrics from h, which applies the same filtering
+// and relabeling as a scrape through the proxy, and parses the response.
+// Samples without an explicit timestamp are stamped with the scrape time.
+func scrapeSamples(ctx context.Context, h http.Handler) ([]sample, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	now := time.Now()
+	resp := recordResponse(h, req)
+	if resp.status != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned %d", resp.status)
+	}
+
+	var samples []sample
+	types, helps := map[string]string{}, map[string]string{}
+	err = rewriteExposition(bytes.NewReader(resp.body), io.Discard, func(l *line) bool {
+		switch l.kind {
+		case lineHelp:
+			helps[l.name] = l.rest
+		case lineType:
+			types[l.name] = strings.TrimSpace(l.rest)
+		case lineSample:
+			s, ok := parseSampleValue(l.rest, now)
+			if !ok {
+				return false
+			}
+			s.name, s.family, s.labels = l.name, l.family, l.labels
+			s.typ, s.help = types[l.family], helps[l.family]
+			if s.typ == "" {
+				s.typ = "untyped"
+			}
+			samples = append(samples, s)
+		}
+		return false
+	})
+	return samples, err
+}
+
+// parseSampleValue parses the value and optional millisecond timestamp
+// following the labels of a text format sample.
+func parseSampleValue(rest string, now time.Time) (sample, bool) {
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return sample{}, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample{}, false
+	}
+	s := sample{value: v, timestamp: now}
+	if len(fields) > 1 && fields[1] != "#" {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return sample{}, false
+		}
+		s.timestamp = time.UnixMilli(ms)
+	}
+	return s, true
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// scraperIdleExpiry is how long the quota of a scraper that stopped
+// sending requests is kept before it is forgotten.
+const scraperIdleExpiry = 10 * time.Minute
+
+type scraperSubjectKey struct{}
+
+// withScraperSubject notes the subject of the JWT the scraper presented.
+func withScraperSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, scraperSubjectKey{}, subject)
+}
+
+// scraperIdentity names the scraper of r: "jwt:" and the subject of its
+// token, "cert:" and the common name, or else the identity, of its client
+// certificate, or "ip:" and its address.
+func scraperIdentity(r *http.Request, trusted []netip.Prefix) string {
+	if subject, ok := r.Context().Value(scraperSubjectKey{}).(string); ok {
+		return "jwt:" + subject
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		if cert.Subject.CommonName != "" {
+			return "cert:" + cert.Subject.CommonName
+		}
+		return "cert:" + certIdentity(cert)
+	}
+	if addr, ok := clientAddr(r, trusted); ok {
+		return "ip:" + addr.String()
+	}
+	return "ip:unknown"
+}
+
+// scraperAccounting counts the /metrics requests and bytes served to each
+// scraper with --scraper-metrics and, with --scraper-requests-per-second,
+// gives each its own token bucket, answering requests beyond it with 429,
+// so one team's Prometheus can't use up the proxy shared with others.
+type scraperAccounting struct {
+	next    http.Handler
+	trusted []netip.Prefix
+	metrics bool
+	limit   rate.Limit
+	burst   int
+
+	mu       sync.Mutex
+	limiters map[string]*scraperLimiter
+	swept    time.Time
+}
+
+type scraperLimiter struct {
+	*rate.Limiter
+	seen time.Time
+}
+
+func newScraperAccounting(next http.Handler, c *Config, trusted []netip.Prefix) *scraperAccounting {
+	return &scraperAccounting{
+		next:     next,
+		trusted:  trusted,
+		metrics:  c.ScraperMetrics,
+		limit:    rate.Limit(c.ScraperRequestsPerSecond),
+		burst:    c.ScraperBurst,
+		limiters: map[string]*scraperLimiter{},
+	}
+}
+
+func (s *scraperAccounting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scraper := scraperIdentity(r, s.trusted)
+	if s.limit > 0 && !s.allow(scraper) {
+		scraperQuotaRejections.WithLabelValues(scraper).Inc()
+		if s.metrics {
+			scraperRequests.WithLabelValues(scraper, strconv.Itoa(http.StatusTooManyRequests)).Inc()
+		}
+		slog.Debug("scraper quota exceeded", "scraper", scraper, "remote", r.RemoteAddr)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "scraper quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+	if !s.metrics {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+	cw := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	s.next.ServeHTTP(cw, r)
+	scraperRequests.WithLabelValues(scraper, strconv.Itoa(cw.status)).Inc()
+	scraperBytes.WithLabelValues(scraper).Add(float64(cw.bytes))
+}
+
+// allow takes a token from the bucket of scraper, forgetting the buckets
+// of scrapers idle for scraperIdleExpiry along the way.
+func (s *scraperAccounting) allow(scraper string) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > scraperIdleExpiry {
+		for id, l := range s.limiters {
+			if now.Sub(l.seen) > scraperIdleExpiry {
+				delete(s.limiters, id)
+			}
+		}
+		s.swept = now
+	}
+	l, ok := s.limiters[scraper]
+	if !ok {
+		l = &scraperLimiter{Limiter: rate.NewLimiter(s.limit, s.burst)}
+		s.limiters[scraper] = l
+	}
+	l.seen = now
+	return l.AllowN(now, 1)
+}
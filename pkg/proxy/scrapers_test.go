@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+func TestScraperIdentity(t *testing.T) {
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/monitoring/sa/prometheus")
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name    string
+		subject string
+		cert    *x509.Certificate
+		remote  string
+		xff     string
+		want    string
+	}{
+		{name: "jwt", subject: "system:serviceaccount:monitoring:prometheus", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "prometheus"}}, want: "jwt:system:serviceaccount:monitoring:prometheus"},
+		{name: "cert common name", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "prometheus"}, URIs: []*url.URL{spiffeID}}, want: "cert:prometheus"},
+		{name: "cert without a common name", cert: &x509.Certificate{URIs: []*url.URL{spiffeID}}, want: "cert:" + spiffeID.String()},
+		{name: "address", remote: "192.0.2.1:1234", want: "ip:192.0.2.1"},
+		{name: "behind a trusted proxy", remote: "10.0.0.1:1234", xff: "192.0.2.2", want: "ip:192.0.2.2"},
+		{name: "untrusted forwarded for", remote: "192.0.2.1:1234", xff: "192.0.2.2", want: "ip:192.0.2.1"},
+		{name: "unix socket", remote: "@", want: "ip:unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.remote != "" {
+				r.RemoteAddr = tt.remote
+			}
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.cert != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.cert}}
+			}
+			if tt.subject != "" {
+				r = r.WithContext(withScraperSubject(r.Context(), tt.subject))
+			}
+			if got := scraperIdentity(r, trusted); got != tt.want {
+				t.Errorf("scraperIdentity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScraperAccounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics bool
+		rate    float64
+		// want are the status codes of the requests of the first scraper.
+		want         []int
+		wantRejected float64
+	}{
+		{name: "metrics", metrics: true, want: []int{200, 200, 200}},
+		{name: "quota", rate: 0.001, want: []int{200, 200, 429}, wantRejected: 1},
+		{name: "metrics and quota", metrics: true, rate: 0.001, want: []int{200, 200, 429}, wantRejected: 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every case has its own scrapers, so their series start at 0.
+			first, second := fmt.Sprintf("192.0.2.%d", 10+i), fmt.Sprintf("192.0.2.%d", 20+i)
+			for _, addr := range []string{first, second} {
+				defer scraperRequests.DeleteLabelValues("ip:"+addr, "200")
+				defer scraperRequests.DeleteLabelValues("ip:"+addr, "429")
+				defer scraperBytes.DeleteLabelValues("ip:" + addr)
+				defer scraperQuotaRejections.DeleteLabelValues("ip:" + addr)
+			}
+			c := DefaultConfig()
+			c.ScraperMetrics, c.ScraperRequestsPerSecond, c.ScraperBurst = tt.metrics, tt.rate, 2
+			h := newScraperAccounting(okHandler, &c, nil)
+			serve := func(addr string) int {
+				r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+				r.RemoteAddr = addr + ":1234"
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+					t.Errorf("got Retry-After %q, want 1", rec.Header().Get("Retry-After"))
+				}
+				return rec.Code
+			}
+			for n, want := range tt.want {
+				if got := serve(first); got != want {
+					t.Errorf("request %d got %d, want %d", n, got, want)
+				}
+			}
+			// the quota of one scraper doesn't hold back another.
+			if got := serve(second); got != http.StatusOK {
+				t.Errorf("the second scraper got %d, want 200", got)
+			}
+
+			if got := testutil.ToFloat64(scraperQuotaRejections.WithLabelValues("ip:" + first)); got != tt.wantRejected {
+				t.Errorf("got %v quota rejections, want %v", got, tt.wantRejected)
+			}
+			var wantOK, wantRejected, wantBytes float64
+			if tt.metrics {
+				wantOK, wantRejected = float64(len(tt.want))-tt.wantRejected, tt.wantRejected
+				wantBytes = wantOK * float64(len("etcd_server_has_leader 1\n"))
+			}
+			if got := testutil.ToFloat64(scraperRequests.WithLabelValues("ip:"+first, "200")); got != wantOK {
+				t.Errorf("got %v requests with 200, want %v", got, wantOK)
+			}
+			if got := testutil.ToFloat64(scraperRequests.WithLabelValues("ip:"+first, "429")); got != wantRejected {
+				t.Errorf("got %v requests with 429, want %v", got, wantRejected)
+			}
+			if got := testutil.ToFloat64(scraperBytes.WithLabelValues("ip:" + first)); got != wantBytes {
+				t.Errorf("got %v response bytes, want %v", got, wantBytes)
+			}
+		})
+	}
+}
+
+func TestScraperIdleExpiry(t *testing.T) {
+	c := DefaultConfig()
+	c.ScraperRequestsPerSecond, c.ScraperBurst = 0.001, 1
+	s := newScraperAccounting(okHandler, &c, nil)
+	if !s.allow("ip:192.0.2.1") || s.allow("ip:192.0.2.1") {
+		t.Fatal("want one request allowed in the burst")
+	}
+	// the bucket of a scraper idle for long enough is forgotten, the one of
+	// a scraper seen since is kept.
+	s.mu.Lock()
+	s.limiters["ip:192.0.2.1"].seen = time.Now().Add(-scraperIdleExpiry - time.Second)
+	s.limiters["ip:192.0.2.2"] = &scraperLimiter{Limiter: rate.NewLimiter(s.limit, s.burst), seen: time.Now()}
+	s.swept = time.Now().Add(-scraperIdleExpiry - time.Second)
+	s.mu.Unlock()
+	if !s.allow("ip:192.0.2.1") {
+		t.Error("the forgotten scraper got no fresh bucket")
+	}
+	if _, ok := s.limiters["ip:192.0.2.2"]; !ok {
+		t.Error("the bucket of a scraper seen recently was forgotten")
+	}
+}
+
+func TestScraperQuotaWithJWT(t *testing.T) {
+	iss := newTestIssuer(t, "a")
+	subject := "system:serviceaccount:monitoring:prometheus"
+	defer scraperQuotaRejections.DeleteLabelValues("jwt:" + subject)
+	p, _ := newTestProxy(t, okHandler, func(c *Config) {
+		c.JWTJWKSURL, c.JWTIssuer, c.JWTAudience = iss.server.URL, "https://issuer.example.com", "etcd-metrics-proxy"
+		c.ScraperRequestsPerSecond, c.ScraperBurst = 0.001, 1
+	})
+	token := iss.token("a", validClaims())
+	// the scrapers share an address but not a subject.
+	for n, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if got := serveWithToken(p.Handler(), token); got != want {
+			t.Errorf("request %d got %d, want %d", n, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(scraperQuotaRejections.WithLabelValues("jwt:" + subject)); got != 1 {
+		t.Errorf("got %v quota rejections of the subject, want 1", got)
+	}
+	claims := validClaims()
+	claims.Subject = "system:serviceaccount:monitoring:other"
+	defer scraperQuotaRejections.DeleteLabelValues("jwt:" + claims.Subject)
+	if got := serveWithToken(p.Handler(), iss.token("a", claims)); got != http.StatusOK {
+		t.Errorf("another subject got %d, want 200", got)
+	}
+}
+
+func TestScraperQuotaFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "metrics", configure: func(c *Config) { c.ScraperMetrics = true }},
+		{name: "quota", configure: func(c *Config) { c.ScraperRequestsPerSecond, c.ScraperBurst = 1, 1 }},
+		{name: "negative rate", configure: func(c *Config) { c.ScraperRequestsPerSecond = -1 }, wantErr: "--scraper-requests-per-second must not be negative"},
+		{name: "no burst", configure: func(c *Config) { c.ScraperRequestsPerSecond, c.ScraperBurst = 1, 0 }, wantErr: "--scraper-burst must be at least 1"},
+		{name: "no burst without a quota", configure: func(c *Config) { c.ScraperBurst = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			tt.configure(&c)
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+type pinnedMemberKey struct{}
+
+// pinnedMember returns the upstream member the request of ctx is pinned to,
+// or "".
+func pinnedMember(ctx context.Context) string {
+	member, _ := ctx.Value(pinnedMemberKey{}).(string)
+	return member
+}
+
+// withMemberPinning sends /metrics requests with a member parameter, the
+// per-member targets listed on /sd, to that upstream member only, without
+// failing over. Only a current target may be named; others get a 404.
+func withMemberPinning(next http.Handler, targets *upstreamTargets) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		member := r.URL.Query().Get("member")
+		if member == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !slices.Contains(targets.all(), member) {
+			http.Error(w, "unknown member", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pinnedMemberKey{}, member)))
+	})
+}
+
+// sdGroup is a target group of the Prometheus http_sd format.
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdHandler serves /sd, a Prometheus http_sd target group for every
+// upstream member of the proxy and its clusters. Each target is the proxy
+// itself, at the address it was reached at or --http-sd-target, with the
+// member to scrape in the member parameter.
+func (p *Proxy) sdHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := p.cfg.HTTPSDTarget
+		if target == "" {
+			target = r.Host
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		groups := p.sdGroups(target, scheme, "", "")
+		for _, name := range slices.Sorted(maps.Keys(p.clusters)) {
+			groups = append(groups, p.clusters[name].sdGroups(target, scheme, "/clusters/"+name, name)...)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+	})
+}
+
+// sdGroups lists the members of p, scraped through prefix, labeled with
+// cluster unless it is "".
+func (p *Proxy) sdGroups(target, scheme, prefix, cluster string) []sdGroup {
+	groups := []sdGroup{}
+	for _, member := range p.targets.all() {
+		labels := map[string]string{
+			"__scheme__":       scheme,
+			"__metrics_path__": prefix + "/metrics",
+			"__param_member":   member,
+			"member":           member,
+		}
+		if cluster != "" {
+			labels["cluster"] = cluster
+		}
+		groups = append(groups, sdGroup{Targets: []string{target}, Labels: labels})
+	}
+	return groups
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSDHandler(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, config, `clusters:
+  - name: events
+    upstream_scheme: http
+    upstream_endpoints: [10.0.1.1:2379]
+`)
+	group := func(target, member, path, cluster string) sdGroup {
+		labels := map[string]string{"__scheme__": "http", "__metrics_path__": path, "__param_member": member, "member": member}
+		if cluster != "" {
+			labels["cluster"] = cluster
+		}
+		return sdGroup{Targets: []string{target}, Labels: labels}
+	}
+	tests := []struct {
+		name   string
+		target string
+		want   func(target string) []sdGroup
+	}{
+		{
+			name: "requested address",
+			want: func(target string) []sdGroup {
+				return []sdGroup{
+					group(target, "10.0.0.1:2379", "/metrics", ""),
+					group(target, "10.0.0.2:2379", "/metrics", ""),
+					group(target, "10.0.1.1:2379", "/clusters/events/metrics", "events"),
+				}
+			},
+		},
+		{
+			name:   "target",
+			target: "etcd-metrics-proxy.monitoring:9100",
+			want: func(string) []sdGroup {
+				return []sdGroup{
+					group("etcd-metrics-proxy.monitoring:9100", "10.0.0.1:2379", "/metrics", ""),
+					group("etcd-metrics-proxy.monitoring:9100", "10.0.0.2:2379", "/metrics", ""),
+					group("etcd-metrics-proxy.monitoring:9100", "10.0.1.1:2379", "/clusters/events/metrics", "events"),
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme, c.UpstreamEndpoints = "http", []string{"10.0.0.1:2379", "10.0.0.2:2379"}
+			c.HTTPSD, c.HTTPSDTarget = true, tt.target
+			c.ConfigFile = config
+			c.AccessLogFormat = "none"
+			p, err := NewProxy(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := getPath(p.Handler(), "/sd")
+			var got []sdGroup
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("got %d %q: %v", rec.Code, rec.Body.String(), err)
+			}
+			// httptest.NewRequest sends the request to example.com.
+			if want := tt.want("example.com"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", ct)
+			}
+		})
+	}
+}
+
+func TestSDDisabled(t *testing.T) {
+	p, _ := newTestProxy(t, okHandler, nil)
+	if rec := getPath(p.Handler(), "/sd"); rec.Code != http.StatusNotFound {
+		t.Errorf("got %d, want 404 without --http-sd", rec.Code)
+	}
+}
+
+func TestSDAllowlist(t *testing.T) {
+	p, _ := newTestProxy(t, okHandler, func(c *Config) {
+		c.HTTPSD = true
+		c.AllowedCIDRs = []string{"10.0.0.0/8"}
+	})
+	// httptest.NewRequest comes from 192.0.2.1.
+	if rec := getPath(p.Handler(), "/sd"); rec.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403 for a scraper not let in to /metrics", rec.Code)
+	}
+}
+
+func TestMemberPinning(t *testing.T) {
+	// each upstream answers with its name and the query it got.
+	upstream := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "etcd_server_has_leader{upstream=%q,query=%q} 1\n", name, r.URL.RawQuery)
+		}))
+		t.Cleanup(srv.Close)
+		t.Cleanup(func() { forgetEndpoints([]string{srv.Listener.Addr().String()}) })
+		return srv.Listener.Addr().String()
+	}
+	first, second := upstream("first"), upstream("second")
+	c := DefaultConfig()
+	c.UpstreamScheme, c.UpstreamEndpoints = "http", []string{first, second}
+	c.HTTPSD = true
+	// the cache doesn't serve the response of one member for another.
+	c.CacheTTL = time.Minute
+	c.AccessLogFormat = "none"
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/metrics?member=" + second, http.StatusOK, "etcd_server_has_leader{upstream=\"second\",query=\"\"} 1\n"},
+		{"/metrics?member=" + first + "&debug=1", http.StatusOK, "etcd_server_has_leader{upstream=\"first\",query=\"debug=1\"} 1\n"},
+		{"/metrics?member=" + second, http.StatusOK, "etcd_server_has_leader{upstream=\"second\",query=\"\"} 1\n"},
+		{"/metrics?member=10.0.0.1:2379", http.StatusNotFound, "unknown member\n"},
+	}
+	for _, tt := range tests {
+		if rec := getPath(p.Handler(), tt.path); rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+			t.Errorf("%s got %d %q, want %d %q", tt.path, rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+		}
+	}
+}
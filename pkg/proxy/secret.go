@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// secretRetryInterval is the delay before re-establishing a failed watch of
+// the tls secret.
+const secretRetryInterval = 5 * time.Second
+
+// tlsSecret reads the etcd tls material from a kubernetes.io/tls style
+// Secret through the Kubernetes API: the client certificate and key from
+// tls.crt and tls.key, and the CA from ca.crt if present.
+type tlsSecret struct {
+	client    *kubeClient
+	namespace string
+	name      string
+}
+
+type kubeSecret struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string][]byte `json:"data"`
+}
+
+type kubeSecretEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func newTLSSecret(c *Config) (*tlsSecret, error) {
+	client, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up kubernetes client for --etcd-tls-secret: %w", err)
+	}
+	ns, name, ok := strings.Cut(c.EtcdTLSSecret, "/")
+	if !ok {
+		name = c.EtcdTLSSecret
+		if ns, err = inClusterNamespace(); err != nil {
+			return nil, fmt.Errorf("failed to determine kubernetes namespace, use --etcd-tls-secret=<namespace>/<name>: %w", err)
+		}
+	}
+	return &tlsSecret{client: client, namespace: ns, name: name}, nil
+}
+
+func (s *tlsSecret) String() string {
+	return s.namespace + "/" + s.name
+}
+
+func (s *tlsSecret) get(ctx context.Context) (*kubeSecret, error) {
+	var secret kubeSecret
+	if err := s.client.get(ctx, "/api/v1/namespaces/"+s.namespace+"/secrets/"+s.name, nil, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// tlsConfig builds the upstream tls config from the secret. The CA in
+// ca.crt is trusted in addition to any --etcd-ca and --use-system-ca.
+func (s *tlsSecret) tlsConfig(c *Config, secret *kubeSecret) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(secret.Data["tls.crt"], secret.Data["tls.key"])
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %w", s, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("secret %s: %w", s, err)
+		}
+	}
+	pool := x509.NewCertPool()
+	if len(c.EtcdCA) > 0 || c.UseSystemCA {
+		if pool, err = loadCAPool(c.EtcdCA, c.UseSystemCA); err != nil {
+			return nil, err
+		}
+	}
+	if ca, ok := secret.Data["ca.crt"]; ok {
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("secret %s: failed to add ca.crt to cert pool", s)
+		}
+	} else if len(c.EtcdCA) == 0 && !c.UseSystemCA && !c.InsecureSkipVerify {
+		return nil, fmt.Errorf("secret %s has no ca.crt, set --etcd-ca or --use-system-ca", s)
+	}
+	return &tls.Config{
+		RootCAs:            pool,
+		Certificates:       []tls.Certificate{cert},
+		ServerName:         c.UpstreamServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}, nil
+}
+
+// watch calls apply with every new version of the secret until ctx is done.
+// A broken watch is re-established after getting the secret again, so
+// updates missed in between aren't lost.
+func (s *tlsSecret) watch(ctx context.Context, version string, apply func(*kubeSecret)) {
+	for {
+		err := s.watchOnce(ctx, &version, apply)
+		if ctx.Err() != nil {
+			return
+		}
+		// the api server ends watches after a while.
+		if err != nil && !errors.Is(err, io.EOF) {
+			slog.Warn("tls secret watch failed", "secret", s.String(), "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(secretRetryInterval):
+		}
+		secret, err := s.get(ctx)
+		if err != nil {
+			slog.Warn("failed to get tls secret", "secret", s.String(), "err", err)
+			continue
+		}
+		if secret.Metadata.ResourceVersion != version {
+			version = secret.Metadata.ResourceVersion
+			apply(secret)
+		}
+	}
+}
+
+func (s *tlsSecret) watchOnce(ctx context.Context, version *string, apply func(*kubeSecret)) error {
+	q := url.Values{
+		"watch":           {"true"},
+		"fieldSelector":   {"metadata.name=" + s.name},
+		"resourceVersion": {*version},
+	}
+	body, err := s.client.stream(ctx, "/api/v1/namespaces/"+s.namespace+"/secrets", q)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var event kubeSecretEvent
+		if err := dec.Decode(&event); err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var secret kubeSecret
+			if err := json.Unmarshal(event.Object, &secret); err != nil {
+				return err
+			}
+			if secret.Metadata.ResourceVersion == *version {
+				continue
+			}
+			*version = secret.Metadata.ResourceVersion
+			apply(&secret)
+		case "DELETED":
+			slog.Warn("tls secret was deleted, keeping the current configuration", "secret", s.String())
+		case "ERROR":
+			// e.g. 410 Gone once the resource version is too old.
+			return errors.New(string(event.Object))
+		}
+	}
+}
+
+// applySecret swaps in the tls material of a new version of the secret once
+// it has been validated like reloaded files.
+func (r *reloader) applySecret(s *tlsSecret, secret *kubeSecret) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tlsReloadAttempts.WithLabelValues(r.c.cluster).Inc()
+	err := func() error {
+		tlsConfig, err := s.tlsConfig(r.c, secret)
+		if err != nil {
+			return err
+		}
+		t := buildHTTPSTransport(r.c, tlsConfig)
+		if err := r.validate(t.TLSClientConfig); err != nil {
+			return fmt.Errorf("new tls material rejected: %w", err)
+		}
+		r.switcher.Store(t)
+		recordLeafExpiry(r.c, "secret:"+s.String(), tlsConfig.Certificates[0].Leaf)
+		return nil
+	}()
+	if err != nil {
+		tlsReloadFailures.WithLabelValues(r.c.cluster).Inc()
+		slog.Error("tls reload failed, keeping the current configuration", "secret", s.String(), "err", err)
+		return
+	}
+	tlsReloadSuccesses.WithLabelValues(r.c.cluster).Inc()
+	tlsLastSuccessfulReload.WithLabelValues(r.c.cluster).SetToCurrentTime()
+	slog.Info("reloaded tls configuration", "secret", s.String())
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testSecret returns version of a tls secret holding a client certificate
+// issued by ca, valid until notAfter, and ca.crt unless withoutCA.
+func testSecret(t *testing.T, ca *testCA, version string, notAfter time.Time, withoutCA bool) *kubeSecret {
+	t.Helper()
+	cert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client " + version}, NotAfter: notAfter})
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s kubeSecret
+	s.Metadata.ResourceVersion = version
+	s.Data = map[string][]byte{
+		"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		"tls.key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+	}
+	if !withoutCA {
+		s.Data["ca.crt"] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	}
+	return &s
+}
+
+func TestTLSSecretConfig(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	etcdCA := filepath.Join(dir, "ca.crt")
+	writeTestCertificate(t, etcdCA, filepath.Join(dir, "ca.key"), "etcd ca")
+	valid := time.Now().Add(time.Hour)
+	// signed are certificates signed by the cas by name.
+	signed := map[string]*x509.Certificate{
+		"test ca": ca.issue(t, &x509.Certificate{NotAfter: valid}).Leaf,
+		"etcd ca": readTestCertificate(t, etcdCA),
+	}
+	corrupt := testSecret(t, ca, "1", valid, false)
+	corrupt.Data["tls.key"] = []byte("not a key")
+
+	tests := []struct {
+		name      string
+		secret    *kubeSecret
+		configure func(*Config)
+		// wantTrusted are the cas the upstream may be signed by.
+		wantTrusted []string
+		wantErr     string
+	}{
+		{name: "ca.crt", secret: testSecret(t, ca, "1", valid, false), wantTrusted: []string{"test ca"}},
+		{
+			name:        "ca.crt and --etcd-ca",
+			secret:      testSecret(t, ca, "1", valid, false),
+			configure:   func(c *Config) { c.EtcdCA = []string{etcdCA} },
+			wantTrusted: []string{"test ca", "etcd ca"},
+		},
+		{
+			name:        "--etcd-ca without ca.crt",
+			secret:      testSecret(t, ca, "1", valid, true),
+			configure:   func(c *Config) { c.EtcdCA = []string{etcdCA} },
+			wantTrusted: []string{"etcd ca"},
+		},
+		{name: "without any ca", secret: testSecret(t, ca, "1", valid, true), wantErr: "secret etcd/etcd-client has no ca.crt, set --etcd-ca or --use-system-ca"},
+		{name: "insecure without any ca", secret: testSecret(t, ca, "1", valid, true), configure: func(c *Config) { c.InsecureSkipVerify = true }},
+		{name: "invalid key", secret: corrupt, wantErr: "secret etcd/etcd-client: tls:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			if tt.configure != nil {
+				tt.configure(&c)
+			}
+			s := &tlsSecret{namespace: "etcd", name: "etcd-client"}
+			tlsConfig, err := s.tlsConfig(&c, tt.secret)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("tlsConfig() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, cert := range signed {
+				_, err := cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+				if trusted := err == nil; trusted != slices.Contains(tt.wantTrusted, name) {
+					t.Errorf("%s trusted: %v, want %v", name, trusted, !trusted)
+				}
+			}
+			if leaf := tlsConfig.Certificates[0].Leaf; leaf == nil || leaf.Subject.CommonName != "client 1" {
+				t.Errorf("got leaf %v, want the secret's certificate", leaf)
+			}
+		})
+	}
+}
+
+func TestTLSSecretWatch(t *testing.T) {
+	ca := newTestCA(t)
+	valid := time.Now().Add(time.Hour)
+	event := func(typ string, s *kubeSecret) string {
+		object, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return `{"type":"` + typ + `","object":` + string(object) + "}\n"
+	}
+	events := []string{
+		// the version the watch started from isn't applied again.
+		event("ADDED", testSecret(t, ca, "1", valid, false)),
+		event("MODIFIED", testSecret(t, ca, "2", valid, false)),
+		event("DELETED", testSecret(t, ca, "2", valid, false)),
+		event("MODIFIED", testSecret(t, ca, "3", valid, false)),
+	}
+	queries := make(chan url.Values, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/etcd/secrets" {
+			http.NotFound(w, r)
+			return
+		}
+		queries <- r.URL.Query()
+		for _, e := range events {
+			w.Write([]byte(e))
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer api.Close()
+	token := filepath.Join(t.TempDir(), "token")
+	writeFile(t, token, "token")
+	s := &tlsSecret{client: &kubeClient{baseURL: api.URL, client: api.Client(), tokenFile: token}, namespace: "etcd", name: "etcd-client"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan string, 10)
+	go s.watch(ctx, "1", func(secret *kubeSecret) { applied <- secret.Metadata.ResourceVersion })
+
+	q := <-queries
+	if q.Get("watch") != "true" || q.Get("fieldSelector") != "metadata.name=etcd-client" || q.Get("resourceVersion") != "1" {
+		t.Errorf("got watch query %v", q)
+	}
+	for _, want := range []string{"2", "3"} {
+		select {
+		case got := <-applied:
+			if got != want {
+				t.Errorf("applied version %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("version %s wasn't applied", want)
+		}
+	}
+}
+
+func TestApplySecret(t *testing.T) {
+	ca := newTestCA(t)
+	tests := []struct {
+		name        string
+		secret      *kubeSecret
+		wantApplied bool
+	}{
+		{"valid", testSecret(t, ca, "2", time.Now().Add(time.Hour), false), true},
+		{"expired client certificate", testSecret(t, ca, "2", time.Now().Add(-time.Minute), false), false},
+		{"without a ca", testSecret(t, ca, "2", time.Now().Add(time.Hour), true), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{cluster: "secret-" + tt.name}
+			initTLSReloadMetrics(c.cluster)
+			defer tlsReloadSuccesses.DeleteLabelValues(c.cluster)
+			defer tlsReloadFailures.DeleteLabelValues(c.cluster)
+			defer certExpiry.DeleteLabelValues("secret:etcd/etcd-client")
+			current := &http.Transport{}
+			r := &reloader{c: c, tls: true, switcher: newTransportSwitcher(current)}
+			r.applySecret(&tlsSecret{namespace: "etcd", name: "etcd-client"}, tt.secret)
+
+			if applied := r.switcher.Load() != current; applied != tt.wantApplied {
+				t.Errorf("transport replaced: %v, want %v", applied, tt.wantApplied)
+			}
+			want := map[bool]float64{true: 1, false: 0}
+			if got := testutil.ToFloat64(tlsReloadSuccesses.WithLabelValues(c.cluster)); got != want[tt.wantApplied] {
+				t.Errorf("%v successes, want %v", got, want[tt.wantApplied])
+			}
+			if got := testutil.ToFloat64(tlsReloadFailures.WithLabelValues(c.cluster)); got != want[!tt.wantApplied] {
+				t.Errorf("%v failures, want %v", got, want[!tt.wantApplied])
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// listenerTLS is the tls configuration of one of the proxy's own listeners.
+// With clientCAs set, clients must present a certificate issued by one of
+// them.
+type listenerTLS struct {
+	flag      string
+	cert, key string
+	clientCAs []string
+}
+
+func (t listenerTLS) enabled() bool {
+	return t.cert != ""
+}
+
+func (t listenerTLS) validate() error {
+	if (t.cert == "") != (t.key == "") {
+		return fmt.Errorf("--%s-cert and --%s-key must be given together", t.flag, t.flag)
+	}
+	if len(t.clientCAs) > 0 && t.cert == "" {
+		return fmt.Errorf("--%s-client-ca requires --%s-cert", t.flag, t.flag)
+	}
+	return nil
+}
+
+// config returns the server tls configuration, offering HTTP/2 through ALPN.
+// The key pair is re-read whenever the files change, so rotated listener
+// certificates are picked up by new connections without a reload.
+func (t listenerTLS) config() (*tls.Config, error) {
+	pair := &keyPairFiles{cert: t.cert, key: t.key}
+	if _, err := pair.get(nil); err != nil {
+		return nil, fmt.Errorf("--%s-cert: %w", t.flag, err)
+	}
+	cfg := &tls.Config{
+		GetCertificate: pair.get,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+	if len(t.clientCAs) > 0 {
+		pool, err := loadCAPool(t.clientCAs, false)
+		if err != nil {
+			return nil, fmt.Errorf("--%s-client-ca: %w", t.flag, err)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// withListenerTLS wraps listeners to serve tls when t is enabled.
+func withListenerTLS(listeners []net.Listener, t listenerTLS) ([]net.Listener, error) {
+	if !t.enabled() {
+		return listeners, nil
+	}
+	cfg, err := t.config()
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	wrapped := make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		wrapped[i] = tls.NewListener(l, cfg)
+	}
+	return wrapped, nil
+}
+
+// adminAddress returns the address of the admin listener, or "" if it is
+// disabled.
+func (c *Config) adminAddress() string {
+	switch {
+	case c.AdminListenAddress != "":
+		return c.AdminListenAddress
+	case c.AdminPort > 0:
+		return fmt.Sprintf(":%d", c.AdminPort)
+	}
+	return ""
+}
+
+// scrapeTLS and adminTLS return the tls configuration of the scrape and
+// admin listeners.
+func (c *Config) scrapeTLS() listenerTLS {
+	return listenerTLS{flag: "listen-tls", cert: c.ListenTLSCert, key: c.ListenTLSKey, clientCAs: c.ListenTLSClientCA}
+}
+
+func (c *Config) adminTLS() listenerTLS {
+	return listenerTLS{flag: "admin-tls", cert: c.AdminTLSCert, key: c.AdminTLSKey, clientCAs: c.AdminTLSClientCA}
+}
+
+// keyPairFiles serves a certificate and key from disk, loading them again
+// when either file's modification time changes. A pair that fails to load,
+// e.g. halfway through a rotation, keeps the previous one in use, and isn't
+// read again on every handshake until the files change once more.
+type keyPairFiles struct {
+	cert, key string
+
+	mu                        sync.Mutex
+	certModified, keyModified time.Time
+	pair                      *tls.Certificate
+	// err is why the files at the recorded modification times failed to
+	// load.
+	err error
+}
+
+func (k *keyPairFiles) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certInfo, certErr := os.Stat(k.cert)
+	keyInfo, keyErr := os.Stat(k.key)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := errors.Join(certErr, keyErr); err != nil {
+		if k.pair != nil {
+			return k.pair, nil
+		}
+		return nil, err
+	}
+	if !certInfo.ModTime().Equal(k.certModified) || !keyInfo.ModTime().Equal(k.keyModified) {
+		k.certModified, k.keyModified = certInfo.ModTime(), keyInfo.ModTime()
+		pair, err := tls.LoadX509KeyPair(k.cert, k.key)
+		if err != nil {
+			if k.pair != nil {
+				slog.Warn("failed to load the rotated listener certificate, keeping the previous one", "cert", k.cert, "key", k.key, "err", err)
+			}
+			k.err = err
+		} else {
+			k.pair, k.err = &pair, nil
+		}
+	}
+	if k.pair == nil {
+		return nil, k.err
+	}
+	return k.pair, nil
+}
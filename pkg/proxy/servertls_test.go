@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyPairFilesReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, cert, key, "first")
+	k := &keyPairFiles{cert: cert, key: key}
+	first, err := k.get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rotation halfway through: the new certificate with the old key.
+	writeTestCertificate(t, cert, filepath.Join(dir, "other.key"), "second")
+	if got, err := k.get(nil); err != nil || got != first {
+		t.Fatalf("get() = %v, want the previous pair", err)
+	}
+	// the failed pair isn't read again until the files change: a valid
+	// pair written with the same modification times goes unnoticed.
+	certInfo, err := os.Stat(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo, err := os.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, cert, key, "unnoticed")
+	os.Chtimes(cert, certInfo.ModTime(), certInfo.ModTime())
+	os.Chtimes(key, keyInfo.ModTime(), keyInfo.ModTime())
+	if got, err := k.get(nil); err != nil || got != first {
+		t.Fatalf("get() = %v, read the files again although they didn't change", err)
+	}
+
+	writeTestCertificate(t, cert, key, "third")
+	// mod times can be coarse.
+	later := time.Now().Add(time.Second)
+	os.Chtimes(cert, later, later)
+	os.Chtimes(key, later, later)
+	third, err := k.get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || third.Leaf == nil || third.Leaf.Subject.CommonName != "third" {
+		t.Errorf("get() didn't load the rotated pair")
+	}
+}
+
+func TestKeyPairFilesNoPair(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, cert, filepath.Join(dir, "other.key"), "first")
+	if err := os.WriteFile(key, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k := &keyPairFiles{cert: cert, key: key}
+	for range 2 {
+		if _, err := k.get(nil); err == nil {
+			t.Fatal("get() of an invalid pair succeeded")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshotIdleExpiry is how long a snapshot that no scraper asked for is
+// kept refreshing before it is forgotten.
+const snapshotIdleExpiry = 10 * time.Minute
+
+// snapshotter scrapes the upstream every --background-scrape-interval on
+// its own and answers /metrics requests with the latest snapshot, so the
+// load on etcd doesn't depend on how many scrapers there are or how often
+// they scrape. A snapshot is kept per pinned member and exposition format,
+// taken first for the request that asks for it and refreshed in the
+// background from then on. A failed refresh keeps the previous snapshot,
+// whose age shows in the Age header and etcd_metrics_proxy_snapshot_age_seconds.
+type snapshotter struct {
+	next     http.Handler
+	interval time.Duration
+	cluster  string
+
+	mu        sync.Mutex
+	snapshots map[string]*snapshot
+}
+
+type snapshot struct {
+	member string
+	format string
+	// accept is the Accept header of the request the snapshot was first
+	// taken for.
+	accept string
+
+	// entry is the last successful response, with a nil resp if there
+	// was none yet.
+	entry     cacheEntry
+	requested time.Time
+	// first is the fetch of the first snapshot while it is in flight, which
+	// the requests arriving meanwhile wait for rather than fetching too.
+	first *flight
+}
+
+// flight is a fetch that the requests arriving while it is in flight wait
+// for. resp is set once done is closed.
+type flight struct {
+	done chan struct{}
+	resp *recordedResponse
+}
+
+func newSnapshotter(next http.Handler, c *Config) *snapshotter {
+	return &snapshotter{next: next, interval: c.BackgroundScrapeInterval, cluster: c.cluster, snapshots: map[string]*snapshot{}}
+}
+
+func (s *snapshotter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+	member, format := pinnedMember(r.Context()), expositionFormat(r.Header.Get("Accept"))
+	key := member + "\x00" + format
+	s.mu.Lock()
+	snap, ok := s.snapshots[key]
+	if !ok {
+		snap = &snapshot{member: member, format: format, accept: r.Header.Get("Accept")}
+		s.snapshots[key] = snap
+	}
+	snap.requested = time.Now()
+	e, f := snap.entry, snap.first
+	if e.resp == nil && f == nil {
+		f = &flight{done: make(chan struct{})}
+		snap.first = f
+		s.mu.Unlock()
+		s.takeFirst(r.Context(), snap, f)
+	} else {
+		s.mu.Unlock()
+	}
+	if e.resp == nil {
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+		// a failed first snapshot is answered as is, and the next request
+		// tries again.
+		if f.resp.status != http.StatusOK {
+			f.resp.writeTo(w)
+			return
+		}
+		s.mu.Lock()
+		e = snap.entry
+		s.mu.Unlock()
+	}
+	e.serve(w, r)
+}
+
+// takeFirst takes the first snapshot of snap for f. It isn't cancelled with
+// the request that started it, as others may be waiting for it.
+func (s *snapshotter) takeFirst(ctx context.Context, snap *snapshot, f *flight) {
+	f.resp = s.refresh(context.WithoutCancel(ctx), snap)
+	s.mu.Lock()
+	snap.first = nil
+	s.mu.Unlock()
+	close(f.done)
+}
+
+// refresh takes a new snapshot for snap, keeping the previous one if the
+// upstream fails.
+func (s *snapshotter) refresh(ctx context.Context, snap *snapshot) *recordedResponse {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, pinnedMemberKey{}, snap.member), http.MethodGet, "/metrics", nil)
+	if err != nil {
+		return &recordedResponse{status: http.StatusInternalServerError, header: http.Header{}}
+	}
+	req.Header.Set("Accept", snap.accept)
+	resp := recordResponse(s.next, req)
+	if resp.status != http.StatusOK {
+		snapshotFailures.Inc()
+		slog.Warn("background scrape failed, keeping the previous snapshot", "member", snap.member, "format", snap.format, "status", resp.status)
+		return resp
+	}
+	now := time.Now()
+	e := cacheEntry{resp: resp, fetched: now, etag: bodyETag(resp.body), modified: now}
+	s.mu.Lock()
+	if snap.entry.etag == e.etag {
+		e.modified = snap.entry.modified
+	}
+	snap.entry = e
+	s.mu.Unlock()
+	return resp
+}
+
+// run refreshes the snapshots every interval until ctx is done, forgetting
+// those no scraper asked for within snapshotIdleExpiry.
+func (s *snapshotter) run(ctx context.Context) {
+	snapshotAges.add(s)
+	defer snapshotAges.remove(s)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		var snaps []*snapshot
+		for key, snap := range s.snapshots {
+			if time.Since(snap.requested) > snapshotIdleExpiry {
+				delete(s.snapshots, key)
+				continue
+			}
+			if snap.first != nil {
+				// being taken for a request right now.
+				continue
+			}
+			snaps = append(snaps, snap)
+		}
+		s.mu.Unlock()
+		for _, snap := range snaps {
+			s.refresh(ctx, snap)
+		}
+	}
+}
+
+// snapshotAgeCollector exports the age of the snapshots of every running
+// snapshotter.
+type snapshotAgeCollector struct {
+	desc *prometheus.Desc
+
+	mu           sync.Mutex
+	snapshotters []*snapshotter
+}
+
+func (c *snapshotAgeCollector) add(s *snapshotter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snapshotters = append(c.snapshotters, s)
+}
+
+func (c *snapshotAgeCollector) remove(s *snapshotter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snapshotters = slices.DeleteFunc(c.snapshotters, func(other *snapshotter) bool { return other == s })
+}
+
+func (c *snapshotAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *snapshotAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.snapshotters {
+		s.mu.Lock()
+		for _, snap := range s.snapshots {
+			if snap.entry.resp == nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(snap.entry.fetched).Seconds(), s.cluster, snap.member, snap.format)
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveConcurrently serves n concurrent GET /metrics requests with s,
+// closes release once they had time to reach the upstream and returns their
+// status codes.
+func serveConcurrently(s http.Handler, n int, release chan struct{}) []int {
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			codes[i] = rec.Code
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return codes
+}
+
+func TestSnapshotterCoalescesFirstSnapshot(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	})
+	s := newSnapshotter(next, &Config{BackgroundScrapeInterval: time.Minute})
+
+	for _, code := range serveConcurrently(s, 20, release) {
+		if code != http.StatusOK {
+			t.Errorf("got %d, want 200", code)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d upstream fetches for the first snapshot, want 1", n)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "etcd_server_has_leader 1\n" || rec.Header().Get("Age") == "" {
+		t.Errorf("got %d %q Age %q, want the snapshot", rec.Code, rec.Body.String(), rec.Header().Get("Age"))
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("%d upstream fetches after serving the snapshot, want 1", n)
+	}
+}
+
+func TestSnapshotterFailedFirstSnapshot(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			<-release
+			http.Error(w, "unavailable", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	})
+	s := newSnapshotter(next, &Config{BackgroundScrapeInterval: time.Minute})
+
+	// the requests waiting for the failed snapshot share its response.
+	for _, code := range serveConcurrently(s, 5, release) {
+		if code != http.StatusBadGateway {
+			t.Errorf("got %d, want 502", code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got %d after a failed first snapshot, want 200", rec.Code)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("%d upstream fetches, want 2", n)
+	}
+}
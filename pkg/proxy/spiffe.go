@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// spiffeFetchTimeout bounds the wait for the first SVID at startup.
+const spiffeFetchTimeout = 30 * time.Second
+
+// spiffeCertLabel is the file label of the SVID in the cert expiry metric.
+const spiffeCertLabel = "spiffe:svid"
+
+// newSPIFFESource connects to the Workload API at --spiffe-socket and waits
+// for the first X.509 SVID and trust bundle. The source keeps them rotated
+// in the background until it is closed.
+func newSPIFFESource(c *Config) (*workloadapi.X509Source, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeFetchTimeout)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(c.SPIFFESocket)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch svid from %s: %w", c.SPIFFESocket, err)
+	}
+	return source, nil
+}
+
+// spiffeTLSConfig presents the current SVID of source and verifies that the
+// upstream presents an SVID issued by a trust bundle of source, with the
+// --spiffe-server-id if given. Rotated SVIDs and bundles are used by new
+// connections without rebuilding the transport.
+func spiffeTLSConfig(c *Config, source *workloadapi.X509Source) (*tls.Config, error) {
+	authorizer := tlsconfig.AuthorizeAny()
+	if c.SPIFFEServerID != "" {
+		id, err := spiffeid.FromString(c.SPIFFEServerID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --spiffe-server-id: %w", err)
+		}
+		authorizer = tlsconfig.AuthorizeID(id)
+	}
+	tlsConfig := tlsconfig.MTLSClientConfig(source, source, authorizer)
+	tlsConfig.ServerName = c.UpstreamServerName
+	return tlsConfig, nil
+}
+
+// describeSVID prints the SPIFFE ID and expiry of the current SVID.
+func describeSVID(w io.Writer, source *workloadapi.X509Source) error {
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "svid %s:\n", svid.ID)
+	for _, cert := range svid.Certificates {
+		describeCert(w, cert)
+	}
+	return checkValidity(svid.Certificates[0], time.Now())
+}
+
+// watchSVID records the expiry of every SVID the source rotates to, until
+// ctx is done.
+func watchSVID(ctx context.Context, source *workloadapi.X509Source) {
+	for {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			slog.Warn("failed to get svid", "err", err)
+		} else {
+			expiry := svid.Certificates[0].NotAfter
+			certExpiry.WithLabelValues(spiffeCertLabel).Set(float64(expiry.Unix()))
+			slog.Info("svid updated", "id", svid.ID.String(), "expiry", expiry)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-source.Updated():
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+)
+
+// testCA issues certificates for tests that need a chain rather than the
+// self-signed certificates of writeTestCertificate.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a leaf certificate for tmpl, signed by the ca. The serial
+// number, key usages and validity start are filled in.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// issueSVID returns an svid for the spiffe id, valid until notAfter.
+func (ca *testCA) issueSVID(t *testing.T, id string, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	u, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.issue(t, &x509.Certificate{URIs: []*url.URL{u}, NotAfter: notAfter})
+}
+
+// fakeWorkloadAPI streams the svid set with setSVID to every client.
+type fakeWorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	mu      sync.Mutex
+	resp    *workload.X509SVIDResponse
+	updated chan struct{}
+}
+
+// newFakeWorkloadAPI serves the Workload API on a unix socket and returns
+// its --spiffe-socket address.
+func newFakeWorkloadAPI(t *testing.T) (*fakeWorkloadAPI, string) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &fakeWorkloadAPI{updated: make(chan struct{})}
+	srv := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(srv, api)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return api, "unix://" + socket
+}
+
+func (f *fakeWorkloadAPI) setSVID(t *testing.T, ca *testCA, id string, cert tls.Certificate) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resp = &workload.X509SVIDResponse{Svids: []*workload.X509SVID{{
+		SpiffeId:    id,
+		X509Svid:    cert.Certificate[0],
+		X509SvidKey: key,
+		Bundle:      ca.cert.Raw,
+	}}}
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+func (f *fakeWorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	for {
+		f.mu.Lock()
+		resp, updated := f.resp, f.updated
+		f.mu.Unlock()
+		if resp != nil {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-updated:
+		}
+	}
+}
+
+func TestSPIFFE(t *testing.T) {
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issueSVID(t, "spiffe://example.org/etcd", time.Now().Add(time.Hour))},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	defer forgetEndpoints([]string{srv.Listener.Addr().String()})
+	api, socket := newFakeWorkloadAPI(t)
+	api.setSVID(t, ca, "spiffe://example.org/proxy", ca.issueSVID(t, "spiffe://example.org/proxy", time.Now().Add(time.Hour)))
+
+	tests := []struct {
+		name       string
+		serverID   string
+		wantErr    string
+		wantStatus int
+	}{
+		{name: "any id trusted by the bundle", wantStatus: http.StatusOK},
+		{name: "expected server id", serverID: "spiffe://example.org/etcd", wantStatus: http.StatusOK},
+		{name: "unexpected server id", serverID: "spiffe://example.org/other", wantStatus: http.StatusBadGateway},
+		{name: "invalid server id", serverID: "https://example.org/etcd", wantErr: "invalid --spiffe-server-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamURL = srv.URL + "/metrics"
+			c.SPIFFESocket, c.SPIFFEServerID = socket, tt.serverID
+			c.AccessLogFormat = "none"
+			p, err := NewProxy(c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewProxy() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.closeSPIFFE()
+			if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != tt.wantStatus {
+				t.Errorf("got %d %q, want %d", rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSPIFFEFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{
+			name:      "with file based tls",
+			configure: func(c *Config) { c.SPIFFESocket, c.EtcdCert = "unix:///agent.sock", "client.crt" },
+			wantErr:   "--spiffe-socket can't be used with the file based etcd tls flags",
+		},
+		{
+			name:      "server id without a socket",
+			configure: func(c *Config) { c.SPIFFEServerID = "spiffe://example.org/etcd" },
+			wantErr:   "--spiffe-server-id requires --spiffe-socket",
+		},
+		{
+			name:      "with revocation checks",
+			configure: func(c *Config) { c.SPIFFESocket, c.EtcdOCSP = "unix:///agent.sock", true },
+			wantErr:   "--etcd-crl and --etcd-ocsp can't be used with --spiffe-socket",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.configure(&c)
+			if _, err := NewProxy(c); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewProxy() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWatchSVID(t *testing.T) {
+	ca := newTestCA(t)
+	api, socket := newFakeWorkloadAPI(t)
+	first := time.Now().Add(time.Hour).Truncate(time.Second)
+	api.setSVID(t, ca, "spiffe://example.org/proxy", ca.issueSVID(t, "spiffe://example.org/proxy", first))
+	c := DefaultConfig()
+	c.SPIFFESocket = socket
+	source, err := newSPIFFESource(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	defer certExpiry.DeleteLabelValues(spiffeCertLabel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchSVID(ctx, source)
+
+	var out strings.Builder
+	if err := describeSVID(&out, source); err != nil || !strings.Contains(out.String(), "svid spiffe://example.org/proxy:") {
+		t.Errorf("describeSVID() = %v, got\n%s", err, out.String())
+	}
+	waitExpiry := func(want time.Time) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			got := testutil.ToFloat64(certExpiry.WithLabelValues(spiffeCertLabel))
+			if got == float64(want.Unix()) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got expiry %v, want %v", got, want.Unix())
+			}
+		}
+	}
+	waitExpiry(first)
+	// the expiry follows the rotated svid.
+	rotated := first.Add(time.Hour)
+	api.setSVID(t, ca, "spiffe://example.org/proxy", ca.issueSVID(t, "spiffe://example.org/proxy", rotated))
+	waitExpiry(rotated)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	textContentType = "text/plain; version=0.0.4; charset=utf-8"
+	eofLine         = "# EOF\n"
+)
+
+// staleHandler keeps the last successful upstream response and serves it
+// when the upstream fails, so a brief etcd outage doesn't drop every series.
+// Responses are annotated with synthetic series describing upstream health.
+// The last response is kept per negotiated format so a scraper asking for
+// OpenMetrics isn't served the text format or vice versa.
+type staleHandler struct {
+	next http.Handler
+
+	mu          sync.Mutex
+	last        map[string]*recordedResponse
+	lastSuccess time.Time
+}
+
+func (s *staleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+	resp := recordResponse(s.next, r)
+	up := resp.status == http.StatusOK
+	key := pinnedMember(r.Context()) + "\x00" + expositionFormat(r.Header.Get("Accept"))
+
+	s.mu.Lock()
+	if up {
+		if s.last == nil {
+			s.last = make(map[string]*recordedResponse)
+		}
+		s.last[key], s.lastSuccess = resp, time.Now()
+	}
+	last, lastSuccess := s.last[key], s.lastSuccess
+	s.mu.Unlock()
+
+	body := getBuffer()
+	defer putBuffer(body)
+	var header http.Header
+	switch {
+	case up:
+		header = resp.header.Clone()
+		body.Write(resp.body)
+	case last != nil:
+		slog.Warn("upstream request failed, serving stale metrics", "status", resp.status, "fetched", lastSuccess)
+		header = last.header.Clone()
+		body.Write(last.body)
+	default:
+		slog.Warn("upstream request failed and no previous metrics are available", "status", resp.status)
+		header = http.Header{"Content-Type": {textContentType}}
+	}
+	writeUpMetrics(body, up, lastSuccess)
+
+	header.Set("Content-Length", strconv.Itoa(body.Len()))
+	(&recordedResponse{status: http.StatusOK, header: header, body: body.Bytes()}).writeTo(w)
+}
+
+func writeUpMetrics(b *bytes.Buffer, up bool, lastSuccess time.Time) {
+	if b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	// OpenMetrics requires the series to come before the terminator.
+	if bytes.HasSuffix(b.Bytes(), []byte(eofLine)) {
+		b.Truncate(b.Len() - len(eofLine))
+		defer b.WriteString(eofLine)
+	}
+	v := 0
+	if up {
+		v = 1
+	}
+	fmt.Fprintf(b, "# HELP etcd_metrics_proxy_upstream_up Whether the last request to the upstream etcd succeeded.\n")
+	fmt.Fprintf(b, "# TYPE etcd_metrics_proxy_upstream_up gauge\n")
+	fmt.Fprintf(b, "etcd_metrics_proxy_upstream_up %d\n", v)
+	if lastSuccess.IsZero() {
+		return
+	}
+	fmt.Fprintf(b, "# HELP etcd_metrics_proxy_last_success_timestamp_seconds Unix time of the last successful request to the upstream etcd.\n")
+	fmt.Fprintf(b, "# TYPE etcd_metrics_proxy_last_success_timestamp_seconds gauge\n")
+	fmt.Fprintf(b, "etcd_metrics_proxy_last_success_timestamp_seconds %.3f\n", float64(lastSuccess.UnixNano())/1e9)
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	testUpSeries = `# HELP etcd_metrics_proxy_upstream_up Whether the last request to the upstream etcd succeeded.
+# TYPE etcd_metrics_proxy_upstream_up gauge
+etcd_metrics_proxy_upstream_up %d
+`
+	testLastSuccessSeries = `# HELP etcd_metrics_proxy_last_success_timestamp_seconds Unix time of the last successful request to the upstream etcd.
+# TYPE etcd_metrics_proxy_last_success_timestamp_seconds gauge
+etcd_metrics_proxy_last_success_timestamp_seconds %s
+`
+)
+
+func TestStaleHandler(t *testing.T) {
+	status, body, responses := http.StatusOK, "", 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responses++
+		w.Header().Set("Content-Type", textContentType)
+		w.Header().Set("X-Response", fmt.Sprint(responses))
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+	s := &staleHandler{next: upstream}
+	openMetrics := "application/openmetrics-text; version=1.0.0"
+
+	tests := []struct {
+		name   string
+		accept string
+		status int
+		body   string
+		// want is the body served, with %s for the series the proxy adds.
+		want string
+		up   int
+		// from is the upstream response whose headers are served, 0 if none.
+		from int
+	}{
+		{"failure without a previous response", "", http.StatusBadGateway, "upstream down\n", "%s", 0, 0},
+		{"success", "", http.StatusOK, "etcd_server_has_leader 1\n", "etcd_server_has_leader 1\n%s", 1, 2},
+		{"failure serves the last response", "", http.StatusServiceUnavailable, "upstream down\n", "etcd_server_has_leader 1\n%s", 0, 2},
+		{"body without a trailing newline", "", http.StatusOK, "etcd_server_has_leader 1", "etcd_server_has_leader 1\n%s", 1, 4},
+		{"openmetrics isn't served a text response", openMetrics, http.StatusBadGateway, "", "%s", 0, 0},
+		{"openmetrics success", openMetrics, http.StatusOK, "etcd_server_has_leader 1\n# EOF\n", "etcd_server_has_leader 1\n%s# EOF\n", 1, 6},
+		{"openmetrics failure", openMetrics, http.StatusBadGateway, "", "etcd_server_has_leader 1\n%s# EOF\n", 0, 6},
+		{"success after a failure", "", http.StatusOK, "etcd_server_has_leader 0\n", "etcd_server_has_leader 0\n%s", 1, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body = tt.status, tt.body
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			before := s.lastSuccess
+			s.ServeHTTP(rec, r)
+			if updated := s.lastSuccess != before; updated != (tt.status == http.StatusOK) {
+				t.Errorf("last success updated: %v, want %v", updated, !updated)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got %d, want 200", rec.Code)
+			}
+
+			series := fmt.Sprintf(testUpSeries, tt.up)
+			if !s.lastSuccess.IsZero() {
+				series += fmt.Sprintf(testLastSuccessSeries, fmt.Sprintf("%.3f", float64(s.lastSuccess.UnixNano())/1e9))
+			}
+			if want := fmt.Sprintf(tt.want, series); rec.Body.String() != want {
+				t.Errorf("got\n%s\nwant\n%s", rec.Body.String(), want)
+			}
+			if got, want := rec.Header().Get("Content-Length"), fmt.Sprint(rec.Body.Len()); got != want {
+				t.Errorf("Content-Length %s, want %s", got, want)
+			}
+			// a stale response keeps the headers of the response it was.
+			want := ""
+			if tt.from > 0 {
+				want = fmt.Sprint(tt.from)
+			}
+			if got := rec.Header().Get("X-Response"); got != want {
+				t.Errorf("headers of response %q, want %q", got, want)
+			}
+			if got := rec.Header().Get("Content-Type"); got != textContentType {
+				t.Errorf("Content-Type %q, want %q", got, textContentType)
+			}
+		})
+	}
+}
+
+func TestStaleHandlerPassesOtherMethods(t *testing.T) {
+	s := &staleHandler{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Body.Len() != 0 {
+		t.Errorf("got %d %q, want the upstream's 405", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdListenFDsStart is the first file descriptor passed by systemd
+// socket activation.
+const systemdListenFDsStart = 3
+
+// systemdListeners returns the listening sockets passed by systemd socket
+// activation through LISTEN_FDS, or nil when the proxy wasn't started that
+// way. The variables are unset so child processes don't inherit them.
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var listeners []net.Listener
+	for i := range n {
+		name := "LISTEN_FD_" + strconv.Itoa(systemdListenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		// FileListener dups the descriptor; the original is closed either way.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s passed by systemd: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends state, e.g. READY=1, to the systemd notification socket.
+// It does nothing when NOTIFY_SOCKET isn't set, i.e. outside of a
+// Type=notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// a leading @ names a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifySystemd sends state to systemd, logging a failure.
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		slog.Warn("failed to notify systemd", "state", state, "err", err)
+	}
+}
+
+// systemdWatchdogInterval returns the interval at which systemd expects
+// WATCHDOG=1 pings, from WatchdogSec= of the unit, or 0 if the watchdog
+// isn't enabled for this process.
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runSystemdWatchdog pings the systemd watchdog at half its interval until
+// ctx is done, so systemd restarts the proxy if it hangs.
+func runSystemdWatchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notifySystemd("WATCHDOG=1")
+		}
+	}
+}
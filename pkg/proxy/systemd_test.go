@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSystemdListenersProcess lists the sockets passed by systemd in the
+// child processes of TestSystemdListeners, as systemd sets LISTEN_PID to the
+// pid of the process it starts.
+func TestSystemdListenersProcess(t *testing.T) {
+	if os.Getenv("ETCD_METRICS_PROXY_SYSTEMD") != "1" {
+		t.Skip("only run by TestSystemdListeners")
+	}
+	if os.Getenv("LISTEN_PID") == "self" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+	listeners, err := systemdListeners()
+	if err != nil {
+		fmt.Println("error:", err)
+	}
+	for _, l := range listeners {
+		fmt.Println("listener:", l.Addr())
+	}
+	fmt.Printf("env: %q\n", os.Getenv("LISTEN_PID")+os.Getenv("LISTEN_FDS")+os.Getenv("LISTEN_FDNAMES"))
+	os.Exit(0)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string
+		fds  string
+		// files are the addresses of the sockets passed, with "" for a
+		// regular file.
+		files   []string
+		want    []string
+		wantErr string
+	}{
+		{name: "not socket activated", want: nil},
+		{name: "sockets", pid: "self", fds: "2", files: []string{"a", "b"}, want: []string{"a", "b"}},
+		{name: "other process", pid: "1", fds: "1", files: []string{"a"}},
+		{name: "not a socket", pid: "self", fds: "1", files: []string{""}, wantErr: "socket LISTEN_FD_3 passed by systemd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListenersProcess$")
+			cmd.Env = append(os.Environ(), "ETCD_METRICS_PROXY_SYSTEMD=1", "LISTEN_PID="+tt.pid, "LISTEN_FDS="+tt.fds)
+			addrs := map[string]string{}
+			for _, f := range tt.files {
+				if f == "" {
+					file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer file.Close()
+					cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+					continue
+				}
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer l.Close()
+				addrs[f] = l.Addr().String()
+				file, err := l.(*net.TCPListener).File()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+			}
+			var out bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &out, &out
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("%v: %s", err, out.String())
+			}
+
+			// wantLines are prefixes of the lines printed by the child.
+			var wantLines []string
+			if tt.wantErr != "" {
+				wantLines = append(wantLines, "error: "+tt.wantErr)
+			}
+			for _, f := range tt.want {
+				wantLines = append(wantLines, "listener: "+addrs[f])
+			}
+			// the variables aren't passed on to child processes.
+			wantLines = append(wantLines, `env: ""`)
+			var lines []string
+			for _, line := range strings.Split(out.String(), "\n") {
+				if strings.HasPrefix(line, "error: ") || strings.HasPrefix(line, "listener: ") || strings.HasPrefix(line, "env: ") {
+					lines = append(lines, line)
+				}
+			}
+			if len(lines) != len(wantLines) {
+				t.Fatalf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(wantLines, "\n"))
+			}
+			for i, want := range wantLines {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("got %q, want %q", lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+// notifySocket listens on a unixgram socket at name and returns a channel
+// of the datagrams it receives.
+func notifySocket(t *testing.T, name string) <-chan string {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	states := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return states
+}
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	tests := []struct {
+		name   string
+		socket string
+		listen string
+	}{
+		{name: "path", socket: path, listen: path},
+		{name: "abstract namespace", socket: "@etcd-metrics-proxy-test-" + strconv.Itoa(os.Getpid()), listen: "\x00etcd-metrics-proxy-test-" + strconv.Itoa(os.Getpid())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if strings.HasPrefix(tt.socket, "@") && runtime.GOOS != "linux" {
+				t.Skip("abstract sockets are linux only")
+			}
+			states := notifySocket(t, tt.listen)
+			t.Setenv("NOTIFY_SOCKET", tt.socket)
+			if err := sdNotify("READY=1"); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-states:
+				if got != "READY=1" {
+					t.Errorf("got %q, want READY=1", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no notification received")
+			}
+		})
+	}
+	t.Run("outside of systemd", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		if err := sdNotify("READY=1"); err != nil {
+			t.Errorf("sdNotify() = %v", err)
+		}
+	})
+}
+
+func TestSystemdWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name, usec, pid string
+		want            time.Duration
+	}{
+		{"disabled", "", "", 0},
+		{"enabled", "30000000", "", 30 * time.Second},
+		{"for this process", "30000000", self, 30 * time.Second},
+		{"for another process", "30000000", "1", 0},
+		{"invalid", "30s", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := systemdWatchdogInterval(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunSystemdWatchdog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	states := notifySocket(t, path)
+	t.Setenv("NOTIFY_SOCKET", path)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runSystemdWatchdog(ctx, 40*time.Millisecond)
+	for range 2 {
+		select {
+		case got := <-states:
+			if got != "WATCHDOG=1" {
+				t.Errorf("got %q, want WATCHDOG=1", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the watchdog wasn't pinged")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTracedRequest(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	rp := httputil.NewSingleHostReverseProxy(u)
+	rp.Transport = tracedTransport(upstream.Client().Transport)
+	h := tracedHandler(rp, "scrape")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+
+	var server, client, clientParent trace.SpanContext
+	var names []string
+	for _, s := range spans.Ended() {
+		names = append(names, s.Name())
+		switch s.SpanKind() {
+		case trace.SpanKindServer:
+			server = s.SpanContext()
+		case trace.SpanKindClient:
+			client, clientParent = s.SpanContext(), s.Parent()
+		}
+	}
+	if !server.IsValid() || !client.IsValid() {
+		t.Fatalf("got spans %v, want a scrape and an upstream span", names)
+	}
+	if clientParent.SpanID() != server.SpanID() {
+		t.Error("the upstream span isn't a child of the scrape span")
+	}
+	// the sub-spans of the upstream request.
+	for _, name := range []string{"http.getconn", "http.tls", "http.receive"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("got spans %v, want a %s span", names, name)
+		}
+	}
+	if want := "00-" + client.TraceID().String() + "-"; len(traceparent) < len(want) || traceparent[:len(want)] != want {
+		t.Errorf("upstream got traceparent %q, want the trace of the upstream span", traceparent)
+	}
+}
+
+func TestTracingExportsOverOTLP(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req coltracepb.ExportTraceServiceRequest
+		if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, &req) != nil {
+			http.Error(w, "unexpected export", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					names = append(names, s.Name)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+	p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}), func(c *Config) { c.OTLPEndpoint = collector.URL })
+
+	getPath(p.MetricsHandler(), "/metrics")
+	// shutting down flushes the spans.
+	if err := p.shutdownTracing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Contains(names, "scrape") {
+		t.Errorf("exported spans %v, want the scrape", names)
+	}
+}
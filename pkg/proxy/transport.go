@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newUpstreamProxy returns a reverse proxy forwarding requests to the upstream
+// targets through transport, failing over between them in order. With a
+// non-nil leaderOnly, requests only go to the leader while it is known.
+func newUpstreamProxy(scheme string, transport *failoverTransport, headers *headerScrubber) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: scheme})
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		headers.scrub(req)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		headers.scrubResponse(resp)
+		return nil
+	}
+	proxy.Transport = transport
+	proxy.BufferPool = copyBufferPool{}
+	proxy.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelError)
+	proxy.ErrorHandler = proxyErrorHandler
+	return proxy
+}
+
+// errResponseTooLarge is returned for upstream responses over
+// --max-response-bytes.
+var errResponseTooLarge = errors.New("upstream response exceeds --max-response-bytes")
+
+// proxyErrorHandler logs a failed upstream request and answers 502 with the
+// reason when it is one the proxy raised itself, or 504 when the request
+// ran out of time. The answer names the request id, to find the request in
+// the logs.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	id := requestID(r.Context())
+	switch ctxErr := r.Context().Err(); {
+	case errors.Is(ctxErr, context.Canceled):
+		// the scraper went away; nobody reads the answer.
+		upstreamAborted.WithLabelValues("cancelled").Inc()
+		slog.Debug("scrape cancelled by the client, upstream request aborted", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	case errors.Is(ctxErr, context.DeadlineExceeded):
+		upstreamAborted.WithLabelValues("deadline").Inc()
+		slog.Error("http: proxy error", "request_id", id, "err", err)
+		http.Error(w, appendRequestID("upstream request exceeded the scrape deadline", id), http.StatusGatewayTimeout)
+		return
+	}
+	// failing fast is logged when the circuit opens, not for every request.
+	if !errors.Is(err, errCircuitOpen) {
+		slog.Error("http: proxy error", "request_id", id, "err", err)
+	}
+	status, msg := http.StatusBadGateway, http.StatusText(http.StatusBadGateway)
+	switch {
+	case errors.Is(err, errResponseTooLarge), errors.Is(err, errInvalidExposition):
+		msg = err.Error()
+	case errors.Is(err, errCircuitOpen):
+		status, msg = http.StatusServiceUnavailable, err.Error()
+	}
+	http.Error(w, appendRequestID(msg, id), status)
+}
+
+// appendRequestID appends the request id, if any, to an error message.
+func appendRequestID(msg, id string) string {
+	if id == "" {
+		return msg
+	}
+	return msg + " (request id " + id + ")"
+}
+
+// limitResponseBody buffers at most max bytes of the response body and
+// fails with errResponseTooLarge if there is more.
+func limitResponseBody(resp *http.Response, max int64) error {
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		upstreamResponsesTooLarge.Inc()
+		return fmt.Errorf("%w: content length %d", errResponseTooLarge, resp.ContentLength)
+	}
+	defer resp.Body.Close()
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(io.LimitReader(resp.Body, max+1)); err != nil {
+		putBuffer(buf)
+		return err
+	}
+	if int64(buf.Len()) > max {
+		putBuffer(buf)
+		upstreamResponsesTooLarge.Inc()
+		return errResponseTooLarge
+	}
+	resp.Body = newPooledBody(buf)
+	return nil
+}
+
+// contextDialer is implemented by net.Dialer and upstreamProxyDialer.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// upstreamDialer returns the dialer of upstream connections, through
+// --upstream-proxy-url if it is set.
+func upstreamDialer(c *Config) contextDialer {
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.UpstreamKeepAlive,
+	}
+	if c.upstreamProxy != nil {
+		return &upstreamProxyDialer{proxy: c.upstreamProxy, dialer: dialer}
+	}
+	return dialer
+}
+
+// buildHTTPTransport returns the transport used for plain http upstreams,
+// tuned by the upstream connection flags. With --upstream-url=unix:// all
+// connections are made to the unix socket.
+func buildHTTPTransport(c *Config) *http.Transport {
+	dialer := upstreamDialer(c)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if c.upstreamSocket != "" {
+			// every target is reached through the socket; the address
+			// only keys the connection pool.
+			network, addr = "unix", c.upstreamSocket
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return trackConn(conn), nil
+	}
+	return &http.Transport{
+		DialContext:           dial,
+		TLSHandshakeTimeout:   c.DialTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       c.MaxConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		DisableKeepAlives:     c.DisableKeepAlives,
+	}
+}
+
+// buildHTTPSTransport returns the transport used for tls upstreams,
+// presenting the client certificate from tlsConfig, restricted to the
+// configured tls versions and cipher suites, checking the revocation of
+// the server certificate and resuming tls sessions.
+func buildHTTPSTransport(c *Config, tlsConfig *tls.Config) *http.Transport {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = c.tlsMinVersion
+	tlsConfig.MaxVersion = c.tlsMaxVersion
+	tlsConfig.CipherSuites = c.cipherSuites
+	if c.revocation != nil {
+		tlsConfig.VerifyConnection = c.revocation.verifyConnection
+	}
+	// a new transport, e.g. with rotated tls material, starts without
+	// sessions to resume.
+	tlsConfig.ClientSessionCache = nil
+	if !c.DisableTLSResumption {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(c.TLSSessionCacheSize)
+	}
+	t := buildHTTPTransport(c)
+	t.TLSClientConfig = tlsConfig
+	return t
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSParameters parses --tls-min-version, --tls-max-version and
+// --tls-cipher-suites. Unset versions are left to Go's defaults.
+func (c *Config) parseTLSParameters() error {
+	for _, v := range []struct {
+		flag, value string
+		dst         *uint16
+	}{
+		{"--tls-min-version", c.TLSMinVersion, &c.tlsMinVersion},
+		{"--tls-max-version", c.TLSMaxVersion, &c.tlsMaxVersion},
+	} {
+		if v.value == "" {
+			*v.dst = 0
+			continue
+		}
+		version, ok := tlsVersions[v.value]
+		if !ok {
+			return fmt.Errorf("%s must be 1.0, 1.1, 1.2 or 1.3, got %q", v.flag, v.value)
+		}
+		*v.dst = version
+	}
+	if c.tlsMinVersion != 0 && c.tlsMaxVersion != 0 && c.tlsMinVersion > c.tlsMaxVersion {
+		return fmt.Errorf("--tls-min-version %s is above --tls-max-version %s", c.TLSMinVersion, c.TLSMaxVersion)
+	}
+
+	c.cipherSuites = nil
+	if len(c.TLSCipherSuites) == 0 {
+		return nil
+	}
+	if c.tlsMinVersion == tls.VersionTLS13 {
+		return errors.New("--tls-cipher-suites has no effect with --tls-min-version 1.3; tls 1.3 suites are not configurable")
+	}
+	suites := map[string]*tls.CipherSuite{}
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s
+	}
+	for _, name := range c.TLSCipherSuites {
+		name = strings.TrimSpace(name)
+		s, ok := suites[name]
+		if !ok {
+			return fmt.Errorf("--tls-cipher-suites: unknown or insecure cipher suite %q", name)
+		}
+		if !slices.Contains(s.SupportedVersions, tls.VersionTLS12) {
+			return fmt.Errorf("--tls-cipher-suites: %s is a tls 1.3 suite, which is not configurable", name)
+		}
+		c.cipherSuites = append(c.cipherSuites, s.ID)
+	}
+	return nil
+}
+
+// withTimeout bounds every request handled by next to the timeout d
+// returns, cancelling the upstream request when it is exceeded. d is called
+// for every request, as the timeout may be reloaded.
+func withTimeout(next http.Handler, d func() time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWithin(next, w, r, d())
+	})
+}
+
+// serveWithin serves r with next, bounded to d unless d is 0.
+func serveWithin(next http.Handler, w http.ResponseWriter, r *http.Request, d time.Duration) {
+	if d <= 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// scrapeTimeoutHeader carries the scrape timeout of Prometheus, in seconds.
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// withScrapeTimeout bounds scrapes like withTimeout, and additionally to the
+// Prometheus scrape timeout less offset, so that the scraper receives the
+// error, or stale metrics, before it gives up itself.
+func withScrapeTimeout(next http.Handler, d func() time.Duration, offset time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := d()
+		if t := scrapeTimeout(r, offset); t > 0 && (timeout <= 0 || t < timeout) {
+			timeout = t
+		}
+		serveWithin(next, w, r, timeout)
+	})
+}
+
+// scrapeTimeout returns the scrape timeout r carries less offset, the full
+// timeout if it is no longer than offset, or 0 if r carries none.
+func scrapeTimeout(r *http.Request, offset time.Duration) time.Duration {
+	seconds, err := strconv.ParseFloat(r.Header.Get(scrapeTimeoutHeader), 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) {
+		return 0
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	return timeout
+}
+
+// upstreamHeader is set on proxied responses to the endpoint that served them.
+const upstreamHeader = "X-Etcd-Metrics-Proxy-Upstream"
+
+// failoverTransport sends a request to each upstream target in order until
+// one responds without a connection error or 5xx status.
+type failoverTransport struct {
+	targets *upstreamTargets
+	next    http.RoundTripper
+	// leaderOnly, if set, restricts requests to the leader.
+	leaderOnly *leaderTracker
+	// retry, if set, retries requests that failed on every target.
+	retry *retryPolicy
+	// breaker, if set, skips targets that keep failing.
+	breaker *circuitBreaker
+}
+
+func (f *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f.retry.do(req, f.roundTripOnce)
+}
+
+// roundTripOnce tries every target once.
+func (f *failoverTransport) roundTripOnce(req *http.Request) (*http.Response, error) {
+	addrs := f.targets.all()
+	if len(addrs) == 0 {
+		return nil, errors.New("no upstream targets")
+	}
+	if member := pinnedMember(req.Context()); member != "" {
+		addrs = []string{member}
+	} else if f.leaderOnly != nil {
+		// without a known leader, e.g. during an election, fail over as usual.
+		if leader := f.leaderOnly.leaderAddr(); leader != "" {
+			addrs = []string{leader}
+		}
+	}
+	allowed := addrs[:0:0]
+	for _, addr := range addrs {
+		if f.breaker.available(addr) {
+			allowed = append(allowed, addr)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errCircuitOpen
+	}
+	addrs = allowed
+	// a consumed body can't be sent again.
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	var lastErr error
+	for i, addr := range addrs {
+		last := i == len(addrs)-1 || !replayable
+		// another request may have started probing addr meanwhile.
+		if !f.breaker.allow(addr) {
+			if last {
+				break
+			}
+			continue
+		}
+		r := req.Clone(req.Context())
+		r.URL.Host = addr
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		start := time.Now()
+		resp, err := f.next.RoundTrip(r)
+		if !errors.Is(req.Context().Err(), context.Canceled) {
+			// a deadline that passed counts as a timeout of the upstream.
+			recordUpstreamResult(addr, time.Since(start), resp, err)
+		}
+		switch {
+		case err != nil && req.Context().Err() != nil:
+			f.breaker.abort(addr)
+			return nil, err
+		case err != nil:
+			f.breaker.record(addr, false)
+			lastErr = err
+			if last {
+				return nil, err
+			}
+			slog.Warn("upstream request failed, trying next endpoint", "endpoint", addr, "err", err)
+		case resp.StatusCode >= 500 && !last:
+			f.breaker.record(addr, false)
+			slog.Warn("upstream returned an error, trying next endpoint", "endpoint", addr, "status", resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		default:
+			f.breaker.record(addr, resp.StatusCode < 500)
+			resp.Header.Set(upstreamHeader, addr)
+			recordUpstream(req.Context(), addr, time.Since(start))
+			slog.Debug("upstream request served", "endpoint", addr, "status", resp.StatusCode)
+			return resp, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = errCircuitOpen
+	}
+	return nil, lastErr
+}
+
+// recordUpstreamResult observes the duration of an upstream request to
+// addr, until its response headers arrived or it failed, and counts a
+// failure by its class.
+func recordUpstreamResult(addr string, d time.Duration, resp *http.Response, err error) {
+	upstreamDuration.WithLabelValues(addr).Observe(d.Seconds())
+	if class := failureClass(resp, err); class != "" {
+		upstreamFailures.WithLabelValues(addr, class).Inc()
+	}
+}
+
+// failureClass tells where an upstream request went wrong: "dns", "connect"
+// (the tcp connection), "tls" (the handshake or certificate verification),
+// "timeout", "reset", "5xx" or "other". It returns "" for a request that
+// succeeded.
+func failureClass(resp *http.Response, err error) string {
+	if err == nil {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return "5xx"
+		}
+		return ""
+	}
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr):
+		return "tls"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errorClass(nil, err) == retryReset:
+		return "reset"
+	}
+	return "other"
+}
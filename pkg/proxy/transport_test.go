@@ -0,0 +1,708 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBuildHTTPTransport(t *testing.T) {
+	c := DefaultConfig()
+	c.DialTimeout = 2 * time.Second
+	c.ResponseHeaderTimeout = 3 * time.Second
+	c.MaxIdleConns = 7
+	c.MaxIdleConnsPerHost = 5
+	c.MaxConnsPerHost = 9
+	c.IdleConnTimeout = time.Minute
+	c.DisableKeepAlives = true
+	tr := buildHTTPTransport(&c)
+	if tr.TLSHandshakeTimeout != 2*time.Second || tr.ResponseHeaderTimeout != 3*time.Second ||
+		tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 5 || tr.MaxConnsPerHost != 9 ||
+		tr.IdleConnTimeout != time.Minute || !tr.DisableKeepAlives {
+		t.Errorf("transport doesn't follow the flags: %+v", tr)
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		delay     time.Duration
+		want      int
+		wantBody  string
+	}{
+		{
+			name:      "within the timeout",
+			configure: func(c *Config) { c.UpstreamTimeout = 5 * time.Second },
+			want:      http.StatusOK,
+			wantBody:  "etcd_server_has_leader 1\n",
+		},
+		{
+			name:      "upstream timeout",
+			configure: func(c *Config) { c.UpstreamTimeout = 50 * time.Millisecond },
+			delay:     5 * time.Second,
+			want:      http.StatusGatewayTimeout,
+			wantBody:  "upstream request exceeded the scrape deadline",
+		},
+		{
+			name:      "no upstream timeout",
+			configure: func(c *Config) { c.UpstreamTimeout = 0 },
+			delay:     100 * time.Millisecond,
+			want:      http.StatusOK,
+			wantBody:  "etcd_server_has_leader 1\n",
+		},
+		{
+			name: "response header timeout",
+			configure: func(c *Config) {
+				c.UpstreamTimeout = 5 * time.Second
+				c.ResponseHeaderTimeout = 50 * time.Millisecond
+			},
+			delay:    5 * time.Second,
+			want:     http.StatusBadGateway,
+			wantBody: "Bad Gateway",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := make(chan struct{})
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+					close(cancelled)
+					return
+				case <-time.After(tt.delay):
+				}
+				w.Write([]byte("etcd_server_has_leader 1\n"))
+			}), tt.configure)
+
+			rec := getPath(p.MetricsHandler(), "/metrics")
+			if rec.Code != tt.want || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.want, tt.wantBody)
+			}
+			if tt.want != http.StatusOK {
+				select {
+				case <-cancelled:
+				case <-time.After(5 * time.Second):
+					t.Error("the upstream request wasn't cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamAborted(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		reason  string
+	}{
+		{name: "scraper went away", timeout: 5 * time.Second, cancel: true, reason: "cancelled"},
+		{name: "deadline", timeout: 50 * time.Millisecond, reason: "deadline"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, cancelled := make(chan struct{}), make(chan struct{})
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-r.Context().Done():
+					close(cancelled)
+				case <-time.After(5 * time.Second):
+					w.Write([]byte("etcd_server_has_leader 1\n"))
+				}
+			}), func(c *Config) { c.UpstreamTimeout = tt.timeout })
+			aborted := testutil.ToFloat64(upstreamAborted.WithLabelValues(tt.reason))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-started
+				if tt.cancel {
+					cancel()
+				}
+			}()
+			rec := httptest.NewRecorder()
+			p.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the upstream request wasn't cancelled")
+			}
+			if !tt.cancel && rec.Code != http.StatusGatewayTimeout {
+				t.Errorf("got %d %q, want %d", rec.Code, rec.Body.String(), http.StatusGatewayTimeout)
+			}
+			// the proxy may still be unwinding the cancelled request.
+			deadline := time.Now().Add(5 * time.Second)
+			for testutil.ToFloat64(upstreamAborted.WithLabelValues(tt.reason))-aborted != 1 {
+				if time.Now().After(deadline) {
+					t.Fatalf("got %v aborted upstream requests for %q, want 1",
+						testutil.ToFloat64(upstreamAborted.WithLabelValues(tt.reason))-aborted, tt.reason)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		offset time.Duration
+		want   time.Duration
+	}{
+		{name: "no header", offset: 500 * time.Millisecond},
+		{name: "less the offset", header: "10", offset: 500 * time.Millisecond, want: 9500 * time.Millisecond},
+		{name: "fractional seconds", header: "1.5", offset: 500 * time.Millisecond, want: time.Second},
+		{name: "no longer than the offset", header: "0.25", offset: 500 * time.Millisecond, want: 250 * time.Millisecond},
+		{name: "no offset", header: "10", want: 10 * time.Second},
+		{name: "invalid", header: "10s", offset: 500 * time.Millisecond},
+		{name: "negative", header: "-1", offset: 500 * time.Millisecond},
+		{name: "infinite", header: "+Inf", offset: 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				r.Header.Set(scrapeTimeoutHeader, tt.header)
+			}
+			if got := scrapeTimeout(r, tt.offset); got != tt.want {
+				t.Errorf("scrapeTimeout(%q, %v) = %v, want %v", tt.header, tt.offset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		header   string
+		want     time.Duration
+		deadline bool
+	}{
+		{name: "shorter scrape timeout", timeout: time.Minute, header: "10", want: 9500 * time.Millisecond, deadline: true},
+		{name: "shorter upstream timeout", timeout: 5 * time.Second, header: "10", want: 5 * time.Second, deadline: true},
+		{name: "no upstream timeout", header: "10", want: 9500 * time.Millisecond, deadline: true},
+		{name: "no header", timeout: 5 * time.Second, want: 5 * time.Second, deadline: true},
+		{name: "no timeout at all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got time.Duration
+			var ok bool
+			h := withScrapeTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var deadline time.Time
+				if deadline, ok = r.Context().Deadline(); ok {
+					got = time.Until(deadline)
+				}
+			}), func() time.Duration { return tt.timeout }, 500*time.Millisecond)
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				r.Header.Set(scrapeTimeoutHeader, tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if ok != tt.deadline || got > tt.want || got < tt.want-time.Second {
+				t.Errorf("got a deadline %v from now (set: %v), want %v (set: %v)", got, ok, tt.want, tt.deadline)
+			}
+		})
+	}
+}
+
+func TestHonorScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		name  string
+		honor bool
+		want  int
+	}{
+		{name: "honored", honor: true, want: http.StatusGatewayTimeout},
+		{name: "ignored", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(300 * time.Millisecond):
+				}
+				w.Write([]byte("etcd_server_has_leader 1\n"))
+			}), func(c *Config) {
+				c.UpstreamTimeout = 5 * time.Second
+				c.HonorScrapeTimeout = tt.honor
+				c.ScrapeTimeoutOffset = 0
+			})
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.Header.Set(scrapeTimeoutHeader, "0.05")
+			rec := httptest.NewRecorder()
+			p.MetricsHandler().ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("got %d %q, want %d", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureClass(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   string
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "5xx", status: http.StatusServiceUnavailable, want: "5xx"},
+		{name: "dns", err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "etcd-0", IsNotFound: true}}, want: "dns"},
+		{name: "connect", err: errConnRefused, want: "connect"},
+		{name: "tls record", err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, want: "tls"},
+		{name: "tls alert", err: &net.OpError{Op: "remote error", Err: tls.AlertError(42)}, want: "tls"},
+		{name: "certificate", err: &tls.CertificateVerificationError{Err: errors.New("x509: certificate signed by unknown authority")}, want: "tls"},
+		{name: "timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, want: "timeout"},
+		{name: "reset", err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, want: "reset"},
+		{name: "eof", err: io.EOF, want: "reset"},
+		{name: "other", err: errors.New("malformed HTTP response"), want: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := failureClass(resp, tt.err); got != tt.want {
+				t.Errorf("failureClass(%d, %v) = %q, want %q", tt.status, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamResultMetrics(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		cancel       bool
+		wantDuration bool
+		want5xx      float64
+	}{
+		{name: "ok", status: http.StatusOK, wantDuration: true},
+		{name: "5xx", status: http.StatusInternalServerError, wantDuration: true, want5xx: 1},
+		{name: "cancelled scrape", status: http.StatusOK, cancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			p, srv := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.cancel {
+					close(release)
+					<-r.Context().Done()
+					return
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte("etcd_server_has_leader 1\n"))
+			}), nil)
+			addr := srv.Listener.Addr().String()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				go func() {
+					<-release
+					cancel()
+				}()
+			}
+			p.MetricsHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+			count := fmt.Sprintf("etcd_metrics_proxy_upstream_request_duration_seconds_count{endpoint=%q} 1\n", addr)
+			if got := strings.Contains(gatherSelfMetrics(t), count); got != tt.wantDuration {
+				t.Errorf("the upstream request duration was observed: %v, want %v", got, tt.wantDuration)
+			}
+			if got := testutil.ToFloat64(upstreamFailures.WithLabelValues(addr, "5xx")); got != tt.want5xx {
+				t.Errorf("got %v 5xx failures, want %v", got, tt.want5xx)
+			}
+		})
+	}
+}
+
+var errConnRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+// fakeRoundTripper answers a request to an address with the status, or
+// fails it with the error, it was given for the address, recording the
+// addresses tried and the bodies sent.
+type fakeRoundTripper struct {
+	statuses map[string]int
+	errs     map[string]error
+
+	mu     sync.Mutex
+	tried  []string
+	bodies []string
+}
+
+func (f *fakeRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tried = append(f.tried, r.URL.Host)
+	if r.Body != nil {
+		body, _ := io.ReadAll(r.Body)
+		f.bodies = append(f.bodies, string(body))
+	}
+	if err := f.errs[r.URL.Host]; err != nil {
+		return nil, err
+	}
+	status, ok := f.statuses[r.URL.Host]
+	if !ok {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("etcd_server_has_leader 1\n")),
+		Request:    r,
+	}, nil
+}
+
+func TestFailoverTransport(t *testing.T) {
+	targets := []string{"etcd-0:2379", "etcd-1:2379", "etcd-2:2379"}
+	defer forgetEndpoints(targets)
+	tests := []struct {
+		name         string
+		method       string
+		body         io.Reader
+		statuses     map[string]int
+		errs         map[string]error
+		wantTried    []string
+		wantStatus   int
+		wantUpstream string
+	}{
+		{
+			name:         "first target serves",
+			wantTried:    []string{"etcd-0:2379"},
+			wantStatus:   http.StatusOK,
+			wantUpstream: "etcd-0:2379",
+		},
+		{
+			name:         "connection error fails over",
+			errs:         map[string]error{"etcd-0:2379": errConnRefused},
+			wantTried:    []string{"etcd-0:2379", "etcd-1:2379"},
+			wantStatus:   http.StatusOK,
+			wantUpstream: "etcd-1:2379",
+		},
+		{
+			name:         "5xx fails over",
+			statuses:     map[string]int{"etcd-0:2379": http.StatusServiceUnavailable, "etcd-1:2379": http.StatusInternalServerError},
+			wantTried:    []string{"etcd-0:2379", "etcd-1:2379", "etcd-2:2379"},
+			wantStatus:   http.StatusOK,
+			wantUpstream: "etcd-2:2379",
+		},
+		{
+			name:         "5xx of the last target is returned",
+			statuses:     map[string]int{"etcd-0:2379": 503, "etcd-1:2379": 503, "etcd-2:2379": 502},
+			wantTried:    []string{"etcd-0:2379", "etcd-1:2379", "etcd-2:2379"},
+			wantStatus:   http.StatusBadGateway,
+			wantUpstream: "etcd-2:2379",
+		},
+		{
+			name:         "4xx doesn't fail over",
+			statuses:     map[string]int{"etcd-0:2379": http.StatusNotFound},
+			wantTried:    []string{"etcd-0:2379"},
+			wantStatus:   http.StatusNotFound,
+			wantUpstream: "etcd-0:2379",
+		},
+		{
+			name:      "every target fails",
+			errs:      map[string]error{"etcd-0:2379": errConnRefused, "etcd-1:2379": errConnRefused, "etcd-2:2379": errConnRefused},
+			wantTried: []string{"etcd-0:2379", "etcd-1:2379", "etcd-2:2379"},
+		},
+		{
+			name:      "consumed body isn't sent again",
+			method:    http.MethodPost,
+			body:      io.MultiReader(strings.NewReader("payload")),
+			errs:      map[string]error{"etcd-0:2379": errConnRefused},
+			wantTried: []string{"etcd-0:2379"},
+		},
+		{
+			name:         "replayable body fails over",
+			method:       http.MethodPost,
+			body:         strings.NewReader("payload"),
+			errs:         map[string]error{"etcd-0:2379": errConnRefused},
+			wantTried:    []string{"etcd-0:2379", "etcd-1:2379"},
+			wantStatus:   http.StatusOK,
+			wantUpstream: "etcd-1:2379",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &fakeRoundTripper{statuses: tt.statuses, errs: tt.errs}
+			f := &failoverTransport{targets: newUpstreamTargets(targets...), next: next}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, err := http.NewRequest(method, "http://upstream/metrics", tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := f.RoundTrip(req)
+			if strings.Join(next.tried, " ") != strings.Join(tt.wantTried, " ") {
+				t.Errorf("tried %v, want %v", next.tried, tt.wantTried)
+			}
+			if tt.wantStatus == 0 {
+				if err == nil {
+					t.Fatalf("got %d, want an error", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get(upstreamHeader); got != tt.wantUpstream {
+				t.Errorf("served by %q, want %q", got, tt.wantUpstream)
+			}
+			if tt.body != nil {
+				for i, body := range next.bodies {
+					if body != "payload" {
+						t.Errorf("body %q sent to %s, want the request's", body, next.tried[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFailoverTransportSkipsOpenCircuits(t *testing.T) {
+	targets := []string{"etcd-0:2379", "etcd-1:2379"}
+	defer forgetEndpoints(targets)
+	next := &fakeRoundTripper{errs: map[string]error{"etcd-0:2379": errConnRefused}}
+	breaker := &circuitBreaker{failures: 1, cooldown: time.Minute, endpoints: map[string]*endpointBreaker{}}
+	f := &failoverTransport{targets: newUpstreamTargets(targets...), next: next, breaker: breaker}
+
+	for i := range 3 {
+		req, _ := http.NewRequest(http.MethodGet, "http://upstream/metrics", nil)
+		resp, err := f.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get(upstreamHeader); got != "etcd-1:2379" {
+			t.Errorf("request %d served by %q, want etcd-1:2379", i, got)
+		}
+	}
+	// the failure opened the circuit of etcd-0, which isn't tried again.
+	if want := "etcd-0:2379 etcd-1:2379 etcd-1:2379 etcd-1:2379"; strings.Join(next.tried, " ") != want {
+		t.Errorf("tried %v, want %s", next.tried, want)
+	}
+
+	breaker.record("etcd-1:2379", false)
+	req, _ := http.NewRequest(http.MethodGet, "http://upstream/metrics", nil)
+	if _, err := f.RoundTrip(req); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("got %v with every circuit open, want %v", err, errCircuitOpen)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	body := strings.Repeat("etcd_server_has_leader 1\n", 4)
+	tests := []struct {
+		name       string
+		limit      int64
+		chunked    bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "no limit", wantStatus: http.StatusOK, wantBody: body},
+		{name: "within the limit", limit: 1000, wantStatus: http.StatusOK, wantBody: body},
+		{name: "at the limit", limit: int64(len(body)), wantStatus: http.StatusOK, wantBody: body},
+		{name: "over the limit", limit: 10, wantStatus: http.StatusBadGateway, wantBody: "upstream response exceeds --max-response-bytes: content length 100"},
+		{name: "chunked over the limit", limit: 10, chunked: true, wantStatus: http.StatusBadGateway, wantBody: "upstream response exceeds --max-response-bytes"},
+		{name: "chunked within the limit", limit: 1000, chunked: true, wantStatus: http.StatusOK, wantBody: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.chunked {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				}
+				for _, line := range strings.SplitAfter(body, "\n") {
+					w.Write([]byte(line))
+					w.(http.Flusher).Flush()
+				}
+			}), func(c *Config) { c.MaxResponseBytes = tt.limit })
+			before := testutil.ToFloat64(upstreamResponsesTooLarge)
+			rec := getPath(p.MetricsHandler(), "/metrics")
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d with %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			want := before
+			if tt.wantStatus != http.StatusOK {
+				want++
+			}
+			if got := testutil.ToFloat64(upstreamResponsesTooLarge); got != want {
+				t.Errorf("%v responses counted as too large, want %v", got-before, want-before)
+			}
+		})
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	defer srv.Close()
+	defer forgetEndpoints([]string{srv.Listener.Addr().String()})
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, cert, key, "client")
+
+	tests := []struct {
+		name       string
+		configure  func(*Config)
+		wantErr    string
+		wantStatus int
+	}{
+		{name: "verified against an unrelated ca", configure: func(c *Config) { c.EtcdCA = []string{cert} }, wantStatus: http.StatusBadGateway},
+		{name: "skipped without a ca", configure: func(c *Config) { c.InsecureSkipVerify = true }, wantStatus: http.StatusOK},
+		{
+			name:       "skipped with an unrelated ca",
+			configure:  func(c *Config) { c.EtcdCA, c.InsecureSkipVerify = []string{cert}, true },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:      "with revocation checks",
+			configure: func(c *Config) { c.InsecureSkipVerify, c.EtcdOCSP = true, true },
+			wantErr:   "--etcd-crl and --etcd-ocsp can't be used with --insecure-skip-verify",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamURL = srv.URL + "/metrics"
+			c.EtcdCert, c.EtcdKey = cert, key
+			c.AccessLogFormat = "none"
+			tt.configure(&c)
+			defer certExpiry.DeleteLabelValues(cert)
+			p, err := NewProxy(c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewProxy() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != tt.wantStatus {
+				t.Errorf("got %d %q, want %d", rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+			// the client certificate is still presented.
+			if got := p.switcher.Load().TLSClientConfig; len(got.Certificates) != 1 || got.InsecureSkipVerify != c.InsecureSkipVerify {
+				t.Errorf("got %d client certificates, InsecureSkipVerify %v", len(got.Certificates), got.InsecureSkipVerify)
+			}
+		})
+	}
+}
+
+func TestParseTLSParameters(t *testing.T) {
+	tests := []struct {
+		name             string
+		min, max         string
+		suites           []string
+		wantMin, wantMax uint16
+		wantSuites       []uint16
+		wantErr          string
+	}{
+		{name: "defaults"},
+		{name: "versions", min: "1.2", max: "1.3", wantMin: tls.VersionTLS12, wantMax: tls.VersionTLS13},
+		{
+			name:       "cipher suites",
+			min:        "1.2",
+			suites:     []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			wantMin:    tls.VersionTLS12,
+			wantSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		},
+		{name: "unknown version", min: "1.4", wantErr: `--tls-min-version must be 1.0, 1.1, 1.2 or 1.3, got "1.4"`},
+		{name: "min above max", min: "1.3", max: "1.2", wantErr: "--tls-min-version 1.3 is above --tls-max-version 1.2"},
+		{name: "suites with tls 1.3 only", min: "1.3", suites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, wantErr: "has no effect with --tls-min-version 1.3"},
+		{name: "unknown suite", suites: []string{"TLS_FOO"}, wantErr: `unknown or insecure cipher suite "TLS_FOO"`},
+		{name: "insecure suite", suites: []string{"TLS_RSA_WITH_RC4_128_SHA"}, wantErr: "unknown or insecure cipher suite"},
+		{name: "tls 1.3 suite", suites: []string{"TLS_AES_128_GCM_SHA256"}, wantErr: "is a tls 1.3 suite"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.TLSMinVersion, c.TLSMaxVersion, c.TLSCipherSuites = tt.min, tt.max, tt.suites
+			err := c.parseTLSParameters()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseTLSParameters() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := buildHTTPSTransport(&c, &tls.Config{})
+			if got := tr.TLSClientConfig; got.MinVersion != tt.wantMin || got.MaxVersion != tt.wantMax || !slices.Equal(got.CipherSuites, tt.wantSuites) {
+				t.Errorf("got min %x max %x suites %x, want %x %x %x", got.MinVersion, got.MaxVersion, got.CipherSuites, tt.wantMin, tt.wantMax, tt.wantSuites)
+			}
+		})
+	}
+}
+
+func TestTLSVersionNegotiation(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("etcd_server_has_leader 1\n"))
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	defer forgetEndpoints([]string{srv.Listener.Addr().String()})
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeTestCertificate(t, cert, key, "client")
+
+	tests := []struct {
+		name       string
+		min        string
+		wantStatus int
+	}{
+		{"server version allowed", "1.2", http.StatusOK},
+		{"server version below the minimum", "1.3", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamURL = srv.URL + "/metrics"
+			c.EtcdCert, c.EtcdKey, c.InsecureSkipVerify = cert, key, true
+			c.TLSMinVersion = tt.min
+			c.AccessLogFormat = "none"
+			defer certExpiry.DeleteLabelValues(cert)
+			p, err := NewProxy(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec := getPath(p.MetricsHandler(), "/metrics"); rec.Code != tt.wantStatus {
+				t.Errorf("got %d %q, want %d", rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The environment of a process started to replace this one: the names of
+// the listening sockets it inherits from file descriptor 3 on, "scrape" or
+// "admin", and the descriptor of the pipe it reports on once it serves.
+const (
+	upgradeListenersEnv = "ETCD_METRICS_PROXY_UPGRADE_LISTENERS"
+	upgradeReadyFDEnv   = "ETCD_METRICS_PROXY_UPGRADE_READY_FD"
+)
+
+// upgradeTimeout bounds how long the new process may take to start serving
+// before the upgrade is abandoned and the old process carries on.
+const upgradeTimeout = time.Minute
+
+// handoff holds the listening sockets passed from a process to the one
+// upgrading it, so connections queue on the same sockets while the old
+// process drains and the new one starts accepting.
+type handoff struct {
+	scrape []net.Listener
+	admin  net.Listener
+	// ready is the pipe the new process reports on that it serves.
+	ready *os.File
+}
+
+// inheritedListeners returns the sockets handed over by the process this one
+// was started by to upgrade it, or none. The variables are unset so child
+// processes don't inherit them.
+func inheritedListeners() (*handoff, error) {
+	defer os.Unsetenv(upgradeListenersEnv)
+	defer os.Unsetenv(upgradeReadyFDEnv)
+
+	h := &handoff{}
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyFDEnv)); err == nil && fd > 0 {
+		h.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	names := os.Getenv(upgradeListenersEnv)
+	if names == "" {
+		return h, nil
+	}
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		// FileListener dups the descriptor; the original is closed either way.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			h.close()
+			return nil, fmt.Errorf("socket %s inherited from the upgraded process: %w", name, err)
+		}
+		if name == "admin" {
+			h.admin = l
+		} else {
+			h.scrape = append(h.scrape, l)
+		}
+	}
+	return h, nil
+}
+
+func (h *handoff) close() {
+	for _, l := range h.scrape {
+		l.Close()
+	}
+	if h.admin != nil {
+		h.admin.Close()
+	}
+}
+
+// signalReady tells the process being upgraded that this one serves, so it
+// can stop accepting and drain.
+func (h *handoff) signalReady() {
+	if h.ready == nil {
+		return
+	}
+	if _, err := h.ready.Write([]byte{1}); err != nil {
+		slog.Warn("failed to tell the upgraded process this one is ready", "err", err)
+	}
+	h.ready.Close()
+	h.ready = nil
+}
+
+// upgrade starts the binary at the path of the running one, which may have
+// been replaced since, with the same arguments and the sockets of h, and
+// waits up to upgradeTimeout for it to serve. A new process that exits or
+// doesn't become ready in time is killed.
+func (h *handoff) upgrade() (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	add := func(name string, l net.Listener) error {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot hand over %s listener %s", name, l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		files = append(files, f)
+		return nil
+	}
+	for _, l := range h.scrape {
+		if err := add("scrape", l); err != nil {
+			return nil, err
+		}
+	}
+	if h.admin != nil {
+		if err := add("admin", h.admin); err != nil {
+			return nil, err
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// WATCHDOG_PID names this process. Dropping it lets the new one ping
+	// the systemd watchdog once it is the main process of the unit.
+	env := slices.DeleteFunc(os.Environ(), func(kv string) bool { return strings.HasPrefix(kv, "WATCHDOG_PID=") })
+	env = append(env,
+		upgradeListenersEnv+"="+strings.Join(names, ","),
+		upgradeReadyFDEnv+"="+strconv.Itoa(systemdListenFDsStart+len(files)),
+	)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, append(files, w)...),
+	})
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	var b [1]byte
+	n, err := r.Read(b[:])
+	if n == 1 {
+		return proc, nil
+	}
+	proc.Kill()
+	proc.Wait()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("new process %d not serving after %s", proc.Pid, upgradeTimeout)
+	}
+	return nil, fmt.Errorf("new process %d exited before serving", proc.Pid)
+}
+
+// keepSockets stops the unix sockets of h from being removed when the old
+// process closes them, as the new one still serves them.
+func (h *handoff) keepSockets() {
+	for _, l := range append([]net.Listener{h.admin}, h.scrape...) {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package proxy
+
+import "context"
+
+// watchUpgrade does nothing: upgrades are triggered by SIGUSR2, which only
+// exists on unix.
+func watchUpgrade(ctx context.Context, h *handoff, upgraded chan<- struct{}) {}
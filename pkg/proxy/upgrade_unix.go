@@ -0,0 +1,48 @@
+//go:build unix
+
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// watchUpgrade upgrades the proxy whenever the process receives SIGUSR2,
+// until ctx is done: the binary is started anew with the listening sockets
+// of h, and once it serves, upgraded is closed for this process to drain.
+// A failed upgrade leaves this process serving; signals while it drains are
+// ignored.
+func watchUpgrade(ctx context.Context, h *handoff, upgraded chan<- struct{}) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+	done := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr2:
+			if done {
+				slog.Info("received SIGUSR2, already upgraded and draining")
+				continue
+			}
+			slog.Info("received SIGUSR2, upgrading")
+			proc, err := h.upgrade()
+			if err != nil {
+				slog.Error("upgrade failed, continuing to serve", "err", err)
+				continue
+			}
+			slog.Info("new process is serving, draining this one", "pid", proc.Pid)
+			// the new process takes over as the main process of the unit.
+			notifySystemd("MAINPID=" + strconv.Itoa(proc.Pid))
+			proc.Release()
+			h.keepSockets()
+			close(upgraded)
+			done = true
+		}
+	}
+}
@@ -0,0 +1,239 @@
+//go:build unix
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestUpgradeProcess is the process started by the upgrades of TestUpgrade
+// and TestInheritedListeners. With ETCD_METRICS_PROXY_UPGRADE=serve it
+// answers one request on each inherited socket with the socket name and
+// the variables it was started with, with exit it exits before serving and
+// with list it prints the sockets it inherited.
+func TestUpgradeProcess(t *testing.T) {
+	mode := os.Getenv("ETCD_METRICS_PROXY_UPGRADE")
+	if mode == "" {
+		t.Skip("only run by TestUpgrade and TestInheritedListeners")
+	}
+	if mode == "exit" {
+		os.Exit(1)
+	}
+	h, err := inheritedListeners()
+	if mode == "list" {
+		if err != nil {
+			fmt.Println("error:", err)
+		} else {
+			for _, l := range h.scrape {
+				fmt.Println("scrape:", l.Addr())
+			}
+			if h.admin != nil {
+				fmt.Println("admin:", h.admin.Addr())
+			}
+		}
+		fmt.Printf("env: %q\n", os.Getenv(upgradeListenersEnv)+os.Getenv(upgradeReadyFDEnv))
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(2)
+	}
+	env := fmt.Sprintf("%q %q", os.Getenv(upgradeListenersEnv)+os.Getenv(upgradeReadyFDEnv), os.Getenv("WATCHDOG_PID"))
+	var served sync.WaitGroup
+	serve := func(name string, l net.Listener) {
+		served.Add(1)
+		var once sync.Once
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+			fmt.Fprintf(w, "%s %s", name, env)
+			once.Do(served.Done)
+		}))
+	}
+	for _, l := range h.scrape {
+		serve("scrape", l)
+	}
+	if h.admin != nil {
+		serve("admin", h.admin)
+	}
+	h.signalReady()
+	done := make(chan struct{})
+	go func() {
+		served.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		// lets the last response be written.
+		time.Sleep(100 * time.Millisecond)
+	case <-time.After(10 * time.Second):
+	}
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		admin   bool
+		wantErr string
+	}{
+		{name: "scrape and admin sockets", mode: "serve", admin: true},
+		{name: "scrape socket", mode: "serve"},
+		{name: "new process exits", mode: "exit", wantErr: "exited before serving"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ETCD_METRICS_PROXY_UPGRADE", tt.mode)
+			// the watchdog is pinged by the new process once it is the main
+			// process.
+			t.Setenv("WATCHDOG_PID", "1")
+			// the new process runs TestUpgradeProcess, rather than this
+			// test, from the same binary.
+			args := os.Args
+			os.Args = []string{os.Args[0], "-test.run=^TestUpgradeProcess$"}
+			defer func() { os.Args = args }()
+
+			h := &handoff{}
+			scrape, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer scrape.Close()
+			h.scrape = []net.Listener{scrape}
+			if tt.admin {
+				if h.admin, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+					t.Fatal(err)
+				}
+				defer h.admin.Close()
+			}
+
+			proc, err := h.upgrade()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("upgrade() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proc.Wait()
+			// this process stops accepting, the new one serves the sockets.
+			scrape.Close()
+			want := map[string]net.Listener{"scrape": scrape}
+			if tt.admin {
+				h.admin.Close()
+				want["admin"] = h.admin
+			}
+			for name, l := range want {
+				resp, err := http.Get("http://" + l.Addr().String() + "/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if want := name + ` "" ""`; string(body) != want {
+					t.Errorf("got %q, want %q", body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInheritedListeners(t *testing.T) {
+	scrape, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scrape.Close()
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	socketFile := func(l net.Listener) *os.File {
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	tests := []struct {
+		name  string
+		names string
+		files []*os.File
+		want  []string
+	}{
+		{name: "not upgraded", want: []string{`env: ""`}},
+		{
+			name:  "sockets",
+			names: "scrape,admin",
+			files: []*os.File{socketFile(scrape), socketFile(admin)},
+			want:  []string{"scrape: " + scrape.Addr().String(), "admin: " + admin.Addr().String(), `env: ""`},
+		},
+		{
+			name:  "not a socket",
+			names: "scrape",
+			files: []*os.File{file},
+			want:  []string{"error: socket scrape inherited from the upgraded process", `env: ""`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestUpgradeProcess$")
+			cmd.Env = append(os.Environ(), "ETCD_METRICS_PROXY_UPGRADE=list", upgradeListenersEnv+"="+tt.names)
+			cmd.ExtraFiles = tt.files
+			var out bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &out, &out
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("%v: %s", err, out.String())
+			}
+			var lines []string
+			for _, line := range strings.Split(out.String(), "\n") {
+				if strings.HasPrefix(line, "error: ") || strings.HasPrefix(line, "scrape: ") || strings.HasPrefix(line, "admin: ") || strings.HasPrefix(line, "env: ") {
+					lines = append(lines, line)
+				}
+			}
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(tt.want, "\n"))
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("got %q, want %q", lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepSockets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handoff{scrape: []net.Listener{l}}
+	h.keepSockets()
+	l.Close()
+	// the new process still serves the socket.
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the socket was removed: %v", err)
+	}
+}
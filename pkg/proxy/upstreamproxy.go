@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// upstreamProxyPorts are the ports of --upstream-proxy-url when it has none.
+var upstreamProxyPorts = map[string]string{
+	"http":    "80",
+	"https":   "443",
+	"socks5":  "1080",
+	"socks5h": "1080",
+}
+
+// upstreamProxyDialer connects to the upstream through the jump proxy of
+// --upstream-proxy-url: an http or https proxy with CONNECT or a SOCKS5
+// proxy, authenticating with the user and password of the url, if any.
+// The HTTP_PROXY and related environment variables are never used for the
+// upstream.
+type upstreamProxyDialer struct {
+	proxy  *url.URL
+	dialer *net.Dialer
+}
+
+// DialContext connects to addr through the proxy. Failures are dial
+// errors, so they are failed over and retried like failing to connect to
+// the upstream itself.
+func (d *upstreamProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// --dial-timeout covers the handshake with the proxy too.
+	if d.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+		defer cancel()
+	}
+	var conn net.Conn
+	var err error
+	switch d.proxy.Scheme {
+	case "socks5", "socks5h":
+		conn, err = d.dialSOCKS5(ctx, network, addr)
+	default:
+		conn, err = d.dialCONNECT(ctx, addr)
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s through %s proxy %s: %w", addr, d.proxy.Scheme, d.addr(), err)}
+	}
+	return conn, nil
+}
+
+// addr is the host:port of the proxy.
+func (d *upstreamProxyDialer) addr() string {
+	port := d.proxy.Port()
+	if port == "" {
+		port = upstreamProxyPorts[d.proxy.Scheme]
+	}
+	return net.JoinHostPort(d.proxy.Hostname(), port)
+}
+
+func (d *upstreamProxyDialer) dialSOCKS5(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth *netproxy.Auth
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		auth = &netproxy.Auth{User: user.Username(), Password: password}
+	}
+	socks, err := netproxy.SOCKS5("tcp", d.addr(), auth, d.dialer)
+	if err != nil {
+		return nil, err
+	}
+	return socks.(netproxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// dialCONNECT opens a tunnel to addr with an http CONNECT request, over
+// tls to the proxy for https.
+func (d *upstreamProxyDialer) dialCONNECT(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.addr())
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	// the tunnel is bounded by ctx like the dial.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = d.connect(conn, addr)
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *upstreamProxyDialer) connect(conn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT returned %s", resp.Status)
+	}
+	return nil
+}
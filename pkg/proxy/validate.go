@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errInvalidExposition = errors.New("upstream returned a malformed exposition")
+
+// validateResponse checks the exposition of a successful upstream response
+// with --validate-exposition. In reject mode a malformed one fails the
+// scrape; in repair mode its malformed lines and incomplete tail are
+// dropped, so Prometheus still ingests the rest.
+func validateResponse(resp *http.Response, mode string) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	defer resp.Body.Close()
+	body := io.Reader(resp.Body)
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = gz
+		resp.Header.Del("Content-Encoding")
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	openMetrics := strings.HasPrefix(resp.Header.Get("Content-Type"), "application/openmetrics-text")
+	if repaired, problem := checkExposition(data, openMetrics); problem != "" {
+		expositionValidationFailures.WithLabelValues(problem).Inc()
+		if mode == "reject" {
+			return fmt.Errorf("%w: %s", errInvalidExposition, problem)
+		}
+		slog.Warn("repaired a malformed exposition from the upstream", "endpoint", resp.Header.Get(upstreamHeader), "problem", problem, "dropped_bytes", len(data)-len(repaired))
+		data = repaired
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// checkExposition parses data and returns it without its malformed lines,
+// along with the first problem found: "truncated" if the last line is cut
+// off, "malformed" for a line that doesn't parse and "missing_eof" for
+// OpenMetrics without its terminator, which is added back. The problem is
+// "" if data is valid.
+func checkExposition(data []byte, openMetrics bool) ([]byte, string) {
+	problem := ""
+	note := func(p string) {
+		if problem == "" {
+			problem = p
+		}
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		note("truncated")
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+	}
+	var b bytes.Buffer
+	b.Grow(len(data))
+	eof := false
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		s := string(data[:i])
+		data = data[i+1:]
+		if eof {
+			// nothing may follow the terminator.
+			note("malformed")
+			continue
+		}
+		if !validLine(s) {
+			note("malformed")
+			continue
+		}
+		eof = s == "# EOF"
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	if openMetrics && !eof {
+		note("missing_eof")
+		b.WriteString(eofLine)
+	}
+	return b.Bytes(), problem
+}
+
+// validLine reports whether s is a comment or a sample with a numeric value
+// and, if present, timestamp.
+func validLine(s string) bool {
+	l, err := parseLine(s)
+	if err != nil {
+		return false
+	}
+	if l.kind != lineSample {
+		return true
+	}
+	sample, _, _ := strings.Cut(l.rest, "#")
+	fields := strings.Fields(sample)
+	if len(fields) == 0 || len(fields) > 2 {
+		return false
+	}
+	for _, f := range fields {
+		if _, err := strconv.ParseFloat(f, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
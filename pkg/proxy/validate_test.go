@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckExposition(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		openMetrics bool
+		want        string
+		wantProblem string
+	}{
+		{
+			name: "valid",
+			in:   "# HELP etcd_server_has_leader Whether or not a leader exists.\n# TYPE etcd_server_has_leader gauge\netcd_server_has_leader 1\n",
+			want: "# HELP etcd_server_has_leader Whether or not a leader exists.\n# TYPE etcd_server_has_leader gauge\netcd_server_has_leader 1\n",
+		},
+		{
+			name: "timestamps and special values",
+			in:   "etcd_server_has_leader 1 1700000000000\netcd_disk_wal_fsync_duration_seconds_bucket{le=\"+Inf\"} NaN\n",
+			want: "etcd_server_has_leader 1 1700000000000\netcd_disk_wal_fsync_duration_seconds_bucket{le=\"+Inf\"} NaN\n",
+		},
+		{
+			name:        "truncated",
+			in:          "etcd_server_has_leader 1\netcd_server_is_le",
+			want:        "etcd_server_has_leader 1\n",
+			wantProblem: "truncated",
+		},
+		{
+			name:        "malformed line",
+			in:          "etcd_server_has_leader 1\netcd_server_is_leader one\netcd_server_leader_changes_seen_total 3\n",
+			want:        "etcd_server_has_leader 1\netcd_server_leader_changes_seen_total 3\n",
+			wantProblem: "malformed",
+		},
+		{
+			name:        "too many fields",
+			in:          "etcd_server_has_leader 1 1700000000000 2\n",
+			want:        "",
+			wantProblem: "malformed",
+		},
+		{
+			name:        "openmetrics",
+			in:          "# TYPE etcd_server_has_leader gauge\netcd_server_has_leader 1\n# EOF\n",
+			openMetrics: true,
+			want:        "# TYPE etcd_server_has_leader gauge\netcd_server_has_leader 1\n# EOF\n",
+		},
+		{
+			name:        "openmetrics exemplar",
+			in:          "grpc_server_handled_total{grpc_code=\"OK\"} 42 # {trace_id=\"abc\"} 1\n# EOF\n",
+			openMetrics: true,
+			want:        "grpc_server_handled_total{grpc_code=\"OK\"} 42 # {trace_id=\"abc\"} 1\n# EOF\n",
+		},
+		{
+			name:        "openmetrics without eof",
+			in:          "etcd_server_has_leader 1\n",
+			openMetrics: true,
+			want:        "etcd_server_has_leader 1\n# EOF\n",
+			wantProblem: "missing_eof",
+		},
+		{
+			name:        "lines after the eof",
+			in:          "etcd_server_has_leader 1\n# EOF\netcd_server_is_leader 1\n",
+			openMetrics: true,
+			want:        "etcd_server_has_leader 1\n# EOF\n",
+			wantProblem: "malformed",
+		},
+		{
+			name:        "the first problem is reported",
+			in:          "etcd_server_has_leader one\netcd_server_is_le",
+			openMetrics: true,
+			want:        "# EOF\n",
+			wantProblem: "truncated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problem := checkExposition([]byte(tt.in), tt.openMetrics)
+			if string(got) != tt.want || problem != tt.wantProblem {
+				t.Errorf("got %q, %q, want %q, %q", got, problem, tt.want, tt.wantProblem)
+			}
+		})
+	}
+}
+
+func TestValidateExposition(t *testing.T) {
+	const malformed = "etcd_server_has_leader 1\netcd_server_is_leader one\netcd_server_leader_changes_seen_total 3\n"
+	tests := []struct {
+		name     string
+		mode     string
+		want     int
+		wantBody string
+		wantErrs float64
+	}{
+		{name: "off", mode: "off", want: http.StatusOK, wantBody: malformed},
+		{name: "reject", mode: "reject", want: http.StatusBadGateway, wantBody: "upstream returned a malformed exposition: malformed", wantErrs: 1},
+		{name: "repair", mode: "repair", want: http.StatusOK, wantBody: "etcd_server_has_leader 1\netcd_server_leader_changes_seen_total 3\n", wantErrs: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(malformed))
+			}), func(c *Config) { c.ValidateExposition = tt.mode })
+			failures := testutil.ToFloat64(expositionValidationFailures.WithLabelValues("malformed"))
+			rec := getPath(p.MetricsHandler(), "/metrics")
+			if rec.Code != tt.want || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.want, tt.wantBody)
+			}
+			if got := testutil.ToFloat64(expositionValidationFailures.WithLabelValues("malformed")) - failures; got != tt.wantErrs {
+				t.Errorf("got %v validation failures, want %v", got, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestValidateExpositionFlag(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr string
+	}{
+		{mode: "off"},
+		{mode: "reject"},
+		{mode: "repair"},
+		{mode: "fix", wantErr: `invalid --validate-exposition "fix", must be off, reject or repair`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			c := DefaultConfig()
+			c.UpstreamScheme = "http"
+			c.ValidateExposition = tt.mode
+			err := c.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
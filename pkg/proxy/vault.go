@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultRetryMin and vaultRetryMax bound the backoff between failed
+// certificate renewals.
+const (
+	vaultRetryMin = 10 * time.Second
+	vaultRetryMax = 5 * time.Minute
+)
+
+// vaultIssuer requests the etcd client certificate from the issue endpoint
+// of a Vault PKI secrets engine, authenticating with a token file or
+// AppRole.
+type vaultIssuer struct {
+	c      *Config
+	client *http.Client
+}
+
+func newVaultIssuer(c *Config) (*vaultIssuer, error) {
+	tlsConfig := &tls.Config{}
+	if c.VaultCA != "" {
+		pool, err := loadCAPool([]string{c.VaultCA}, false)
+		if err != nil {
+			return nil, fmt.Errorf("vault ca: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &vaultIssuer{
+		c: c,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// validateVault checks the --vault-* flags.
+func (c *Config) validateVault() error {
+	if c.EtcdCert != "" || c.EtcdKey != "" || c.EtcdPKCS12 != "" || c.SPIFFESocket != "" {
+		return errors.New("--vault-addr can't be used with --etcd-cert, --etcd-key, --etcd-pkcs12 or --spiffe-socket")
+	}
+	if c.VaultRole == "" || c.VaultCommonName == "" {
+		return errors.New("--vault-addr requires --vault-role and --vault-common-name")
+	}
+	approle := c.VaultRoleIDFile != "" || c.VaultSecretIDFile != ""
+	if approle == (c.VaultTokenFile != "") {
+		return errors.New("--vault-addr requires either --vault-token-file or --vault-role-id-file and --vault-secret-id-file")
+	}
+	if approle && (c.VaultRoleIDFile == "" || c.VaultSecretIDFile == "") {
+		return errors.New("--vault-role-id-file and --vault-secret-id-file must be set together")
+	}
+	return nil
+}
+
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+type vaultIssueResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+		PrivateKey  string   `json:"private_key"`
+	} `json:"data"`
+}
+
+// do sends a JSON request to the Vault API and decodes the response into
+// out.
+func (v *vaultIssuer) do(ctx context.Context, path, token string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(v.c.VaultAddr, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.c.VaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.c.VaultNamespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("vault %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// token returns a Vault token. The token file is re-read on every call, so
+// a token kept fresh by e.g. Vault Agent is picked up; with AppRole a new
+// token is obtained for every issue.
+func (v *vaultIssuer) token(ctx context.Context) (string, error) {
+	if v.c.VaultTokenFile != "" {
+		data, err := os.ReadFile(v.c.VaultTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	roleID, err := os.ReadFile(v.c.VaultRoleIDFile)
+	if err != nil {
+		return "", err
+	}
+	secretID, err := os.ReadFile(v.c.VaultSecretIDFile)
+	if err != nil {
+		return "", err
+	}
+	var resp vaultAuthResponse
+	in := map[string]string{
+		"role_id":   strings.TrimSpace(string(roleID)),
+		"secret_id": strings.TrimSpace(string(secretID)),
+	}
+	if err := v.do(ctx, "auth/"+v.c.VaultAppRolePath+"/login", "", in, &resp); err != nil {
+		return "", err
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("vault approle login returned no token")
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+// issue requests a new client certificate and returns the tls config using
+// it. The CA chain returned by Vault is trusted along with any --etcd-ca and
+// --use-system-ca.
+func (v *vaultIssuer) issue(ctx context.Context) (*tls.Config, error) {
+	c := v.c
+	token, err := v.token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("vault login: %w", err)
+	}
+	in := map[string]string{"common_name": c.VaultCommonName}
+	if c.VaultTTL > 0 {
+		in["ttl"] = c.VaultTTL.String()
+	}
+	var resp vaultIssueResponse
+	if err := v.do(ctx, c.VaultPKIPath+"/issue/"+c.VaultRole, token, in, &resp); err != nil {
+		return nil, err
+	}
+	chain := resp.Data.CAChain
+	if len(chain) == 0 && resp.Data.IssuingCA != "" {
+		chain = []string{resp.Data.IssuingCA}
+	}
+	cert, err := tls.X509KeyPair([]byte(resp.Data.Certificate+"\n"+strings.Join(chain, "\n")), []byte(resp.Data.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("vault returned an invalid certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	pool := x509.NewCertPool()
+	if len(c.EtcdCA) > 0 || c.UseSystemCA {
+		if pool, err = loadCAPool(c.EtcdCA, c.UseSystemCA); err != nil {
+			return nil, err
+		}
+	}
+	for _, ca := range chain {
+		pool.AppendCertsFromPEM([]byte(ca))
+	}
+	return &tls.Config{
+		RootCAs:            pool,
+		Certificates:       []tls.Certificate{cert},
+		ServerName:         c.UpstreamServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}, nil
+}
+
+// renewAt returns when the certificate in tlsConfig should be renewed: once
+// two thirds of its lifetime have passed.
+func renewAt(tlsConfig *tls.Config) time.Time {
+	leaf := tlsConfig.Certificates[0].Leaf
+	return leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+}
+
+// recordVaultExpiry exports the expiry of the certificate issued by Vault.
+func recordVaultExpiry(c *Config, tlsConfig *tls.Config) {
+	leaf := tlsConfig.Certificates[0].Leaf
+	certExpiry.WithLabelValues("vault:" + c.VaultPKIPath + "/" + c.VaultRole).Set(float64(leaf.NotAfter.Unix()))
+	slog.Info("issued etcd client certificate from vault", "serial", leaf.SerialNumber.Text(16), "expiry", leaf.NotAfter)
+}
+
+// run renews the certificate before it expires and swaps in a transport
+// using the new one, until ctx is done. Failed renewals are retried with
+// backoff, the current certificate staying in use meanwhile.
+func (v *vaultIssuer) run(ctx context.Context, switcher *transportSwitcher) {
+	next := renewAt(switcher.Load().TLSClientConfig)
+	backoff := vaultRetryMin
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		tlsReloadAttempts.WithLabelValues(v.c.cluster).Inc()
+		tlsConfig, err := v.issue(ctx)
+		if err != nil {
+			tlsReloadFailures.WithLabelValues(v.c.cluster).Inc()
+			slog.Error("vault certificate renewal failed, keeping the current certificate", "err", err, "retry_in", backoff)
+			next = time.Now().Add(backoff)
+			backoff = min(backoff*2, vaultRetryMax)
+			continue
+		}
+		backoff = vaultRetryMin
+		switcher.Store(buildHTTPSTransport(v.c, tlsConfig))
+		tlsReloadSuccesses.WithLabelValues(v.c.cluster).Inc()
+		tlsLastSuccessfulReload.WithLabelValues(v.c.cluster).SetToCurrentTime()
+		recordVaultExpiry(v.c, tlsConfig)
+		next = renewAt(tlsConfig)
+	}
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeVault serves the approle login and the pki issue endpoints, issuing
+// certificates from ca valid for lifetime.
+type fakeVault struct {
+	*httptest.Server
+	ca *testCA
+
+	mu       sync.Mutex
+	status   int
+	lifetime time.Duration
+	issued   []map[string]string
+	headers  []http.Header
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	v := &fakeVault{ca: newTestCA(t), status: http.StatusOK, lifetime: 24 * time.Hour}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			if in["role_id"] != "role" || in["secret_id"] != "secret" {
+				http.Error(w, `{"errors":["invalid role or secret id"]}`, http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"auth":{"client_token":"approle-token"}}`))
+		case "/v1/pki/issue/etcd":
+			if token := r.Header.Get("X-Vault-Token"); token != "file-token" && token != "approle-token" {
+				http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+				return
+			}
+			v.mu.Lock()
+			status, lifetime := v.status, v.lifetime
+			v.issued = append(v.issued, in)
+			v.headers = append(v.headers, r.Header.Clone())
+			v.mu.Unlock()
+			if status != http.StatusOK {
+				http.Error(w, `{"errors":["internal error"]}`, status)
+				return
+			}
+			cert := v.ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: in["common_name"]}, NotAfter: time.Now().Add(lifetime)})
+			key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+			if err != nil {
+				t.Error(err)
+			}
+			ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.ca.cert.Raw}))
+			var resp vaultIssueResponse
+			resp.Data.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+			resp.Data.IssuingCA = ca
+			resp.Data.CAChain = []string{ca}
+			resp.Data.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+			json.NewEncoder(w).Encode(resp)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(v.Close)
+	return v
+}
+
+// vaultConfig returns a configuration issuing from v with the token file.
+func (v *fakeVault) config(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	c := DefaultConfig()
+	c.VaultAddr = v.URL + "/"
+	c.VaultRole, c.VaultCommonName = "etcd", "etcd-metrics-proxy"
+	c.VaultTokenFile = filepath.Join(dir, "token")
+	writeFile(t, c.VaultTokenFile, "file-token\n")
+	c.VaultRoleIDFile, c.VaultSecretIDFile = filepath.Join(dir, "role-id"), filepath.Join(dir, "secret-id")
+	writeFile(t, c.VaultRoleIDFile, "role\n")
+	writeFile(t, c.VaultSecretIDFile, "secret\n")
+	return &c
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateVault(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{name: "token file", configure: func(c *Config) { c.VaultTokenFile = "token" }},
+		{name: "approle", configure: func(c *Config) { c.VaultRoleIDFile, c.VaultSecretIDFile = "role-id", "secret-id" }},
+		{
+			name:      "with a client certificate",
+			configure: func(c *Config) { c.VaultTokenFile, c.EtcdCert = "token", "client.crt" },
+			wantErr:   "--vault-addr can't be used with --etcd-cert",
+		},
+		{
+			name:      "without a role",
+			configure: func(c *Config) { c.VaultTokenFile, c.VaultRole = "token", "" },
+			wantErr:   "--vault-addr requires --vault-role and --vault-common-name",
+		},
+		{name: "without auth", configure: func(c *Config) {}, wantErr: "requires either --vault-token-file or --vault-role-id-file"},
+		{
+			name: "token file and approle",
+			configure: func(c *Config) {
+				c.VaultTokenFile, c.VaultRoleIDFile, c.VaultSecretIDFile = "token", "role-id", "secret-id"
+			},
+			wantErr: "requires either --vault-token-file or --vault-role-id-file",
+		},
+		{
+			name:      "role id without a secret id",
+			configure: func(c *Config) { c.VaultRoleIDFile = "role-id" },
+			wantErr:   "--vault-role-id-file and --vault-secret-id-file must be set together",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.VaultAddr, c.VaultRole, c.VaultCommonName = "https://vault:8200", "etcd", "proxy"
+			tt.configure(&c)
+			err := c.validateVault()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateVault() = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateVault() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVaultIssue(t *testing.T) {
+	v := newFakeVault(t)
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantIssue map[string]string
+		wantErr   string
+	}{
+		{
+			name:      "token file",
+			configure: func(c *Config) { c.VaultRoleIDFile, c.VaultSecretIDFile = "", "" },
+			wantIssue: map[string]string{"common_name": "etcd-metrics-proxy"},
+		},
+		{
+			name:      "approle",
+			configure: func(c *Config) { c.VaultTokenFile = "" },
+			wantIssue: map[string]string{"common_name": "etcd-metrics-proxy"},
+		},
+		{
+			name: "ttl and namespace",
+			configure: func(c *Config) {
+				c.VaultRoleIDFile, c.VaultSecretIDFile = "", ""
+				c.VaultTTL, c.VaultNamespace = 90*time.Minute, "team"
+			},
+			wantIssue: map[string]string{"common_name": "etcd-metrics-proxy", "ttl": "1h30m0s"},
+		},
+		{
+			name: "rejected token",
+			configure: func(c *Config) {
+				c.VaultRoleIDFile, c.VaultSecretIDFile = "", ""
+				writeFile(t, c.VaultTokenFile, "expired")
+			},
+			wantErr: "vault pki/issue/etcd: 403 Forbidden: {\"errors\":[\"permission denied\"]}",
+		},
+		{
+			name: "rejected approle",
+			configure: func(c *Config) {
+				c.VaultTokenFile = ""
+				writeFile(t, c.VaultSecretIDFile, "wrong")
+			},
+			wantErr: "vault login: vault auth/approle/login: 400 Bad Request",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := v.config(t)
+			tt.configure(c)
+			issuer, err := newVaultIssuer(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.mu.Lock()
+			v.issued, v.headers = nil, nil
+			v.mu.Unlock()
+			tlsConfig, err := issuer.issue(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("issue() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.mu.Lock()
+			issued, headers := v.issued, v.headers
+			v.mu.Unlock()
+			if len(issued) != 1 || !maps.Equal(issued[0], tt.wantIssue) {
+				t.Fatalf("vault got %v, want %v", issued, tt.wantIssue)
+			}
+			if got := headers[0].Get("X-Vault-Namespace"); got != c.VaultNamespace {
+				t.Errorf("got namespace %q, want %q", got, c.VaultNamespace)
+			}
+			// the issuing ca is trusted for the upstream.
+			leaf := tlsConfig.Certificates[0].Leaf
+			if leaf.Subject.CommonName != "etcd-metrics-proxy" || tlsConfig.ServerName != c.UpstreamServerName {
+				t.Errorf("got %s for server name %q", leaf.Subject, tlsConfig.ServerName)
+			}
+			if _, err := leaf.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+				t.Errorf("the issuing ca isn't trusted: %v", err)
+			}
+		})
+	}
+}
+
+func TestVaultRenewal(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		wantRenewed bool
+	}{
+		{"renewed", http.StatusOK, true},
+		{"renewal failed", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newFakeVault(t)
+			c := v.config(t)
+			c.VaultRoleIDFile, c.VaultSecretIDFile = "", ""
+			c.cluster = "vault-" + tt.name
+			initTLSReloadMetrics(c.cluster)
+			defer tlsReloadSuccesses.DeleteLabelValues(c.cluster)
+			defer tlsReloadFailures.DeleteLabelValues(c.cluster)
+			defer certExpiry.DeleteLabelValues("vault:pki/etcd")
+			issuer, err := newVaultIssuer(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the first certificate is due for renewal right away: two thirds
+			// of its lifetime from an hour ago have passed.
+			v.mu.Lock()
+			v.lifetime = 30 * time.Minute
+			v.mu.Unlock()
+			tlsConfig, err := issuer.issue(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if due := renewAt(tlsConfig); time.Until(due) > time.Second {
+				t.Fatalf("renewal due in %v", time.Until(due))
+			}
+			v.mu.Lock()
+			v.status, v.lifetime = tt.status, 24*time.Hour
+			v.mu.Unlock()
+			current := buildHTTPSTransport(c, tlsConfig)
+			switcher := newTransportSwitcher(current)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go issuer.run(ctx, switcher)
+
+			counter := tlsReloadFailures
+			if tt.wantRenewed {
+				counter = tlsReloadSuccesses
+			}
+			for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(counter.WithLabelValues(c.cluster)) != 1; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("the certificate wasn't renewed")
+				}
+			}
+			if renewed := switcher.Load() != current; renewed != tt.wantRenewed {
+				t.Errorf("transport replaced: %v, want %v", renewed, tt.wantRenewed)
+			}
+			if tt.wantRenewed {
+				leaf := switcher.Load().TLSClientConfig.Certificates[0].Leaf
+				if got := testutil.ToFloat64(certExpiry.WithLabelValues("vault:pki/etcd")); got != float64(leaf.NotAfter.Unix()) {
+					t.Errorf("got expiry %v, want %v", got, leaf.NotAfter.Unix())
+				}
+			}
+		})
+	}
+}
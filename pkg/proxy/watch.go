@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchRetryMin and watchRetryMax bound the backoff between restarts of a
+// failed tls or config file watcher.
+const (
+	watchRetryMin = time.Second
+	watchRetryMax = time.Minute
+)
+
+// configReloadDebounce groups the events of a single write of the config
+// file, such as a kubernetes ConfigMap update, into one reload.
+const configReloadDebounce = 250 * time.Millisecond
+
+// fileWatch tracks the directories and files that must be watched for the
+// configured tls or config file paths. Kubernetes secret and ConfigMap
+// volumes expose each file as a symlink through the ..data symlink into a
+// timestamped directory, which is swapped atomically on update, so both the
+// configured paths and their resolved targets are watched. A CA directory
+// is watched itself, so that files added to or removed from it are noticed.
+type fileWatch struct {
+	paths []string
+	dirs  map[string]bool
+	files map[string]bool
+	// trees are the configured directories; any event in them is relevant.
+	trees map[string]bool
+}
+
+func newFileWatch(paths ...string) *fileWatch {
+	w := &fileWatch{paths: paths}
+	w.resolve()
+	return w
+}
+
+// resolve recomputes the watched set from the current symlink targets.
+func (w *fileWatch) resolve() {
+	w.dirs = map[string]bool{}
+	w.files = map[string]bool{}
+	w.trees = map[string]bool{}
+	for _, p := range w.paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			abs = p
+		}
+		if info, err := os.Stat(abs); err == nil && info.IsDir() {
+			w.trees[abs] = true
+			w.dirs[abs] = true
+			files, _ := caFiles([]string{abs})
+			for _, f := range files {
+				w.addFile(f)
+			}
+			continue
+		}
+		w.addFile(abs)
+	}
+}
+
+func (w *fileWatch) addFile(abs string) {
+	w.files[abs] = true
+	w.dirs[filepath.Dir(abs)] = true
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		w.files[real] = true
+		w.dirs[filepath.Dir(real)] = true
+	}
+}
+
+// relevant reports whether an event on name may have changed the watched files.
+func (w *fileWatch) relevant(name string) bool {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	// ..data and the ..<timestamp> directories of kubernetes atomic writes.
+	return w.files[name] || w.trees[filepath.Dir(name)] || strings.HasPrefix(filepath.Base(name), "..")
+}
+
+// watches reports whether name is a watched directory.
+func (w *fileWatch) watches(name string) bool {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	return w.dirs[name]
+}
+
+// arm adds watches for the current set of directories and removes those no
+// longer needed, e.g. after the ..<timestamp> directory was swapped out. It
+// fails if a directory can't be watched, e.g. while a volume is remounted.
+func (w *fileWatch) arm(watcher *fsnotify.Watcher) error {
+	for _, dir := range watcher.WatchList() {
+		if !w.dirs[dir] {
+			watcher.Remove(dir)
+		}
+	}
+	var errs []error
+	for dir := range w.dirs {
+		if err := watcher.Add(dir); err != nil {
+			errs = append(errs, fmt.Errorf("watch %s: %w", dir, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// watchAndReloadTLS reloads the tls material when the files change on disk,
+// until ctx is done. A failed watcher is recreated with backoff, and the
+// files are checked for changes missed meanwhile.
+func (r *reloader) watchAndReloadTLS(ctx context.Context) {
+	// the files loaded at startup, unless they were reloaded since.
+	r.loadedTLSSum()
+	backoff := watchRetryMin
+	for {
+		start := time.Now()
+		err := r.watchTLS(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		tlsWatcherRestarts.WithLabelValues(r.c.cluster).Inc()
+		if time.Since(start) > watchRetryMax {
+			backoff = watchRetryMin
+		}
+		slog.Warn("tls file watcher failed, restarting", "err", err, "retry_in", backoff)
+		if sleepContext(ctx, backoff) != nil {
+			return
+		}
+		backoff = min(backoff*2, watchRetryMax)
+
+		if sum, err := r.hashTLSFiles(); err == nil && r.tlsFilesChanged(sum) {
+			slog.Info("tls files changed while the watcher was down, reloading")
+			if err := r.performReload(); err != nil {
+				slog.Error("tls reload failed, keeping the current configuration", "err", err)
+			}
+		}
+	}
+}
+
+// watchTLS watches the tls files until ctx is done or the watcher fails.
+func (r *reloader) watchTLS(ctx context.Context) error {
+	paths := append(slices.Clone(r.c.EtcdCA), r.c.clientFiles()...)
+	// --tls-reload-debounce groups the burst of events produced by a single
+	// rotation into one reload; with 0 the timer fires at once.
+	return watchFiles(ctx, paths, r.c.TLSReloadDebounce, func() {
+		slog.Info("tls files changed, reloading")
+		if err := r.performReload(); err != nil {
+			slog.Error("tls reload failed, keeping the current configuration", "err", err)
+		}
+	})
+}
+
+// watchAndReloadConfig reloads the config file when it changes on disk,
+// until ctx is done. A failed watcher is recreated with backoff, and the
+// file is reloaded in case a change was missed meanwhile.
+func (r *reloader) watchAndReloadConfig(ctx context.Context) {
+	backoff := watchRetryMin
+	for {
+		start := time.Now()
+		err := watchFiles(ctx, []string{r.c.ConfigFile}, configReloadDebounce, func() {
+			slog.Info("config file changed, reloading")
+			if err := r.reloadConfig(); err != nil {
+				slog.Error("config reload failed, keeping the current configuration", "err", err)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > watchRetryMax {
+			backoff = watchRetryMin
+		}
+		slog.Warn("config file watcher failed, restarting", "err", err, "retry_in", backoff)
+		if sleepContext(ctx, backoff) != nil {
+			return
+		}
+		backoff = min(backoff*2, watchRetryMax)
+		if err := r.reloadConfig(); err != nil {
+			slog.Error("config reload failed, keeping the current configuration", "err", err)
+		}
+	}
+}
+
+// watchFiles calls reload once the files at paths changed and the events
+// have been quiet for debounce, until ctx is done or the watcher fails.
+func watchFiles(ctx context.Context, paths []string, debounceDelay time.Duration, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	w := newFileWatch(paths...)
+	if err := w.arm(watcher); err != nil {
+		return err
+	}
+
+	debounce := time.NewTimer(0)
+	<-debounce.C
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			// a watched directory going away takes its watch along; re-arming
+			// after the debounce fails if it is still needed, restarting the
+			// watcher until it is back.
+			removedDir := (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) && w.watches(event.Name)
+			if !removedDir && (event.Op == fsnotify.Chmod || !w.relevant(event.Name)) {
+				continue
+			}
+			slog.Debug("file event", "name", event.Name, "op", event.Op.String())
+			debounce.Reset(debounceDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			return err
+		case <-debounce.C:
+			reload()
+			w.resolve()
+			if err := w.arm(watcher); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeSecretVolume writes files into dir the way kubernetes updates a
+// secret volume: into a new ..<version> directory, atomically swapped in
+// through the ..data symlink, which the files link through.
+func writeSecretVolume(t *testing.T, dir, version string, files map[string]string) {
+	t.Helper()
+	data := filepath.Join(dir, ".."+version)
+	if err := os.Mkdir(data, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(data, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, _ := os.Readlink(filepath.Join(dir, "..data"))
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(".."+version, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(filepath.Join("..data", name), link); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if old != "" {
+		if err := os.RemoveAll(filepath.Join(dir, old)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeSecretVolume(t, dir, "2024_01_01", map[string]string{"tls.crt": "cert", "tls.key": "key"})
+	cas := filepath.Join(t.TempDir(), "cas")
+	if err := os.Mkdir(cas, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	w := newFileWatch(filepath.Join(dir, "tls.crt"), cas)
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"configured file", filepath.Join(dir, "tls.crt"), true},
+		{"symlink target", filepath.Join(dir, "..2024_01_01", "tls.crt"), true},
+		{"data symlink swap", filepath.Join(dir, "..data"), true},
+		{"new version directory", filepath.Join(dir, "..2024_01_02"), true},
+		{"other file of the secret", filepath.Join(dir, "tls.key"), false},
+		{"file added to the ca directory", filepath.Join(cas, "new.crt"), true},
+		{"unrelated file", filepath.Join(t.TempDir(), "tls.crt"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.relevant(tt.path); got != tt.want {
+				t.Errorf("relevant(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+	for _, d := range []string{dir, filepath.Join(dir, "..2024_01_01"), cas} {
+		if !w.watches(d) {
+			t.Errorf("%s isn't watched", d)
+		}
+	}
+}
+
+func TestWatchFilesFollowsSecretSymlinkSwaps(t *testing.T) {
+	dir := t.TempDir()
+	writeSecretVolume(t, dir, "1", map[string]string{"tls.crt": "cert 1"})
+	reloads := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- watchFiles(ctx, []string{filepath.Join(dir, "tls.crt")}, 10*time.Millisecond, func() {
+			reloads <- struct{}{}
+		})
+	}()
+	defer func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("watchFiles() = %v", err)
+		}
+	}()
+	// gives the watcher time to arm before the first rotation.
+	time.Sleep(100 * time.Millisecond)
+
+	// every rotation is noticed, also after the watched ..<version>
+	// directory was removed by the previous one.
+	for i, version := range []string{"2", "3", "4"} {
+		writeSecretVolume(t, dir, version, map[string]string{"tls.crt": "cert " + version})
+		select {
+		case <-reloads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("rotation %d wasn't noticed", i+1)
+		}
+		// drains the reloads of the same rotation.
+		time.Sleep(50 * time.Millisecond)
+		for len(reloads) > 0 {
+			<-reloads
+		}
+	}
+}
+
+func TestWatchFilesDebounce(t *testing.T) {
+	tests := []struct {
+		name     string
+		debounce time.Duration
+		// gap is the time between the writes of a rotation.
+		gap              time.Duration
+		wantMin, wantMax int
+	}{
+		{name: "burst within the debounce", debounce: 300 * time.Millisecond, gap: 20 * time.Millisecond, wantMin: 1, wantMax: 1},
+		{name: "no debounce", gap: 150 * time.Millisecond, wantMin: 3, wantMax: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "client.crt")
+			if err := os.WriteFile(path, []byte("cert 0"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var reloads atomic.Int32
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go watchFiles(ctx, []string{path}, tt.debounce, func() { reloads.Add(1) })
+			// gives the watcher time to arm.
+			time.Sleep(100 * time.Millisecond)
+
+			for i := range 3 {
+				if err := os.WriteFile(path, []byte(fmt.Sprint("cert ", i+1)), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(tt.gap)
+			}
+			time.Sleep(tt.debounce + 200*time.Millisecond)
+			if n := int(reloads.Load()); n < tt.wantMin || n > tt.wantMax {
+				t.Errorf("%d reloads, want %d to %d", n, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestTLSReloadDebounceFlag(t *testing.T) {
+	c := DefaultConfig()
+	c.UpstreamScheme, c.TLSReloadDebounce = "http", -time.Second
+	if _, err := NewProxy(c); err == nil || err.Error() != "--tls-reload-debounce must not be negative" {
+		t.Errorf("NewProxy() = %v, want the negative debounce rejected", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Package version holds the build information of the binary, set at link
+// time with
+//
+//	-ldflags "-X github.com/openinsight-proj/etcd-metrics-proxy/pkg/version.Version=..."
+//
+// and likewise for Commit and BuildDate.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	Version   = ""
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build information, falling back to what the go toolchain
+// recorded in the binary for anything not set through ldflags.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	for _, v := range []*string{&info.Version, &info.Commit, &info.BuildDate} {
+		if *v == "" {
+			*v = "unknown"
+		}
+	}
+	return info
+}
+
+// String formats the build information for --version.
+func (i Info) String() string {
+	return fmt.Sprintf("etcd-metrics-proxy %s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
@@ -0,0 +1,49 @@
+package version
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	defer func(v, c, d string) { Version, Commit, BuildDate = v, c, d }(Version, Commit, BuildDate)
+	tests := []struct {
+		name                    string
+		version, commit, built  string
+		wantVersion, wantCommit string
+		wantBuildDate           string
+	}{
+		{
+			name:    "ldflags",
+			version: "v1.2.3", commit: "0123abc", built: "2024-05-01T10:00:00Z",
+			wantVersion: "v1.2.3", wantCommit: "0123abc", wantBuildDate: "2024-05-01T10:00:00Z",
+		},
+		// test binaries carry no vcs information.
+		{name: "no ldflags", wantCommit: "unknown", wantBuildDate: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Version, Commit, BuildDate = tt.version, tt.commit, tt.built
+			got := Get()
+			if tt.wantVersion != "" && got.Version != tt.wantVersion {
+				t.Errorf("got version %q, want %q", got.Version, tt.wantVersion)
+			}
+			if got.Version == "" {
+				t.Error("got an empty version, want the module version or unknown")
+			}
+			if got.Commit != tt.wantCommit || got.BuildDate != tt.wantBuildDate {
+				t.Errorf("got commit %q built %q, want %q built %q", got.Commit, got.BuildDate, tt.wantCommit, tt.wantBuildDate)
+			}
+			if got.GoVersion != runtime.Version() {
+				t.Errorf("got go version %q, want %q", got.GoVersion, runtime.Version())
+			}
+		})
+	}
+}
+
+func TestInfoString(t *testing.T) {
+	i := Info{Version: "v1.2.3", Commit: "0123abc", BuildDate: "2024-05-01T10:00:00Z", GoVersion: "go1.23.4"}
+	if got, want := i.String(), "etcd-metrics-proxy v1.2.3 (commit 0123abc, built 2024-05-01T10:00:00Z, go1.23.4)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}